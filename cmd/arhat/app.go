@@ -21,7 +21,6 @@ import (
 	"fmt"
 	"os"
 	"sort"
-	"time"
 
 	"arhat.dev/pkg/backoff"
 	"arhat.dev/pkg/log"
@@ -119,82 +118,42 @@ func runApp(appCtx context.Context, config *conf.Config) error {
 		return fmt.Errorf("failed to change group id: %w", err)
 	}
 
-	bs := backoff.NewStrategy(
-		config.Connectivity.InitialBackoff,
-		config.Connectivity.MaxBackoff,
-		config.Connectivity.BackoffFactor,
-		1,
-	)
+	clientMethods := make([]client.Method, len(methods))
+	for i, m := range methods {
+		clientMethods[i] = client.Method{
+			Name:   m.Name,
+			Config: m.Config,
+		}
+	}
 
-	backoffTimer := time.NewTimer(0)
-	if !backoffTimer.Stop() {
-		<-backoffTimer.C
+	failbackInterval := config.Connectivity.FailbackInterval
+	if failbackInterval == 0 {
+		failbackInterval = constant.DefaultConnectivityFailbackInterval
 	}
-	defer backoffTimer.Stop()
-
-	for {
-		// select connectivity according to its priority
-		for i := 0; i < len(config.Connectivity.Methods); i++ {
-			select {
-			case <-appCtx.Done():
-				// application exited, no more retry
-				return nil
-			default:
-				// not exited, maintain connectivity
-			}
-
-			name := config.Connectivity.Methods[i].Name
-			id := fmt.Sprintf("%s@%d", name, i)
-
-			logger.I("creating client", log.String("id", id))
-			cl, err := client.NewClient(
-				appCtx, name, ag.HandleCmd, config.Connectivity.Methods[i].Config,
-			)
-			if err != nil {
-				logger.I("failed to create client", log.Error(err))
-			} else {
-				logger.D("client created")
-				ag.SetClient(cl)
-
-				err = func() error {
-					dialCtx, cancelDial := context.WithTimeout(appCtx, config.Connectivity.DialTimeout)
-					defer cancelDial()
-
-					logger.I("establishing connectivity")
-					return cl.Connect(dialCtx)
-				}()
-
-				if err != nil {
-					logger.I("failed to establish connectivity", log.Error(err))
-				} else {
-					// start to sync
-					logger.I("connected, starting communication")
-					err = cl.Start(appCtx)
-					if err != nil {
-						logger.I("failed to communicate", log.Error(err))
-					}
-				}
-
-				_ = cl.Close()
-				logger.I("connectivity lost")
-			}
-
-			if err != nil {
-				wait := bs.Next(id)
-
-				logger.I("connectivity backoff", log.Duration("wait", wait))
-
-				backoffTimer.Reset(wait)
-				select {
-				case <-appCtx.Done():
-					return nil
-				case <-backoffTimer.C:
-				}
-			} else {
-				bs.Reset(id)
-			}
-		}
+
+	maxPublishFailures := config.Connectivity.MaxPublishFailures
+	if maxPublishFailures == 0 {
+		maxPublishFailures = constant.DefaultConnectivityMaxPublishFailures
 	}
 
-	// unreachable
+	return client.NewSupervisor(
+		appCtx,
+		logger,
+		ag.HandleCmd,
+		ag.SetClient,
+		&client.SupervisorOptions{
+			Methods:     clientMethods,
+			DialTimeout: config.Connectivity.DialTimeout,
+			Backoff: backoff.NewStrategy(
+				config.Connectivity.InitialBackoff,
+				config.Connectivity.MaxBackoff,
+				config.Connectivity.BackoffFactor,
+				1,
+			),
+			Standby:            config.Connectivity.Standby,
+			FailbackInterval:   failbackInterval,
+			MaxPublishFailures: maxPublishFailures,
+			QuarantineDuration: config.Connectivity.MaxBackoff,
+		},
+	).Run()
 }
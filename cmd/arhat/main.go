@@ -27,10 +27,12 @@ import (
 	"arhat.dev/arhat/pkg/exec"
 
 	// connectivity methods
-	_ "arhat.dev/arhat/pkg/client/coap" // add coap client support
-	_ "arhat.dev/arhat/pkg/client/grpc" // add grpc client support
-	_ "arhat.dev/arhat/pkg/client/mqtt" // add mqtt client support
-	_ "arhat.dev/arhat/pkg/client/nats" // add nats streaming client support
+	_ "arhat.dev/arhat/pkg/client/coap"   // add coap client support
+	_ "arhat.dev/arhat/pkg/client/grpc"   // add grpc client support
+	_ "arhat.dev/arhat/pkg/client/kafka"  // add kafka client support
+	_ "arhat.dev/arhat/pkg/client/mqtt"   // add mqtt client support
+	_ "arhat.dev/arhat/pkg/client/mqttsn" // add mqtt-sn client support
+	_ "arhat.dev/arhat/pkg/client/nats"   // add nats streaming and jetstream client support
 
 	// extension and port-forward network support
 	_ "arhat.dev/pkg/nethelper/piondtls" // add udp dtls network support
@@ -60,7 +62,7 @@ func main() {
 		startedCmd, err2 := exec.DoIfTryFailed(
 			os.Stdin, os.Stdout, os.Stderr,
 			append([]string{bin}, os.Args[1:]...),
-			false, nil, true,
+			false, nil, nil, true,
 		)
 		if err2 != nil {
 			printErr("failed to run as command "+bin, err2)
@@ -86,7 +88,7 @@ func main() {
 		startedCmd, err2 := exec.DoIfTryFailed(
 			os.Stdin, os.Stdout, os.Stderr,
 			append([]string{bin}, os.Args[1:]...),
-			false, nil, true,
+			false, nil, nil, true,
 		)
 		if err2 != nil {
 			printErr("failed to run as command "+bin, err2)
@@ -12,16 +12,19 @@ require (
 	github.com/denisbrodbeck/machineid v1.0.1
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/gogo/protobuf v1.3.2
+	github.com/golang/snappy v0.0.3
 	github.com/goiiot/libmqtt v0.9.6
-	github.com/klauspost/compress v1.12.3
+	github.com/klauspost/compress v1.15.9
 	github.com/mholt/archiver/v3 v3.5.0
 	github.com/mssola/user_agent v0.5.3
 	github.com/nats-io/jwt/v2 v2.0.2
+	github.com/nats-io/nats-server/v2 v2.2.6
 	github.com/nats-io/nats-streaming-server v0.19.0 // indirect
 	github.com/nats-io/nats.go v1.11.0
 	github.com/nats-io/nkeys v0.3.0
 	github.com/nats-io/stan.go v0.9.0
 	github.com/pbnjay/memory v0.0.0-20201129165224-b12e5d931931
+	github.com/pierrec/lz4/v4 v4.0.3
 	github.com/pion/dtls/v2 v2.0.9
 	github.com/pion/logging v0.2.2
 	github.com/plgd-dev/go-coap/v2 v2.4.0
@@ -30,18 +33,20 @@ require (
 	github.com/prometheus/client_model v0.2.0
 	github.com/prometheus/common v0.25.0
 	github.com/prometheus/node_exporter v1.1.2
+	github.com/segmentio/kafka-go v0.4.47
 	github.com/spf13/pflag v1.0.5
 	golang.org/x/sys v0.0.0-20210531080801-fdfd190a6549
 	google.golang.org/grpc v1.35.0
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
+	nhooyr.io/websocket v1.8.6
 )
 
 replace (
 	github.com/creack/pty => github.com/jeffreystoke/pty v1.1.12-0.20210531091229-b834701fbcc6
 	github.com/dsnet/golib => github.com/dsnet/golib v0.0.0-20200723050859-c110804dfa93
 	github.com/fsnotify/fsnotify => github.com/fsnotify/fsnotify v1.4.9
-	github.com/klauspost/compress => github.com/klauspost/compress v1.12.3
+	github.com/pierrec/lz4/v4 => github.com/pierrec/lz4/v4 v4.0.3
 	github.com/pion/dtls/v2 => github.com/pion/dtls/v2 v2.0.4
 	github.com/spf13/cobra => github.com/spf13/cobra v1.1.1
 	go.uber.org/atomic => go.uber.org/atomic v1.7.0
@@ -75,6 +80,7 @@ replace (
 	golang.org/x/sync => github.com/golang/sync v0.0.0-20210220032951-036812b2e83c
 	golang.org/x/sys => github.com/golang/sys v0.0.0-20210531080801-fdfd190a6549
 	golang.org/x/text => github.com/golang/text v0.3.6
+	golang.org/x/time => github.com/golang/time v0.0.0-20200416051211-89c76fbcd5d1
 	golang.org/x/tools => github.com/golang/tools v0.1.2
 	golang.org/x/xerrors => github.com/golang/xerrors v0.0.0-20200804184101-5ec99f83aff1
 )
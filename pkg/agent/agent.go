@@ -23,6 +23,7 @@ import (
 	"io"
 	"runtime"
 	"sync/atomic"
+	"time"
 
 	"arhat.dev/aranya-proto/aranyagopb"
 	"arhat.dev/arhat-proto/arhatgopb"
@@ -31,15 +32,22 @@ import (
 	"arhat.dev/pkg/log"
 	"arhat.dev/pkg/wellknownerrors"
 	"ext.arhat.dev/runtimeutil/networkutil"
-	"ext.arhat.dev/runtimeutil/storageutil"
 	"github.com/gogo/protobuf/proto"
 
 	"arhat.dev/arhat/pkg/client"
+	"arhat.dev/arhat/pkg/cmdauth"
 	"arhat.dev/arhat/pkg/conf"
+	"arhat.dev/arhat/pkg/constant"
+	"arhat.dev/arhat/pkg/policy"
 	"arhat.dev/arhat/pkg/util/errconv"
 	"arhat.dev/arhat/pkg/util/manager"
 )
 
+const (
+	spoolReplayInitialBackoff = time.Second
+	spoolReplayMaxBackoff     = 30 * time.Second
+)
+
 var (
 	errClientNotSet            = errors.New("client not set")
 	errRequiredOptionsNotFound = errors.New("required options not found")
@@ -56,9 +64,21 @@ func NewAgent(appCtx context.Context, logger log.Interface, config *conf.Config)
 		return nil, err
 	}
 
-	sc, err := config.Storage.CreateClient(appCtx)
+	nodeConditions, err := newNodeConditionChecker(
+		logger.WithName("node"), &config.Arhat.Node.Conditions,
+	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create storage client: %w", err)
+		return nil, err
+	}
+
+	policyEngine, err := policy.NewEngine(&config.Arhat.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeProbes, err := newNodeProbeManager(logger.WithName("probe"), config.Arhat.Node.Probes)
+	if err != nil {
+		return nil, err
 	}
 
 	nc := networkutil.NewClient(
@@ -94,16 +114,63 @@ func NewAgent(appCtx context.Context, logger log.Interface, config *conf.Config)
 		ctx:    appCtx,
 		logger: logger,
 
-		hostConfig:    &config.Arhat.Host,
-		machineIDFrom: &config.Arhat.Node.MachineIDFrom,
-		kubeLogFile:   config.Arhat.Log.KubeLogFile(),
-		extInfo:       extInfo,
+		policy:         policyEngine,
+		machineIDFrom:  &config.Arhat.Node.MachineIDFrom,
+		kubeLogFile:    config.Arhat.Log.KubeLogFile(),
+		extInfo:        extInfo,
+		nodeConditions: nodeConditions,
+		nodeProbes:     nodeProbes,
 
-		cmdMgr:        manager.NewCmdManager(),
-		storageClient: sc,
 		networkClient: nc,
 
-		streams: extutil.NewStreamManager(),
+		streams:  extutil.NewStreamManager(),
+		sessions: newSessionRegistry(),
+
+		scheduler: newWorkScheduler(appCtx, &config.Arhat.Workers),
+	}
+	agent.sender = newSendScheduler(appCtx, agent.GetClient)
+
+	partialCmdTTL := config.Connectivity.PartialCmdTTL
+	if partialCmdTTL == 0 {
+		partialCmdTTL = constant.DefaultPartialCmdTTL
+	}
+
+	maxCmdSize := config.Connectivity.MaxCmdSize
+	if maxCmdSize == 0 {
+		maxCmdSize = constant.DefaultMaxCmdSize
+	}
+
+	maxCmdChunks := config.Connectivity.MaxCmdChunks
+	if maxCmdChunks == 0 {
+		maxCmdChunks = constant.DefaultMaxCmdChunks
+	}
+
+	agent.cmdMgr = manager.NewCmdManager(
+		appCtx, partialCmdTTL, maxCmdSize, maxCmdChunks, agent.handlePartialCmdDropped,
+	)
+
+	if config.Connectivity.CmdDedup.Enabled {
+		dedupTTL := config.Connectivity.CmdDedup.TTL
+		if dedupTTL <= 0 {
+			dedupTTL = constant.DefaultCmdDedupTTL
+		}
+
+		maxEntries := config.Connectivity.CmdDedup.MaxEntries
+		if maxEntries <= 0 {
+			maxEntries = constant.DefaultCmdDedupMaxEntries
+		}
+
+		agent.cmdDedup = manager.NewCmdDeduplicator(dedupTTL, maxEntries)
+	}
+
+	agent.cmdVerifier, err = newCmdVerifier(&config.Connectivity.CmdAuth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cmd verifier: %w", err)
+	}
+
+	agent.spool, err = newMsgSpool(logger.WithName("spool"), &config.Connectivity.Spool)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool: %w", err)
 	}
 
 	err = agent.agentComponentExtension.init(agent, agent.logger, &config.Extension)
@@ -121,6 +188,14 @@ func NewAgent(appCtx context.Context, logger log.Interface, config *conf.Config)
 		return nil, fmt.Errorf("failed to init metrics: %w", err)
 	}
 
+	err = agent.agentComponentStorage.init(agent.ctx, &config.Storage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage client: %w", err)
+	}
+
+	agent.nodeProbes.onChange = agent.postNodeStatusUpdate
+	agent.nodeProbes.start(agent.ctx)
+
 	agent.funcMap = map[aranyagopb.CmdType]rawCmdHandleFunc{
 		aranyagopb.CMD_SESSION_CLOSE: agent.handleSessionClose,
 		aranyagopb.CMD_REJECT:        agent.handleRejectCmd,
@@ -143,6 +218,10 @@ func NewAgent(appCtx context.Context, logger log.Interface, config *conf.Config)
 
 		aranyagopb.CMD_CRED_ENSURE: agent.handleCredentialEnsure,
 
+		aranyagopb.CMD_STORAGE_LIST:   agent.handleStorageList,
+		aranyagopb.CMD_STORAGE_ENSURE: agent.handleStorageEnsure,
+		aranyagopb.CMD_STORAGE_DELETE: agent.handleStorageDelete,
+
 		aranyagopb.CMD_PERIPHERAL_LIST:            agent.handlePeripheralList,
 		aranyagopb.CMD_PERIPHERAL_ENSURE:          agent.handlePeripheralEnsure,
 		aranyagopb.CMD_PERIPHERAL_DELETE:          agent.handlePeripheralDelete,
@@ -158,25 +237,40 @@ type Agent struct {
 	ctx    context.Context
 	logger log.Interface
 
-	hostConfig    *conf.HostConfig
-	machineIDFrom *conf.ValueFromSpec
-	kubeLogFile   string
-	extInfo       []*aranyagopb.NodeExtInfo
+	policy         *policy.Engine
+	machineIDFrom  *conf.ValueFromSpec
+	kubeLogFile    string
+	extInfo        []*aranyagopb.NodeExtInfo
+	nodeConditions *nodeConditionChecker
+	nodeProbes     *nodeProbeManager
 
-	cmdMgr *manager.CmdManager
+	cmdMgr   *manager.CmdManager
+	cmdDedup *manager.CmdDeduplicator
+	spool    *msgSpool
+
+	// cmdVerifier is not nil when cmds are required to be sealed
+	cmdVerifier *cmdauth.Verifier
 
-	storageClient *storageutil.Client
 	networkClient *networkutil.Client
 
-	streams *extutil.StreamManager
+	streams  *extutil.StreamManager
+	sessions *sessionRegistry
+
+	scheduler *workScheduler
+	sender    *sendScheduler
 
 	agentComponentPProf
 	agentComponentMetrics
+	agentComponentStorage
 	agentComponentExtension
 
 	settingClient uint32
 	client        client.Interface
 
+	// lastPostFailed is 1 when the last msg post with the current client
+	// failed, used to report network condition
+	lastPostFailed uint32
+
 	funcMap map[aranyagopb.CmdType]rawCmdHandleFunc
 }
 
@@ -184,8 +278,23 @@ func (b *Agent) SetClient(client client.Interface) {
 	for !atomic.CompareAndSwapUint32(&b.settingClient, 0, 1) {
 		runtime.Gosched()
 	}
+	prev := b.client
 	b.client = client
+	atomic.StoreUint32(&b.lastPostFailed, 0)
 	atomic.StoreUint32(&b.settingClient, 0)
+
+	if prev != nil && prev != client {
+		// connectivity lost or another client took over, aranya can not
+		// resume sessions of the previous connectivity
+		if n := b.sessions.terminateAll(); n != 0 {
+			b.logger.I("terminated sessions of previous client", log.Int("count", n))
+		}
+	}
+
+	if client != nil && b.spool != nil {
+		b.spool.setChunkSize(client.MaxPayloadSize())
+		b.replaySpool()
+	}
 }
 
 func (b *Agent) GetClient() client.Interface {
@@ -197,43 +306,163 @@ func (b *Agent) GetClient() client.Interface {
 	return c
 }
 
+// post the msg with the send scheduler and record the result
+func (b *Agent) post(msg *aranyagopb.Msg) error {
+	err := b.sender.post(msg)
+	if err != nil {
+		atomic.StoreUint32(&b.lastPostFailed, 1)
+	} else {
+		atomic.StoreUint32(&b.lastPostFailed, 0)
+	}
+
+	return err
+}
+
+// networkCondition is healthy when connected and the last post succeeded
+func (b *Agent) networkCondition() aranyagopb.NodeCondition {
+	if b.GetClient() == nil || atomic.LoadUint32(&b.lastPostFailed) == 1 {
+		return aranyagopb.NODE_CONDITION_UNHEALTHY
+	}
+
+	return aranyagopb.NODE_CONDITION_HEALTHY
+}
+
+// PostData posts data in chunks and returns the seq of the last chunk,
+// chunks failed to post are spooled if spool enabled
 func (b *Agent) PostData(sid uint64, kind aranyagopb.MsgType, seq uint64, completed bool, data []byte) (uint64, error) {
 	c := b.GetClient()
-	if c == nil {
+	if c == nil && b.spool == nil {
 		return seq, errClientNotSet
 	}
 
-	n := c.MaxPayloadSize()
+	var n int
+	if c != nil {
+		n = c.MaxPayloadSize()
+	} else {
+		n = b.spool.getChunkSize()
+	}
+
+	var msgs []*aranyagopb.Msg
 	for len(data) > n {
-		buf := data
-		err := c.PostMsg(&aranyagopb.Msg{
+		msgs = append(msgs, &aranyagopb.Msg{
 			Kind:     kind,
 			Sid:      sid,
 			Seq:      seq,
 			Complete: false,
-			Payload:  buf[:n],
+			Payload:  data[:n],
 		})
-		if err != nil {
-			return seq, fmt.Errorf("failed to post msg chunk: %w", err)
-		}
 
 		seq++
 		data = data[n:]
 	}
 
-	err := c.PostMsg(&aranyagopb.Msg{
+	msgs = append(msgs, &aranyagopb.Msg{
 		Kind:     kind,
 		Sid:      sid,
 		Seq:      seq,
 		Complete: completed,
 		Payload:  data,
 	})
-	if err != nil {
-		return seq, fmt.Errorf("failed to post msg chunk: %w", err)
+
+	if c == nil {
+		return seq, b.spoolMsgs(msgs, errClientNotSet)
+	}
+
+	if b.spool != nil {
+		// keep order with messages not replayed
+		spooled, err := b.spool.addIfPending(msgs)
+		if spooled {
+			b.replaySpool()
+			return seq, err
+		}
+	}
+
+	for i, msg := range msgs {
+		toPost := msg
+		if b.spool != nil {
+			toPost = b.spool.shifted(msg)
+		}
+
+		err := b.post(toPost)
+		if err != nil {
+			err = fmt.Errorf("failed to post msg chunk: %w", err)
+			if b.spool == nil {
+				return msg.Seq, err
+			}
+
+			return seq, b.spoolMsgs(msgs[i:], err)
+		}
+
+		if b.spool != nil {
+			b.spool.posted(toPost)
+		}
 	}
+
 	return seq, nil
 }
 
+// spoolMsgs adds msgs failed to post to the spool, postErr is returned if
+// spool is not enabled or the msg kind is not spooled
+func (b *Agent) spoolMsgs(msgs []*aranyagopb.Msg, postErr error) error {
+	if b.spool == nil || !b.spool.accept(msgs[0]) {
+		return postErr
+	}
+
+	err := b.spool.add(msgs)
+	if err != nil {
+		b.logger.I("failed to spool msgs", log.Error(err))
+		return postErr
+	}
+
+	b.logger.V("spooled msgs", log.Int("count", len(msgs)), log.NamedError("reason", postErr))
+	return nil
+}
+
+// replaySpool posts spooled messages in background, retries until all
+// messages posted or there is no client
+func (b *Agent) replaySpool() {
+	if b.GetClient() == nil || !b.spool.startReplay() {
+		return
+	}
+
+	maxPayloadSize := func() int {
+		c := b.GetClient()
+		if c == nil {
+			return 0
+		}
+
+		return c.MaxPayloadSize()
+	}
+
+	go func() {
+		wait := spoolReplayInitialBackoff
+		for {
+			err := b.spool.replay(b.post, maxPayloadSize)
+			if err == nil {
+				return
+			}
+
+			b.logger.D("failed to replay spooled msgs", log.Error(err))
+			if b.GetClient() == nil {
+				b.spool.stopReplay()
+				return
+			}
+
+			// client may not be started yet, retry later
+			select {
+			case <-b.ctx.Done():
+				b.spool.stopReplay()
+				return
+			case <-time.After(wait):
+			}
+
+			if wait *= 2; wait > spoolReplayMaxBackoff {
+				wait = spoolReplayMaxBackoff
+			}
+		}
+	}()
+}
+
 func (b *Agent) PostMsg(sid uint64, kind aranyagopb.MsgType, msg proto.Marshaler) error {
 	var (
 		payload []byte
@@ -258,6 +487,16 @@ func (b *Agent) HandleCmd(cmdBytes []byte) {
 		return
 	}
 
+	if b.cmdVerifier != nil {
+		var err error
+		cmdBytes, err = b.cmdVerifier.Open(cmdBytes)
+		if err != nil {
+			// never respond to unauthenticated cmds
+			b.logger.I("discard unauthenticated cmd", log.Error(err))
+			return
+		}
+	}
+
 	cmd := new(aranyagopb.Cmd)
 	err := cmd.Unmarshal(cmdBytes)
 	if err != nil {
@@ -266,6 +505,16 @@ func (b *Agent) HandleCmd(cmdBytes []byte) {
 		return
 	}
 
+	// tty resize is sent repeatedly with the same seq, and is safe to repeat
+	if cmd.Kind != aranyagopb.CMD_TTY_RESIZE && b.cmdDedup.Seen(cmd) {
+		b.logger.D("discard duplicate cmd",
+			log.String("kind", cmd.Kind.String()),
+			log.Uint64("sid", cmd.Sid),
+			log.Uint64("seq", cmd.Seq),
+		)
+		return
+	}
+
 	sid := cmd.Sid
 
 	// handle stream as special target, since data sequence is expected
@@ -288,7 +537,12 @@ func (b *Agent) HandleCmd(cmdBytes []byte) {
 	}
 
 	// reassamble cmd payload
-	cmdPayload, complete := b.cmdMgr.Process(cmd)
+	cmdPayload, complete, err := b.cmdMgr.Process(cmd)
+	if err != nil {
+		b.handlePartialCmdDropped(sid, err)
+		return
+	}
+
 	if !complete {
 		b.logger.V("partial cmd not complete")
 		return
@@ -316,11 +570,24 @@ func (b *Agent) HandleCmd(cmdBytes []byte) {
 }
 
 func (b *Agent) processInNewGoroutine(sid uint64, cmdName string, process func()) {
-	go func() {
+	reject := func(err error) {
+		b.logger.I("work rejected", log.Uint64("sid", sid), log.String("work", cmdName), log.Error(err))
+		b.handleRuntimeError(sid, err)
+	}
+
+	err := b.scheduler.submit(cmdName, func() {
 		b.logger.V("working on", log.Uint64("sid", sid), log.String("work", cmdName))
 		process()
 		b.logger.V("finished", log.Uint64("sid", sid), log.String("work", cmdName))
-	}()
+	}, reject)
+	if err != nil {
+		reject(err)
+	}
+}
+
+func (b *Agent) handlePartialCmdDropped(sid uint64, err error) {
+	b.logger.I("partial cmd dropped", log.Uint64("sid", sid), log.Error(err))
+	b.handleRuntimeError(sid, err)
 }
 
 // nolint:unparam
@@ -0,0 +1,227 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/arhat/pkg/conf"
+)
+
+// testClient records msgs posted by the agent
+type testClient struct {
+	ctx            context.Context
+	maxPayloadSize int
+
+	mu      sync.Mutex
+	msgs    []*aranyagopb.Msg
+	notify  chan struct{}
+	postErr error
+}
+
+func newTestClient(ctx context.Context, maxPayloadSize int) *testClient {
+	return &testClient{
+		ctx:            ctx,
+		maxPayloadSize: maxPayloadSize,
+		notify:         make(chan struct{}, 1),
+	}
+}
+
+func (c *testClient) Context() context.Context              { return c.ctx }
+func (c *testClient) Connect(dialCtx context.Context) error { return nil }
+func (c *testClient) Start(appCtx context.Context) error    { return nil }
+func (c *testClient) Close() error                          { return nil }
+func (c *testClient) MaxPayloadSize() int                   { return c.maxPayloadSize }
+
+func (c *testClient) PostMsg(msg *aranyagopb.Msg) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.postErr != nil {
+		return c.postErr
+	}
+
+	c.msgs = append(c.msgs, msg)
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (c *testClient) setPostErr(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.postErr = err
+}
+
+// sessionMsgs returns all msgs of the session received so far
+func (c *testClient) sessionMsgs(sid uint64) []*aranyagopb.Msg {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var ret []*aranyagopb.Msg
+	for _, m := range c.msgs {
+		if m.Sid == sid {
+			ret = append(ret, m)
+		}
+	}
+
+	return ret
+}
+
+// waitComplete waits until the last msg of the session arrived
+func (c *testClient) waitComplete(t *testing.T, sid uint64, timeout time.Duration) []*aranyagopb.Msg {
+	t.Helper()
+
+	deadline := time.After(timeout)
+	for {
+		msgs := c.sessionMsgs(sid)
+		for _, m := range msgs {
+			if m.Complete {
+				return msgs
+			}
+		}
+
+		select {
+		case <-c.notify:
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("session %d not complete in %v, got %d msgs", sid, timeout, len(msgs))
+		}
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func newTestAgent(t *testing.T, config *conf.Config) (*Agent, *testClient) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	if config == nil {
+		config = &conf.Config{}
+	}
+
+	ag, err := NewAgent(ctx, log.NoOpLogger, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestClient(ctx, 4096)
+	ag.SetClient(c)
+
+	return ag, c
+}
+
+type marshaler interface {
+	Marshal() ([]byte, error)
+}
+
+// sendCmd delivers a single packet cmd to the agent
+func sendCmd(t *testing.T, ag *Agent, sid uint64, kind aranyagopb.CmdType, payload marshaler) {
+	t.Helper()
+
+	var (
+		data []byte
+		err  error
+	)
+	if payload != nil {
+		data, err = payload.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmdBytes, err := (&aranyagopb.Cmd{
+		Kind:     kind,
+		Sid:      sid,
+		Complete: true,
+		Payload:  data,
+	}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ag.HandleCmd(cmdBytes)
+}
+
+func TestSetClientSessions(t *testing.T) {
+	ag, c := newTestAgent(t, nil)
+
+	var terminated uint32
+	ag.sessions.add(1, func() { atomic.AddUint32(&terminated, 1) })
+
+	// same client set again
+	ag.SetClient(c)
+
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadUint32(&terminated); n != 0 {
+		t.Fatalf("session terminated %d times without client change", n)
+	}
+
+	// another client took over
+	other := newTestClient(c.ctx, 4096)
+	ag.SetClient(other)
+	waitFor(t, "session terminated on client swap", func() bool {
+		return atomic.LoadUint32(&terminated) == 1
+	})
+
+	// connectivity lost
+	ag.sessions.add(2, func() { atomic.AddUint32(&terminated, 1) })
+	ag.SetClient(nil)
+	waitFor(t, "session terminated on connectivity loss", func() bool {
+		return atomic.LoadUint32(&terminated) == 2
+	})
+}
+
+func TestSetClientSessionsWithSpool(t *testing.T) {
+	config := &conf.Config{}
+	config.Connectivity.Spool.Dir = t.TempDir()
+
+	ag, _ := newTestAgent(t, config)
+
+	var terminated uint32
+	ag.sessions.add(1, func() { atomic.AddUint32(&terminated, 1) })
+
+	// spool does not keep sessions of lost connectivity
+	ag.SetClient(nil)
+	waitFor(t, "session terminated", func() bool {
+		return atomic.LoadUint32(&terminated) == 1
+	})
+}
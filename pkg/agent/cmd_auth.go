@@ -0,0 +1,72 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"crypto/cipher"
+	"fmt"
+
+	"arhat.dev/arhat/pkg/cmdauth"
+	"arhat.dev/arhat/pkg/conf"
+	"arhat.dev/arhat/pkg/constant"
+)
+
+// newCmdVerifier creates the verifier of sealed cmds, nil if cmd auth is
+// not enabled
+func newCmdVerifier(config *conf.CmdAuthConfig) (*cmdauth.Verifier, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	pkStr, err := config.PublicKeyFrom.Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get public key: %w", err)
+	}
+
+	if pkStr == "" {
+		return nil, fmt.Errorf("no public key provided")
+	}
+
+	publicKey, err := cmdauth.ParsePublicKey(pkStr)
+	if err != nil {
+		return nil, err
+	}
+
+	keyStr, err := config.EncryptionKeyFrom.Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get encryption key: %w", err)
+	}
+
+	var aead cipher.AEAD
+	if keyStr != "" {
+		aead, err = cmdauth.NewAEAD(keyStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	maxClockSkew := config.MaxClockSkew
+	if maxClockSkew <= 0 {
+		maxClockSkew = constant.DefaultCmdAuthMaxClockSkew
+	}
+
+	return cmdauth.NewVerifier(publicKey, aead, cmdauth.VerifierConfig{
+		MaxClockSkew: maxClockSkew,
+		MaxAge:       config.MaxAge,
+		NonceFile:    config.NonceFile,
+	})
+}
@@ -45,6 +45,15 @@ func (c *extensionComponentPeripheral) init(
 
 func (c *extensionComponentPeripheral) start(agent *Agent) error { return nil }
 
+// RetrieveCachedMetrics returns nil when extensions are not enabled
+func (c *extensionComponentPeripheral) RetrieveCachedMetrics() interface{} {
+	if c.Manager == nil {
+		return nil
+	}
+
+	return c.Manager.RetrieveCachedMetrics()
+}
+
 func (b *Agent) handlePeripheralList(sid uint64, data []byte) {
 	if b.Manager == nil {
 		b.handleUnknownCmd(sid, "peripheral.list", nil)
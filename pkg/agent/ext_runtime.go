@@ -78,6 +78,25 @@ func (c *extensionComponentRuntime) start(agent *Agent) error {
 	return nil
 }
 
+// runtimeReady returns false when runtime is required but not connected
+func (c *extensionComponentRuntime) runtimeReady() bool {
+	if !c.waitForRuntime {
+		return true
+	}
+
+	for !atomic.CompareAndSwapUintptr(&c.workingOnConn, 0, 1) {
+		runtime.Gosched()
+	}
+
+	ready := c.runtimeCtx != nil
+
+	for !atomic.CompareAndSwapUintptr(&c.workingOnConn, 1, 0) {
+		runtime.Gosched()
+	}
+
+	return ready
+}
+
 func (c *extensionComponentRuntime) handleRuntimeConn(ctx *server.ExtensionContext) {
 	for !atomic.CompareAndSwapUintptr(&c.workingOnConn, 0, 1) {
 		runtime.Gosched()
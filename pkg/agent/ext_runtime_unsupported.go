@@ -23,3 +23,4 @@ type extensionComponentRuntime struct{}
 func (c *extensionComponentRuntime) init(_, _, _ interface{})                    {}
 func (c *extensionComponentRuntime) start(agent *Agent) error                    { return nil }
 func (c *extensionComponentRuntime) sendRuntimeCmd(_, _, _, _ interface{}) error { return nil }
+func (c *extensionComponentRuntime) runtimeReady() bool                          { return true }
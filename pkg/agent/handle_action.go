@@ -18,6 +18,8 @@ package agent
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -32,6 +34,7 @@ import (
 	"time"
 
 	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/aranya-proto/aranyagopb/aranyagoconst"
 	"arhat.dev/libext/types"
 	"arhat.dev/pkg/exechelper"
 	"arhat.dev/pkg/iohelper"
@@ -41,6 +44,7 @@ import (
 
 	"arhat.dev/arhat/pkg/constant"
 	"arhat.dev/arhat/pkg/exec"
+	"arhat.dev/arhat/pkg/policy"
 	"arhat.dev/arhat/pkg/util/errconv"
 )
 
@@ -54,6 +58,11 @@ func (b *Agent) handleExec(sid uint64, data []byte) {
 	}
 
 	b.processInNewGoroutine(sid, "exec", func() {
+		if opts.Tty {
+			b.sender.setSessionClass(sid, sendClassInteractive)
+			defer b.sender.clearSessionClass(sid)
+		}
+
 		var (
 			wg  = new(sync.WaitGroup)
 			seq uint64
@@ -69,17 +78,24 @@ func (b *Agent) handleExec(sid uint64, data []byte) {
 			},
 			// run
 			func(stdout, stderr io.WriteCloser) *aranyagopb.ErrorMsg {
-				if !b.hostConfig.AllowExec {
-					return &aranyagopb.ErrorMsg{
-						Kind:        aranyagopb.ERR_NOT_SUPPORTED,
-						Description: "host exec not allowed",
-					}
+				decision, err := b.policy.CheckExec(&policy.ExecRequest{
+					Kind:    policy.ExecKindExec,
+					Command: opts.Command,
+					Env:     opts.Envs,
+					TTY:     opts.Tty,
+				})
+				if err != nil {
+					return errconv.ToConnectivityError(err)
 				}
 
-				var (
-					cmd exec.Cmd
-					err error
-				)
+				sysProcAttr, err := exec.CreateSysProcAttr(decision.UID, decision.GID)
+				if err != nil {
+					return errconv.ToConnectivityError(
+						fmt.Errorf("failed to apply rule %q: %w", decision.Rule, err),
+					)
+				}
+
+				var cmd exec.Cmd
 
 				if opts.Stdin {
 					err = b.streams.Add(sid, func() (io.WriteCloser, types.ResizeHandleFunc, error) {
@@ -99,9 +115,10 @@ func (b *Agent) handleExec(sid uint64, data []byte) {
 							procStdin,
 							stdout,
 							stderr,
-							opts.Command,
+							decision.Command,
 							opts.Tty,
-							opts.Envs,
+							decision.Env,
+							sysProcAttr,
 							false,
 						)
 						if err != nil {
@@ -154,7 +171,7 @@ func (b *Agent) handleExec(sid uint64, data []byte) {
 					})
 				} else {
 					cmd, err = exec.DoIfTryFailed(
-						nil, stdout, stderr, opts.Command, opts.Tty, opts.Envs, false,
+						nil, stdout, stderr, decision.Command, opts.Tty, decision.Env, sysProcAttr, false,
 					)
 				}
 
@@ -166,6 +183,15 @@ func (b *Agent) handleExec(sid uint64, data []byte) {
 					}
 				}
 
+				exited := make(chan struct{})
+				b.sessions.add(sid, func() {
+					exec.Terminate(cmd, exited, constant.DefaultSessionTerminationGracePeriod)
+				})
+				defer func() {
+					close(exited)
+					b.sessions.remove(sid)
+				}()
+
 				// mark stream prepared (can be obsolute)
 				_, err = b.PostData(
 					sid, aranyagopb.MSG_STREAM_CONTINUE, nextSeq(&seq), false, nil,
@@ -206,6 +232,9 @@ func (b *Agent) handleAttach(sid uint64, data []byte) {
 	}
 
 	b.processInNewGoroutine(sid, "attach", func() {
+		b.sender.setSessionClass(sid, sendClassInteractive)
+		defer b.sender.clearSessionClass(sid)
+
 		var (
 			wg  = new(sync.WaitGroup)
 			seq uint64
@@ -216,13 +245,6 @@ func (b *Agent) handleAttach(sid uint64, data []byte) {
 			nil,
 			// run
 			func(stdout, stderr io.WriteCloser) *aranyagopb.ErrorMsg {
-				if !b.hostConfig.AllowAttach {
-					return &aranyagopb.ErrorMsg{
-						Kind:        aranyagopb.ERR_NOT_SUPPORTED,
-						Description: "host attach not allowed",
-					}
-				}
-
 				shell := os.Getenv("SHELL")
 				if shell == "" {
 					switch runtime.GOOS {
@@ -233,15 +255,34 @@ func (b *Agent) handleAttach(sid uint64, data []byte) {
 					}
 				}
 
+				decision, err := b.policy.CheckExec(&policy.ExecRequest{
+					Kind:    policy.ExecKindAttach,
+					Command: []string{shell},
+					TTY:     true,
+				})
+				if err != nil {
+					return errconv.ToConnectivityError(err)
+				}
+
+				sysProcAttr, err := exec.CreateSysProcAttr(decision.UID, decision.GID)
+				if err != nil {
+					return errconv.ToConnectivityError(
+						fmt.Errorf("failed to apply rule %q: %w", decision.Rule, err),
+					)
+				}
+
 				var cmd *exechelper.Cmd
 				err = b.streams.Add(sid, func() (io.WriteCloser, types.ResizeHandleFunc, error) {
 					cmd, err = exechelper.Do(exechelper.Spec{
 						Context: nil,
-						Command: []string{shell},
+						Env:     decision.Env,
+						Command: decision.Command,
 						Stdin:   nil,
 						Stdout:  nil,
 						Stderr:  nil,
 						Tty:     true,
+
+						SysProcAttr: sysProcAttr,
 					})
 					if err != nil {
 						return nil, nil, err
@@ -286,6 +327,15 @@ func (b *Agent) handleAttach(sid uint64, data []byte) {
 					}
 				}
 
+				exited := make(chan struct{})
+				b.sessions.add(sid, func() {
+					exec.Terminate(cmd, exited, constant.DefaultSessionTerminationGracePeriod)
+				})
+				defer func() {
+					close(exited)
+					b.sessions.remove(sid)
+				}()
+
 				// mark stream prepared (can be obsolute)
 				_, err = b.PostData(
 					sid, aranyagopb.MSG_STREAM_CONTINUE, nextSeq(&seq), false, nil,
@@ -337,35 +387,48 @@ func (b *Agent) handleLogs(sid uint64, data []byte) {
 			nil,
 			// run
 			func(stdout, stderr io.WriteCloser) *aranyagopb.ErrorMsg {
-				if !b.hostConfig.AllowLog {
-					return &aranyagopb.ErrorMsg{
-						Kind:        aranyagopb.ERR_NOT_SUPPORTED,
-						Description: "host logs not allowed",
+				err := b.policy.CheckLog()
+				if err != nil {
+					return errconv.ToConnectivityError(err)
+				}
+
+				opts, err := newLogReadOptions(cmd)
+				if err != nil {
+					return errconv.ToConnectivityError(err)
+				}
+
+				ctx, cancel := context.WithCancel(b.ctx)
+				defer cancel()
+
+				if opts.follow {
+					// stop following logs once session closed
+					err = b.streams.Add(sid, func() (io.WriteCloser, types.ResizeHandleFunc, error) {
+						return &flexWriteCloser{
+							Writer: ioutil.Discard,
+							closeFunc: func() error {
+								cancel()
+								return nil
+							},
+						}, nil, nil
+					})
+					if err != nil {
+						return errconv.ToConnectivityError(err)
 					}
 				}
 
 				if cmd.Path != "" {
-					info, err := os.Stat(cmd.Path)
+					path, err := b.policy.CheckLogPath(cmd.Path)
 					if err != nil {
 						return errconv.ToConnectivityError(err)
 					}
 
-					if info.IsDir() {
-						var files []os.FileInfo
-						files, err = ioutil.ReadDir(cmd.Path)
-						if err != nil {
-							return errconv.ToConnectivityError(err)
-						}
-
-						buf := new(bytes.Buffer)
-						buf.WriteString(constant.IdentifierLogDir)
-						buf.WriteByte('\n')
-						for _, f := range files {
-							buf.WriteString(filepath.Base(f.Name()))
-							buf.WriteByte('\n')
-						}
+					info, err := os.Stat(path)
+					if err != nil {
+						return errconv.ToConnectivityError(err)
+					}
 
-						_, err = buf.WriteTo(stdout)
+					if info.IsDir() {
+						err = b.listLogDir(path, stdout)
 						if err != nil {
 							return errconv.ToConnectivityError(err)
 						}
@@ -373,14 +436,15 @@ func (b *Agent) handleLogs(sid uint64, data []byte) {
 						return nil
 					}
 
-					data, err := ioutil.ReadFile(cmd.Path)
+					_, err = stdout.Write([]byte(constant.IdentifierLogFile + "\n"))
 					if err != nil {
 						return errconv.ToConnectivityError(err)
 					}
 
-					_, _ = stdout.Write([]byte(constant.IdentifierLogFile))
-					_, _ = stdout.Write([]byte{'\n'})
-					_, err = stdout.Write(data)
+					// log file can be rotated in follow mode, check the
+					// requested path every time it's opened
+					opts.checkPath = b.policy.CheckLogPath
+					err = readLogFile(ctx, cmd.Path, opts, stdout)
 					if err != nil {
 						return errconv.ToConnectivityError(err)
 					}
@@ -398,7 +462,7 @@ func (b *Agent) handleLogs(sid uint64, data []byte) {
 					file = constant.PrevLogFile(file)
 				}
 
-				err := actionutil.ReadLogs(b.ctx, file, cmd, stdout, stderr)
+				err = actionutil.ReadLogs(ctx, file, cmd, stdout, stderr)
 				if err != nil {
 					return errconv.ToConnectivityError(err)
 				}
@@ -409,6 +473,36 @@ func (b *Agent) handleLogs(sid uint64, data []byte) {
 	})
 }
 
+// listLogDir writes entries of the dir permitted by log policy, one entry
+// per line in format of `<name>\t<size>\t<modification time>`
+func (b *Agent) listLogDir(dir string, w io.Writer) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(constant.IdentifierLogDir)
+	buf.WriteByte('\n')
+	for _, f := range files {
+		_, err = b.policy.CheckLogPath(filepath.Join(dir, f.Name()))
+		if err != nil {
+			// not permitted or broken symlink
+			continue
+		}
+
+		buf.WriteString(filepath.Base(f.Name()))
+		buf.WriteByte('\t')
+		buf.WriteString(strconv.FormatInt(f.Size(), 10))
+		buf.WriteByte('\t')
+		buf.WriteString(f.ModTime().UTC().Format(aranyagoconst.TimeLayout))
+		buf.WriteByte('\n')
+	}
+
+	_, err = buf.WriteTo(w)
+	return err
+}
+
 type flexWriteCloser struct {
 	io.Writer
 	closeFunc func() error
@@ -446,11 +540,7 @@ func (b *Agent) handlePortForward(sid uint64, data []byte) {
 			// send fin msg to close input in aranya
 			if err != nil {
 				kind = aranyagopb.MSG_ERROR
-				payload, _ = (&aranyagopb.ErrorMsg{
-					Kind:        aranyagopb.ERR_COMMON,
-					Description: err.Error(),
-					Code:        0,
-				}).Marshal()
+				payload, _ = errconv.ToConnectivityError(err).Marshal()
 			}
 
 			// best effort
@@ -468,13 +558,25 @@ func (b *Agent) handlePortForward(sid uint64, data []byte) {
 				if len(address) == 0 {
 					address = "localhost"
 				}
+			}
 
+			var dialer interface{}
+			d, err2 := b.policy.PortForwardDialer(opts.Network, address, opts.Port)
+			if err2 != nil {
+				return nil, nil, err2
+			}
+
+			if d != nil {
+				dialer = d
+			}
+
+			if opts.Port > 0 {
 				address = net.JoinHostPort(address, strconv.FormatInt(int64(opts.Port), 10))
 			}
 
 			downstream, closeWrite, errCh, err = nethelper.Forward(
 				b.ctx,
-				nil,
+				dialer,
 				opts.Network,
 				address,
 				pr,
@@ -491,12 +593,10 @@ func (b *Agent) handlePortForward(sid uint64, data []byte) {
 			return &flexWriteCloser{
 				Writer: pw,
 				closeFunc: func() error {
-					closeWrite()
-
-					// assume 64KB/s
-					closeWithDelay(pr, 10*time.Second, 64*1024)
-					closeWithDelay(downstream, 10*time.Second, 64*1024)
-					return nil
+					// forwarding of input ends with EOF after all input
+					// written to downstream, pr is not closed here since
+					// it's still being read
+					return pw.Close()
 				},
 			}, nil, nil
 		})
@@ -504,6 +604,12 @@ func (b *Agent) handlePortForward(sid uint64, data []byte) {
 			return
 		}
 
+		b.sessions.add(sid, func() {
+			closeWrite()
+			_ = downstream.Close()
+		})
+		defer b.sessions.remove(sid)
+
 		// mark stream prepared (can be obsolute)
 		_, err = b.PostData(
 			sid, aranyagopb.MSG_STREAM_CONTINUE, nextSeq(&seq), false, nil,
@@ -542,6 +648,8 @@ func (b *Agent) handlePortForward(sid uint64, data []byte) {
 				}
 
 				if !more {
+					// input forwarded
+					closeWrite()
 					return
 				}
 			}
@@ -665,36 +773,46 @@ func (b *Agent) createStreams(
 	}
 }
 
+// closeWithDelay closes r once there is no data unread or waitAtLeast passed,
+// r can be closed by other goroutines at the same time (e.g. the reader got
+// EOF)
 func closeWithDelay(r io.Closer, waitAtLeast time.Duration, throughput int) {
 	if r == nil {
 		return
 	}
 
-	var (
-		fd    uintptr
-		hasFd = false
-	)
+	var checkBytesToRead func() (int, error)
 	switch t := r.(type) {
-	case interface {
-		Fd() uintptr
-	}:
-		fd = t.Fd()
-		hasFd = true
 	case interface {
 		SyscallConn() (syscall.RawConn, error)
 	}:
+		// access fd through raw conn, which fails once closed instead of
+		// racing with Close
 		rawConn, err := t.SyscallConn()
 		if err == nil {
-			err = rawConn.Control(func(_fd uintptr) {
-				fd = _fd
-			})
+			checkBytesToRead = func() (n int, err error) {
+				err2 := rawConn.Control(func(fd uintptr) {
+					n, err = iohelper.CheckBytesToRead(fd)
+				})
+				if err2 != nil {
+					return 0, err2
+				}
+
+				return
+			}
+		}
+	case interface {
+		Fd() uintptr
+	}:
+		fd := t.Fd()
+		checkBytesToRead = func() (int, error) {
+			return iohelper.CheckBytesToRead(fd)
 		}
-		hasFd = err == nil
 	}
 
 	// do not block close function call
 
-	if !hasFd {
+	if checkBytesToRead == nil {
 		go func() {
 			time.Sleep(waitAtLeast)
 			_ = r.Close()
@@ -709,8 +827,13 @@ func closeWithDelay(r io.Closer, waitAtLeast time.Duration, throughput int) {
 
 		var wait time.Duration
 		for {
-			n, err := iohelper.CheckBytesToRead(fd)
+			n, err := checkBytesToRead()
 			if err != nil {
+				if errors.Is(err, os.ErrClosed) || errors.Is(err, net.ErrClosed) {
+					// already closed
+					return
+				}
+
 				// unable to check bytes to read
 				if waitAtLeast > 0 {
 					time.Sleep(waitAtLeast)
@@ -742,7 +865,18 @@ func (b *Agent) uploadDataOutput(
 	kind aranyagopb.MsgType,
 	pSeq *uint64,
 ) {
-	size := b.GetClient().MaxPayloadSize()
+	// client is unset when connectivity lost, use the same chunk size as
+	// PostData
+	var size int
+	switch c := b.GetClient(); {
+	case c != nil:
+		size = c.MaxPayloadSize()
+	case b.spool != nil:
+		size = b.spool.getChunkSize()
+	default:
+		return
+	}
+
 	if size > 64*1024 {
 		size = 64 * 1024
 	}
@@ -0,0 +1,134 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	_ "arhat.dev/pkg/nethelper/stdnet" // add tcp network support
+
+	"arhat.dev/arhat/pkg/conf"
+)
+
+func TestCloseWithDelay(t *testing.T) {
+	t.Run("closed by reader", func(t *testing.T) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+
+			_, _ = ioutil.ReadAll(r)
+			_ = r.Close()
+		}()
+
+		_, _ = w.Write([]byte("data"))
+		_ = w.Close()
+		closeWithDelay(r, time.Second, 1024)
+
+		<-done
+	})
+
+	t.Run("unread data", func(t *testing.T) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = w.Close() }()
+
+		_, _ = w.Write([]byte("data"))
+		closeWithDelay(r, 0, 1024)
+
+		// still readable until data consumed or waited long enough
+		buf := make([]byte, 4)
+		if _, err = r.Read(buf); err != nil {
+			t.Fatalf("reader closed with unread data: %v", err)
+		}
+
+		// blocked until closed
+		if _, err = r.Read(buf); err == nil {
+			t.Error("reader not closed")
+		}
+	})
+}
+
+func TestPortForwardTerminated(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+
+	connCh := make(chan net.Conn, 1)
+	go func() {
+		conn, err2 := l.Accept()
+		if err2 == nil {
+			connCh <- conn
+		}
+	}()
+
+	config := &conf.Config{}
+	config.Arhat.Host.AllowPortForward = true
+	ag, _ := newTestAgent(t, config)
+
+	const sid = 1
+	sendCmd(t, ag, sid, aranyagopb.CMD_PORT_FORWARD, &aranyagopb.PortForwardCmd{
+		Network: "tcp",
+		Address: "localhost",
+		Port:    int32(l.Addr().(*net.TCPAddr).Port),
+	})
+
+	var conn net.Conn
+	select {
+	case conn = <-connCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("port-forward not connected")
+	}
+	defer func() { _ = conn.Close() }()
+
+	waitFor(t, "port-forward session registered", func() bool {
+		ag.sessions.mu.Lock()
+		defer ag.sessions.mu.Unlock()
+
+		_, ok := ag.sessions.sessions[sid]
+		return ok
+	})
+
+	// connectivity lost, session terminated without closing its input
+	ag.SetClient(nil)
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("forwarded connection not closed: %v", err)
+	}
+
+	waitFor(t, "port-forward session removed", func() bool {
+		ag.sessions.mu.Lock()
+		defer ag.sessions.mu.Unlock()
+
+		return len(ag.sessions.sessions) == 0
+	})
+}
@@ -21,6 +21,7 @@ package agent
 import (
 	"bytes"
 	"fmt"
+	"strings"
 	"sync"
 
 	"arhat.dev/aranya-proto/aranyagopb"
@@ -102,6 +103,14 @@ func (b *Agent) handleMetricsCollect(sid uint64, data []byte) {
 	}
 
 	b.processInNewGoroutine(sid, "metrics.collect", func() {
+		b.sender.setSessionClass(sid, sendClassMetrics)
+		defer b.sender.clearSessionClass(sid)
+
+		if b.spool != nil {
+			b.spool.trackMetrics(sid)
+			defer b.spool.untrackMetrics(sid)
+		}
+
 		mtc, err := collect()
 		if err != nil {
 			b.handleRuntimeError(sid, err)
@@ -114,6 +123,8 @@ func (b *Agent) handleMetricsCollect(sid uint64, data []byte) {
 			mtc = append(mtc, pMtc...)
 		}
 
+		mtc = append(mtc, b.collectAgentMetrics()...)
+
 		data, err := b.encodeMetrics(mtc)
 		if err != nil {
 			b.handleConnectivityError(sid, fmt.Errorf("failed to encode metrics: %w", err))
@@ -127,3 +138,71 @@ func (b *Agent) handleMetricsCollect(sid uint64, data []byte) {
 		}
 	})
 }
+
+// collectAgentMetrics collects metrics of arhat itself
+func (b *Agent) collectAgentMetrics() []*dto.MetricFamily {
+	var (
+		gauge   = dto.MetricType_GAUGE
+		counter = dto.MetricType_COUNTER
+
+		activeName   = "arhat_agent_works_active"
+		activeHelp   = "Count of works running for commands"
+		queuedName   = "arhat_agent_works_queued"
+		queuedHelp   = "Count of works waiting for free slots"
+		rejectedName = "arhat_agent_works_rejected_total"
+		rejectedHelp = "Count of works rejected due to concurrency limits"
+
+		duplicateName = "arhat_agent_cmds_duplicate_total"
+		duplicateHelp = "Count of duplicate command packets dropped"
+
+		kindLabel = "kind"
+	)
+
+	active := &dto.MetricFamily{Name: &activeName, Help: &activeHelp, Type: &gauge}
+	queued := &dto.MetricFamily{Name: &queuedName, Help: &queuedHelp, Type: &gauge}
+	rejected := &dto.MetricFamily{Name: &rejectedName, Help: &rejectedHelp, Type: &counter}
+	duplicate := &dto.MetricFamily{Name: &duplicateName, Help: &duplicateHelp, Type: &counter}
+
+	for _, s := range b.scheduler.stats() {
+		var (
+			kind        = s.kind
+			activeCount = float64(s.active)
+			queuedCount = float64(s.queued)
+			rejectCount = float64(s.rejected)
+			labels      = []*dto.LabelPair{{Name: &kindLabel, Value: &kind}}
+		)
+
+		active.Metric = append(active.Metric, &dto.Metric{
+			Label: labels, Gauge: &dto.Gauge{Value: &activeCount},
+		})
+		queued.Metric = append(queued.Metric, &dto.Metric{
+			Label: labels, Gauge: &dto.Gauge{Value: &queuedCount},
+		})
+		rejected.Metric = append(rejected.Metric, &dto.Metric{
+			Label: labels, Counter: &dto.Counter{Value: &rejectCount},
+		})
+	}
+
+	for k, n := range b.cmdDedup.Duplicates() {
+		var (
+			kind  = strings.ToLower(strings.TrimPrefix(k.String(), "CMD_"))
+			count = float64(n)
+		)
+
+		duplicate.Metric = append(duplicate.Metric, &dto.Metric{
+			Label:   []*dto.LabelPair{{Name: &kindLabel, Value: &kind}},
+			Counter: &dto.Counter{Value: &count},
+		})
+	}
+
+	var ret []*dto.MetricFamily
+	if len(active.Metric) != 0 {
+		ret = append(ret, active, queued, rejected)
+	}
+
+	if len(duplicate.Metric) != 0 {
+		ret = append(ret, duplicate)
+	}
+
+	return ret
+}
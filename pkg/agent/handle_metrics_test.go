@@ -0,0 +1,43 @@
+// +build !nometrics
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestMetricsCollectWithoutExtensions(t *testing.T) {
+	// extensions are not enabled by default
+	ag, c := newTestAgent(t, nil)
+
+	ag.metricsMU.Lock()
+	ag.collectNodeMetrics = func() ([]*dto.MetricFamily, error) { return nil, nil }
+	ag.metricsMU.Unlock()
+
+	sendCmd(t, ag, 1, aranyagopb.CMD_METRICS_COLLECT, nil)
+
+	msgs := c.waitComplete(t, 1, 5*time.Second)
+	if last := msgs[len(msgs)-1]; last.Kind != aranyagopb.MSG_DATA_METRICS {
+		t.Errorf("unexpected msg %v", last.Kind)
+	}
+}
@@ -62,7 +62,7 @@ func (b *Agent) handleNodeInfoGet(sid uint64, cmdBytes []byte) {
 				SystemInfo: systemInfo,
 				Capacity:   capacity,
 				Conditions: b.getNodeConditions(),
-				ExtInfo:    b.extInfo,
+				ExtInfo:    append(append([]*aranyagopb.NodeExtInfo{}, b.extInfo...), b.nodeProbes.getExtInfo()...),
 			}
 			if err := b.PostMsg(sid, aranyagopb.MSG_NODE_STATUS, nodeMsg); err != nil {
 				b.handleConnectivityError(sid, err)
@@ -71,10 +71,7 @@ func (b *Agent) handleNodeInfoGet(sid uint64, cmdBytes []byte) {
 		})
 	case aranyagopb.NODE_INFO_DYN:
 		b.processInNewGoroutine(sid, "node.info.dyn", func() {
-			nodeMsg := &aranyagopb.NodeStatusMsg{
-				Conditions: b.getNodeConditions(),
-			}
-			if err := b.PostMsg(sid, aranyagopb.MSG_NODE_STATUS, nodeMsg); err != nil {
+			if err := b.PostMsg(sid, aranyagopb.MSG_NODE_STATUS, b.getDynNodeStatus()); err != nil {
 				b.handleConnectivityError(sid, err)
 				return
 			}
@@ -84,14 +81,43 @@ func (b *Agent) handleNodeInfoGet(sid uint64, cmdBytes []byte) {
 	}
 }
 
+func (b *Agent) getDynNodeStatus() *aranyagopb.NodeStatusMsg {
+	return &aranyagopb.NodeStatusMsg{
+		Conditions: b.getNodeConditions(),
+		ExtInfo:    b.nodeProbes.getExtInfo(),
+	}
+}
+
+// postNodeStatusUpdate pushes dynamic node status without waiting for the
+// next NODE_INFO_GET poll, skipped when there is no client since aranya will
+// query node status after reconnection
+func (b *Agent) postNodeStatusUpdate() {
+	if b.GetClient() == nil {
+		return
+	}
+
+	if err := b.PostMsg(0, aranyagopb.MSG_NODE_STATUS, b.getDynNodeStatus()); err != nil {
+		b.handleConnectivityError(0, err)
+	}
+}
+
 func (b *Agent) getNodeConditions() *aranyagopb.NodeConditions {
-	// TODO: use real conditions
-	return &aranyagopb.NodeConditions{
-		Ready:   aranyagopb.NODE_CONDITION_HEALTHY,
-		Memory:  aranyagopb.NODE_CONDITION_HEALTHY,
-		Disk:    aranyagopb.NODE_CONDITION_HEALTHY,
-		Pid:     aranyagopb.NODE_CONDITION_HEALTHY,
-		Network: aranyagopb.NODE_CONDITION_HEALTHY,
+	ready := aranyagopb.NODE_CONDITION_HEALTHY
+	if !b.runtimeReady() {
+		ready = aranyagopb.NODE_CONDITION_UNHEALTHY
+	}
+
+	conditions := &aranyagopb.NodeConditions{
+		Ready:   ready,
+		Memory:  b.nodeConditions.checkMemory(),
+		Disk:    b.nodeConditions.checkDisk(),
+		Pid:     b.nodeConditions.checkPid(),
+		Network: b.networkCondition(),
 		Pod:     aranyagopb.NODE_CONDITION_HEALTHY,
 	}
+
+	// user defined probes
+	b.nodeProbes.applyConditions(conditions)
+
+	return conditions
 }
@@ -18,11 +18,70 @@ package agent
 
 import (
 	"fmt"
+	"sync"
 
 	"arhat.dev/aranya-proto/aranyagopb"
 	"arhat.dev/pkg/log"
 )
 
+// sessionRegistry tracks running processes and port-forwards of sessions,
+// so they can be terminated when session closed or connectivity lost
+type sessionRegistry struct {
+	mu       *sync.Mutex
+	sessions map[uint64]func()
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		mu:       new(sync.Mutex),
+		sessions: make(map[uint64]func()),
+	}
+}
+
+// add terminate func of the session
+func (r *sessionRegistry) add(sid uint64, terminate func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sessions[sid] = terminate
+}
+
+// remove session finished by itself
+func (r *sessionRegistry) remove(sid uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.sessions, sid)
+}
+
+// terminate the session in background, returns false if not found
+func (r *sessionRegistry) terminate(sid uint64) bool {
+	r.mu.Lock()
+	terminate, ok := r.sessions[sid]
+	delete(r.sessions, sid)
+	r.mu.Unlock()
+
+	if ok {
+		go terminate()
+	}
+
+	return ok
+}
+
+// terminateAll sessions in background, returns count of sessions terminated
+func (r *sessionRegistry) terminateAll() int {
+	r.mu.Lock()
+	sessions := r.sessions
+	r.sessions = make(map[uint64]func())
+	r.mu.Unlock()
+
+	for _, terminate := range sessions {
+		go terminate()
+	}
+
+	return len(sessions)
+}
+
 func (b *Agent) handleSessionClose(sid uint64, data []byte) {
 	cmd := new(aranyagopb.SessionCloseCmd)
 
@@ -33,5 +92,9 @@ func (b *Agent) handleSessionClose(sid uint64, data []byte) {
 	}
 
 	b.logger.D("closing session", log.Uint64("sid", sid))
+	if b.sessions.terminate(sid) {
+		b.logger.D("terminating session", log.Uint64("sid", sid))
+	}
+
 	b.streams.Del(sid)
 }
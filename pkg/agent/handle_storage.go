@@ -0,0 +1,297 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/pkg/log"
+	"arhat.dev/pkg/wellknownerrors"
+	"ext.arhat.dev/runtimeutil/storageutil"
+)
+
+type agentComponentStorage struct {
+	storageClient *storageutil.Client
+
+	// storageEnabled is false when no storage driver configured, the nop
+	// driver never produces mount commands
+	storageEnabled bool
+
+	mountsMU *sync.RWMutex
+	// mounts are active mounts, key is the local mount point
+	mounts map[string]*aranyagopb.StorageStatusMsg
+
+	mountLocksMU *sync.Mutex
+	// mountLocks serialize ensure and delete of the same mount point
+	mountLocks map[string]*mountLock
+}
+
+type mountLock struct {
+	mu   *sync.Mutex
+	refs int
+}
+
+func (c *agentComponentStorage) init(
+	ctx context.Context,
+	config *storageutil.ClientConfig,
+) error {
+	var err error
+	c.storageClient, err = config.CreateClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.storageEnabled = config.Driver != ""
+	c.mountsMU = new(sync.RWMutex)
+	c.mounts = make(map[string]*aranyagopb.StorageStatusMsg)
+	c.mountLocksMU = new(sync.Mutex)
+	c.mountLocks = make(map[string]*mountLock)
+
+	return nil
+}
+
+// lockMountPoint blocks until no other operation is working on the mount
+// point, the returned func MUST be called to release the lock
+func (c *agentComponentStorage) lockMountPoint(mountPoint string) (unlock func()) {
+	c.mountLocksMU.Lock()
+	l, ok := c.mountLocks[mountPoint]
+	if !ok {
+		l = &mountLock{mu: new(sync.Mutex)}
+		c.mountLocks[mountPoint] = l
+	}
+	l.refs++
+	c.mountLocksMU.Unlock()
+
+	l.mu.Lock()
+
+	return func() {
+		l.mu.Unlock()
+
+		c.mountLocksMU.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(c.mountLocks, mountPoint)
+		}
+		c.mountLocksMU.Unlock()
+	}
+}
+
+func (c *agentComponentStorage) getStorageStatus(mountPoint string) *aranyagopb.StorageStatusMsg {
+	c.mountsMU.RLock()
+	defer c.mountsMU.RUnlock()
+
+	status, ok := c.mounts[mountPoint]
+	if !ok {
+		return nil
+	}
+
+	return status
+}
+
+func (c *agentComponentStorage) getAllStorageStatuses() []*aranyagopb.StorageStatusMsg {
+	c.mountsMU.RLock()
+	defer c.mountsMU.RUnlock()
+
+	result := make([]*aranyagopb.StorageStatusMsg, 0, len(c.mounts))
+	for _, s := range c.mounts {
+		result = append(result, s)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].MountPoint < result[j].MountPoint
+	})
+
+	return result
+}
+
+func (c *agentComponentStorage) setStorageMounted(remotePath, mountPoint string) *aranyagopb.StorageStatusMsg {
+	status := &aranyagopb.StorageStatusMsg{
+		State:      aranyagopb.STORAGE_STATE_MOUNTED,
+		RemotePath: remotePath,
+		MountPoint: mountPoint,
+	}
+
+	c.mountsMU.Lock()
+	c.mounts[mountPoint] = status
+	c.mountsMU.Unlock()
+
+	return status
+}
+
+// nolint:unparam
+func (c *agentComponentStorage) setStorageUnmounted(remotePath, mountPoint string) *aranyagopb.StorageStatusMsg {
+	c.mountsMU.Lock()
+	if s, ok := c.mounts[mountPoint]; ok && remotePath == "" {
+		remotePath = s.RemotePath
+	}
+	delete(c.mounts, mountPoint)
+	c.mountsMU.Unlock()
+
+	return &aranyagopb.StorageStatusMsg{
+		State:      aranyagopb.STORAGE_STATE_UNMOUNTED,
+		RemotePath: remotePath,
+		MountPoint: mountPoint,
+	}
+}
+
+func (b *Agent) handleStorageList(sid uint64, data []byte) {
+	cmd := new(aranyagopb.StorageListCmd)
+	err := cmd.Unmarshal(data)
+	if err != nil {
+		b.handleRuntimeError(sid, fmt.Errorf("failed to unmarshal StorageListCmd: %w", err))
+		return
+	}
+
+	err = b.PostMsg(
+		sid,
+		aranyagopb.MSG_STORAGE_STATUS_LIST,
+		&aranyagopb.StorageStatusListMsg{
+			Storages: b.getAllStorageStatuses(),
+		},
+	)
+	if err != nil {
+		b.handleConnectivityError(sid, err)
+	}
+}
+
+func (b *Agent) handleStorageEnsure(sid uint64, data []byte) {
+	cmd := new(aranyagopb.StorageEnsureCmd)
+	err := cmd.Unmarshal(data)
+	if err != nil {
+		b.handleRuntimeError(sid, fmt.Errorf("failed to unmarshal StorageEnsureCmd: %w", err))
+		return
+	}
+
+	if !b.storageEnabled {
+		b.handleRuntimeError(sid, fmt.Errorf("no storage driver configured: %w", wellknownerrors.ErrNotSupported))
+		return
+	}
+
+	if cmd.RemotePath == "" || cmd.LocalPath == "" {
+		b.handleRuntimeError(sid, errRequiredOptionsNotFound)
+		return
+	}
+
+	b.processInNewGoroutine(sid, "storage.ensure", func() {
+		defer b.lockMountPoint(cmd.LocalPath)()
+
+		status := b.getStorageStatus(cmd.LocalPath)
+		if status != nil {
+			if status.RemotePath != cmd.RemotePath {
+				b.handleRuntimeError(sid, fmt.Errorf(
+					"mount point %q used by %q: %w",
+					cmd.LocalPath, status.RemotePath, wellknownerrors.ErrAlreadyExists,
+				))
+				return
+			}
+
+			// already mounted
+			err = b.PostMsg(sid, aranyagopb.MSG_STORAGE_STATUS, status)
+			if err != nil {
+				b.handleConnectivityError(sid, err)
+			}
+			return
+		}
+
+		err = os.MkdirAll(cmd.LocalPath, 0750)
+		if err != nil && !os.IsExist(err) {
+			b.handleRuntimeError(sid, fmt.Errorf("failed to ensure mount point: %w", err))
+			return
+		}
+
+		err = b.storageClient.Mount(b.ctx, cmd.RemotePath, cmd.LocalPath, b.handleStorageExited)
+		if err != nil {
+			if errors.Is(err, storageutil.ErrMountpointInUse) {
+				err = fmt.Errorf("%v: %w", err, wellknownerrors.ErrAlreadyExists)
+			}
+
+			b.handleRuntimeError(sid, fmt.Errorf("failed to mount remote volume: %w", err))
+			return
+		}
+
+		b.logger.D("remote volume mounted",
+			log.String("remote", cmd.RemotePath),
+			log.String("local", cmd.LocalPath),
+		)
+
+		err = b.PostMsg(
+			sid,
+			aranyagopb.MSG_STORAGE_STATUS,
+			b.setStorageMounted(cmd.RemotePath, cmd.LocalPath),
+		)
+		if err != nil {
+			b.handleConnectivityError(sid, err)
+		}
+	})
+}
+
+func (b *Agent) handleStorageDelete(sid uint64, data []byte) {
+	cmd := new(aranyagopb.StorageDeleteCmd)
+	err := cmd.Unmarshal(data)
+	if err != nil {
+		b.handleRuntimeError(sid, fmt.Errorf("failed to unmarshal StorageDeleteCmd: %w", err))
+		return
+	}
+
+	if !b.storageEnabled {
+		b.handleRuntimeError(sid, fmt.Errorf("no storage driver configured: %w", wellknownerrors.ErrNotSupported))
+		return
+	}
+
+	if cmd.LocalPath == "" {
+		b.handleRuntimeError(sid, errRequiredOptionsNotFound)
+		return
+	}
+
+	b.processInNewGoroutine(sid, "storage.delete", func() {
+		defer b.lockMountPoint(cmd.LocalPath)()
+
+		err = b.storageClient.Unmount(b.ctx, cmd.LocalPath)
+		if err != nil {
+			b.handleRuntimeError(sid, fmt.Errorf("failed to unmount remote volume: %w", err))
+			return
+		}
+
+		b.logger.D("remote volume unmounted", log.String("local", cmd.LocalPath))
+
+		err = b.PostMsg(
+			sid,
+			aranyagopb.MSG_STORAGE_STATUS,
+			b.setStorageUnmounted(cmd.RemotePath, cmd.LocalPath),
+		)
+		if err != nil {
+			b.handleConnectivityError(sid, err)
+		}
+	})
+}
+
+// handleStorageExited is called when mount program exited unexpectedly
+func (b *Agent) handleStorageExited(remotePath, mountPoint string, err error) {
+	b.logger.I("remote volume mount exited",
+		log.String("remote", remotePath),
+		log.String("local", mountPoint),
+		log.Error(err),
+	)
+
+	_ = b.setStorageUnmounted(remotePath, mountPoint)
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"ext.arhat.dev/runtimeutil/storageutil"
+
+	"arhat.dev/arhat/pkg/conf"
+)
+
+const fakeStorageDriver = "fake"
+
+func init() {
+	storageutil.Register(fakeStorageDriver,
+		func(interface{}) (storageutil.Interface, error) {
+			return &fakeStorageDriverImpl{}, nil
+		},
+		func() interface{} { return &struct{}{} },
+	)
+}
+
+// fakeStorageDriverImpl mounts by running a process until the mount point
+// has a `.unmount` file (or removed), every mount is logged to `mounts.log` in the
+// parent dir of the mount point
+type fakeStorageDriverImpl struct{}
+
+func (d *fakeStorageDriverImpl) GetMountCmd(remotePath, mountPoint string) []string {
+	return []string{"sh", "-c", `echo "$1" >> "$2/../mounts.log"
+while [ -d "$2" ] && [ ! -e "$2/.unmount" ]; do sleep 0.02; done`, "sh", remotePath, mountPoint}
+}
+
+func (d *fakeStorageDriverImpl) GetUnmountCmd(mountPoint string) []string {
+	return []string{"touch", filepath.Join(mountPoint, ".unmount")}
+}
+
+func newStorageTestAgent(t *testing.T) (*Agent, *testClient, string) {
+	config := &conf.Config{}
+	config.Storage.Driver = fakeStorageDriver
+	config.Storage.SuccessTimeWait = 100 * time.Millisecond
+	config.Storage.StdoutFile = "none"
+	config.Storage.StderrFile = "none"
+
+	ag, c := newTestAgent(t, config)
+	return ag, c, t.TempDir()
+}
+
+func storageStatusOf(t *testing.T, msgs []*aranyagopb.Msg) *aranyagopb.StorageStatusMsg {
+	t.Helper()
+
+	last := msgs[len(msgs)-1]
+	if last.Kind != aranyagopb.MSG_STORAGE_STATUS {
+		t.Fatalf("unexpected msg %v: %q", last.Kind, last.Payload)
+	}
+
+	status := new(aranyagopb.StorageStatusMsg)
+	if err := status.Unmarshal(last.Payload); err != nil {
+		t.Fatal(err)
+	}
+
+	return status
+}
+
+func countMounts(t *testing.T, dir string) int {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "mounts.log"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	return strings.Count(string(data), "\n")
+}
+
+func TestStorageLifecycle(t *testing.T) {
+	ag, c, dir := newStorageTestAgent(t)
+	mountPoint := filepath.Join(dir, "vol")
+
+	sendCmd(t, ag, 1, aranyagopb.CMD_STORAGE_ENSURE, &aranyagopb.StorageEnsureCmd{
+		RemotePath: "remote:/foo", LocalPath: mountPoint,
+	})
+	status := storageStatusOf(t, c.waitComplete(t, 1, 5*time.Second))
+	if status.State != aranyagopb.STORAGE_STATE_MOUNTED || status.RemotePath != "remote:/foo" {
+		t.Fatalf("unexpected status %v", status)
+	}
+
+	// ensure again is a no-op
+	sendCmd(t, ag, 2, aranyagopb.CMD_STORAGE_ENSURE, &aranyagopb.StorageEnsureCmd{
+		RemotePath: "remote:/foo", LocalPath: mountPoint,
+	})
+	if status = storageStatusOf(t, c.waitComplete(t, 2, 5*time.Second)); status.State != aranyagopb.STORAGE_STATE_MOUNTED {
+		t.Fatalf("unexpected status %v", status)
+	}
+
+	// mount point in use
+	sendCmd(t, ag, 3, aranyagopb.CMD_STORAGE_ENSURE, &aranyagopb.StorageEnsureCmd{
+		RemotePath: "remote:/bar", LocalPath: mountPoint,
+	})
+	if msgs := c.waitComplete(t, 3, 5*time.Second); msgs[len(msgs)-1].Kind != aranyagopb.MSG_ERROR {
+		t.Fatalf("expecting error, got %v", msgs[len(msgs)-1].Kind)
+	}
+
+	sendCmd(t, ag, 4, aranyagopb.CMD_STORAGE_LIST, &aranyagopb.StorageListCmd{})
+	msgs := c.waitComplete(t, 4, 5*time.Second)
+	list := new(aranyagopb.StorageStatusListMsg)
+	if err := list.Unmarshal(msgs[len(msgs)-1].Payload); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Storages) != 1 || list.Storages[0].MountPoint != mountPoint {
+		t.Fatalf("unexpected storage list %v", list.Storages)
+	}
+
+	sendCmd(t, ag, 5, aranyagopb.CMD_STORAGE_DELETE, &aranyagopb.StorageDeleteCmd{LocalPath: mountPoint})
+	if status = storageStatusOf(t, c.waitComplete(t, 5, 5*time.Second)); status.State != aranyagopb.STORAGE_STATE_UNMOUNTED {
+		t.Fatalf("unexpected status %v", status)
+	}
+
+	if s := ag.getAllStorageStatuses(); len(s) != 0 {
+		t.Fatalf("unexpected mounts after delete %v", s)
+	}
+
+	if n := countMounts(t, dir); n != 1 {
+		t.Fatalf("expecting 1 mount, got %d", n)
+	}
+}
+
+func TestStorageEnsureConcurrent(t *testing.T) {
+	ag, c, dir := newStorageTestAgent(t)
+	mountPoint := filepath.Join(dir, "vol")
+
+	const n = 4
+	wg := new(sync.WaitGroup)
+	for i := uint64(1); i <= n; i++ {
+		wg.Add(1)
+		go func(sid uint64) {
+			defer wg.Done()
+
+			sendCmd(t, ag, sid, aranyagopb.CMD_STORAGE_ENSURE, &aranyagopb.StorageEnsureCmd{
+				RemotePath: "remote:/foo", LocalPath: mountPoint,
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	for i := uint64(1); i <= n; i++ {
+		if status := storageStatusOf(t, c.waitComplete(t, i, 5*time.Second)); status.State != aranyagopb.STORAGE_STATE_MOUNTED {
+			t.Fatalf("unexpected status of %d: %v", i, status)
+		}
+	}
+
+	if m := countMounts(t, dir); m != 1 {
+		t.Fatalf("expecting 1 mount, got %d", m)
+	}
+
+	sendCmd(t, ag, n+1, aranyagopb.CMD_STORAGE_DELETE, &aranyagopb.StorageDeleteCmd{LocalPath: mountPoint})
+	c.waitComplete(t, n+1, 5*time.Second)
+}
+
+func TestStorageNoDriver(t *testing.T) {
+	ag, c := newTestAgent(t, nil)
+
+	sendCmd(t, ag, 1, aranyagopb.CMD_STORAGE_ENSURE, &aranyagopb.StorageEnsureCmd{
+		RemotePath: "remote:/foo", LocalPath: filepath.Join(t.TempDir(), "vol"),
+	})
+	if msgs := c.waitComplete(t, 1, 5*time.Second); msgs[len(msgs)-1].Kind != aranyagopb.MSG_ERROR {
+		t.Fatalf("expecting error, got %v", msgs[len(msgs)-1].Kind)
+	}
+}
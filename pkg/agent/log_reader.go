@@ -0,0 +1,440 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/aranya-proto/aranyagopb/aranyagoconst"
+)
+
+const (
+	// logFollowInterval is the interval to check log file changes in follow mode
+	logFollowInterval = 500 * time.Millisecond
+
+	// logTailBlockSize is the size of a single read when searching tail lines
+	logTailBlockSize = 4096
+)
+
+var (
+	errLogBytesLimitReached = errors.New("log bytes limit reached")
+
+	// logLineTimeLayouts are time layouts tried on the first field of a log line
+	logLineTimeLayouts = []string{
+		time.RFC3339Nano,
+		time.RFC3339,
+		"2006-01-02T15:04:05.999999999",
+	}
+
+	// logJSONTimeKeys are keys checked for timestamp in json formatted log line
+	logJSONTimeKeys = []string{"T", "time", "ts", "timestamp", "@timestamp"}
+)
+
+type logReadOptions struct {
+	// tailLines to read, negative value means all
+	tailLines int64
+	// bytesLimit of the output, non-positive value means no limit
+	bytesLimit int64
+	since      time.Time
+	follow     bool
+	timestamp  bool
+
+	// checkPath resolves and checks the log file path, called every time
+	// the log file is (re-)opened, nil means no check
+	checkPath func(p string) (string, error)
+}
+
+func newLogReadOptions(cmd *aranyagopb.LogsCmd) (*logReadOptions, error) {
+	opts := &logReadOptions{
+		tailLines:  cmd.TailLines,
+		bytesLimit: cmd.BytesLimit,
+		follow:     cmd.Follow,
+		timestamp:  cmd.Timestamp,
+	}
+
+	if cmd.Since != "" {
+		var err error
+		opts.since, err = time.Parse(aranyagoconst.TimeLayout, cmd.Since)
+		if err != nil {
+			return nil, fmt.Errorf("invalid since time %q: %w", cmd.Since, err)
+		}
+	}
+
+	return opts, nil
+}
+
+// readLogFile writes lines of the host log file to w according to opts
+//
+// in follow mode, it keeps reading appended data until ctx is canceled, log
+// rotation (file renamed or truncated) is detected by comparing file info
+func readLogFile(ctx context.Context, path string, opts *logReadOptions, w io.Writer) error {
+	f, err := openLogFile(path, opts)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	start, err := findLogTailStart(f, opts.tailLines)
+	if err != nil {
+		return fmt.Errorf("failed to find tail lines of log file %q: %w", path, err)
+	}
+
+	offset, err := f.Seek(start, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("failed to seek log file %q: %w", path, err)
+	}
+
+	lw := &logLineWriter{
+		w:      w,
+		opts:   opts,
+		remain: opts.bytesLimit,
+		// only filter by time when lines carry parsable timestamp
+		include: true,
+	}
+
+	var (
+		r       = bufio.NewReader(f)
+		partial []byte
+		ticker  *time.Ticker
+	)
+
+	for {
+		line, err := r.ReadBytes('\n')
+		offset += int64(len(line))
+
+		if len(partial) != 0 {
+			line = append(partial, line...)
+			partial = nil
+		}
+
+		if err == nil {
+			err = lw.writeLine(line)
+			if err != nil {
+				return lw.finish(err)
+			}
+
+			continue
+		}
+
+		if err != io.EOF {
+			return fmt.Errorf("failed to read log file %q: %w", path, err)
+		}
+
+		if !opts.follow {
+			if len(line) != 0 {
+				return lw.finish(lw.writeLine(line))
+			}
+
+			return nil
+		}
+
+		// keep incomplete line until we get the whole line
+		partial = line
+
+		if ticker == nil {
+			ticker = time.NewTicker(logFollowInterval)
+			defer ticker.Stop()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		current, err := f.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to check log file %q: %w", path, err)
+		}
+
+		latest, err := os.Stat(path)
+		switch {
+		case err != nil:
+			// log file moved without new one created, keep reading
+		case !os.SameFile(current, latest):
+			// log file rotated, drain remaining data of the old one
+			// (move to .old file) and switch to the new log file
+			var rest []byte
+			rest, err = ioutil.ReadAll(r)
+			if err != nil {
+				return fmt.Errorf("failed to drain rotated log file %q: %w", path, err)
+			}
+
+			for _, l := range bytes.SplitAfter(append(partial, rest...), []byte{'\n'}) {
+				if len(l) == 0 {
+					continue
+				}
+
+				err = lw.writeLine(l)
+				if err != nil {
+					return lw.finish(err)
+				}
+			}
+			partial = nil
+
+			// path may have been replaced by a symlink, check again
+			newFile, err := openLogFile(path, opts)
+			if err != nil {
+				return fmt.Errorf("failed to open rotated log file %q: %w", path, err)
+			}
+
+			_ = f.Close()
+			f = newFile
+			offset = 0
+			r.Reset(f)
+		case latest.Size() < offset:
+			// log file truncated (copytruncate), read from the beginning
+			offset, err = f.Seek(0, io.SeekStart)
+			if err != nil {
+				return fmt.Errorf("failed to seek truncated log file %q: %w", path, err)
+			}
+
+			partial = nil
+			r.Reset(f)
+		}
+	}
+}
+
+// openLogFile resolves path with opts.checkPath and opens the resolved
+// file, the opened file must still be the one checked
+func openLogFile(path string, opts *logReadOptions) (*os.File, error) {
+	var (
+		resolved string
+		err      error
+	)
+	if opts.checkPath != nil {
+		resolved, err = opts.checkPath(path)
+	} else {
+		resolved, err = filepath.EvalSymlinks(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(resolved)
+	if err != nil {
+		return nil, err
+	}
+
+	// resolved path contains no symlink, it can only be the opened file
+	// if not replaced after the check
+	opened, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	checked, err := os.Lstat(resolved)
+	if err != nil || !os.SameFile(opened, checked) {
+		_ = f.Close()
+		return nil, fmt.Errorf("log file %q changed while opening", path)
+	}
+
+	return f, nil
+}
+
+// findLogTailStart returns the offset of the start of last n lines
+//
+// the last line is counted even if it has no line ending
+func findLogTailStart(f io.ReadSeeker, n int64) (int64, error) {
+	if n < 0 {
+		return 0, nil
+	}
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	if n == 0 {
+		return size, nil
+	}
+
+	var (
+		buf   = make([]byte, logTailBlockSize)
+		end   = size
+		found int64
+	)
+
+	for end > 0 {
+		start := end - logTailBlockSize
+		if start < 0 {
+			start = 0
+		}
+
+		block := buf[:end-start]
+		_, err = f.Seek(start, io.SeekStart)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = io.ReadFull(f, block)
+		if err != nil {
+			return 0, err
+		}
+
+		for i := len(block) - 1; i >= 0; i-- {
+			if block[i] != '\n' || start+int64(i) == size-1 {
+				// not a line ending, or trailing line ending of the last line
+				continue
+			}
+
+			found++
+			if found == n {
+				return start + int64(i) + 1, nil
+			}
+		}
+
+		end = start
+	}
+
+	return 0, nil
+}
+
+type logLineWriter struct {
+	w    io.Writer
+	opts *logReadOptions
+
+	remain int64
+
+	// lastTime is the timestamp of last line with parsable timestamp
+	lastTime time.Time
+	// include lines without timestamp, they are continuation of the
+	// previous line, or the log has no parsable timestamp at all
+	include bool
+}
+
+func (lw *logLineWriter) writeLine(rawLine []byte) error {
+	msg := parseLogLine(rawLine)
+	if msg.hasTime {
+		lw.lastTime = msg.time
+		lw.include = !msg.time.Before(lw.opts.since)
+	}
+
+	if !lw.include {
+		return nil
+	}
+
+	line := msg.content
+	if lw.opts.timestamp && !msg.leadingTime && !lw.lastTime.IsZero() {
+		prefix := lw.lastTime.UTC().Format(aranyagoconst.TimeLayout) + " "
+		line = append([]byte(prefix), line...)
+	}
+
+	limited := lw.opts.bytesLimit > 0
+	if limited && int64(len(line)) > lw.remain {
+		line = line[:lw.remain]
+	}
+
+	n, err := lw.w.Write(line)
+	lw.remain -= int64(n)
+	if err != nil {
+		return err
+	}
+
+	if limited && lw.remain <= 0 {
+		return errLogBytesLimitReached
+	}
+
+	return nil
+}
+
+func (lw *logLineWriter) finish(err error) error {
+	if errors.Is(err, errLogBytesLimitReached) {
+		return nil
+	}
+
+	return err
+}
+
+// logLine is a parsed log line
+type logLine struct {
+	time    time.Time
+	hasTime bool
+	// leadingTime is true when content starts with the timestamp
+	leadingTime bool
+
+	content []byte
+}
+
+// parseLogLine finds timestamp of the log line, the line is kept as is
+func parseLogLine(line []byte) logLine {
+	t, ok := parseLogLineTime(line)
+	trimmed := bytes.TrimLeft(line, " \t")
+	return logLine{
+		time:        t,
+		hasTime:     ok,
+		leadingTime: ok && len(trimmed) != 0 && trimmed[0] != '{',
+		content:     line,
+	}
+}
+
+// parseLogLineTime tries to find timestamp in the log line
+func parseLogLineTime(line []byte) (time.Time, bool) {
+	line = bytes.TrimLeft(line, " \t")
+	if len(line) == 0 {
+		return time.Time{}, false
+	}
+
+	if line[0] == '{' {
+		m := make(map[string]interface{})
+		if json.Unmarshal(line, &m) != nil {
+			return time.Time{}, false
+		}
+
+		for _, k := range logJSONTimeKeys {
+			s, ok := m[k].(string)
+			if !ok {
+				continue
+			}
+
+			for _, layout := range logLineTimeLayouts {
+				t, err := time.Parse(layout, s)
+				if err == nil {
+					return t, true
+				}
+			}
+		}
+
+		return time.Time{}, false
+	}
+
+	field := line
+	if i := bytes.IndexAny(line, " \t"); i > 0 {
+		field = line[:i]
+	}
+
+	for _, layout := range logLineTimeLayouts {
+		t, err := time.Parse(layout, string(field))
+		if err == nil {
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
@@ -0,0 +1,328 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"arhat.dev/arhat/pkg/conf"
+	"arhat.dev/arhat/pkg/policy"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func writeLogFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func appendLogFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	if _, err = f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readLogString(t *testing.T, content string, opts *logReadOptions) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "test.log")
+	writeLogFile(t, path, content)
+
+	buf := new(bytes.Buffer)
+	if err := readLogFile(context.TODO(), path, opts, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.String()
+}
+
+func TestReadLogFileTail(t *testing.T) {
+	var long strings.Builder
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&long, "line %d\n", i)
+	}
+
+	for _, test := range []struct {
+		name     string
+		content  string
+		tail     int64
+		expected string
+	}{
+		{name: "All", content: "a\nb\nc\n", tail: -1, expected: "a\nb\nc\n"},
+		{name: "None", content: "a\nb\nc\n", tail: 0, expected: ""},
+		{name: "Last Two", content: "a\nb\nc\n", tail: 2, expected: "b\nc\n"},
+		{name: "No Line Ending", content: "a\nb\nc", tail: 1, expected: "c"},
+		{name: "More Than File", content: "a\nb\n", tail: 10, expected: "a\nb\n"},
+		{name: "Multiple Blocks", content: long.String(), tail: 3, expected: "line 1997\nline 1998\nline 1999\n"},
+		{name: "Empty", content: "", tail: 3, expected: ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			actual := readLogString(t, test.content, &logReadOptions{tailLines: test.tail})
+			if actual != test.expected {
+				t.Errorf("expecting %q, got %q", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestReadLogFileSince(t *testing.T) {
+	since := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{
+			name: "Text",
+			content: "2019-12-31T23:59:59Z old\n" +
+				"  old continuation\n" +
+				"2020-01-01T00:00:00Z new\n" +
+				"  new continuation\n" +
+				"2020-01-01T00:00:01.5Z newer\n",
+			expected: "2020-01-01T00:00:00Z new\n" +
+				"  new continuation\n" +
+				"2020-01-01T00:00:01.5Z newer\n",
+		},
+		{
+			name: "JSON",
+			content: `{"ts":"2019-12-31T23:59:59Z","msg":"old"}` + "\n" +
+				`{"ts":"2020-01-01T00:00:01Z","msg":"new"}` + "\n",
+			expected: `{"ts":"2020-01-01T00:00:01Z","msg":"new"}` + "\n",
+		},
+		{
+			name:     "No Timestamp",
+			content:  "Oct 18 06:29:05 host app: foo\nOct 18 06:29:06 host app: bar\n",
+			expected: "Oct 18 06:29:05 host app: foo\nOct 18 06:29:06 host app: bar\n",
+		},
+		{
+			name:     "Leading Lines Without Timestamp",
+			content:  "header\n2019-12-31T23:59:59Z old\n2020-01-02T00:00:00Z new\n",
+			expected: "header\n2020-01-02T00:00:00Z new\n",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			actual := readLogString(t, test.content, &logReadOptions{tailLines: -1, since: since})
+			if actual != test.expected {
+				t.Errorf("expecting %q, got %q", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestReadLogFileBytesLimit(t *testing.T) {
+	content := "0123456789\nabcdefghij\n"
+
+	for _, test := range []struct {
+		limit    int64
+		expected string
+	}{
+		{limit: 0, expected: content},
+		{limit: 5, expected: "01234"},
+		{limit: 11, expected: "0123456789\n"},
+		{limit: 15, expected: "0123456789\nabcd"},
+		{limit: 100, expected: content},
+	} {
+		t.Run(fmt.Sprint(test.limit), func(t *testing.T) {
+			actual := readLogString(t, content, &logReadOptions{tailLines: -1, bytesLimit: test.limit})
+			if actual != test.expected {
+				t.Errorf("expecting %q, got %q", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestReadLogFileTimestamp(t *testing.T) {
+	actual := readLogString(t,
+		`{"time":"2020-01-01T00:00:00Z"}`+"\n"+
+			"continuation\n"+
+			"2020-01-01T00:00:01Z text\n",
+		&logReadOptions{tailLines: -1, timestamp: true},
+	)
+
+	// no extra timestamp for lines starting with one
+	expected := "2020-01-01T00:00:00Z " + `{"time":"2020-01-01T00:00:00Z"}` + "\n" +
+		"2020-01-01T00:00:00Z continuation\n" +
+		"2020-01-01T00:00:01Z text\n"
+	if actual != expected {
+		t.Errorf("expecting %q, got %q", expected, actual)
+	}
+}
+
+func TestReadLogFileFollow(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.log")
+	writeLogFile(t, path, "old 1\nold 2\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		buf  = new(syncBuffer)
+		done = make(chan error)
+	)
+	go func() {
+		done <- readLogFile(ctx, path, &logReadOptions{tailLines: 1, follow: true}, buf)
+	}()
+
+	waitOutput := func(expected string) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for buf.String() != expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("expecting %q, got %q", expected, buf.String())
+			}
+
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	waitOutput("old 2\n")
+
+	// partial line is written once completed
+	appendLogFile(t, path, "appended")
+	time.Sleep(2 * logFollowInterval)
+	appendLogFile(t, path, " line\n")
+	waitOutput("old 2\nappended line\n")
+
+	// rotation: moved to .old file, lines written to the old file before
+	// the switch are not lost
+	if err := os.Rename(path, path+".old"); err != nil {
+		t.Fatal(err)
+	}
+	appendLogFile(t, path+".old", "before rotation\n")
+	writeLogFile(t, path, "rotated 1\n")
+	waitOutput("old 2\nappended line\nbefore rotation\nrotated 1\n")
+
+	// truncation (copytruncate)
+	time.Sleep(2 * logFollowInterval)
+	writeLogFile(t, path, "")
+	time.Sleep(2 * logFollowInterval)
+	appendLogFile(t, path, "truncated\n")
+	waitOutput("old 2\nappended line\nbefore rotation\nrotated 1\ntruncated\n")
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadLogFileFollowPolicy(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		logDir  = filepath.Join(dir, "log")
+		path    = filepath.Join(logDir, "test.log")
+		outside = filepath.Join(dir, "secret")
+	)
+	if err := os.Mkdir(logDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeLogFile(t, path, "line 1\n")
+	writeLogFile(t, outside, "secret\n")
+
+	engine, err := policy.NewEngine(&conf.HostConfig{
+		AllowLog:  true,
+		LogPolicy: conf.LogPolicyConfig{Roots: []string{logDir}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		buf  = new(syncBuffer)
+		done = make(chan error)
+	)
+	go func() {
+		done <- readLogFile(ctx, path, &logReadOptions{
+			tailLines: -1,
+			follow:    true,
+			checkPath: engine.CheckLogPath,
+		}, buf)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for buf.String() != "line 1\n" {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected output %q", buf.String())
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// rotate to a symlink pointing outside of allowed roots
+	if err = os.Rename(path, path+".old"); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink(outside, path); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err = <-done:
+		if err == nil {
+			t.Error("expecting policy error after rotation")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("log reading not stopped after rotation")
+	}
+
+	if actual := buf.String(); actual != "line 1\n" {
+		t.Errorf("unexpected output %q", actual)
+	}
+}
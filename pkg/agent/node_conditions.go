@@ -0,0 +1,213 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"fmt"
+	"sync"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/arhat/pkg/conf"
+	"arhat.dev/arhat/pkg/constant"
+	"arhat.dev/arhat/pkg/sysinfo"
+)
+
+type nodeConditionChecker struct {
+	logger log.Interface
+
+	memoryAvailable *conf.ResourceThreshold
+	diskAvailable   *conf.ResourceThreshold
+	pidAvailable    *conf.ResourceThreshold
+
+	filesystems []string
+
+	// last conditions by resource, pressure is only logged when changed
+	mu   *sync.Mutex
+	last map[string]aranyagopb.NodeCondition
+
+	// resource usage sources, replaceable in tests
+	getMemory    func() (available, total uint64, err error)
+	getDiskUsage func(path string) (available, total uint64, err error)
+	getPidUsage  func() (used, max uint64, err error)
+}
+
+func newNodeConditionChecker(
+	logger log.Interface,
+	config *conf.NodeConditionsConfig,
+) (*nodeConditionChecker, error) {
+	thresholdOrDefault := func(name, value, def string) (*conf.ResourceThreshold, error) {
+		if value == "" {
+			value = def
+		}
+
+		t, err := conf.ParseResourceThreshold(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s threshold: %w", name, err)
+		}
+
+		return t, nil
+	}
+
+	var (
+		c = &nodeConditionChecker{
+			logger:      logger,
+			filesystems: config.Filesystems,
+
+			mu:   new(sync.Mutex),
+			last: make(map[string]aranyagopb.NodeCondition),
+
+			getMemory: func() (uint64, uint64, error) {
+				available, err := sysinfo.GetAvailableMemory()
+				return available, sysinfo.GetTotalMemory(), err
+			},
+			getDiskUsage: sysinfo.GetDiskUsage,
+			getPidUsage:  sysinfo.GetPidUsage,
+		}
+		err error
+	)
+
+	c.memoryAvailable, err = thresholdOrDefault(
+		"memory", config.MemoryAvailable, constant.DefaultNodeMemoryAvailableThreshold,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	c.diskAvailable, err = thresholdOrDefault(
+		"disk", config.DiskAvailable, constant.DefaultNodeDiskAvailableThreshold,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	c.pidAvailable, err = thresholdOrDefault(
+		"pid", config.PidAvailable, constant.DefaultNodePidAvailableThreshold,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.filesystems) == 0 {
+		c.filesystems = []string{"/"}
+	}
+
+	return c, nil
+}
+
+func (c *nodeConditionChecker) checkMemory() aranyagopb.NodeCondition {
+	available, total, err := c.getMemory()
+	if err != nil {
+		c.logger.V("unable to check available memory", log.Error(err))
+		return aranyagopb.NODE_CONDITION_UNKNOWN
+	}
+
+	if c.memoryAvailable.Reached(available, total) {
+		if c.changed("memory", aranyagopb.NODE_CONDITION_UNHEALTHY) {
+			c.logger.I("memory pressure", log.Uint64("available", available))
+		}
+
+		return aranyagopb.NODE_CONDITION_UNHEALTHY
+	}
+
+	if c.changed("memory", aranyagopb.NODE_CONDITION_HEALTHY) {
+		c.logger.I("memory pressure relieved", log.Uint64("available", available))
+	}
+
+	return aranyagopb.NODE_CONDITION_HEALTHY
+}
+
+// checkDisk reports pressure if any filesystem checked is under pressure,
+// filesystems failed to check are skipped, unknown if all of them failed
+func (c *nodeConditionChecker) checkDisk() aranyagopb.NodeCondition {
+	checked := 0
+	for _, path := range c.filesystems {
+		available, total, err := c.getDiskUsage(path)
+		if err != nil {
+			c.logger.V("unable to check disk usage", log.String("path", path), log.Error(err))
+			continue
+		}
+
+		checked++
+
+		if c.diskAvailable.Reached(available, total) {
+			if c.changed("disk", aranyagopb.NODE_CONDITION_UNHEALTHY) {
+				c.logger.I("disk pressure",
+					log.String("path", path),
+					log.Uint64("available", available),
+					log.Uint64("total", total),
+				)
+			}
+
+			return aranyagopb.NODE_CONDITION_UNHEALTHY
+		}
+	}
+
+	if checked == 0 {
+		return aranyagopb.NODE_CONDITION_UNKNOWN
+	}
+
+	if c.changed("disk", aranyagopb.NODE_CONDITION_HEALTHY) {
+		c.logger.I("disk pressure relieved")
+	}
+
+	return aranyagopb.NODE_CONDITION_HEALTHY
+}
+
+func (c *nodeConditionChecker) checkPid() aranyagopb.NodeCondition {
+	used, max, err := c.getPidUsage()
+	if err != nil {
+		c.logger.V("unable to check pid usage", log.Error(err))
+		return aranyagopb.NODE_CONDITION_UNKNOWN
+	}
+
+	var available uint64
+	if max > used {
+		available = max - used
+	}
+
+	if c.pidAvailable.Reached(available, max) {
+		if c.changed("pid", aranyagopb.NODE_CONDITION_UNHEALTHY) {
+			c.logger.I("pid pressure", log.Uint64("used", used), log.Uint64("max", max))
+		}
+
+		return aranyagopb.NODE_CONDITION_UNHEALTHY
+	}
+
+	if c.changed("pid", aranyagopb.NODE_CONDITION_HEALTHY) {
+		c.logger.I("pid pressure relieved", log.Uint64("used", used), log.Uint64("max", max))
+	}
+
+	return aranyagopb.NODE_CONDITION_HEALTHY
+}
+
+// changed records the condition of the resource, returns true if it's
+// different from the last recorded one, the first healthy condition is not
+// considered a change
+func (c *nodeConditionChecker) changed(resource string, cond aranyagopb.NodeCondition) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	last, ok := c.last[resource]
+	c.last[resource] = cond
+	if !ok {
+		return cond != aranyagopb.NODE_CONDITION_HEALTHY
+	}
+
+	return last != cond
+}
@@ -0,0 +1,211 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"errors"
+	"testing"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/arhat/pkg/conf"
+)
+
+func newTestNodeConditionChecker(t *testing.T, config *conf.NodeConditionsConfig) *nodeConditionChecker {
+	c, err := newNodeConditionChecker(log.NoOpLogger, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestNewNodeConditionChecker(t *testing.T) {
+	c := newTestNodeConditionChecker(t, &conf.NodeConditionsConfig{})
+	if c.memoryAvailable == nil || c.diskAvailable == nil || c.pidAvailable == nil {
+		t.Error("default thresholds not applied")
+	}
+
+	if len(c.filesystems) != 1 || c.filesystems[0] != "/" {
+		t.Errorf("unexpected default filesystems %v", c.filesystems)
+	}
+
+	for _, config := range []*conf.NodeConditionsConfig{
+		{MemoryAvailable: "10Xi"},
+		{DiskAvailable: "200%"},
+		{PidAvailable: "18446744073709551616"},
+	} {
+		if _, err := newNodeConditionChecker(log.NoOpLogger, config); err == nil {
+			t.Errorf("expected error for invalid config %+v", config)
+		}
+	}
+}
+
+func TestNodeConditionCheckerMemory(t *testing.T) {
+	c := newTestNodeConditionChecker(t, &conf.NodeConditionsConfig{MemoryAvailable: "100Mi"})
+
+	tests := []struct {
+		name      string
+		available uint64
+		err       error
+		expected  aranyagopb.NodeCondition
+	}{
+		{"Healthy", 200 << 20, nil, aranyagopb.NODE_CONDITION_HEALTHY},
+		{"Pressure", 99 << 20, nil, aranyagopb.NODE_CONDITION_UNHEALTHY},
+		{"Error", 0, errors.New("test"), aranyagopb.NODE_CONDITION_UNKNOWN},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c.getMemory = func() (uint64, uint64, error) {
+				return test.available, 1 << 30, test.err
+			}
+
+			if cond := c.checkMemory(); cond != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, cond)
+			}
+		})
+	}
+}
+
+func TestNodeConditionCheckerDisk(t *testing.T) {
+	c := newTestNodeConditionChecker(t, &conf.NodeConditionsConfig{
+		DiskAvailable: "10%",
+		Filesystems:   []string{"/a", "/b"},
+	})
+
+	tests := []struct {
+		name      string
+		available map[string]uint64
+		expected  aranyagopb.NodeCondition
+	}{
+		{"Healthy", map[string]uint64{"/a": 50, "/b": 10}, aranyagopb.NODE_CONDITION_HEALTHY},
+		{"Pressure First", map[string]uint64{"/a": 9, "/b": 50}, aranyagopb.NODE_CONDITION_UNHEALTHY},
+		{"Pressure Second", map[string]uint64{"/a": 50, "/b": 9}, aranyagopb.NODE_CONDITION_UNHEALTHY},
+		{"Error Skipped", map[string]uint64{"/a": 50}, aranyagopb.NODE_CONDITION_HEALTHY},
+		{"Error With Pressure", map[string]uint64{"/b": 9}, aranyagopb.NODE_CONDITION_UNHEALTHY},
+		{"All Errors", map[string]uint64{}, aranyagopb.NODE_CONDITION_UNKNOWN},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c.getDiskUsage = func(path string) (uint64, uint64, error) {
+				available, ok := test.available[path]
+				if !ok {
+					return 0, 0, errors.New("test")
+				}
+				return available, 100, nil
+			}
+
+			if cond := c.checkDisk(); cond != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, cond)
+			}
+		})
+	}
+}
+
+func TestNodeConditionCheckerPid(t *testing.T) {
+	c := newTestNodeConditionChecker(t, &conf.NodeConditionsConfig{PidAvailable: "1000"})
+
+	tests := []struct {
+		name     string
+		used     uint64
+		max      uint64
+		err      error
+		expected aranyagopb.NodeCondition
+	}{
+		{"Healthy", 100, 32768, nil, aranyagopb.NODE_CONDITION_HEALTHY},
+		{"Pressure", 31769, 32768, nil, aranyagopb.NODE_CONDITION_UNHEALTHY},
+		{"Exhausted", 40000, 32768, nil, aranyagopb.NODE_CONDITION_UNHEALTHY},
+		{"Error", 0, 0, errors.New("test"), aranyagopb.NODE_CONDITION_UNKNOWN},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c.getPidUsage = func() (uint64, uint64, error) {
+				return test.used, test.max, test.err
+			}
+
+			if cond := c.checkPid(); cond != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, cond)
+			}
+		})
+	}
+}
+
+func TestNodeConditionCheckerChanged(t *testing.T) {
+	c := newTestNodeConditionChecker(t, &conf.NodeConditionsConfig{})
+
+	for i, test := range []struct {
+		cond     aranyagopb.NodeCondition
+		expected bool
+	}{
+		// initial healthy condition is not a change
+		{aranyagopb.NODE_CONDITION_HEALTHY, false},
+		{aranyagopb.NODE_CONDITION_UNHEALTHY, true},
+		{aranyagopb.NODE_CONDITION_UNHEALTHY, false},
+		{aranyagopb.NODE_CONDITION_UNHEALTHY, false},
+		{aranyagopb.NODE_CONDITION_HEALTHY, true},
+		{aranyagopb.NODE_CONDITION_HEALTHY, false},
+	} {
+		if changed := c.changed("memory", test.cond); changed != test.expected {
+			t.Errorf("#%d: expected changed %v, got %v", i, test.expected, changed)
+		}
+	}
+
+	if !c.changed("disk", aranyagopb.NODE_CONDITION_UNHEALTHY) {
+		t.Error("initial pressure not reported as change")
+	}
+}
+
+func TestNodeNetworkCondition(t *testing.T) {
+	ag, c := newTestAgent(t, nil)
+
+	if cond := ag.getNodeConditions().Network; cond != aranyagopb.NODE_CONDITION_HEALTHY {
+		t.Errorf("expected healthy network when connected, got %v", cond)
+	}
+
+	c.mu.Lock()
+	c.postErr = errors.New("test")
+	c.mu.Unlock()
+
+	if err := ag.PostMsg(0, aranyagopb.MSG_NODE_STATUS, ag.getDynNodeStatus()); err == nil {
+		t.Fatal("expected post error")
+	}
+
+	if cond := ag.getNodeConditions().Network; cond != aranyagopb.NODE_CONDITION_UNHEALTHY {
+		t.Errorf("expected unhealthy network after post failure, got %v", cond)
+	}
+
+	c.mu.Lock()
+	c.postErr = nil
+	c.mu.Unlock()
+
+	if err := ag.PostMsg(0, aranyagopb.MSG_NODE_STATUS, ag.getDynNodeStatus()); err != nil {
+		t.Fatal(err)
+	}
+
+	if cond := ag.getNodeConditions().Network; cond != aranyagopb.NODE_CONDITION_HEALTHY {
+		t.Errorf("expected healthy network after post succeeded, got %v", cond)
+	}
+
+	ag.SetClient(nil)
+	if cond := ag.getNodeConditions().Network; cond != aranyagopb.NODE_CONDITION_UNHEALTHY {
+		t.Errorf("expected unhealthy network without client, got %v", cond)
+	}
+}
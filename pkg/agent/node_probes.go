@@ -0,0 +1,329 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/pkg/exechelper"
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/arhat/pkg/conf"
+	"arhat.dev/arhat/pkg/constant"
+)
+
+type nodeProbeFunc func(ctx context.Context) error
+
+type nodeProbe struct {
+	name             string
+	interval         time.Duration
+	timeout          time.Duration
+	failureThreshold int
+
+	probe nodeProbeFunc
+
+	// setCondition to unhealthy, nil if not mapped to any condition
+	setCondition func(c *aranyagopb.NodeConditions)
+
+	extInfo        *aranyagopb.NodeExtInfo
+	healthyValue   string
+	unhealthyValue string
+
+	// failures is the count of consecutive failures
+	failures int
+	healthy  bool
+}
+
+type nodeProbeManager struct {
+	logger log.Interface
+	probes []*nodeProbe
+
+	// onChange is called when any probe changed its health state
+	onChange func()
+
+	mu *sync.RWMutex
+}
+
+func newNodeProbeManager(logger log.Interface, probes []conf.NodeProbe) (*nodeProbeManager, error) {
+	m := &nodeProbeManager{
+		logger: logger,
+		mu:     new(sync.RWMutex),
+	}
+
+	for i, p := range probes {
+		np, err := newNodeProbe(&p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node probe #%d %q: %w", i, p.Name, err)
+		}
+
+		m.probes = append(m.probes, np)
+	}
+
+	return m, nil
+}
+
+func newNodeProbe(p *conf.NodeProbe) (*nodeProbe, error) {
+	np := &nodeProbe{
+		name:             p.Name,
+		interval:         p.Interval,
+		timeout:          p.Timeout,
+		failureThreshold: p.FailureThreshold,
+
+		// assume healthy until probed
+		healthy: true,
+	}
+
+	if np.interval <= 0 {
+		np.interval = constant.DefaultNodeProbeInterval
+	}
+
+	if np.timeout <= 0 {
+		np.timeout = constant.DefaultNodeProbeTimeout
+	}
+
+	if np.failureThreshold <= 0 {
+		np.failureThreshold = 1
+	}
+
+	var count int
+	if len(p.Exec) != 0 {
+		count++
+		np.probe = createExecProbe(p.Exec)
+	}
+
+	if p.File != "" {
+		count++
+		np.probe = createFileProbe(p.File)
+	}
+
+	if p.TCP != "" {
+		count++
+		np.probe = createTCPProbe(p.TCP)
+	}
+
+	if p.HTTP != "" {
+		count++
+		np.probe = createHTTPProbe(p.HTTP, np.timeout)
+	}
+
+	if count != 1 {
+		return nil, fmt.Errorf("exactly one of exec, file, tcp and http should be set")
+	}
+
+	switch strings.ToLower(p.Condition) {
+	case "":
+	case "ready":
+		np.setCondition = func(c *aranyagopb.NodeConditions) { c.Ready = aranyagopb.NODE_CONDITION_UNHEALTHY }
+	case "memory":
+		np.setCondition = func(c *aranyagopb.NodeConditions) { c.Memory = aranyagopb.NODE_CONDITION_UNHEALTHY }
+	case "disk":
+		np.setCondition = func(c *aranyagopb.NodeConditions) { c.Disk = aranyagopb.NODE_CONDITION_UNHEALTHY }
+	case "pid":
+		np.setCondition = func(c *aranyagopb.NodeConditions) { c.Pid = aranyagopb.NODE_CONDITION_UNHEALTHY }
+	case "network":
+		np.setCondition = func(c *aranyagopb.NodeConditions) { c.Network = aranyagopb.NODE_CONDITION_UNHEALTHY }
+	case "pod":
+		np.setCondition = func(c *aranyagopb.NodeConditions) { c.Pod = aranyagopb.NODE_CONDITION_UNHEALTHY }
+	default:
+		return nil, fmt.Errorf("unsupported condition %q", p.Condition)
+	}
+
+	if p.ExtInfo != nil {
+		target, targetKey, err := parseNodeExtInfoTarget(p.ExtInfo.ApplyTo)
+		if err != nil {
+			return nil, err
+		}
+
+		np.extInfo = &aranyagopb.NodeExtInfo{
+			ValueType: aranyagopb.NODE_EXT_INFO_TYPE_STRING,
+			Operator:  aranyagopb.NODE_EXT_INFO_OPERATOR_SET,
+			Target:    target,
+			TargetKey: targetKey,
+		}
+
+		np.healthyValue = p.ExtInfo.HealthyValue
+		if np.healthyValue == "" {
+			np.healthyValue = "true"
+		}
+
+		np.unhealthyValue = p.ExtInfo.UnhealthyValue
+		if np.unhealthyValue == "" {
+			np.unhealthyValue = "false"
+		}
+	}
+
+	return np, nil
+}
+
+// start all probes, probes stop when ctx canceled
+func (m *nodeProbeManager) start(ctx context.Context) {
+	for _, p := range m.probes {
+		go m.run(ctx, p)
+	}
+}
+
+func (m *nodeProbeManager) run(ctx context.Context, p *nodeProbe) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		probeCtx, cancel := context.WithTimeout(ctx, p.timeout)
+		err := p.probe(probeCtx)
+		cancel()
+
+		changed := m.update(p, err)
+		if changed && m.onChange != nil {
+			m.onChange()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// update probe state with the probe result, return true if health state changed
+func (m *nodeProbeManager) update(p *nodeProbe, err error) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil {
+		p.failures++
+		if p.healthy && p.failures >= p.failureThreshold {
+			m.logger.I("node probe failed", log.String("name", p.name), log.Error(err))
+			p.healthy = false
+			return true
+		}
+
+		return false
+	}
+
+	p.failures = 0
+	if !p.healthy {
+		m.logger.I("node probe succeeded", log.String("name", p.name))
+		p.healthy = true
+		return true
+	}
+
+	return false
+}
+
+// applyConditions sets conditions of failed probes to unhealthy
+func (m *nodeProbeManager) applyConditions(c *aranyagopb.NodeConditions) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, p := range m.probes {
+		if !p.healthy && p.setCondition != nil {
+			p.setCondition(c)
+		}
+	}
+}
+
+// getExtInfo returns node ext info generated from probe results
+func (m *nodeProbeManager) getExtInfo() []*aranyagopb.NodeExtInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var result []*aranyagopb.NodeExtInfo
+	for _, p := range m.probes {
+		if p.extInfo == nil {
+			continue
+		}
+
+		info := *p.extInfo
+		info.Value = p.healthyValue
+		if !p.healthy {
+			info.Value = p.unhealthyValue
+		}
+
+		result = append(result, &info)
+	}
+
+	return result
+}
+
+func createExecProbe(command []string) nodeProbeFunc {
+	return func(ctx context.Context) error {
+		cmd, err := exechelper.Prepare(exechelper.Spec{
+			Context: ctx,
+			Command: command,
+		})
+		if err != nil {
+			return err
+		}
+
+		return cmd.Run()
+	}
+}
+
+func createFileProbe(path string) nodeProbeFunc {
+	return func(ctx context.Context) error {
+		_, err := os.Stat(path)
+		return err
+	}
+}
+
+func createTCPProbe(address string) nodeProbeFunc {
+	return func(ctx context.Context) error {
+		conn, err := new(net.Dialer).DialContext(ctx, "tcp", address)
+		if err != nil {
+			return err
+		}
+
+		return conn.Close()
+	}
+}
+
+func createHTTPProbe(url string, timeout time.Duration) nodeProbeFunc {
+	client := &http.Client{
+		Timeout: timeout,
+		// redirects are treated as healthy, do not follow them
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,266 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/arhat/pkg/conf"
+)
+
+func TestNewNodeProbe(t *testing.T) {
+	tests := []struct {
+		name       string
+		probe      conf.NodeProbe
+		shouldFail bool
+	}{
+		{name: "Exec", probe: conf.NodeProbe{Exec: []string{"true"}}},
+		{name: "File", probe: conf.NodeProbe{File: "/"}},
+		{name: "TCP", probe: conf.NodeProbe{TCP: "localhost:80"}},
+		{name: "HTTP", probe: conf.NodeProbe{HTTP: "http://localhost"}},
+		{name: "Condition", probe: conf.NodeProbe{File: "/", Condition: "Network"}},
+		{name: "ExtInfo", probe: conf.NodeProbe{File: "/", ExtInfo: &conf.NodeProbeExtInfo{
+			ApplyTo: "metadata.labels['example.com/probe']",
+		}}},
+
+		{name: "None", probe: conf.NodeProbe{}, shouldFail: true},
+		{name: "Multiple", probe: conf.NodeProbe{File: "/", TCP: "localhost:80"}, shouldFail: true},
+		{name: "Invalid Condition", probe: conf.NodeProbe{File: "/", Condition: "foo"}, shouldFail: true},
+		{name: "Invalid ExtInfo", probe: conf.NodeProbe{File: "/", ExtInfo: &conf.NodeProbeExtInfo{
+			ApplyTo: "spec.foo",
+		}}, shouldFail: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			np, err := newNodeProbe(&test.probe)
+			if test.shouldFail {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !np.healthy || np.interval <= 0 || np.timeout <= 0 || np.failureThreshold != 1 {
+				t.Errorf("unexpected defaults %+v", np)
+			}
+		})
+	}
+}
+
+func TestNodeProbeManagerUpdate(t *testing.T) {
+	m, err := newNodeProbeManager(log.NoOpLogger, []conf.NodeProbe{{
+		File:             "/",
+		FailureThreshold: 2,
+		Condition:        "disk",
+		ExtInfo: &conf.NodeProbeExtInfo{
+			ApplyTo:        "metadata.annotations['example.com/probe']",
+			UnhealthyValue: "down",
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := m.probes[0]
+	check := func(healthy bool) {
+		t.Helper()
+
+		c := &aranyagopb.NodeConditions{Disk: aranyagopb.NODE_CONDITION_HEALTHY}
+		m.applyConditions(c)
+
+		info := m.getExtInfo()
+		if len(info) != 1 {
+			t.Fatalf("expected 1 ext info, got %d", len(info))
+		}
+
+		if healthy {
+			if c.Disk != aranyagopb.NODE_CONDITION_HEALTHY || info[0].Value != "true" {
+				t.Errorf("expected healthy, got %v %q", c.Disk, info[0].Value)
+			}
+		} else {
+			if c.Disk != aranyagopb.NODE_CONDITION_UNHEALTHY || info[0].Value != "down" {
+				t.Errorf("expected unhealthy, got %v %q", c.Disk, info[0].Value)
+			}
+		}
+	}
+
+	check(true)
+
+	if m.update(p, errors.New("test")) {
+		t.Error("changed before reaching failure threshold")
+	}
+	check(true)
+
+	if !m.update(p, errors.New("test")) {
+		t.Error("not changed after reaching failure threshold")
+	}
+	check(false)
+
+	if m.update(p, errors.New("test")) {
+		t.Error("changed when staying unhealthy")
+	}
+
+	if !m.update(p, nil) {
+		t.Error("not changed after recovery")
+	}
+	check(true)
+
+	if m.update(p, nil) {
+		t.Error("changed when staying healthy")
+	}
+}
+
+func TestHTTPProbe(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/error", http.StatusFound)
+	})
+	mux.HandleFunc("/error", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		path    string
+		healthy bool
+	}{
+		{"OK", "/ok", true},
+		{"Redirect", "/redirect", true},
+		{"Error", "/error", false},
+		{"Not Found", "/not-found", false},
+		{"Timeout", "/slow", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// context without deadline, timeout must come from the probe
+			err := createHTTPProbe(srv.URL+test.path, 200*time.Millisecond)(context.Background())
+			if test.healthy && err != nil {
+				t.Errorf("expected healthy, got %v", err)
+			}
+
+			if !test.healthy && err == nil {
+				t.Error("expected unhealthy")
+			}
+		})
+	}
+}
+
+func TestTCPProbe(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	addr := srv.Listener.Addr().String()
+
+	if err := createTCPProbe(addr)(context.Background()); err != nil {
+		t.Errorf("expected healthy, got %v", err)
+	}
+
+	srv.Close()
+	if err := createTCPProbe(addr)(context.Background()); err == nil {
+		t.Error("expected unhealthy")
+	}
+}
+
+func TestNodeProbePushStatus(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "healthy")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, c := newTestAgent(t, &conf.Config{
+		Arhat: conf.AppConfig{
+			Node: conf.NodeConfig{
+				Probes: []conf.NodeProbe{{
+					Interval:  20 * time.Millisecond,
+					File:      file,
+					Condition: "network",
+				}},
+			},
+		},
+	})
+
+	// probe stays healthy, nothing pushed
+	time.Sleep(100 * time.Millisecond)
+	if msgs := c.sessionMsgs(0); len(msgs) != 0 {
+		t.Fatalf("unexpected node status pushed: %v", msgs)
+	}
+
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+
+	waitNodeStatus := func(expected aranyagopb.NodeCondition, count int) {
+		t.Helper()
+
+		waitFor(t, "node status pushed", func() bool {
+			msgs := c.sessionMsgs(0)
+			if len(msgs) < count {
+				return false
+			}
+
+			m := msgs[count-1]
+			if m.Kind != aranyagopb.MSG_NODE_STATUS {
+				t.Fatalf("unexpected msg kind %v", m.Kind)
+			}
+
+			status := new(aranyagopb.NodeStatusMsg)
+			if err := status.Unmarshal(m.Payload); err != nil {
+				t.Fatal(err)
+			}
+
+			if status.Conditions.Network != expected {
+				t.Fatalf("expected network %v, got %v", expected, status.Conditions.Network)
+			}
+
+			return true
+		})
+	}
+
+	waitNodeStatus(aranyagopb.NODE_CONDITION_UNHEALTHY, 1)
+
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	waitNodeStatus(aranyagopb.NODE_CONDITION_HEALTHY, 2)
+}
@@ -0,0 +1,340 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"arhat.dev/arhat/pkg/conf"
+	"arhat.dev/arhat/pkg/constant"
+)
+
+// workScheduler limits concurrent works started for commands
+//
+// works are grouped into kinds by the first part of the work name
+// (e.g. `exec`, `logs`, `metrics` for `metrics.collect`), each kind has
+// its own concurrency limit in addition to the global limit, works exceeding
+// limits are queued until the queue is full
+//
+// some slots of the global limit are reserved for short control works (node
+// info, metrics, storage ...) so long running sessions (exec, attach, logs,
+// port-forward ...) can never starve them
+//
+// queued works are started in the order they were submitted, a queued work
+// is only passed by later works when its own kind limit is reached or it's
+// not allowed to use reserved slots, works waited in the queue longer than
+// maxQueueWait are rejected since aranya may have given up on them
+type workScheduler struct {
+	ctx context.Context
+
+	// maxActive is the global limit, non-positive value means no limit
+	maxActive int
+	// reserved slots of maxActive only usable by control works
+	reserved     int
+	maxQueued    int
+	maxQueueWait time.Duration
+
+	limits map[string]int
+
+	mu *sync.Mutex
+	// active is the count of all active works, activeOther is the count of
+	// active works not of control kinds
+	active      int
+	activeOther int
+	queue       []*queuedWork
+	kinds       map[string]*workKind
+}
+
+// controlWorkKinds are kinds of short control works
+var controlWorkKinds = map[string]struct{}{
+	"node":       {},
+	"metrics":    {},
+	"storage":    {},
+	"peripheral": {},
+	"net":        {},
+}
+
+type workKind struct {
+	control bool
+	// limit of concurrent works of this kind, non-positive value means
+	// no limit
+	limit int
+
+	active   int64
+	queued   int64
+	rejected uint64
+}
+
+type queuedWork struct {
+	name string
+	kind *workKind
+	work func()
+
+	reject func(err error)
+	// timer to reject the work when waited too long, nil means no limit
+	timer *time.Timer
+}
+
+type workKindStats struct {
+	kind     string
+	active   int64
+	queued   int64
+	rejected uint64
+}
+
+func newWorkScheduler(ctx context.Context, config *conf.WorkersConfig) *workScheduler {
+	maxActive := config.MaxActive
+	if maxActive == 0 {
+		maxActive = constant.DefaultMaxActiveWorks
+	}
+
+	reserved := config.ReservedControl
+	if reserved == 0 {
+		reserved = constant.DefaultReservedControlWorks
+	}
+
+	if reserved < 0 || maxActive <= 0 {
+		reserved = 0
+	} else if reserved >= maxActive {
+		// leave at least one slot for sessions
+		reserved = maxActive - 1
+	}
+
+	maxQueued := config.MaxQueued
+	if maxQueued == 0 {
+		maxQueued = constant.DefaultMaxQueuedWorks
+	}
+
+	maxQueueWait := config.MaxQueueWait
+	if maxQueueWait == 0 {
+		maxQueueWait = constant.DefaultMaxWorkQueueWait
+	}
+
+	s := &workScheduler{
+		ctx: ctx,
+
+		maxActive:    maxActive,
+		reserved:     reserved,
+		maxQueued:    maxQueued,
+		maxQueueWait: maxQueueWait,
+
+		limits: config.Limits,
+
+		mu:    new(sync.Mutex),
+		kinds: make(map[string]*workKind),
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		// agent exited, drop queued works
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		for _, w := range s.queue {
+			w.kind.queued--
+			if w.timer != nil {
+				w.timer.Stop()
+			}
+		}
+		s.queue = nil
+	}()
+
+	return s
+}
+
+// getKind must be called with s.mu held
+func (s *workScheduler) getKind(kind string) *workKind {
+	k, ok := s.kinds[kind]
+	if !ok {
+		_, control := controlWorkKinds[kind]
+		k = &workKind{
+			control: control,
+			limit:   s.limits[kind],
+		}
+
+		s.kinds[kind] = k
+	}
+
+	return k
+}
+
+// submit work to run in a new goroutine, returns error when there is no
+// free slot and the queue is full, reject (if not nil) is called with the
+// error in a new goroutine when the work is dropped after waited in the
+// queue for too long
+func (s *workScheduler) submit(name string, work func(), reject func(err error)) error {
+	kind := name
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		kind = name[:i]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := s.getKind(kind)
+
+	// queued works are never runnable at this point, since they are
+	// started as soon as slots released
+	if s.canRun(k) {
+		s.start(k, work)
+		return nil
+	}
+
+	// control works can also queue in the space of reserved slots
+	maxQueued := s.maxQueued
+	if k.control && maxQueued >= 0 {
+		maxQueued += s.reserved
+	}
+
+	if s.ctx.Err() != nil || (maxQueued >= 0 && len(s.queue) >= maxQueued) {
+		k.rejected++
+		return fmt.Errorf("too many %q works in progress, rejected", kind)
+	}
+
+	w := &queuedWork{name: name, kind: k, work: work, reject: reject}
+	if s.maxQueueWait > 0 {
+		w.timer = time.AfterFunc(s.maxQueueWait, func() { s.expire(w) })
+	}
+
+	k.queued++
+	s.queue = append(s.queue, w)
+
+	return nil
+}
+
+// expire removes the work from the queue if not started yet
+func (s *workScheduler) expire(w *queuedWork) {
+	s.mu.Lock()
+	found := false
+	for i, v := range s.queue {
+		if v == w {
+			found = true
+			copy(s.queue[i:], s.queue[i+1:])
+			s.queue[len(s.queue)-1] = nil
+			s.queue = s.queue[:len(s.queue)-1]
+			break
+		}
+	}
+
+	if found {
+		w.kind.queued--
+		w.kind.rejected++
+	}
+	s.mu.Unlock()
+
+	if found && w.reject != nil {
+		w.reject(fmt.Errorf("%q work waited in queue for more than %v, rejected", w.name, s.maxQueueWait))
+	}
+}
+
+// canRun checks limits for a new work of kind k, must be called with s.mu
+// held
+func (s *workScheduler) canRun(k *workKind) bool {
+	if k.limit > 0 && k.active >= int64(k.limit) {
+		return false
+	}
+
+	if s.maxActive <= 0 {
+		return true
+	}
+
+	if s.active >= s.maxActive {
+		return false
+	}
+
+	return k.control || s.activeOther < s.maxActive-s.reserved
+}
+
+// start the work in a new goroutine, must be called with s.mu held
+func (s *workScheduler) start(k *workKind, work func()) {
+	k.active++
+	s.active++
+	if !k.control {
+		s.activeOther++
+	}
+
+	go func() {
+		defer s.release(k)
+
+		work()
+	}()
+}
+
+// release the slot of the finished work and start queued works in order
+func (s *workScheduler) release(k *workKind) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k.active--
+	s.active--
+	if !k.control {
+		s.activeOther--
+	}
+
+	if s.ctx.Err() != nil {
+		return
+	}
+
+	remain := s.queue[:0]
+	for _, w := range s.queue {
+		if !s.canRun(w.kind) {
+			remain = append(remain, w)
+			continue
+		}
+
+		w.kind.queued--
+		if w.timer != nil {
+			// expire is a no-op once the work left the queue
+			w.timer.Stop()
+		}
+
+		s.start(w.kind, w.work)
+	}
+
+	for i := len(remain); i < len(s.queue); i++ {
+		s.queue[i] = nil
+	}
+	s.queue = remain
+}
+
+// stats of all kinds of works, sorted by kind
+func (s *workScheduler) stats() []workKindStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]workKindStats, 0, len(s.kinds))
+	for kind, k := range s.kinds {
+		result = append(result, workKindStats{
+			kind:     kind,
+			active:   k.active,
+			queued:   k.queued,
+			rejected: k.rejected,
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].kind < result[j].kind
+	})
+
+	return result
+}
@@ -0,0 +1,405 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"arhat.dev/arhat/pkg/conf"
+)
+
+// blockingWorks submits works blocking until released
+type blockingWorks struct {
+	started int64
+	release chan struct{}
+	wg      *sync.WaitGroup
+}
+
+func newBlockingWorks() *blockingWorks {
+	return &blockingWorks{
+		release: make(chan struct{}),
+		wg:      new(sync.WaitGroup),
+	}
+}
+
+func (w *blockingWorks) submit(t *testing.T, s *workScheduler, name string) error {
+	t.Helper()
+
+	w.wg.Add(1)
+	err := s.submit(name, func() {
+		defer w.wg.Done()
+
+		atomic.AddInt64(&w.started, 1)
+		<-w.release
+	}, nil)
+	if err != nil {
+		w.wg.Done()
+	}
+
+	return err
+}
+
+func (w *blockingWorks) count() int64 {
+	return atomic.LoadInt64(&w.started)
+}
+
+func (w *blockingWorks) finish() {
+	close(w.release)
+	w.wg.Wait()
+}
+
+func findWorkKindStats(s *workScheduler, kind string) workKindStats {
+	for _, st := range s.stats() {
+		if st.kind == kind {
+			return st
+		}
+	}
+
+	return workKindStats{kind: kind}
+}
+
+func TestWorkSchedulerKindLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newWorkScheduler(ctx, &conf.WorkersConfig{
+		Limits: map[string]int{"exec": 2},
+	})
+
+	w := newBlockingWorks()
+	for i := 0; i < 3; i++ {
+		if err := w.submit(t, s, "exec"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, "exec works started", func() bool { return w.count() == 2 })
+
+	st := findWorkKindStats(s, "exec")
+	if st.active != 2 || st.queued != 1 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+
+	// other kinds are not limited by exec
+	other := newBlockingWorks()
+	if err := other.submit(t, s, "logs"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "logs work started", func() bool { return other.count() == 1 })
+	other.finish()
+
+	w.finish()
+	if w.count() != 3 {
+		t.Errorf("expected 3 exec works, got %d", w.count())
+	}
+}
+
+func TestWorkSchedulerQueueLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newWorkScheduler(ctx, &conf.WorkersConfig{
+		MaxActive: 1,
+		MaxQueued: 1,
+	})
+
+	w := newBlockingWorks()
+	if err := w.submit(t, s, "exec"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "exec work started", func() bool { return w.count() == 1 })
+
+	if err := w.submit(t, s, "attach"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.submit(t, s, "port-forward"); err == nil {
+		t.Error("work not rejected when queue is full")
+	}
+
+	if st := findWorkKindStats(s, "port-forward"); st.rejected != 1 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+
+	w.finish()
+	if w.count() != 2 {
+		t.Errorf("expected 2 works, got %d", w.count())
+	}
+}
+
+func TestWorkSchedulerControlWorks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newWorkScheduler(ctx, &conf.WorkersConfig{
+		MaxActive:       3,
+		ReservedControl: 1,
+		MaxQueued:       1,
+	})
+
+	// long running sessions take all unreserved slots and fill the queue
+	sessions := newBlockingWorks()
+	for _, name := range []string{"exec", "attach", "port-forward"} {
+		if err := sessions.submit(t, s, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "sessions started", func() bool { return sessions.count() == 2 })
+
+	if err := sessions.submit(t, s, "logs"); err == nil {
+		t.Error("session not rejected when queue is full")
+	}
+
+	// control works still run in the reserved slot
+	done := make(chan struct{})
+	for _, name := range []string{"node.info.dyn", "metrics.collect", "storage.ensure"} {
+		if err := s.submit(name, func() { done <- struct{}{} }, nil); err != nil {
+			t.Fatalf("control work %q rejected: %v", name, err)
+		}
+		<-done
+	}
+
+	// control works count toward the global limit
+	control := newBlockingWorks()
+	for _, name := range []string{"node.info.all", "node.info.dyn"} {
+		if err := control.submit(t, s, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "control work started", func() bool { return control.count() == 1 })
+
+	if st := findWorkKindStats(s, "node"); st.active != 1 || st.queued != 1 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+
+	if err := control.submit(t, s, "metrics.collect"); err == nil {
+		t.Error("control work not rejected when queue is full")
+	}
+
+	control.finish()
+	sessions.finish()
+}
+
+func TestWorkSchedulerGlobalLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newWorkScheduler(ctx, &conf.WorkersConfig{
+		MaxActive:       2,
+		ReservedControl: 1,
+		MaxQueued:       -1,
+	})
+
+	// control works can use all slots
+	w := newBlockingWorks()
+	for i := 0; i < 3; i++ {
+		if err := w.submit(t, s, "node.info.dyn"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "control works started", func() bool { return w.count() == 2 })
+
+	if err := w.submit(t, s, "exec"); err != nil {
+		t.Fatal(err)
+	}
+
+	var active int64
+	for _, st := range s.stats() {
+		active += st.active
+	}
+
+	if active != 2 {
+		t.Errorf("expecting 2 active works in total, got %d", active)
+	}
+
+	w.finish()
+	if w.count() != 4 {
+		t.Errorf("expected 4 works, got %d", w.count())
+	}
+}
+
+func TestWorkSchedulerFIFO(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newWorkScheduler(ctx, &conf.WorkersConfig{
+		MaxActive:       1,
+		ReservedControl: -1,
+		MaxQueued:       -1,
+	})
+
+	w := newBlockingWorks()
+	if err := w.submit(t, s, "exec"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "exec work started", func() bool { return w.count() == 1 })
+
+	var (
+		mu    sync.Mutex
+		order []int
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < 10; i++ {
+		i := i
+		wg.Add(1)
+		err := s.submit("logs", func() {
+			defer wg.Done()
+
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w.finish()
+	wg.Wait()
+
+	for i, v := range order {
+		if i != v {
+			t.Fatalf("queued works not started in order: %v", order)
+		}
+	}
+}
+
+func TestWorkSchedulerNoLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newWorkScheduler(ctx, &conf.WorkersConfig{
+		MaxActive:       -1,
+		ReservedControl: -1,
+	})
+
+	w := newBlockingWorks()
+	for i := 0; i < 200; i++ {
+		if err := w.submit(t, s, "exec"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := w.submit(t, s, "node.info.dyn"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, "all works started", func() bool { return w.count() == 400 })
+	w.finish()
+}
+
+func TestWorkSchedulerCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newWorkScheduler(ctx, &conf.WorkersConfig{MaxActive: 1})
+
+	w := newBlockingWorks()
+	if err := w.submit(t, s, "exec"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "exec work started", func() bool { return w.count() == 1 })
+
+	var queuedRun int64
+	if err := s.submit("exec", func() { atomic.AddInt64(&queuedRun, 1) }, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	waitFor(t, "queued work dropped", func() bool {
+		return findWorkKindStats(s, "exec").queued == 0
+	})
+
+	w.finish()
+	if atomic.LoadInt64(&queuedRun) != 0 {
+		t.Error("queued work run after agent exited")
+	}
+}
+
+func TestWorkSchedulerQueueWait(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newWorkScheduler(ctx, &conf.WorkersConfig{
+		MaxActive:    1,
+		MaxQueueWait: 50 * time.Millisecond,
+	})
+
+	w := newBlockingWorks()
+	if err := w.submit(t, s, "exec"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "exec work started", func() bool { return w.count() == 1 })
+
+	var queuedRun int64
+	rejected := make(chan error, 1)
+	err := s.submit("exec", func() {
+		atomic.AddInt64(&queuedRun, 1)
+	}, func(err error) {
+		rejected <- err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err = <-rejected:
+		if err == nil {
+			t.Error("expired work rejected without error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued work not rejected after max queue wait")
+	}
+
+	st := findWorkKindStats(s, "exec")
+	if st.queued != 0 || st.rejected != 1 {
+		t.Errorf("unexpected stats after expired: queued %d, rejected %d", st.queued, st.rejected)
+	}
+
+	w.finish()
+	waitFor(t, "exec work finished", func() bool {
+		return findWorkKindStats(s, "exec").active == 0
+	})
+
+	if atomic.LoadInt64(&queuedRun) != 0 {
+		t.Error("expired work run")
+	}
+
+	// works started before max queue wait are never rejected
+	w = newBlockingWorks()
+	if err := w.submit(t, s, "exec"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.submit(t, s, "exec"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "exec work started", func() bool { return w.count() == 1 })
+
+	w.release <- struct{}{}
+	waitFor(t, "queued exec work started", func() bool { return w.count() == 2 })
+
+	time.Sleep(100 * time.Millisecond)
+	w.finish()
+
+	if st := findWorkKindStats(s, "exec"); st.rejected != 1 {
+		t.Errorf("started work rejected, rejected %d", st.rejected)
+	}
+}
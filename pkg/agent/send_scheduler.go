@@ -0,0 +1,249 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"sync"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+
+	"arhat.dev/arhat/pkg/client"
+)
+
+// sendClass is the priority class of outbound messages, lower value means
+// higher priority
+type sendClass int
+
+const (
+	// sendClassControl for messages other than stream data (e.g. state,
+	// errors, node status)
+	sendClassControl sendClass = iota
+	// sendClassInteractive for data of sessions with tty
+	sendClassInteractive
+	// sendClassBulk for data of other sessions (e.g. `kubectl cp`,
+	// port-forward)
+	sendClassBulk
+	// sendClassMetrics for data of metrics collection
+	sendClassMetrics
+
+	sendClassCount
+)
+
+// sendLane is a range of classes posted by a dedicated goroutine
+type sendLane struct {
+	first, last sendClass
+	notify      chan struct{}
+}
+
+// laneOf returns index of the lane serving the class
+func laneOf(class sendClass) int {
+	if class == sendClassControl {
+		return 0
+	}
+
+	return 1
+}
+
+// sendScheduler serializes posting of messages, messages of higher priority
+// class are always posted first, sessions in the same class share the
+// connectivity in round-robin
+//
+// control messages are posted by their own goroutine, so they are not
+// blocked by a slow post of stream data in flight, which means a control
+// message can be posted before stream data queued earlier by another
+// goroutine
+//
+// callers are blocked until their message is posted, so producers (e.g.
+// uploadDataOutput) are slowed down by the connectivity instead of piling
+// data up in memory
+//
+// the client is resolved when the message is about to be sent, so queued
+// messages go to the client promoted while they were waiting
+type sendScheduler struct {
+	ctx       context.Context
+	getClient func() client.Interface
+
+	mu      *sync.Mutex
+	lanes   [2]*sendLane
+	classes [sendClassCount]*sendQueue
+
+	// sessionClasses are classes of session data set explicitly
+	sessionClasses map[uint64]sendClass
+}
+
+// sendQueue is the queue of a class, requests are queued by session
+type sendQueue struct {
+	// sids with pending requests in round-robin order
+	order    []uint64
+	requests map[uint64][]*sendRequest
+}
+
+type sendRequest struct {
+	msg   *aranyagopb.Msg
+	class sendClass
+	done  chan error
+}
+
+func newSendScheduler(ctx context.Context, getClient func() client.Interface) *sendScheduler {
+	s := &sendScheduler{
+		ctx:       ctx,
+		getClient: getClient,
+
+		mu: new(sync.Mutex),
+		lanes: [2]*sendLane{
+			{first: sendClassControl, last: sendClassControl},
+			{first: sendClassInteractive, last: sendClassCount - 1},
+		},
+
+		sessionClasses: make(map[uint64]sendClass),
+	}
+
+	for i := range s.classes {
+		s.classes[i] = &sendQueue{requests: make(map[uint64][]*sendRequest)}
+	}
+
+	for _, l := range s.lanes {
+		l.notify = make(chan struct{}, 1)
+		go s.run(l)
+	}
+
+	return s
+}
+
+// setSessionClass sets the class of stream data of the session
+func (s *sendScheduler) setSessionClass(sid uint64, class sendClass) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessionClasses[sid] = class
+}
+
+// clearSessionClass is called when the session finished
+func (s *sendScheduler) clearSessionClass(sid uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessionClasses, sid)
+}
+
+// post the msg with the current client and wait until posted
+func (s *sendScheduler) post(msg *aranyagopb.Msg) error {
+	req := &sendRequest{
+		msg:  msg,
+		done: make(chan error, 1),
+	}
+
+	s.mu.Lock()
+	req.class = s.classOf(msg)
+	q := s.classes[req.class]
+	if _, ok := q.requests[msg.Sid]; !ok {
+		q.order = append(q.order, msg.Sid)
+	}
+	q.requests[msg.Sid] = append(q.requests[msg.Sid], req)
+	s.mu.Unlock()
+
+	select {
+	case s.lanes[laneOf(req.class)].notify <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	case err := <-req.done:
+		return err
+	}
+}
+
+// classOf returns class of the msg, must be called with s.mu held
+func (s *sendScheduler) classOf(msg *aranyagopb.Msg) sendClass {
+	switch msg.Kind {
+	case aranyagopb.MSG_DATA, aranyagopb.MSG_DATA_STDERR:
+		if class, ok := s.sessionClasses[msg.Sid]; ok {
+			return class
+		}
+
+		return sendClassBulk
+	default:
+		return sendClassControl
+	}
+}
+
+// next pops the first request of the next session in the class with
+// highest priority of the lane
+func (s *sendScheduler) next(l *sendLane) *sendRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, q := range s.classes[l.first : l.last+1] {
+		if len(q.order) == 0 {
+			continue
+		}
+
+		sid := q.order[0]
+		reqs := q.requests[sid]
+		req := reqs[0]
+
+		q.order = q.order[1:]
+		if len(reqs) == 1 {
+			delete(q.requests, sid)
+		} else {
+			reqs[0] = nil
+			q.requests[sid] = reqs[1:]
+			// move to the tail for fairness
+			q.order = append(q.order, sid)
+		}
+
+		return req
+	}
+
+	return nil
+}
+
+func (s *sendScheduler) run(l *sendLane) {
+	for {
+		req := s.next(l)
+		if req == nil {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-l.notify:
+			}
+
+			continue
+		}
+
+		c := s.getClient()
+		if c == nil {
+			req.done <- errClientNotSet
+			continue
+		}
+
+		req.done <- req.post(c)
+	}
+}
+
+// post the msg, data of metrics collection is posted with PostMetricsMsg
+// if supported by the client
+func (r *sendRequest) post(c client.Interface) error {
+	if p, ok := c.(client.MetricsMsgPoster); ok && r.class == sendClassMetrics {
+		return p.PostMetricsMsg(r.msg)
+	}
+
+	return c.PostMsg(r.msg)
+}
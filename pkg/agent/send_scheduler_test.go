@@ -0,0 +1,439 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+
+	"arhat.dev/arhat/pkg/client"
+)
+
+// testMetricsClient records msgs posted with PostMetricsMsg separately
+type testMetricsClient struct {
+	*testClient
+
+	metrics *testClient
+}
+
+func (c *testMetricsClient) PostMetricsMsg(msg *aranyagopb.Msg) error {
+	return c.metrics.PostMsg(msg)
+}
+
+func TestSendSchedulerMetricsMsg(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		c = &testMetricsClient{
+			testClient: newTestClient(ctx, 4096),
+			metrics:    newTestClient(ctx, 4096),
+		}
+		s = newSendScheduler(ctx, func() client.Interface { return c })
+	)
+
+	s.setSessionClass(1, sendClassMetrics)
+	for _, msg := range []*aranyagopb.Msg{
+		{Kind: aranyagopb.MSG_DATA, Sid: 1},
+		{Kind: aranyagopb.MSG_ERROR, Sid: 1},
+		{Kind: aranyagopb.MSG_DATA, Sid: 2},
+	} {
+		if err := s.post(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if msgs := c.metrics.sessionMsgs(1); len(msgs) != 1 || msgs[0].Kind != aranyagopb.MSG_DATA {
+		t.Errorf("metrics data not posted as metrics msg: %v", msgs)
+	}
+
+	if len(c.sessionMsgs(1)) != 1 || len(c.sessionMsgs(2)) != 1 {
+		t.Error("non metrics data posted as metrics msg")
+	}
+
+	s.clearSessionClass(1)
+	if err := s.post(&aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.metrics.sessionMsgs(1)) != 1 {
+		t.Error("data posted as metrics msg after session finished")
+	}
+}
+
+// gatedClient blocks posting of stream data until the gate is opened
+type gatedClient struct {
+	*testClient
+
+	gate    chan struct{}
+	entered chan struct{}
+}
+
+func newGatedClient(ctx context.Context) *gatedClient {
+	return &gatedClient{
+		testClient: newTestClient(ctx, 4096),
+		gate:       make(chan struct{}),
+		entered:    make(chan struct{}, 1),
+	}
+}
+
+func (c *gatedClient) PostMsg(msg *aranyagopb.Msg) error {
+	switch msg.Kind {
+	case aranyagopb.MSG_DATA, aranyagopb.MSG_DATA_STDERR:
+	default:
+		return c.testClient.PostMsg(msg)
+	}
+
+	select {
+	case c.entered <- struct{}{}:
+	default:
+	}
+
+	<-c.gate
+	return c.testClient.PostMsg(msg)
+}
+
+// posted returns sid and seq of all msgs posted in order
+func (c *testClient) posted() [][2]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var ret [][2]uint64
+	for _, m := range c.msgs {
+		ret = append(ret, [2]uint64{m.Sid, m.Seq})
+	}
+
+	return ret
+}
+
+// pending returns count of queued requests
+func (s *sendScheduler) pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, q := range s.classes {
+		for _, reqs := range q.requests {
+			n += len(reqs)
+		}
+	}
+
+	return n
+}
+
+func waitPending(t *testing.T, s *sendScheduler, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for s.pending() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expecting %d pending requests, got %d", n, s.pending())
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// postInOrder posts msgs in background one after another queued, the
+// scheduler is expected to be blocked by the client, the returned wait
+// group is done when all msgs posted
+func postInOrder(t *testing.T, s *sendScheduler, msgs ...*aranyagopb.Msg) *sync.WaitGroup {
+	t.Helper()
+
+	wg := new(sync.WaitGroup)
+	for _, msg := range msgs {
+		n := s.pending()
+
+		wg.Add(1)
+		go func(msg *aranyagopb.Msg) {
+			defer wg.Done()
+
+			if err := s.post(msg); err != nil {
+				t.Error(err)
+			}
+		}(msg)
+
+		waitPending(t, s, n+1)
+	}
+
+	return wg
+}
+
+// blockScheduler posts a data msg blocked by the gated client, so that
+// data msgs posted later are queued
+func blockScheduler(t *testing.T, s *sendScheduler, c *gatedClient) *sync.WaitGroup {
+	t.Helper()
+
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		if err := s.post(&aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 0}); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	select {
+	case <-c.entered:
+	case <-time.After(10 * time.Second):
+		t.Fatal("scheduler not blocked by the client")
+	}
+
+	return wg
+}
+
+func TestSendSchedulerPriority(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		c = newGatedClient(ctx)
+		s = newSendScheduler(ctx, func() client.Interface { return c })
+	)
+
+	s.setSessionClass(2, sendClassInteractive)
+	s.setSessionClass(4, sendClassMetrics)
+
+	blocked := blockScheduler(t, s, c)
+	wg := postInOrder(t, s,
+		&aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 4},
+		&aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 3},
+		&aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 2},
+		&aranyagopb.Msg{Kind: aranyagopb.MSG_DATA_STDERR, Sid: 3},
+	)
+
+	close(c.gate)
+	blocked.Wait()
+	wg.Wait()
+
+	// interactive, bulk, metrics
+	expected := []uint64{0, 2, 3, 3, 4}
+	posted := c.posted()
+	if len(posted) != len(expected) {
+		t.Fatalf("expecting %d msgs, got %d", len(expected), len(posted))
+	}
+
+	for i, p := range posted {
+		if p[0] != expected[i] {
+			t.Errorf("unexpected order of msgs %v", posted)
+			break
+		}
+	}
+}
+
+func TestSendSchedulerControlNotBlocked(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		c = newGatedClient(ctx)
+		s = newSendScheduler(ctx, func() client.Interface { return c })
+	)
+
+	s.setSessionClass(2, sendClassMetrics)
+
+	// slow post of bulk data in flight, more data queued
+	blocked := blockScheduler(t, s, c)
+	wg := postInOrder(t, s,
+		&aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 1},
+		&aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 2},
+	)
+
+	done := make(chan error, 1)
+	go func() {
+		for _, msg := range []*aranyagopb.Msg{
+			{Kind: aranyagopb.MSG_STATE, Sid: 1},
+			{Kind: aranyagopb.MSG_ERROR, Sid: 2},
+			{Kind: aranyagopb.MSG_NODE_STATUS},
+		} {
+			if err := s.post(msg); err != nil {
+				done <- err
+				return
+			}
+		}
+
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("control msgs blocked by data in flight")
+	}
+
+	expected := []aranyagopb.MsgType{aranyagopb.MSG_STATE, aranyagopb.MSG_ERROR, aranyagopb.MSG_NODE_STATUS}
+	posted := c.posted()
+	if len(posted) != len(expected) {
+		t.Fatalf("expecting %d msgs posted, got %d", len(expected), len(posted))
+	}
+
+	if s.pending() != 2 {
+		t.Errorf("queued data not kept, %d pending", s.pending())
+	}
+
+	close(c.gate)
+	blocked.Wait()
+	wg.Wait()
+
+	for i, msg := range c.msgs[:len(expected)] {
+		if msg.Kind != expected[i] {
+			t.Errorf("unexpected msg %d: %v", i, msg)
+		}
+	}
+}
+
+func TestSendSchedulerFairness(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		c = newGatedClient(ctx)
+		s = newSendScheduler(ctx, func() client.Interface { return c })
+	)
+
+	blocked := blockScheduler(t, s, c)
+
+	var msgs []*aranyagopb.Msg
+	// session 1 queued all its data before session 2
+	for _, sid := range []uint64{1, 2} {
+		for seq := uint64(0); seq < 3; seq++ {
+			msgs = append(msgs, &aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: sid, Seq: seq})
+		}
+	}
+	wg := postInOrder(t, s, msgs...)
+
+	close(c.gate)
+	blocked.Wait()
+	wg.Wait()
+
+	expected := [][2]uint64{{0, 0}, {1, 0}, {2, 0}, {1, 1}, {2, 1}, {1, 2}, {2, 2}}
+	posted := c.posted()
+	if len(posted) != len(expected) {
+		t.Fatalf("expecting %d msgs, got %d", len(expected), len(posted))
+	}
+
+	for i := range expected {
+		if posted[i] != expected[i] {
+			t.Errorf("sessions not posted in round-robin: %v", posted)
+			break
+		}
+	}
+}
+
+func TestSendSchedulerBackpressure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		c = newGatedClient(ctx)
+		s = newSendScheduler(ctx, func() client.Interface { return c })
+
+		done = make(chan error, 1)
+	)
+
+	go func() {
+		done <- s.post(&aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 1})
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("post returned before msg posted")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(c.gate)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// blocked callers are released when the scheduler exited
+	c = newGatedClient(ctx)
+	ctx2, cancel2 := context.WithCancel(ctx)
+	s = newSendScheduler(ctx2, func() client.Interface { return c })
+
+	blocking := make(chan error, 1)
+	go func() {
+		blocking <- s.post(&aranyagopb.Msg{Kind: aranyagopb.MSG_DATA})
+	}()
+	<-c.entered
+
+	go func() {
+		done <- s.post(&aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 1})
+	}()
+	waitPending(t, s, 1)
+
+	cancel2()
+	for _, ch := range []chan error{blocking, done} {
+		if err := <-ch; err != context.Canceled {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+
+	close(c.gate)
+}
+
+func TestSendSchedulerClientResolvedAtSend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mu                       = new(sync.Mutex)
+		old                      = newGatedClient(ctx)
+		current client.Interface = old
+
+		s = newSendScheduler(ctx, func() client.Interface {
+			mu.Lock()
+			defer mu.Unlock()
+
+			return current
+		})
+	)
+
+	blocked := blockScheduler(t, s, old)
+	wg := postInOrder(t, s, &aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 1})
+
+	// client promoted while the msg is queued
+	promoted := newTestClient(ctx, 4096)
+	mu.Lock()
+	current = promoted
+	mu.Unlock()
+
+	close(old.gate)
+	blocked.Wait()
+	wg.Wait()
+
+	if len(old.sessionMsgs(1)) != 0 || len(promoted.sessionMsgs(1)) != 1 {
+		t.Error("queued msg not posted with the promoted client")
+	}
+
+	// no client
+	mu.Lock()
+	current = nil
+	mu.Unlock()
+
+	if err := s.post(&aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 1}); err != errClientNotSet {
+		t.Errorf("unexpected error without client: %v", err)
+	}
+}
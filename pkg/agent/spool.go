@@ -0,0 +1,680 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/aranya-proto/aranyagopb/aranyagoconst"
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/arhat/pkg/conf"
+	"arhat.dev/arhat/pkg/constant"
+)
+
+const (
+	spoolFileSuffix    = ".msg"
+	spoolTmpFileSuffix = ".tmp"
+
+	// spool file header: unix nano time spooled (int64), msg kind (int32),
+	// sid (uint64) and flags (uint8)
+	spoolHeaderSize = 21
+
+	spoolFlagComplete = 1 << 0
+	spoolFlagMetrics  = 1 << 1
+
+	spoolRetentionDefault = "default"
+	// metrics replies share the kind of data msgs
+	spoolRetentionMetrics = "data_metrics"
+)
+
+// kinds spooled by default, other kinds are spooled only when configured
+var defaultSpooledKinds = []aranyagopb.MsgType{
+	aranyagopb.MSG_STATE,
+	aranyagopb.MSG_ERROR,
+	aranyagopb.MSG_NODE_STATUS,
+}
+
+// msgSpool keeps outbound messages on local disk while there is no client
+// or posting failed, messages are posted again in order with their original
+// sid once a client is available
+//
+// spooled chunks larger than max payload size of the client are split when
+// replayed, seq of following msgs in the same session is shifted accordingly
+//
+// when the spool is full or msgs expired, all spooled msgs of the session
+// are dropped together, since aranya can not reassemble a session with seq
+// gaps, msgs with sid 0 are standalone and dropped individually
+type msgSpool struct {
+	dir              string
+	maxSize          int64
+	retention        map[aranyagopb.MsgType]time.Duration
+	metricsRetention time.Duration
+	defaultRetention time.Duration
+	logger           log.Interface
+
+	mu        *sync.Mutex
+	nextSeq   uint64
+	size      int64
+	entries   []*spoolEntry
+	replaying bool
+	chunkSize int
+
+	// seqShift is the count of extra chunks created by splitting spooled
+	// msgs of the session, key: sid
+	seqShift map[uint64]uint64
+
+	// dropped sessions, remaining msgs of them are not spooled, key: sid
+	dropped map[uint64]struct{}
+
+	// sessions replying metrics, their data msgs are spooled with metrics
+	// retention, key: sid
+	metrics map[uint64]struct{}
+}
+
+type spoolEntry struct {
+	seq  uint64
+	kind aranyagopb.MsgType
+	sid  uint64
+	// complete is true when it's the last msg of the session
+	complete bool
+	// metrics is true when it's a metrics reply
+	metrics bool
+	spooled time.Time
+	size    int64
+}
+
+// newMsgSpool creates a spool with messages left by previous runs, nil
+// spool is returned when not configured
+func newMsgSpool(logger log.Interface, config *conf.SpoolConfig) (*msgSpool, error) {
+	if config.Dir == "" {
+		return nil, nil
+	}
+
+	maxSize := config.MaxSize
+	if maxSize == 0 {
+		maxSize = constant.DefaultSpoolMaxSize
+	}
+
+	s := &msgSpool{
+		dir:              config.Dir,
+		maxSize:          maxSize,
+		retention:        make(map[aranyagopb.MsgType]time.Duration),
+		metricsRetention: constant.DefaultSpoolRetention,
+		defaultRetention: -1,
+		logger:           logger,
+
+		mu:       new(sync.Mutex),
+		nextSeq:  1,
+		seqShift: make(map[uint64]uint64),
+		dropped:  make(map[uint64]struct{}),
+		metrics:  make(map[uint64]struct{}),
+		// same as the default of grpc and coap clients until connected
+		chunkSize: aranyagoconst.MaxGRPCDataSize - aranyagopb.EmptyMsgSize,
+	}
+
+	for _, kind := range defaultSpooledKinds {
+		s.retention[kind] = constant.DefaultSpoolRetention
+	}
+
+	for name, d := range config.Retention {
+		switch name {
+		case spoolRetentionDefault:
+			s.defaultRetention = d
+			continue
+		case spoolRetentionMetrics:
+			s.metricsRetention = d
+			continue
+		}
+
+		kind, ok := aranyagopb.MsgType_value["MSG_"+strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown msg kind %q in spool retention", name)
+		}
+
+		s.retention[aranyagopb.MsgType(kind)] = d
+	}
+
+	err := os.MkdirAll(s.dir, 0750)
+	if err != nil {
+		return nil, fmt.Errorf("failed to ensure spool dir: %w", err)
+	}
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool dir: %w", err)
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		switch {
+		case f.IsDir():
+			continue
+		case strings.HasSuffix(name, spoolTmpFileSuffix):
+			// incomplete write
+			_ = os.Remove(filepath.Join(s.dir, name))
+			continue
+		case !strings.HasSuffix(name, spoolFileSuffix):
+			continue
+		}
+
+		seq, err2 := strconv.ParseUint(strings.TrimSuffix(name, spoolFileSuffix), 10, 64)
+		if err2 != nil {
+			continue
+		}
+
+		e, err2 := readSpoolFileHeader(filepath.Join(s.dir, name))
+		if err2 != nil {
+			logger.I("ignored bad spool file", log.String("file", name), log.Error(err2))
+			continue
+		}
+
+		e.seq, e.size = seq, f.Size()
+		s.entries = append(s.entries, e)
+		s.size += e.size
+		if seq >= s.nextSeq {
+			s.nextSeq = seq + 1
+		}
+	}
+
+	sort.Slice(s.entries, func(i, j int) bool {
+		return s.entries[i].seq < s.entries[j].seq
+	})
+
+	s.mu.Lock()
+	s.expire(time.Now())
+	s.mu.Unlock()
+
+	if len(s.entries) != 0 {
+		logger.I("found spooled messages", log.Int("count", len(s.entries)))
+	}
+
+	return s, nil
+}
+
+// accept checks whether the message can be spooled
+func (s *msgSpool) accept(msg *aranyagopb.Msg) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.doAccept(msg)
+}
+
+func (s *msgSpool) doAccept(msg *aranyagopb.Msg) bool {
+	return s.retentionOf(msg.Kind, s.isMetrics(msg)) >= 0
+}
+
+// isMetrics checks whether the message is a metrics reply, must be called
+// with s.mu held
+func (s *msgSpool) isMetrics(msg *aranyagopb.Msg) bool {
+	if msg.Kind != aranyagopb.MSG_DATA_METRICS {
+		return false
+	}
+
+	_, ok := s.metrics[msg.Sid]
+	return ok
+}
+
+// trackMetrics marks data msgs of the session as metrics replies until
+// untrackMetrics is called
+func (s *msgSpool) trackMetrics(sid uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.metrics[sid] = struct{}{}
+}
+
+func (s *msgSpool) untrackMetrics(sid uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.metrics, sid)
+}
+
+// setChunkSize records max payload size of the latest client, used to
+// chunk messages spooled while there is no client
+func (s *msgSpool) setChunkSize(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.chunkSize = n
+}
+
+func (s *msgSpool) getChunkSize() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.chunkSize
+}
+
+// add messages to the spool
+func (s *msgSpool) add(msgs []*aranyagopb.Msg) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.doAdd(msgs)
+}
+
+// addIfPending adds messages of the same kind to the spool only when there
+// are messages not replayed, so that messages are always posted in order,
+// remaining messages of dropped sessions are discarded
+func (s *msgSpool) addIfPending(msgs []*aranyagopb.Msg) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.dropped[msgs[0].Sid]; ok {
+		return true, s.doAdd(msgs)
+	}
+
+	if (len(s.entries) == 0 && !s.replaying) || !s.doAccept(msgs[0]) {
+		return false, nil
+	}
+
+	return true, s.doAdd(msgs)
+}
+
+func (s *msgSpool) doAdd(msgs []*aranyagopb.Msg) error {
+	now := time.Now()
+	for _, msg := range msgs {
+		if !s.doAccept(msg) {
+			continue
+		}
+
+		if _, ok := s.dropped[msg.Sid]; ok {
+			if msg.Complete {
+				delete(s.dropped, msg.Sid)
+			}
+
+			continue
+		}
+
+		data, err := msg.Marshal()
+		if err != nil {
+			return fmt.Errorf("failed to marshal msg: %w", err)
+		}
+
+		e := &spoolEntry{
+			seq:      s.nextSeq,
+			kind:     msg.Kind,
+			sid:      msg.Sid,
+			complete: msg.Complete,
+			metrics:  s.isMetrics(msg),
+			spooled:  now,
+			size:     int64(spoolHeaderSize + len(data)),
+		}
+		s.nextSeq++
+
+		err = s.writeFile(e, data)
+		if err != nil {
+			return err
+		}
+
+		s.entries = append(s.entries, e)
+		s.size += e.size
+	}
+
+	dropped := 0
+	for s.maxSize > 0 && s.size > s.maxSize && len(s.entries) != 0 {
+		dropped += s.dropSession(s.entries[0])
+	}
+
+	if dropped != 0 {
+		s.logger.I("spool full, dropped messages of oldest sessions", log.Int("count", dropped))
+	}
+
+	return nil
+}
+
+// dropSession removes all entries of the session of e, returns count of
+// entries removed, must be called with s.mu held
+func (s *msgSpool) dropSession(e *spoolEntry) int {
+	if e.sid == 0 {
+		s.remove(e)
+		return 1
+	}
+
+	var (
+		kept  = s.entries[:0]
+		count = 0
+		last  *spoolEntry
+	)
+	for _, v := range s.entries {
+		if v.sid != e.sid {
+			kept = append(kept, v)
+			continue
+		}
+
+		s.size -= v.size
+		s.removeFile(v)
+		count++
+		last = v
+	}
+
+	for i := len(kept); i < len(s.entries); i++ {
+		s.entries[i] = nil
+	}
+	s.entries = kept
+
+	delete(s.seqShift, e.sid)
+	if last != nil && !last.complete {
+		// following msgs of the session are incomplete without dropped ones
+		s.dropped[e.sid] = struct{}{}
+	}
+
+	return count
+}
+
+// startReplay returns true if the caller should call replay
+func (s *msgSpool) startReplay() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.replaying || len(s.entries) == 0 {
+		return false
+	}
+
+	s.replaying = true
+	return true
+}
+
+// stopReplay is called when the caller of replay gave up
+func (s *msgSpool) stopReplay() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.replaying = false
+}
+
+// replay posts spooled messages in order until the spool is empty (replay
+// is stopped at the same time) or post failed, messages are split into
+// chunks not larger than maxPayloadSize
+func (s *msgSpool) replay(post func(msg *aranyagopb.Msg) error, maxPayloadSize func() int) error {
+	count := 0
+	defer func() {
+		if count != 0 {
+			s.logger.I("replayed spooled messages", log.Int("count", count))
+		}
+	}()
+
+	for {
+		s.mu.Lock()
+		s.expire(time.Now())
+		if len(s.entries) == 0 {
+			s.replaying = false
+			s.mu.Unlock()
+			return nil
+		}
+		e := s.entries[0]
+		s.mu.Unlock()
+
+		msg, err := s.readFile(e)
+		if err != nil {
+			s.logger.I("dropped bad spool file", log.Uint64("seq", e.seq), log.Error(err))
+
+			s.mu.Lock()
+			s.remove(e)
+			s.mu.Unlock()
+			continue
+		}
+
+		s.mu.Lock()
+		shift := s.seqShift[msg.Sid]
+		s.mu.Unlock()
+
+		// shift is committed only after all chunks posted, chunks posted
+		// before failure are posted again with the same seq
+		chunks := splitMsg(msg, shift, maxPayloadSize())
+		for _, chunk := range chunks {
+			err = post(chunk)
+			if err != nil {
+				return err
+			}
+		}
+
+		count++
+
+		s.mu.Lock()
+		s.setSeqShift(msg, shift+uint64(len(chunks)-1))
+		s.remove(e)
+		s.mu.Unlock()
+	}
+}
+
+// shifted returns the msg to post with seq shifted if spooled msgs of the
+// session were split when replayed
+func (s *msgSpool) shifted(msg *aranyagopb.Msg) *aranyagopb.Msg {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shift := s.seqShift[msg.Sid]
+	if shift == 0 {
+		return msg
+	}
+
+	ret := *msg
+	ret.Seq += shift
+	return &ret
+}
+
+// posted is called when the msg returned by shifted has been posted
+func (s *msgSpool) posted(msg *aranyagopb.Msg) {
+	if !msg.Complete {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.seqShift, msg.Sid)
+}
+
+// setSeqShift of the session of msg, must be called with s.mu held
+func (s *msgSpool) setSeqShift(msg *aranyagopb.Msg, shift uint64) {
+	if msg.Complete || shift == 0 {
+		// no more msgs in this session
+		delete(s.seqShift, msg.Sid)
+		return
+	}
+
+	s.seqShift[msg.Sid] = shift
+}
+
+// splitMsg splits msg into chunks with payload not larger than n, seq of
+// chunks starts from the seq of msg with shift added, only the last chunk
+// inherits Complete, non-positive n means no limit
+func splitMsg(msg *aranyagopb.Msg, shift uint64, n int) []*aranyagopb.Msg {
+	var (
+		ret  []*aranyagopb.Msg
+		data = msg.Payload
+		seq  = msg.Seq + shift
+	)
+
+	for n > 0 && len(data) > n {
+		ret = append(ret, &aranyagopb.Msg{
+			Kind:     msg.Kind,
+			Sid:      msg.Sid,
+			Seq:      seq,
+			Complete: false,
+			Payload:  data[:n],
+		})
+
+		seq++
+		data = data[n:]
+	}
+
+	return append(ret, &aranyagopb.Msg{
+		Kind:     msg.Kind,
+		Sid:      msg.Sid,
+		Seq:      seq,
+		Complete: msg.Complete,
+		Payload:  data,
+	})
+}
+
+func (s *msgSpool) retentionOf(kind aranyagopb.MsgType, metrics bool) time.Duration {
+	if metrics {
+		return s.metricsRetention
+	}
+
+	if d, ok := s.retention[kind]; ok {
+		return d
+	}
+
+	return s.defaultRetention
+}
+
+// expire drops sessions with messages exceeded their retention, must be
+// called with s.mu held
+func (s *msgSpool) expire(now time.Time) {
+	dropped := 0
+	for i := 0; i < len(s.entries); {
+		e := s.entries[i]
+		if d := s.retentionOf(e.kind, e.metrics); d == 0 || now.Sub(e.spooled) <= d {
+			i++
+			continue
+		}
+
+		// entries of the session before e are also removed, start over
+		dropped += s.dropSession(e)
+		i = 0
+	}
+
+	if dropped != 0 {
+		s.logger.I("dropped expired spooled messages", log.Int("count", dropped))
+	}
+}
+
+// remove entry and its file, must be called with s.mu held
+func (s *msgSpool) remove(e *spoolEntry) {
+	for i, v := range s.entries {
+		if v != e {
+			continue
+		}
+
+		s.entries = append(s.entries[:i], s.entries[i+1:]...)
+		s.size -= e.size
+		s.removeFile(e)
+
+		return
+	}
+}
+
+func (s *msgSpool) removeFile(e *spoolEntry) {
+	err := os.Remove(s.filename(e.seq))
+	if err != nil && !os.IsNotExist(err) {
+		s.logger.I("failed to remove spool file", log.Uint64("seq", e.seq), log.Error(err))
+	}
+}
+
+// writeFile writes header and msg data atomically
+func (s *msgSpool) writeFile(e *spoolEntry, data []byte) error {
+	name := s.filename(e.seq)
+	tmpName := strings.TrimSuffix(name, spoolFileSuffix) + spoolTmpFileSuffix
+
+	f, err := os.OpenFile(tmpName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create spool file: %w", err)
+	}
+
+	buf := make([]byte, spoolHeaderSize, spoolHeaderSize+len(data))
+	binary.BigEndian.PutUint64(buf, uint64(e.spooled.UnixNano()))
+	binary.BigEndian.PutUint32(buf[8:], uint32(e.kind))
+	binary.BigEndian.PutUint64(buf[12:], e.sid)
+	if e.complete {
+		buf[20] |= spoolFlagComplete
+	}
+
+	if e.metrics {
+		buf[20] |= spoolFlagMetrics
+	}
+
+	_, err = f.Write(append(buf, data...))
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+
+	if err == nil {
+		err = os.Rename(tmpName, name)
+	}
+
+	if err != nil {
+		_ = os.Remove(tmpName)
+		return fmt.Errorf("failed to write spool file: %w", err)
+	}
+
+	return nil
+}
+
+func (s *msgSpool) readFile(e *spoolEntry) (*aranyagopb.Msg, error) {
+	data, err := ioutil.ReadFile(s.filename(e.seq))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < spoolHeaderSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	msg := new(aranyagopb.Msg)
+	err = msg.Unmarshal(data[spoolHeaderSize:])
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (s *msgSpool) filename(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolFileSuffix))
+}
+
+func readSpoolFileHeader(file string) (*spoolEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var buf [spoolHeaderSize]byte
+	_, err = io.ReadFull(f, buf[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &spoolEntry{
+		spooled:  time.Unix(0, int64(binary.BigEndian.Uint64(buf[:8]))),
+		kind:     aranyagopb.MsgType(binary.BigEndian.Uint32(buf[8:])),
+		sid:      binary.BigEndian.Uint64(buf[12:]),
+		complete: buf[20]&spoolFlagComplete != 0,
+		metrics:  buf[20]&spoolFlagMetrics != 0,
+	}, nil
+}
@@ -0,0 +1,333 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/arhat/pkg/conf"
+	"arhat.dev/arhat/pkg/constant"
+)
+
+func TestSpoolReplayRechunk(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := &conf.Config{}
+	config.Connectivity.Spool.Dir = t.TempDir()
+	config.Connectivity.Spool.Retention = map[string]time.Duration{"data": 0}
+
+	ag, err := NewAgent(ctx, log.NoOpLogger, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		large = bytes.Repeat([]byte("a"), 100)
+		small = []byte("b")
+	)
+
+	// spooled with the default chunk size when there is no client
+	seq, err := ag.PostData(1, aranyagopb.MSG_DATA, 0, false, large)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ag.PostData(1, aranyagopb.MSG_DATA, seq+1, false, small)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another session not affected
+	_, err = ag.PostData(2, aranyagopb.MSG_DATA, 0, true, small)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestClient(ctx, 40)
+	ag.SetClient(c)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(c.sessionMsgs(1)) != 4 || len(c.sessionMsgs(2)) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("spooled msgs not replayed, got %d msgs", len(c.sessionMsgs(1)))
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// msgs posted after replay follow the renumbered seq
+	_, err = ag.PostData(1, aranyagopb.MSG_DATA, seq+2, true, small)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := c.waitComplete(t, 1, 10*time.Second)
+	expected := [][]byte{large[:40], large[40:80], large[80:], small, small}
+	if len(msgs) != len(expected) {
+		t.Fatalf("expecting %d msgs, got %d", len(expected), len(msgs))
+	}
+
+	for i, msg := range msgs {
+		if msg.Seq != uint64(i) || !bytes.Equal(msg.Payload, expected[i]) {
+			t.Errorf("unexpected msg %d, seq %d, payload %q", i, msg.Seq, msg.Payload)
+		}
+
+		if msg.Complete != (i == len(msgs)-1) {
+			t.Errorf("unexpected complete flag of msg %d", i)
+		}
+	}
+
+	if msgs = c.sessionMsgs(2); msgs[0].Seq != 0 || !msgs[0].Complete {
+		t.Errorf("unexpected msg of another session: %+v", msgs[0])
+	}
+
+	files, err := ioutil.ReadDir(config.Connectivity.Spool.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 0 {
+		t.Errorf("replayed msgs not removed from spool: %d", len(files))
+	}
+
+	if len(ag.spool.seqShift) != 0 {
+		t.Errorf("seq shift of completed session not removed")
+	}
+}
+
+func TestSplitMsg(t *testing.T) {
+	msg := &aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 1, Seq: 2, Complete: true, Payload: []byte("abcde")}
+
+	for _, test := range []struct {
+		n        int
+		shift    uint64
+		expected []string
+	}{
+		{n: 0, shift: 0, expected: []string{"abcde"}},
+		{n: 5, shift: 1, expected: []string{"abcde"}},
+		{n: 2, shift: 3, expected: []string{"ab", "cd", "e"}},
+	} {
+		chunks := splitMsg(msg, test.shift, test.n)
+		if len(chunks) != len(test.expected) {
+			t.Fatalf("expecting %d chunks, got %d", len(test.expected), len(chunks))
+		}
+
+		for i, c := range chunks {
+			if c.Sid != msg.Sid || c.Seq != msg.Seq+test.shift+uint64(i) || string(c.Payload) != test.expected[i] {
+				t.Errorf("unexpected chunk %d: %+v", i, c)
+			}
+
+			if c.Complete != (i == len(chunks)-1) {
+				t.Errorf("unexpected complete flag of chunk %d", i)
+			}
+		}
+	}
+}
+
+func TestSpoolDropSession(t *testing.T) {
+	payload := bytes.Repeat([]byte("a"), 64)
+	newMsg := func(sid, seq uint64, complete bool) *aranyagopb.Msg {
+		return &aranyagopb.Msg{
+			Kind:     aranyagopb.MSG_DATA,
+			Sid:      sid,
+			Seq:      seq,
+			Complete: complete,
+			Payload:  payload,
+		}
+	}
+
+	config := &conf.SpoolConfig{
+		Dir:       t.TempDir(),
+		Retention: map[string]time.Duration{"data": 0},
+	}
+	s, err := newMsgSpool(log.NoOpLogger, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range []*aranyagopb.Msg{
+		newMsg(1, 0, false),
+		newMsg(2, 0, false),
+		newMsg(1, 1, false),
+	} {
+		if err = s.add([]*aranyagopb.Msg{msg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// sid and complete flag are persisted in spool files
+	s, err = newMsgSpool(log.NoOpLogger, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.entries) != 3 || s.entries[0].sid != 1 || s.entries[1].sid != 2 {
+		t.Fatalf("unexpected entries loaded: %+v", s.entries)
+	}
+
+	// make the spool full, all msgs of the oldest session are dropped
+	s.maxSize = s.size
+
+	err = s.add([]*aranyagopb.Msg{newMsg(2, 1, false)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.entries) != 2 || s.entries[0].sid != 2 || s.entries[1].sid != 2 {
+		t.Fatalf("unexpected entries after session dropped: %+v", s.entries)
+	}
+
+	// remaining msgs of the dropped session are discarded even when there
+	// is nothing pending
+	s.maxSize = 0
+	s.entries, s.size = nil, 0
+
+	spooled, err := s.addIfPending([]*aranyagopb.Msg{newMsg(1, 2, false)})
+	if err != nil || !spooled || len(s.entries) != 0 {
+		t.Fatalf("msg of dropped session not discarded: %v, %d", err, len(s.entries))
+	}
+
+	spooled, err = s.addIfPending([]*aranyagopb.Msg{newMsg(1, 3, true)})
+	if err != nil || !spooled || len(s.entries) != 0 {
+		t.Fatalf("last msg of dropped session not discarded: %v, %d", err, len(s.entries))
+	}
+
+	if len(s.dropped) != 0 {
+		t.Errorf("completed session not removed from dropped sessions")
+	}
+
+	spooled, err = s.addIfPending([]*aranyagopb.Msg{newMsg(1, 0, true)})
+	if err != nil || spooled {
+		t.Errorf("unexpected msg spooled with nothing pending: %v", err)
+	}
+}
+
+func TestSpoolAccept(t *testing.T) {
+	newMsg := func(kind aranyagopb.MsgType, sid uint64) *aranyagopb.Msg {
+		return &aranyagopb.Msg{Kind: kind, Sid: sid, Complete: true}
+	}
+
+	for _, test := range []struct {
+		name      string
+		retention map[string]time.Duration
+		accepted  []*aranyagopb.Msg
+		rejected  []*aranyagopb.Msg
+	}{
+		{
+			name: "default",
+			accepted: []*aranyagopb.Msg{
+				newMsg(aranyagopb.MSG_STATE, 1),
+				newMsg(aranyagopb.MSG_ERROR, 1),
+				newMsg(aranyagopb.MSG_NODE_STATUS, 0),
+				newMsg(aranyagopb.MSG_DATA_METRICS, 2),
+			},
+			rejected: []*aranyagopb.Msg{
+				newMsg(aranyagopb.MSG_DATA, 1),
+				newMsg(aranyagopb.MSG_DATA_STDERR, 1),
+				newMsg(aranyagopb.MSG_RUNTIME, 1),
+			},
+		},
+		{
+			name:      "opt in",
+			retention: map[string]time.Duration{"default": time.Hour, "error": -1},
+			accepted: []*aranyagopb.Msg{
+				newMsg(aranyagopb.MSG_DATA, 1),
+				newMsg(aranyagopb.MSG_RUNTIME, 1),
+				newMsg(aranyagopb.MSG_STATE, 1),
+			},
+			rejected: []*aranyagopb.Msg{
+				newMsg(aranyagopb.MSG_ERROR, 1),
+			},
+		},
+		{
+			name:      "no metrics",
+			retention: map[string]time.Duration{"data": 0, "data_metrics": -1},
+			accepted: []*aranyagopb.Msg{
+				newMsg(aranyagopb.MSG_DATA, 1),
+			},
+			rejected: []*aranyagopb.Msg{
+				newMsg(aranyagopb.MSG_DATA_METRICS, 2),
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := newMsgSpool(log.NoOpLogger, &conf.SpoolConfig{
+				Dir:       t.TempDir(),
+				Retention: test.retention,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if s.maxSize != constant.DefaultSpoolMaxSize {
+				t.Errorf("unexpected max size %d", s.maxSize)
+			}
+
+			// session 2 is replying metrics
+			s.trackMetrics(2)
+
+			for _, msg := range test.accepted {
+				if !s.accept(msg) {
+					t.Errorf("%s msg of session %d not accepted", msg.Kind, msg.Sid)
+				}
+			}
+
+			for _, msg := range test.rejected {
+				if s.accept(msg) {
+					t.Errorf("%s msg of session %d accepted", msg.Kind, msg.Sid)
+				}
+			}
+		})
+	}
+}
+
+func TestSpoolMetrics(t *testing.T) {
+	config := &conf.SpoolConfig{Dir: t.TempDir()}
+	s, err := newMsgSpool(log.NoOpLogger, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.trackMetrics(1)
+	err = s.add([]*aranyagopb.Msg{{Kind: aranyagopb.MSG_DATA_METRICS, Sid: 1, Complete: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.untrackMetrics(1)
+
+	if s.accept(&aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 1}) {
+		t.Errorf("data msg accepted after metrics reply")
+	}
+
+	// metrics flag is persisted in spool files
+	s, err = newMsgSpool(log.NoOpLogger, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.entries) != 1 || !s.entries[0].metrics || !s.entries[0].complete {
+		t.Fatalf("unexpected entries loaded: %+v", s.entries)
+	}
+}
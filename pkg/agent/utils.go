@@ -76,21 +76,10 @@ func convertNodeExtInfo(extInfo []conf.NodeExtInfo) ([]*aranyagopb.NodeExtInfo,
 			return nil, fmt.Errorf("failed to get value ext info value: %w", err)
 		}
 
-		var (
-			target    aranyagopb.NodeExtInfo_Target
-			targetKey string
-		)
-		switch {
-		case strings.HasPrefix(info.ApplyTo, `metadata.annotations['`):
-			target = aranyagopb.NODE_EXT_INFO_TARGET_ANNOTATION
-			targetKey = strings.TrimPrefix(info.ApplyTo, `metadata.annotations['`)
-		case strings.HasPrefix(info.ApplyTo, `metadata.labels['`):
-			target = aranyagopb.NODE_EXT_INFO_TARGET_LABEL
-			targetKey = strings.TrimPrefix(info.ApplyTo, `metadata.labels['`)
-		default:
-			return nil, fmt.Errorf("invalid ext info target")
+		target, targetKey, err := parseNodeExtInfoTarget(info.ApplyTo)
+		if err != nil {
+			return nil, err
 		}
-		targetKey = strings.TrimSuffix(targetKey, `']`)
 
 		result = append(result, &aranyagopb.NodeExtInfo{
 			Value:     value,
@@ -103,3 +92,22 @@ func convertNodeExtInfo(extInfo []conf.NodeExtInfo) ([]*aranyagopb.NodeExtInfo,
 
 	return result, nil
 }
+
+func parseNodeExtInfoTarget(applyTo string) (
+	target aranyagopb.NodeExtInfo_Target,
+	targetKey string,
+	err error,
+) {
+	switch {
+	case strings.HasPrefix(applyTo, `metadata.annotations['`):
+		target = aranyagopb.NODE_EXT_INFO_TARGET_ANNOTATION
+		targetKey = strings.TrimPrefix(applyTo, `metadata.annotations['`)
+	case strings.HasPrefix(applyTo, `metadata.labels['`):
+		target = aranyagopb.NODE_EXT_INFO_TARGET_LABEL
+		targetKey = strings.TrimPrefix(applyTo, `metadata.labels['`)
+	default:
+		return 0, "", fmt.Errorf("invalid ext info target")
+	}
+
+	return target, strings.TrimSuffix(targetKey, `']`), nil
+}
@@ -31,12 +31,17 @@ var (
 	ErrClientAlreadyConnected = errors.New("client already connected")
 	ErrClientNotConnected     = errors.New("client not connected")
 	ErrCmdRecvClosed          = errors.New("cmd recv closed")
+
+	// ErrUnrecoverable is wrapped by errors which won't recover by
+	// reconnecting with the same config (e.g. authentication rejected)
+	ErrUnrecoverable = errors.New("unrecoverable")
 )
 
 func NewBaseClient(
 	ctx context.Context,
 	handleCmd types.AgentCmdHandleFunc,
 	maxPayloadSize int,
+	compression *MsgCompressionConfig,
 ) (*BaseClient, error) {
 	ctx, cancel := context.WithCancel(ctx)
 
@@ -46,12 +51,19 @@ func NewBaseClient(
 		return nil, fmt.Errorf("maxPayloadSize must be greater than %d", aranyagopb.EmptyMsgSize)
 	}
 
+	compressor, err := newMsgCompressor(compression)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
 	return &BaseClient{
 		ctx:  ctx,
 		exit: cancel,
 
 		Log:            log.Log.WithName("client"),
 		maxPayloadSize: maxPayloadSize,
+		compressor:     compressor,
 
 		handleCmd: handleCmd,
 	}, nil
@@ -62,15 +74,24 @@ type BaseClient struct {
 	exit context.CancelFunc
 
 	maxPayloadSize int
+	compressor     *msgCompressor
 
 	Log       log.Interface
 	handleCmd types.AgentCmdHandleFunc
 }
 
+// HandleCmd passes cmdBytes to the agent as is, cmds are never compressed,
+// so that no data is inflated before cmd auth and size checks of the agent
 func (b *BaseClient) HandleCmd(cmdBytes []byte) {
 	b.handleCmd(cmdBytes)
 }
 
+// EncodeMsg marshals the msg, compressed according to the configured
+// msg compression
+func (b *BaseClient) EncodeMsg(msg *aranyagopb.Msg) ([]byte, error) {
+	return b.compressor.encode(msg)
+}
+
 func (b *BaseClient) OnClose(doExit func() error) error {
 	b.exit()
 
@@ -22,4 +22,7 @@ type CommonConfig struct {
 	Endpoint       string              `json:"endpoint" yaml:"endpoint"`
 	MaxPayloadSize int                 `json:"maxPayloadSize" yaml:"maxPayloadSize"`
 	TLS            tlshelper.TLSConfig `json:"tls" yaml:"tls"`
+
+	// MsgCompression of msgs sent through pub/sub connectivity methods
+	MsgCompression MsgCompressionConfig `json:"msgCompression" yaml:"msgCompression"`
 }
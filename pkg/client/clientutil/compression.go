@@ -0,0 +1,307 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clientutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressed msgs are framed as
+//
+//	[ 0x00 ][ method ][ compressed protobuf encoded Msg ]
+//
+// the frame is only used by methods with msg compression configured, aranya
+// MUST be configured to expect it for the same method, a protobuf encoded
+// message never starts with 0x00 (field number 0 is invalid), so msgs sent
+// uncompressed are still accepted as is
+//
+// cmds are never compressed
+const (
+	compressedFlag byte = 0x00
+
+	compressedMethodZstd    byte = 0x01
+	compressedMethodDeflate byte = 0x02
+
+	compressedHeaderSize = 2
+)
+
+const (
+	MsgCompressionNone    = "none"
+	MsgCompressionZstd    = "zstd"
+	MsgCompressionDeflate = "deflate"
+
+	// DefaultMsgCompressionMinSize is the default min payload size to compress
+	DefaultMsgCompressionMinSize = 512
+
+	// maxDecompressedSize limits memory used to decompress a single msg
+	maxDecompressedSize = 64 << 20
+)
+
+var ErrDecompressedTooLarge = errors.New("decompressed data too large")
+
+// MsgCompressionConfig configures compression of msgs sent to aranya
+type MsgCompressionConfig struct {
+	// Method used to compress msgs, one of [none, zstd, deflate],
+	// defaults to none
+	Method string `json:"method" yaml:"method"`
+
+	// MinSize is the min payload size to be compressed,
+	// defaults to DefaultMsgCompressionMinSize
+	MinSize int `json:"minSize" yaml:"minSize"`
+}
+
+// Enabled returns true when msg compression is configured
+func (c *MsgCompressionConfig) Enabled() bool {
+	return c != nil && c.Method != "" && c.Method != MsgCompressionNone
+}
+
+// compressedMagics are prefixes of well known compressed formats, payloads
+// with these prefixes are sent as is
+var compressedMagics = [][]byte{
+	{0x1f, 0x8b},                       // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+	{'B', 'Z', 'h'},                    // bzip2
+	{'P', 'K', 0x03, 0x04},             // zip
+	{0x04, 0x22, 0x4d, 0x18},           // lz4
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+	{0x89, 'P', 'N', 'G'},              // png
+	{0xff, 0xd8, 0xff},                 // jpeg
+}
+
+func looksCompressed(data []byte) bool {
+	for _, m := range compressedMagics {
+		if bytes.HasPrefix(data, m) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newMsgCompressor(config *MsgCompressionConfig) (*msgCompressor, error) {
+	if !config.Enabled() {
+		return nil, nil
+	}
+
+	c := &msgCompressor{
+		minSize:        config.MinSize,
+		incompressible: make(map[uint64]struct{}),
+		mu:             new(sync.Mutex),
+	}
+
+	if c.minSize <= 0 {
+		c.minSize = DefaultMsgCompressionMinSize
+	}
+
+	switch config.Method {
+	case MsgCompressionZstd:
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+		}
+
+		c.method = compressedMethodZstd
+		c.encoders = &sync.Pool{
+			New: func() interface{} {
+				enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+				return enc
+			},
+		}
+		c.encoders.Put(enc)
+	case MsgCompressionDeflate:
+		c.method = compressedMethodDeflate
+		c.encoders = &sync.Pool{
+			New: func() interface{} {
+				w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+				return w
+			},
+		}
+	default:
+		return nil, fmt.Errorf("unsupported msg compression method %q", config.Method)
+	}
+
+	return c, nil
+}
+
+// msgCompressor compresses encoded msgs
+type msgCompressor struct {
+	method   byte
+	minSize  int
+	encoders *sync.Pool
+
+	// incompressible sessions are sent without compression until complete
+	incompressible map[uint64]struct{}
+	mu             *sync.Mutex
+}
+
+// encode marshals the msg and compresses it when worthwhile
+func (c *msgCompressor) encode(msg *aranyagopb.Msg) ([]byte, error) {
+	data, err := msg.Marshal()
+	if err != nil || c == nil {
+		return data, err
+	}
+
+	if msg.Complete {
+		defer c.forget(msg.Sid)
+	}
+
+	if len(msg.Payload) < c.minSize || !c.compressible(msg) {
+		return data, nil
+	}
+
+	compressed, err := c.compress(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// not worth it, treat the rest of this session as incompressible
+	if len(compressed) >= len(data)-len(data)/10 {
+		c.markIncompressible(msg.Sid)
+		return data, nil
+	}
+
+	return compressed, nil
+}
+
+func (c *msgCompressor) compressible(msg *aranyagopb.Msg) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.incompressible[msg.Sid]; ok {
+		return false
+	}
+
+	if looksCompressed(msg.Payload) {
+		c.incompressible[msg.Sid] = struct{}{}
+		return false
+	}
+
+	return true
+}
+
+func (c *msgCompressor) markIncompressible(sid uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.incompressible[sid] = struct{}{}
+}
+
+func (c *msgCompressor) forget(sid uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.incompressible, sid)
+}
+
+func (c *msgCompressor) compress(data []byte) ([]byte, error) {
+	buf := make([]byte, compressedHeaderSize, compressedHeaderSize+len(data)/2)
+	buf[0], buf[1] = compressedFlag, c.method
+
+	switch c.method {
+	case compressedMethodZstd:
+		enc := c.encoders.Get().(*zstd.Encoder)
+		defer c.encoders.Put(enc)
+
+		return enc.EncodeAll(data, buf), nil
+	default:
+		w := c.encoders.Get().(*flate.Writer)
+		defer c.encoders.Put(w)
+
+		out := bytes.NewBuffer(buf)
+		w.Reset(out)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		return out.Bytes(), nil
+	}
+}
+
+var (
+	zstdDecoderOnce sync.Once
+	zstdDecoder     *zstd.Decoder
+	zstdDecoderErr  error
+)
+
+// IsCompressed returns true when data is framed as compressed
+func IsCompressed(data []byte) bool {
+	return len(data) > 0 && data[0] == compressedFlag
+}
+
+// Decompress returns the protobuf encoded Msg in data, uncompressed data is
+// returned as is, it's meant for the receiving side of msgs (aranya) of
+// methods with msg compression configured
+func Decompress(data []byte) ([]byte, error) {
+	if !IsCompressed(data) {
+		return data, nil
+	}
+
+	if len(data) < compressedHeaderSize {
+		return nil, fmt.Errorf("invalid compressed data")
+	}
+
+	switch method, body := data[1], data[compressedHeaderSize:]; method {
+	case compressedMethodZstd:
+		zstdDecoderOnce.Do(func() {
+			zstdDecoder, zstdDecoderErr = zstd.NewReader(nil,
+				zstd.WithDecoderConcurrency(1),
+				zstd.WithDecoderMaxMemory(maxDecompressedSize),
+			)
+		})
+
+		if zstdDecoderErr != nil {
+			return nil, zstdDecoderErr
+		}
+
+		ret, err := zstdDecoder.DecodeAll(body, nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+			return nil, ErrDecompressedTooLarge
+		}
+
+		return ret, err
+	case compressedMethodDeflate:
+		r := flate.NewReader(bytes.NewReader(body))
+		defer func() { _ = r.Close() }()
+
+		ret, err := ioutil.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(ret) > maxDecompressedSize {
+			return nil, ErrDecompressedTooLarge
+		}
+
+		return ret, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression method %d", method)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clientutil
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+)
+
+func newTestCompressor(t *testing.T, method string) *msgCompressor {
+	c, err := newMsgCompressor(&MsgCompressionConfig{Method: method})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestMsgCompressorRoundTrip(t *testing.T) {
+	for _, method := range []string{MsgCompressionZstd, MsgCompressionDeflate} {
+		t.Run(method, func(t *testing.T) {
+			c := newTestCompressor(t, method)
+
+			msg := &aranyagopb.Msg{
+				Kind:    aranyagopb.MSG_DATA,
+				Sid:     1,
+				Seq:     2,
+				Payload: bytes.Repeat([]byte("log line\n"), 1024),
+			}
+
+			data, err := c.encode(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !IsCompressed(data) || len(data) >= len(msg.Payload) {
+				t.Fatalf("msg not compressed, size %d", len(data))
+			}
+
+			data, err = Decompress(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoded := new(aranyagopb.Msg)
+			if err = decoded.Unmarshal(data); err != nil {
+				t.Fatal(err)
+			}
+
+			if decoded.Sid != 1 || decoded.Seq != 2 || !bytes.Equal(decoded.Payload, msg.Payload) {
+				t.Error("msg changed after decompression")
+			}
+
+			// small msgs are sent as is
+			small := &aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 1, Payload: []byte("foo")}
+			data, err = c.encode(small)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if IsCompressed(data) {
+				t.Error("msg smaller than min size compressed")
+			}
+
+			data, err = Decompress(data)
+			if err != nil || decoded.Unmarshal(data) != nil || string(decoded.Payload) != "foo" {
+				t.Error("uncompressed msg not returned as is")
+			}
+		})
+	}
+}
+
+func TestMsgCompressorAlreadyCompressed(t *testing.T) {
+	c := newTestCompressor(t, MsgCompressionZstd)
+
+	gzipped := append([]byte{0x1f, 0x8b}, bytes.Repeat([]byte{0}, 4096)...)
+	data, err := c.encode(&aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 1, Payload: gzipped})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if IsCompressed(data) {
+		t.Error("compressed payload compressed again")
+	}
+
+	// the rest of the session is sent as is until complete
+	text := bytes.Repeat([]byte("log line\n"), 1024)
+	data, err = c.encode(&aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 1, Payload: text, Complete: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if IsCompressed(data) {
+		t.Error("data of incompressible session compressed")
+	}
+
+	data, err = c.encode(&aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 1, Payload: text})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsCompressed(data) {
+		t.Error("session still incompressible after complete")
+	}
+
+	// other sessions are not affected
+	data, err = c.encode(&aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 2, Payload: text})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsCompressed(data) {
+		t.Error("data of other session not compressed")
+	}
+}
+
+func TestDecompressSizeLimit(t *testing.T) {
+	for _, method := range []string{MsgCompressionZstd, MsgCompressionDeflate} {
+		t.Run(method, func(t *testing.T) {
+			c := newTestCompressor(t, method)
+
+			for _, size := range []int{maxDecompressedSize, maxDecompressedSize + 1} {
+				compressed, err := c.compress(make([]byte, size))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				data, err := Decompress(compressed)
+				switch {
+				case size <= maxDecompressedSize && (err != nil || len(data) != size):
+					t.Errorf("failed to decompress %d bytes: %v", size, err)
+				case size > maxDecompressedSize && err != ErrDecompressedTooLarge:
+					t.Errorf("decompressed %d bytes over limit, err: %v", len(data), err)
+				}
+			}
+		})
+	}
+
+	if _, err := Decompress([]byte{compressedFlag, 0x7f, 0x01}); err == nil {
+		t.Error("unsupported compression method accepted")
+	}
+}
+
+func TestBaseClientHandleCmdNotDecompressed(t *testing.T) {
+	var received []byte
+	b, err := NewBaseClient(context.Background(), func(cmdBytes []byte) {
+		received = cmdBytes
+	}, 4096, &MsgCompressionConfig{Method: MsgCompressionZstd})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compressed, err := newTestCompressor(t, MsgCompressionZstd).compress(bytes.Repeat([]byte("a"), 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.HandleCmd(compressed)
+	if !bytes.Equal(received, compressed) {
+		t.Error("cmd not passed to the agent as is")
+	}
+}
@@ -65,6 +65,11 @@ func init() {
 				Transport:         "tcp",
 				URIQueries:        make(map[string]string),
 				KeepaliveInterval: 60 * time.Second,
+				Blockwise: BlockwiseConfig{
+					Enabled:         true,
+					BlockSize:       1024,
+					TransferTimeout: 30 * time.Second,
+				},
 			}
 		},
 		NewCoAPClient,
@@ -142,7 +147,7 @@ func NewCoAPClient(
 		mu: new(sync.Mutex),
 	}
 
-	coapClient.BaseClient, err = clientutil.NewBaseClient(ctx, handleCmd, maxPayloadSize)
+	coapClient.BaseClient, err = clientutil.NewBaseClient(ctx, handleCmd, maxPayloadSize, &config.MsgCompression)
 	if err != nil {
 		return nil, err
 	}
@@ -154,6 +159,16 @@ func NewCoAPClient(
 
 	brokerAddr := config.Endpoint
 
+	blockSZX, err := config.Blockwise.szx()
+	if err != nil {
+		return nil, err
+	}
+
+	blockTransferTimeout := config.Blockwise.TransferTimeout
+	if blockTransferTimeout <= 0 {
+		blockTransferTimeout = 30 * time.Second
+	}
+
 	// keepaliveInterval := config.KeepaliveInterval
 	// if keepaliveInterval <= 0 {
 	// 	keepaliveInterval = 60 * time.Second
@@ -186,6 +201,7 @@ func NewCoAPClient(
 	if brokerAddr == "" {
 		srvOpts := []coapudp.ServerOption{
 			coapudp.WithMaxMessageSize(aranyagoconst.MaxCoAPDataSize),
+			coapudp.WithBlockwise(config.Blockwise.Enabled, blockSZX, blockTransferTimeout),
 		}
 
 		connectActions = append(connectActions, func(dialCtx context.Context) (*coapudpclient.ClientConn, error) {
@@ -222,6 +238,7 @@ func NewCoAPClient(
 	case "tcp", "tcp4", "tcp6":
 		dialOpts := []coaptcp.DialOption{
 			coaptcp.WithMaxMessageSize(aranyagoconst.MaxCoAPDataSize),
+			coaptcp.WithBlockwise(config.Blockwise.Enabled, blockSZX, blockTransferTimeout),
 			// coaptcp.WithKeepAlive(keepaliveOpt),
 			coaptcp.WithErrors(func(err error) {
 				coapClient.Log.I("internal coap client error", log.Error(err))
@@ -233,23 +250,53 @@ func NewCoAPClient(
 		}
 
 		coapClient.connect = func(dialCtx context.Context) (coapmux.Client, error) {
-			dialOpts = []coaptcp.DialOption{
-				coaptcp.WithContext(dialCtx),
-			}
-
-			conn, err2 := coaptcp.Dial(brokerAddr, dialOpts...)
+			conn, err2 := coaptcp.Dial(brokerAddr,
+				append(dialOpts[:len(dialOpts):len(dialOpts)], coaptcp.WithContext(dialCtx))...,
+			)
 			if err2 != nil {
 				return nil, fmt.Errorf("failed to dial tcp server: %w", err2)
 			}
 
 			return coaptcp.NewClientTCP(conn), nil
 		}
+	case "websocket", "websocket/tls":
+		if brokerAddr == "" {
+			return nil, fmt.Errorf("endpoint is required for websocket transport")
+		}
+
+		wsTLSConfig := tlsCfg
+		if wsTLSConfig == nil && strings.HasSuffix(strings.ToLower(transport), "/tls") {
+			// tls without custom settings
+			wsTLSConfig = new(tls.Config)
+		}
+
+		wsURL := websocketURL(brokerAddr, wsTLSConfig != nil)
+		dialOpts := []coaptcp.DialOption{
+			coaptcp.WithMaxMessageSize(aranyagoconst.MaxCoAPDataSize),
+			coaptcp.WithBlockwise(config.Blockwise.Enabled, blockSZX, blockTransferTimeout),
+			coaptcp.WithErrors(func(err error) {
+				coapClient.Log.I("internal coap client error", log.Error(err))
+			}),
+			// connection lives longer than dialCtx
+			coaptcp.WithContext(coapClient.Context()),
+			coaptcp.WithCloseSocket(),
+		}
+
+		coapClient.connect = func(dialCtx context.Context) (coapmux.Client, error) {
+			conn, err2 := dialWebsocket(dialCtx, wsURL, wsTLSConfig, aranyagoconst.MaxCoAPDataSize)
+			if err2 != nil {
+				return nil, fmt.Errorf("failed to dial websocket server: %w", err2)
+			}
+
+			return coaptcp.NewClientTCP(coaptcp.Client(conn, dialOpts...)), nil
+		}
 	case "udp", "udp4", "udp6":
 		if tlsCfg == nil {
 			connectActions = append(connectActions, func(dialCtx context.Context) (*coapudpclient.ClientConn, error) {
 				dialOpts := []coapudp.DialOption{
 					coapudp.WithMaxMessageSize(aranyagoconst.MaxCoAPDataSize),
 					coapudp.WithContext(dialCtx),
+					coapudp.WithBlockwise(config.Blockwise.Enabled, blockSZX, blockTransferTimeout),
 					// coapudp.WithKeepAlive(keepaliveOpt),
 					coapudp.WithErrors(func(err error) {
 						coapClient.Log.I("internal coap client error", log.Error(err))
@@ -337,6 +384,7 @@ func NewCoAPClient(
 				dialOpts := []coapdtls.DialOption{
 					coapdtls.WithMaxMessageSize(aranyagoconst.MaxCoAPDataSize),
 					coapdtls.WithContext(dialCtx),
+					coapdtls.WithBlockwise(config.Blockwise.Enabled, blockSZX, blockTransferTimeout),
 					// coapdtls.WithKeepAlive(keepaliveOpt),
 					coapdtls.WithErrors(func(err error) {
 						coapClient.Log.I("internal coap client error", log.Error(err))
@@ -406,6 +454,18 @@ func (c *Client) Connect(dialCtx context.Context) error {
 	return err
 }
 
+// Ping the coap server
+func (c *Client) Ping(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == nil {
+		return clientutil.ErrClientNotConnected
+	}
+
+	return c.client.Ping(ctx)
+}
+
 func (c *Client) Start(ctx context.Context) error {
 	if !atomic.CompareAndSwapUint32(&c.started, 0, 1) {
 		return clientutil.ErrClientNotConnected
@@ -445,7 +505,7 @@ func (c *Client) Start(ctx context.Context) error {
 }
 
 func (c *Client) doPostMsg(ctx context.Context, msg *aranyagopb.Msg, msgOpts coapmsg.Options) error {
-	data, err := msg.Marshal()
+	data, err := c.EncodeMsg(msg)
 	if err != nil {
 		return fmt.Errorf("failed to marshal msg: %w", err)
 	}
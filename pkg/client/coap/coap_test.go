@@ -0,0 +1,167 @@
+// +build !noclient_coap
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coap
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/aranya-proto/aranyagopb/aranyagoconst"
+
+	"arhat.dev/arhat/pkg/client/clientutil"
+	"arhat.dev/arhat/pkg/conf"
+)
+
+// cmdRecorder records cmds handled by the client
+type cmdRecorder struct {
+	mu   *sync.Mutex
+	cmds [][]byte
+}
+
+func (r *cmdRecorder) handleCmd(cmdBytes []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cmds = append(r.cmds, cmdBytes)
+}
+
+func (r *cmdRecorder) get() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([][]byte{}, r.cmds...)
+}
+
+func newTestClient(t *testing.T, transport, endpoint string, handleCmd func(cmdBytes []byte)) *Client {
+	c, err := NewCoAPClient(context.TODO(), handleCmd, &Config{
+		CommonConfig: clientutil.CommonConfig{
+			Endpoint:       endpoint,
+			MaxPayloadSize: aranyagoconst.MaxCoAPDataSize,
+		},
+		PathNamespaceFrom: conf.ValueFromSpec{Text: "arhat.test"},
+		Transport:         transport,
+		KeepaliveInterval: time.Minute,
+		Blockwise: BlockwiseConfig{
+			Enabled:         true,
+			BlockSize:       64,
+			TransferTimeout: 10 * time.Second,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c.(*Client)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// testBlockwise posts and receives payloads requiring multiple blocks
+func testBlockwise(t *testing.T, s *fakeServer, transport, endpoint string) {
+	var (
+		recorder = &cmdRecorder{mu: new(sync.Mutex)}
+		c        = newTestClient(t, transport, endpoint, recorder.handleCmd)
+
+		cmdPath, msgPath, statusPath = aranyagoconst.CoAPTopics("arhat.test")
+	)
+
+	err := c.Connect(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Start(context.TODO())
+	}()
+
+	waitFor(t, "online message", func() bool { return len(s.messages(statusPath)) == 1 })
+
+	if s.observed() != cmdPath {
+		t.Fatalf("cmd path not observed, got %q", s.observed())
+	}
+
+	payload := bytes.Repeat([]byte("data"), 4096)
+	err = c.PostMsg(&aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 1, Payload: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := s.messages(msgPath)
+	if len(msgs) != 1 {
+		t.Fatalf("expecting 1 msg put, got %d", len(msgs))
+	}
+
+	msg := new(aranyagopb.Msg)
+	if err = msg.Unmarshal(msgs[0]); err != nil || !bytes.Equal(msg.Payload, payload) {
+		t.Errorf("unexpected msg put: %v", err)
+	}
+
+	cmd := bytes.Repeat([]byte("cmd-"), 4096)
+	s.notify(t, cmd)
+
+	waitFor(t, "cmd notified", func() bool { return len(recorder.get()) == 1 })
+	if !bytes.Equal(recorder.get()[0], cmd) {
+		t.Error("unexpected cmd notified")
+	}
+
+	_ = c.Close()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("client not stopped after closed")
+	}
+}
+
+func TestClientBlockwiseUDP(t *testing.T) {
+	s := newFakeServer()
+	relay, endpoint := newUDPRelay(t, s.runUDP(t))
+
+	testBlockwise(t, s, "udp", endpoint)
+
+	// both msg and cmd are larger than the block size of the server
+	upload, download := relay.datagrams()
+	if upload < 16384/1024 || download < 16384/1024 {
+		t.Errorf("payload not transferred in blocks, %d datagrams sent, %d received", upload, download)
+	}
+}
+
+func TestClientBlockwiseTCP(t *testing.T) {
+	s := newFakeServer()
+
+	testBlockwise(t, s, "tcp", s.runTCP(t))
+}
@@ -19,8 +19,11 @@ limitations under the License.
 package coap
 
 import (
+	"fmt"
 	"time"
 
+	"github.com/plgd-dev/go-coap/v2/net/blockwise"
+
 	"arhat.dev/arhat/pkg/client/clientutil"
 	"arhat.dev/arhat/pkg/conf"
 )
@@ -32,4 +35,35 @@ type Config struct {
 	Transport         string             `json:"transport" yaml:"transport"`
 	URIQueries        map[string]string  `json:"uriQueries" yaml:"uriQueries"`
 	KeepaliveInterval time.Duration      `json:"keepaliveInterval" yaml:"keepaliveInterval"`
+	Blockwise         BlockwiseConfig    `json:"blockwise" yaml:"blockwise"`
+}
+
+// BlockwiseConfig defines block-wise transfer (RFC 7959) of messages larger
+// than a single block
+type BlockwiseConfig struct {
+	// Enabled block-wise transfer, when disabled, every message MUST fit
+	// into a single coap message (usually a single datagram for udp)
+	Enabled bool `json:"enabled" yaml:"enabled"`
+
+	// BlockSize is the preferred size of a block in bytes, server can
+	// negotiate a smaller one, value is a power of 2 between 16 and 1024
+	BlockSize int `json:"blockSize" yaml:"blockSize"`
+
+	// TransferTimeout is the max time to wait for the next block before
+	// dropping partially transferred message
+	TransferTimeout time.Duration `json:"transferTimeout" yaml:"transferTimeout"`
+}
+
+func (c BlockwiseConfig) szx() (blockwise.SZX, error) {
+	if c.BlockSize == 0 {
+		return blockwise.SZX1024, nil
+	}
+
+	for szx := blockwise.SZX16; szx <= blockwise.SZX1024; szx++ {
+		if szx.Size() == int64(c.BlockSize) {
+			return szx, nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid block size %d", c.BlockSize)
 }
@@ -0,0 +1,287 @@
+// +build !noclient_coap
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	coapmsg "github.com/plgd-dev/go-coap/v2/message"
+	coapmsgcodes "github.com/plgd-dev/go-coap/v2/message/codes"
+	coapmux "github.com/plgd-dev/go-coap/v2/mux"
+	coapnet "github.com/plgd-dev/go-coap/v2/net"
+	"github.com/plgd-dev/go-coap/v2/net/blockwise"
+	coaptcp "github.com/plgd-dev/go-coap/v2/tcp"
+	coapudp "github.com/plgd-dev/go-coap/v2/udp"
+)
+
+// fakeServer is an in-process coap server recording messages put by the
+// client and sending notifications to the observing client
+type fakeServer struct {
+	mu        *sync.Mutex
+	published map[string][][]byte
+
+	observedPath string
+	observer     coapmux.Client
+	token        coapmsg.Token
+	obsSeq       uint32
+	lastCmd      []byte
+}
+
+func newFakeServer() *fakeServer {
+	return &fakeServer{
+		mu:        new(sync.Mutex),
+		published: make(map[string][][]byte),
+	}
+}
+
+// runUDP serves the fake server over udp, returns the server address
+func (s *fakeServer) runUDP(t *testing.T) string {
+	l, err := coapnet.NewListenUDP("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := coapudp.NewServer(
+		coapudp.WithMux(s),
+		coapudp.WithBlockwise(true, blockwise.SZX1024, 10*time.Second),
+	)
+	go func() { _ = srv.Serve(l) }()
+
+	t.Cleanup(func() {
+		srv.Stop()
+		_ = l.Close()
+	})
+
+	return l.LocalAddr().String()
+}
+
+// runTCP serves the fake server over tcp, returns the server address
+func (s *fakeServer) runTCP(t *testing.T) string {
+	l, err := coapnet.NewTCPListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := coaptcp.NewServer(
+		coaptcp.WithMux(s),
+		coaptcp.WithBlockwise(true, blockwise.SZX1024, 10*time.Second),
+	)
+	go func() { _ = srv.Serve(l) }()
+
+	t.Cleanup(func() {
+		srv.Stop()
+		_ = l.Close()
+	})
+
+	return l.Addr().String()
+}
+
+func (s *fakeServer) ServeCOAP(w coapmux.ResponseWriter, r *coapmux.Message) {
+	path, err := r.Options.Path()
+	if err != nil {
+		_ = w.SetResponse(coapmsgcodes.BadRequest, coapmsg.TextPlain, nil)
+		return
+	}
+
+	switch r.Code {
+	case coapmsgcodes.GET:
+		obs, err := r.Options.Observe()
+		if err != nil {
+			// remaining blocks of the notification are requested without
+			// observe option (RFC 7959 section 2.6)
+			s.mu.Lock()
+			cmd := s.lastCmd
+			s.mu.Unlock()
+
+			_ = w.SetResponse(coapmsgcodes.Content, coapmsg.AppOctets, bytes.NewReader(cmd))
+			return
+		}
+
+		if obs != 0 {
+			_ = w.SetResponse(coapmsgcodes.BadRequest, coapmsg.TextPlain, nil)
+			return
+		}
+
+		s.mu.Lock()
+		s.observedPath = path
+		s.observer = w.Client()
+		s.token = append(coapmsg.Token{}, r.Token...)
+		s.mu.Unlock()
+
+		opts, _, _ := coapmsg.Options{}.SetObserve(make([]byte, 4), 0)
+		_ = w.SetResponse(coapmsgcodes.Content, coapmsg.TextPlain, nil, opts...)
+	case coapmsgcodes.PUT:
+		var data []byte
+		if r.Body != nil {
+			data, err = ioutil.ReadAll(r.Body)
+			if err != nil {
+				_ = w.SetResponse(coapmsgcodes.BadRequest, coapmsg.TextPlain, nil)
+				return
+			}
+		}
+
+		s.mu.Lock()
+		s.published[path] = append(s.published[path], data)
+		s.mu.Unlock()
+
+		_ = w.SetResponse(coapmsgcodes.Changed, coapmsg.TextPlain, nil)
+	default:
+		_ = w.SetResponse(coapmsgcodes.MethodNotAllowed, coapmsg.TextPlain, nil)
+	}
+}
+
+// observed returns the path observed by the client, empty if not observed
+func (s *fakeServer) observed() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.observedPath
+}
+
+// messages returns payloads put to the path by the client
+func (s *fakeServer) messages(path string) [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([][]byte{}, s.published[path]...)
+}
+
+// notify sends data to the observing client
+func (s *fakeServer) notify(t *testing.T, data []byte) {
+	s.mu.Lock()
+	s.obsSeq++
+	s.lastCmd = data
+	cc, token, seq := s.observer, s.token, s.obsSeq
+	s.mu.Unlock()
+
+	buf := make([]byte, 8)
+	opts, n, err := coapmsg.Options{}.SetContentFormat(buf, coapmsg.AppOctets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts, _, err = opts.SetObserve(buf[n:], seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cc.WriteMessage(&coapmsg.Message{
+		Context: cc.Context(),
+		Code:    coapmsgcodes.Content,
+		Token:   token,
+		Options: opts,
+		Body:    bytes.NewReader(data),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// udpRelay forwards datagrams between a single client and the server,
+// counting datagrams in each direction
+type udpRelay struct {
+	mu       *sync.Mutex
+	upload   int
+	download int
+}
+
+func newUDPRelay(t *testing.T, serverAddr string) (*udpRelay, string) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srvAddr, err := net.ResolveUDPAddr("udp", serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream, err := net.DialUDP("udp", nil, srvAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = conn.Close()
+		_ = upstream.Close()
+	})
+
+	var (
+		r = &udpRelay{mu: new(sync.Mutex)}
+
+		clientMu   = new(sync.Mutex)
+		clientAddr *net.UDPAddr
+	)
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err2 := conn.ReadFromUDP(buf)
+			if err2 != nil {
+				return
+			}
+
+			clientMu.Lock()
+			clientAddr = addr
+			clientMu.Unlock()
+
+			r.count(&r.upload)
+			_, _ = upstream.Write(buf[:n])
+		}
+	}()
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, err2 := upstream.Read(buf)
+			if err2 != nil {
+				return
+			}
+
+			clientMu.Lock()
+			addr := clientAddr
+			clientMu.Unlock()
+
+			r.count(&r.download)
+			_, _ = conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	return r, conn.LocalAddr().String()
+}
+
+func (r *udpRelay) count(n *int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	*n++
+}
+
+// datagrams returns count of datagrams sent by the client and the server
+func (r *udpRelay) datagrams() (upload, download int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.upload, r.download
+}
@@ -0,0 +1,364 @@
+// +build !noclient_coap
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coap
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// coap over websocket (RFC 8323 section 4)
+//
+// messages are framed the same way as coap over tcp except the length
+// field, which is always 0 since every websocket message contains exactly
+// one coap message, so websocketConn translates framing between go-coap's
+// tcp client and the websocket connection
+
+const (
+	websocketSubprotocol = "coap"
+	websocketPath        = "/.well-known/coap"
+)
+
+// websocketURL returns the url of the websocket endpoint, endpoint can be
+// either a host with port or a complete url
+func websocketURL(endpoint string, secure bool) string {
+	if strings.Contains(endpoint, "://") {
+		return endpoint
+	}
+
+	scheme := "ws"
+	if secure {
+		scheme = "wss"
+	}
+
+	return scheme + "://" + endpoint + websocketPath
+}
+
+func newWebsocketConn(conn *websocket.Conn, remoteAddr net.Addr, maxMessageSize int) net.Conn {
+	// websocket message is never larger than the same coap message over tcp
+	conn.SetReadLimit(int64(maxMessageSize))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wc := &websocketConn{
+		conn:       conn,
+		ctx:        ctx,
+		cancel:     cancel,
+		remoteAddr: remoteAddr,
+
+		msgCh: make(chan []byte, 1),
+
+		mu:  new(sync.Mutex),
+		wmu: new(sync.Mutex),
+	}
+
+	go wc.readLoop()
+
+	return wc
+}
+
+type websocketAddr string
+
+func (a websocketAddr) Network() string { return "websocket" }
+func (a websocketAddr) String() string  { return string(a) }
+
+// websocketConn implements net.Conn for go-coap's tcp client
+//
+// read deadline is supported since go-coap relies on it to check connection
+// activity, write deadline limits writes of websocket messages, the websocket
+// connection is closed once a write timed out
+type websocketConn struct {
+	conn       *websocket.Conn
+	ctx        context.Context
+	cancel     context.CancelFunc
+	remoteAddr net.Addr
+
+	// msgCh receives messages in coap over tcp framing
+	msgCh chan []byte
+	rbuf  []byte
+	rerr  error
+
+	mu            *sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	wmu  *sync.Mutex
+	wbuf []byte
+}
+
+func (c *websocketConn) readLoop() {
+	defer close(c.msgCh)
+
+	for {
+		typ, data, err := c.conn.Read(c.ctx)
+		if err != nil {
+			c.mu.Lock()
+			c.rerr = err
+			c.mu.Unlock()
+			return
+		}
+
+		if typ != websocket.MessageBinary {
+			continue
+		}
+
+		msg, err := tcpFramingOf(data)
+		if err != nil {
+			_ = c.conn.Close(websocket.StatusProtocolError, err.Error())
+			c.mu.Lock()
+			c.rerr = err
+			c.mu.Unlock()
+			return
+		}
+
+		select {
+		case c.msgCh <- msg:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *websocketConn) Read(p []byte) (int, error) {
+	if len(c.rbuf) == 0 {
+		c.mu.Lock()
+		deadline := c.readDeadline
+		c.mu.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, errWebsocketTimeout
+			}
+
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case msg, ok := <-c.msgCh:
+			if !ok {
+				c.mu.Lock()
+				defer c.mu.Unlock()
+
+				if c.rerr == nil {
+					return 0, io.EOF
+				}
+
+				return 0, c.rerr
+			}
+
+			c.rbuf = msg
+		case <-timeout:
+			return 0, errWebsocketTimeout
+		}
+	}
+
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+
+	return n, nil
+}
+
+// Write sends every complete coap message in websocket framing, incomplete
+// message is kept until completed by following writes
+func (c *websocketConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+
+	ctx := c.ctx
+	if !deadline.IsZero() {
+		if !time.Now().Before(deadline) {
+			return 0, errWebsocketTimeout
+		}
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(c.ctx, deadline)
+		defer cancel()
+	}
+
+	c.wbuf = append(c.wbuf, p...)
+	for {
+		size, ok := tcpFramedSize(c.wbuf)
+		if !ok {
+			break
+		}
+
+		err := c.conn.Write(ctx, websocket.MessageBinary, websocketFramingOf(c.wbuf[:size]))
+		if err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return 0, errWebsocketTimeout
+			}
+
+			return 0, err
+		}
+
+		c.wbuf = c.wbuf[:copy(c.wbuf, c.wbuf[size:])]
+	}
+
+	return len(p), nil
+}
+
+func (c *websocketConn) Close() error {
+	defer c.cancel()
+
+	return c.conn.Close(websocket.StatusNormalClosure, "")
+}
+
+func (c *websocketConn) LocalAddr() net.Addr  { return websocketAddr("") }
+func (c *websocketConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+func (c *websocketConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline, c.writeDeadline = t, t
+	return nil
+}
+
+func (c *websocketConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	return nil
+}
+
+func (c *websocketConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeDeadline = t
+	return nil
+}
+
+var errWebsocketTimeout net.Error = &websocketTimeoutError{}
+
+type websocketTimeoutError struct{}
+
+func (e *websocketTimeoutError) Error() string   { return "i/o timeout" }
+func (e *websocketTimeoutError) Timeout() bool   { return true }
+func (e *websocketTimeoutError) Temporary() bool { return true }
+
+// tcpFramedSize returns the size of the first coap message in buf with
+// coap over tcp framing (RFC 8323 section 3.2)
+func tcpFramedSize(buf []byte) (int, bool) {
+	if len(buf) == 0 {
+		return 0, false
+	}
+
+	var (
+		length int
+		extLen int
+		tkl    = int(buf[0] & 0x0f)
+	)
+
+	switch l := int(buf[0] >> 4); l {
+	case 13:
+		extLen = 1
+	case 14:
+		extLen = 2
+	case 15:
+		extLen = 4
+	default:
+		length = l
+	}
+
+	if len(buf) < 1+extLen {
+		return 0, false
+	}
+
+	switch extLen {
+	case 1:
+		length = int(buf[1]) + 13
+	case 2:
+		length = int(binary.BigEndian.Uint16(buf[1:])) + 269
+	case 4:
+		length = int(binary.BigEndian.Uint32(buf[1:])) + 65805
+	}
+
+	// length, code, token, options and payload
+	size := 1 + extLen + 1 + tkl + length
+	if len(buf) < size {
+		return 0, false
+	}
+
+	return size, true
+}
+
+// websocketFramingOf converts a complete coap over tcp message to coap over
+// websocket message by removing the length
+func websocketFramingOf(msg []byte) []byte {
+	extLen := 0
+	switch msg[0] >> 4 {
+	case 13:
+		extLen = 1
+	case 14:
+		extLen = 2
+	case 15:
+		extLen = 4
+	}
+
+	ret := make([]byte, 0, len(msg)-extLen)
+	ret = append(ret, msg[0]&0x0f)
+	return append(ret, msg[1+extLen:]...)
+}
+
+// tcpFramingOf converts a coap over websocket message to coap over tcp
+// message by setting the length
+func tcpFramingOf(msg []byte) ([]byte, error) {
+	if len(msg) < 2 {
+		return nil, fmt.Errorf("coap message too short")
+	}
+
+	tkl := int(msg[0] & 0x0f)
+	if msg[0]>>4 != 0 || tkl > 8 || len(msg) < 2+tkl {
+		return nil, fmt.Errorf("invalid coap message header")
+	}
+
+	length := len(msg) - 2 - tkl
+	ret := make([]byte, 0, len(msg)+4)
+	switch {
+	case length < 13:
+		ret = append(ret, byte(length<<4)|byte(tkl))
+	case length < 269:
+		ret = append(ret, 13<<4|byte(tkl), byte(length-13))
+	case length < 65805:
+		ret = append(ret, 14<<4|byte(tkl), 0, 0)
+		binary.BigEndian.PutUint16(ret[1:], uint16(length-269))
+	default:
+		ret = append(ret, 15<<4|byte(tkl), 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(ret[1:], uint32(length-65805))
+	}
+
+	return append(ret, msg[1:]...), nil
+}
@@ -0,0 +1,53 @@
+// +build !noclient_coap
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coap
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"nhooyr.io/websocket"
+)
+
+// dialWebsocket connects to the websocket endpoint with the websocket api of
+// the js runtime, which manages tls and proxy on its own, so tlsConfig is
+// only used to select the url scheme by the caller
+func dialWebsocket(
+	dialCtx context.Context,
+	url string,
+	_ *tls.Config,
+	maxMessageSize int,
+) (net.Conn, error) {
+	// nolint:bodyclose
+	conn, _, err := websocket.Dial(dialCtx, url, &websocket.DialOptions{
+		Subprotocols: []string{websocketSubprotocol},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if p := conn.Subprotocol(); p != websocketSubprotocol {
+		_ = conn.Close(websocket.StatusProtocolError, "coap subprotocol required")
+		return nil, fmt.Errorf("unexpected websocket subprotocol %q", p)
+	}
+
+	return newWebsocketConn(conn, websocketAddr(url), maxMessageSize), nil
+}
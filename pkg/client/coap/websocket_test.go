@@ -0,0 +1,314 @@
+// +build !noclient_coap
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coap
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// websocketMsg creates a coap over websocket message with payload of size
+func websocketMsg(size int) []byte {
+	// token length 2, code 2.05, token
+	msg := []byte{0x02, 0x45, 0x12, 0x34}
+	if size > 0 {
+		msg = append(msg, 0xff)
+		msg = append(msg, bytes.Repeat([]byte{'x'}, size-1)...)
+	}
+
+	return msg
+}
+
+func TestFraming(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		size   int
+		header []byte
+	}{
+		{name: "empty", size: 0, header: []byte{0x02}},
+		{name: "no ext", size: 12, header: []byte{0xc2}},
+		{name: "ext 1 min", size: 13, header: []byte{0xd2, 0x00}},
+		{name: "ext 1 max", size: 268, header: []byte{0xd2, 0xff}},
+		{name: "ext 2 min", size: 269, header: []byte{0xe2, 0x00, 0x00}},
+		{name: "ext 2 max", size: 65804, header: []byte{0xe2, 0xff, 0xff}},
+		{name: "ext 4 min", size: 65805, header: []byte{0xf2, 0x00, 0x00, 0x00, 0x00}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			wsMsg := websocketMsg(test.size)
+
+			tcpMsg, err := tcpFramingOf(wsMsg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(tcpMsg[:len(test.header)], test.header) {
+				t.Errorf("unexpected tcp framing header %x", tcpMsg[:len(test.header)])
+			}
+
+			if !bytes.Equal(tcpMsg[len(test.header):], wsMsg[1:]) {
+				t.Error("unexpected tcp framing body")
+			}
+
+			size, ok := tcpFramedSize(append(tcpMsg, 0x01, 0x02))
+			if !ok || size != len(tcpMsg) {
+				t.Errorf("unexpected framed size %d, expecting %d", size, len(tcpMsg))
+			}
+
+			for i := 0; i < len(tcpMsg); i++ {
+				if _, ok = tcpFramedSize(tcpMsg[:i]); ok {
+					t.Fatalf("incomplete message of size %d reported as complete", i)
+				}
+			}
+
+			if !bytes.Equal(websocketFramingOf(tcpMsg), wsMsg) {
+				t.Error("websocket framing not restored")
+			}
+		})
+	}
+}
+
+func TestTCPFramingOfInvalid(t *testing.T) {
+	for _, msg := range [][]byte{
+		nil,
+		{0x00},
+		// length set
+		{0x10, 0x45, 0x00},
+		// token length too large
+		{0x09, 0x45},
+		// token truncated
+		{0x02, 0x45, 0x12},
+	} {
+		if _, err := tcpFramingOf(msg); err == nil {
+			t.Errorf("invalid message %x accepted", msg)
+		}
+	}
+}
+
+// runWebsocketServer serves websocket connections with coap subprotocol,
+// returns the server address
+func runWebsocketServer(t *testing.T, handle func(conn *websocket.Conn)) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != websocketPath {
+			http.NotFound(w, r)
+			return
+		}
+
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			Subprotocols: []string{websocketSubprotocol},
+		})
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close(websocket.StatusNormalClosure, "") }()
+
+		handle(conn)
+	}))
+	t.Cleanup(srv.Close)
+
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// runWebsocketGateway serves coap over websocket by forwarding messages to
+// the coap over tcp server
+func runWebsocketGateway(t *testing.T, tcpServerAddr string) string {
+	return runWebsocketServer(t, func(conn *websocket.Conn) {
+		conn.SetReadLimit(1 << 20)
+
+		upstream, err := net.Dial("tcp", tcpServerAddr)
+		if err != nil {
+			return
+		}
+		defer func() { _ = upstream.Close() }()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go func() {
+			defer cancel()
+
+			var (
+				buf  []byte
+				rbuf = make([]byte, 65536)
+			)
+			for {
+				n, err2 := upstream.Read(rbuf)
+				if err2 != nil {
+					return
+				}
+
+				buf = append(buf, rbuf[:n]...)
+				for {
+					size, ok := tcpFramedSize(buf)
+					if !ok {
+						break
+					}
+
+					err2 = conn.Write(ctx, websocket.MessageBinary, websocketFramingOf(buf[:size]))
+					if err2 != nil {
+						return
+					}
+
+					buf = buf[size:]
+				}
+			}
+		}()
+
+		for {
+			_, data, err2 := conn.Read(ctx)
+			if err2 != nil {
+				return
+			}
+
+			msg, err2 := tcpFramingOf(data)
+			if err2 != nil {
+				return
+			}
+
+			if _, err2 = upstream.Write(msg); err2 != nil {
+				return
+			}
+		}
+	})
+}
+
+func dialTestWebsocket(t *testing.T, addr string) net.Conn {
+	conn, err := dialWebsocket(context.TODO(), websocketURL(addr, false), nil, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+func TestWebsocketConnWrite(t *testing.T) {
+	received := make(chan []byte, 4)
+	addr := runWebsocketServer(t, func(conn *websocket.Conn) {
+		for {
+			_, data, err := conn.Read(context.TODO())
+			if err != nil {
+				return
+			}
+
+			received <- data
+		}
+	})
+
+	conn := dialTestWebsocket(t, addr)
+
+	first, err := tcpFramingOf(websocketMsg(20))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := tcpFramingOf(websocketMsg(300))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// first message split across writes, completed together with the
+	// second message
+	data := append(append([]byte{}, first...), second...)
+	for _, p := range [][]byte{data[:1], data[1:10], data[10:]} {
+		n, err2 := conn.Write(p)
+		if err2 != nil || n != len(p) {
+			t.Fatalf("failed to write %d bytes: %d, %v", len(p), n, err2)
+		}
+	}
+
+	for i, expected := range [][]byte{websocketMsg(20), websocketMsg(300)} {
+		select {
+		case msg := <-received:
+			if !bytes.Equal(msg, expected) {
+				t.Errorf("unexpected message %d: %x", i, msg)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("message %d not received", i)
+		}
+	}
+
+	select {
+	case msg := <-received:
+		t.Errorf("unexpected message received: %x", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebsocketConnWriteDeadline(t *testing.T) {
+	// never reads messages
+	addr := runWebsocketServer(t, func(conn *websocket.Conn) {
+		time.Sleep(5 * time.Second)
+	})
+
+	conn := dialTestWebsocket(t, addr)
+
+	msg, err := tcpFramingOf(websocketMsg(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = conn.SetWriteDeadline(time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = conn.Write(msg)
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("expecting timeout error for expired deadline, got %v", err)
+	}
+
+	err = conn.SetDeadline(time.Now().Add(200 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fill up socket buffers until write blocked
+	done := make(chan error, 1)
+	go func() {
+		for {
+			if _, err2 := conn.Write(msg); err2 != nil {
+				done <- err2
+				return
+			}
+		}
+	}()
+
+	select {
+	case err = <-done:
+		if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+			t.Errorf("expecting timeout error, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("write deadline not respected")
+	}
+}
+
+func TestClientBlockwiseWebsocket(t *testing.T) {
+	s := newFakeServer()
+
+	testBlockwise(t, s, "websocket", runWebsocketGateway(t, s.runTCP(t)))
+}
@@ -0,0 +1,47 @@
+// +build !noclient_grpc
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc
+
+import (
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/proto"
+)
+
+// rawCmd is the cmd received from the sync stream as is
+type rawCmd []byte
+
+// cmdCodec is the proto codec except cmds are received without decoding,
+// so that cmds sealed by aranya reach cmd auth of the agent unchanged, and
+// plain cmds are not decoded twice
+type cmdCodec struct{}
+
+func (cmdCodec) Name() string { return proto.Name }
+
+func (cmdCodec) Marshal(v interface{}) ([]byte, error) {
+	return encoding.GetCodec(proto.Name).Marshal(v)
+}
+
+func (cmdCodec) Unmarshal(data []byte, v interface{}) error {
+	if cmd, ok := v.(*rawCmd); ok {
+		*cmd = append((*cmd)[:0], data...)
+		return nil
+	}
+
+	return encoding.GetCodec(proto.Name).Unmarshal(data, v)
+}
@@ -0,0 +1,148 @@
+// +build !noclient_grpc
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/grpc/encoding"
+)
+
+const (
+	compressorGzip = "gzip"
+	compressorZstd = "zstd"
+
+	// zstdMaxDecodedSize limits memory used to decode a single message
+	zstdMaxDecodedSize = 64 << 20
+)
+
+func init() {
+	encoding.RegisterCompressor(&gzipCompressor{
+		writers: &sync.Pool{
+			New: func() interface{} {
+				return gzip.NewWriter(ioutil.Discard)
+			},
+		},
+	})
+
+	encoding.RegisterCompressor(&zstdCompressor{
+		encoders: &sync.Pool{
+			New: func() interface{} {
+				enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+				return enc
+			},
+		},
+		decoder: new(sync.Once),
+	})
+}
+
+// gzipCompressor implements encoding.Compressor, the upstream one
+// (google.golang.org/grpc/encoding/gzip) is not used to share gzip
+// implementation with other components
+type gzipCompressor struct {
+	writers *sync.Pool
+}
+
+func (c *gzipCompressor) Name() string { return compressorGzip }
+
+func (c *gzipCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	gw := c.writers.Get().(*gzip.Writer)
+	gw.Reset(w)
+
+	return &pooledWriter{
+		WriteCloser: gw,
+		release:     func() { c.writers.Put(gw) },
+	}, nil
+}
+
+func (c *gzipCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+type zstdCompressor struct {
+	encoders *sync.Pool
+
+	decoder    *sync.Once
+	zstdReader *zstd.Decoder
+	decoderErr error
+}
+
+func (c *zstdCompressor) Name() string { return compressorZstd }
+
+func (c *zstdCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	enc, ok := c.encoders.Get().(*zstd.Encoder)
+	if !ok || enc == nil {
+		var err error
+		enc, err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	enc.Reset(w)
+
+	return &pooledWriter{
+		WriteCloser: enc,
+		release:     func() { c.encoders.Put(enc) },
+	}, nil
+}
+
+// Decompress decodes the whole message at once, streaming decoder runs
+// background goroutines until closed, but grpc never closes the reader
+func (c *zstdCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	c.decoder.Do(func() {
+		c.zstdReader, c.decoderErr = zstd.NewReader(nil,
+			zstd.WithDecoderMaxMemory(zstdMaxDecodedSize),
+		)
+	})
+
+	if c.decoderErr != nil {
+		return nil, c.decoderErr
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = c.zstdReader.DecodeAll(data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+// pooledWriter releases the writer to its pool after closed
+type pooledWriter struct {
+	io.WriteCloser
+
+	release func()
+}
+
+func (w *pooledWriter) Close() error {
+	defer w.release()
+
+	return w.WriteCloser.Close()
+}
@@ -0,0 +1,133 @@
+// +build !noclient_grpc
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/aranya-proto/aranyagopb/aranyagoconst"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/stats"
+
+	"arhat.dev/arhat/pkg/client/clientutil"
+)
+
+// payloadStats records compression and sizes of payloads received by the
+// server
+type payloadStats struct {
+	mu *sync.Mutex
+
+	compression string
+	length      int
+	wireLength  int
+}
+
+func (s *payloadStats) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context { return ctx }
+
+func (s *payloadStats) HandleRPC(_ context.Context, rs stats.RPCStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch st := rs.(type) {
+	case *stats.InHeader:
+		s.compression = st.Compression
+	case *stats.InPayload:
+		s.length, s.wireLength = st.Length, st.WireLength
+	}
+}
+
+func (s *payloadStats) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context { return ctx }
+
+func (s *payloadStats) HandleConn(context.Context, stats.ConnStats) {}
+
+func TestClientCompression(t *testing.T) {
+	payload := bytes.Repeat([]byte("arhat"), 16*1024)
+
+	for _, name := range []string{compressorGzip, compressorZstd} {
+		t.Run(name, func(t *testing.T) {
+			st := &payloadStats{mu: new(sync.Mutex)}
+			srv := newRecordingServer(&aranyagopb.Cmd{Kind: aranyagopb.CMD_DATA_UPSTREAM, Sid: 1, Payload: payload})
+			endpoint := runServer(t, srv, grpc.StatsHandler(st))
+
+			cmdCh := make(chan []byte, 1)
+			c := newTestClientWithConfig(t, func(cmd []byte) { cmdCh <- cmd }, &Config{
+				CommonConfig: clientutil.CommonConfig{
+					Endpoint:       endpoint,
+					MaxPayloadSize: aranyagoconst.MaxGRPCDataSize,
+				},
+				Compression: name,
+			})
+
+			syncOnce(t, c, &aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 1, Payload: payload})
+
+			msg := <-srv.msgs
+			if msg.Sid != 1 || !bytes.Equal(msg.Payload, payload) {
+				t.Error("unexpected msg received by server")
+			}
+
+			st.mu.Lock()
+			if st.compression != name {
+				t.Errorf("msg compressed with %q", st.compression)
+			}
+
+			if st.wireLength >= st.length/10 {
+				t.Errorf("msg not compressed, wire length %d, length %d", st.wireLength, st.length)
+			}
+			st.mu.Unlock()
+
+			// server compresses cmds with the compressor used by the client
+			select {
+			case data := <-cmdCh:
+				cmd := new(aranyagopb.Cmd)
+				if err := cmd.Unmarshal(data); err != nil {
+					t.Fatal(err)
+				}
+
+				if cmd.Sid != 1 || !bytes.Equal(cmd.Payload, payload) {
+					t.Error("unexpected cmd received by client")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("cmd not received")
+			}
+		})
+	}
+}
+
+func TestConfigCompressor(t *testing.T) {
+	for compression, expected := range map[string]string{
+		"":     "",
+		"none": "",
+		"GZIP": compressorGzip,
+		"zstd": compressorZstd,
+	} {
+		name, err := (&Config{Compression: compression}).compressor()
+		if err != nil || name != expected {
+			t.Errorf("unexpected compressor %q for %q: %v", name, compression, err)
+		}
+	}
+
+	if _, err := (&Config{Compression: "lz4"}).compressor(); err == nil {
+		t.Error("unsupported compression accepted")
+	}
+}
@@ -19,9 +19,82 @@ limitations under the License.
 package grpc
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	"arhat.dev/arhat/pkg/client/clientutil"
+	"arhat.dev/arhat/pkg/conf"
 )
 
 type Config struct {
 	clientutil.CommonConfig `json:",inline" yaml:",inline"`
+
+	Keepalive KeepaliveConfig `json:"keepalive" yaml:"keepalive"`
+
+	// Compression of messages sent, one of [none, gzip, zstd], server
+	// should have the same compressor registered
+	Compression string `json:"compression" yaml:"compression"`
+
+	// MaxRecvMsgSize is the max size of message can be received in bytes,
+	// 0 means grpc default (4 MiB)
+	MaxRecvMsgSize int `json:"maxRecvMsgSize" yaml:"maxRecvMsgSize"`
+
+	// BearerTokenFrom sets `authorization: Bearer <token>` for rpc calls,
+	// value is resolved for every rpc call, requires tls
+	BearerTokenFrom conf.ValueFromSpec `json:"bearerTokenFrom" yaml:"bearerTokenFrom"`
+
+	// Metadata to send as headers of rpc calls
+	Metadata map[string]string `json:"metadata" yaml:"metadata"`
+}
+
+// KeepaliveConfig defines http/2 keepalive pings
+type KeepaliveConfig struct {
+	// Time after which a ping is sent when there is no activity,
+	// 0 disables keepalive pings, minimum is 10s
+	Time time.Duration `json:"time" yaml:"time"`
+
+	// Timeout waiting for ping ack before closing the connection
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+
+	// PermitWithoutStream allows pings when there is no active rpc
+	PermitWithoutStream bool `json:"permitWithoutStream" yaml:"permitWithoutStream"`
+}
+
+// compressor returns name of the registered compressor, empty means
+// no compression
+func (c *Config) compressor() (string, error) {
+	switch name := strings.ToLower(c.Compression); name {
+	case "", "none":
+		return "", nil
+	case compressorGzip, compressorZstd:
+		return name, nil
+	default:
+		return "", fmt.Errorf("unsupported compression %q", c.Compression)
+	}
+}
+
+// metadataPairs returns metadata as key value pairs with keys lower cased
+func (c *Config) metadataPairs() ([]string, error) {
+	var kv []string
+	for k, v := range c.Metadata {
+		key := strings.ToLower(k)
+		switch {
+		case key == "":
+			return nil, fmt.Errorf("empty metadata key")
+		case strings.HasPrefix(key, "grpc-"), strings.HasPrefix(key, ":"):
+			return nil, fmt.Errorf("reserved metadata key %q", k)
+		case key == "authorization" && c.hasBearerToken():
+			return nil, fmt.Errorf("metadata authorization conflicts with bearer token")
+		}
+
+		kv = append(kv, key, v)
+	}
+
+	return kv, nil
+}
+
+func (c *Config) hasBearerToken() bool {
+	t := c.BearerTokenFrom
+	return len(t.Exec) != 0 || t.File != "" || t.Text != ""
 }
@@ -0,0 +1,59 @@
+// +build !noclient_grpc
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/credentials"
+
+	"arhat.dev/arhat/pkg/conf"
+)
+
+var _ credentials.PerRPCCredentials = (*bearerToken)(nil)
+
+// bearerToken sets authorization header for rpc calls with token resolved
+// every time, so rotated tokens (e.g. file updated by other program) are
+// picked up when reconnecting
+type bearerToken struct {
+	tokenFrom conf.ValueFromSpec
+}
+
+func (t *bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	token, err := t.tokenFrom.Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bearer token: %w", err)
+	}
+
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return nil, fmt.Errorf("empty bearer token")
+	}
+
+	return map[string]string{
+		"authorization": "Bearer " + token,
+	}, nil
+}
+
+// RequireTransportSecurity returns true to avoid leaking token
+func (t *bearerToken) RequireTransportSecurity() bool {
+	return true
+}
@@ -0,0 +1,167 @@
+// +build !noclient_grpc
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/aranya-proto/aranyagopb/aranyagoconst"
+	"arhat.dev/pkg/tlshelper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"arhat.dev/arhat/pkg/client/clientutil"
+	"arhat.dev/arhat/pkg/conf"
+)
+
+// newServerCert creates a self-signed certificate for 127.0.0.1, returns
+// the certificate and its pem encoded form
+func newServerCert(t *testing.T) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "arhat.test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestClientBearerTokenAndMetadata(t *testing.T) {
+	cert, caPEM := newServerCert(t)
+	srv := newRecordingServer(nil)
+	endpoint := runServer(t, srv, grpc.Creds(credentials.NewServerTLSFromCert(&cert)))
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("foo\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestClientWithConfig(t, func([]byte) {}, &Config{
+		CommonConfig: clientutil.CommonConfig{
+			Endpoint:       endpoint,
+			MaxPayloadSize: aranyagoconst.MaxGRPCDataSize,
+			TLS: tlshelper.TLSConfig{
+				Enabled:    true,
+				CaCertData: caPEM,
+			},
+		},
+		BearerTokenFrom: conf.ValueFromSpec{File: tokenFile},
+		Metadata: map[string]string{
+			"X-Arhat-Node": "test",
+			"region":       "local",
+		},
+	})
+
+	for _, token := range []string{"foo", "bar"} {
+		syncOnce(t, c, &aranyagopb.Msg{Kind: aranyagopb.MSG_STATE})
+
+		md := <-srv.mds
+		if v := md.Get("authorization"); len(v) != 1 || v[0] != "Bearer "+token {
+			t.Errorf("unexpected authorization header %q", v)
+		}
+
+		if v := md.Get("x-arhat-node"); len(v) != 1 || v[0] != "test" {
+			t.Errorf("unexpected metadata x-arhat-node %q", v)
+		}
+
+		if v := md.Get("region"); len(v) != 1 || v[0] != "local" {
+			t.Errorf("unexpected metadata region %q", v)
+		}
+
+		// rotated token is used by the next stream
+		if err := ioutil.WriteFile(tokenFile, []byte("bar"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConfigMetadataPairs(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		config Config
+		ok     bool
+	}{
+		{
+			name:   "valid",
+			config: Config{Metadata: map[string]string{"Authorization": "Basic Zm9v"}},
+			ok:     true,
+		},
+		{
+			name:   "empty key",
+			config: Config{Metadata: map[string]string{"": "foo"}},
+		},
+		{
+			name:   "reserved key",
+			config: Config{Metadata: map[string]string{"grpc-timeout": "1S"}},
+		},
+		{
+			name:   "pseudo header",
+			config: Config{Metadata: map[string]string{":authority": "foo"}},
+		},
+		{
+			name: "authorization with bearer token",
+			config: Config{
+				BearerTokenFrom: conf.ValueFromSpec{Text: "foo"},
+				Metadata:        map[string]string{"Authorization": "Basic Zm9v"},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			kv, err := test.config.metadataPairs()
+			if test.ok {
+				if err != nil || len(kv) != 2 || kv[0] != "authorization" {
+					t.Errorf("unexpected metadata pairs %q: %v", kv, err)
+				}
+			} else if err == nil {
+				t.Errorf("invalid metadata accepted")
+			}
+		})
+	}
+}
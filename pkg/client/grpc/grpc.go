@@ -32,7 +32,10 @@ import (
 	"arhat.dev/pkg/tlshelper"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 
 	"arhat.dev/arhat/pkg/client"
@@ -62,7 +65,9 @@ type Client struct {
 	dialOpts      []grpc.DialOption
 	conn          *grpc.ClientConn
 	client        rpcpb.EdgeDeviceClient
+	metadata      []string
 
+	// syncClientStore holds syncClientRef of the current sync stream
 	syncClientStore *atomic.Value
 
 	mu *sync.RWMutex
@@ -94,6 +99,51 @@ func NewGRPCClient(
 		dialOpts = append(dialOpts, grpc.WithInsecure())
 	}
 
+	if ka := config.Keepalive; ka.Time > 0 {
+		dialOpts = append(dialOpts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                ka.Time,
+			Timeout:             ka.Timeout,
+			PermitWithoutStream: ka.PermitWithoutStream,
+		}))
+	}
+
+	var callOpts []grpc.CallOption
+	compressor, err := config.compressor()
+	if err != nil {
+		return nil, err
+	}
+
+	if compressor != "" {
+		callOpts = append(callOpts, grpc.UseCompressor(compressor))
+	}
+
+	if config.MaxRecvMsgSize > 0 {
+		callOpts = append(callOpts, grpc.MaxCallRecvMsgSize(config.MaxRecvMsgSize))
+	}
+
+	if len(callOpts) != 0 {
+		dialOpts = append(dialOpts, grpc.WithDefaultCallOptions(callOpts...))
+	}
+
+	if config.hasBearerToken() {
+		if tlsConfig == nil {
+			return nil, fmt.Errorf("bearer token requires tls enabled")
+		}
+
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(&bearerToken{
+			tokenFrom: config.BearerTokenFrom,
+		}))
+	}
+
+	md, err := config.metadataPairs()
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+
+	if config.MsgCompression.Enabled() {
+		return nil, fmt.Errorf("msgCompression is not supported by grpc, use compression instead")
+	}
+
 	maxPayloadSize := config.MaxPayloadSize
 	if maxPayloadSize <= 0 {
 		maxPayloadSize = aranyagoconst.MaxGRPCDataSize
@@ -102,13 +152,14 @@ func NewGRPCClient(
 	c := &Client{
 		serverAddress: config.Endpoint,
 		dialOpts:      dialOpts,
+		metadata:      md,
 
 		syncClientStore: new(atomic.Value),
 
 		mu: new(sync.RWMutex),
 	}
 
-	c.BaseClient, err = clientutil.NewBaseClient(ctx, handleCmd, maxPayloadSize)
+	c.BaseClient, err = clientutil.NewBaseClient(ctx, handleCmd, maxPayloadSize, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -131,35 +182,55 @@ func (c *Client) Connect(dialCtx context.Context) error {
 	return nil
 }
 
+// syncClientRef wraps the sync stream so that atomic.Value always stores
+// the same concrete type, the zero value means not connected
+type syncClientRef struct {
+	client rpcpb.EdgeDevice_SyncClient
+}
+
+func (c *Client) syncClient() rpcpb.EdgeDevice_SyncClient {
+	ref, _ := c.syncClientStore.Load().(syncClientRef)
+	return ref.client
+}
+
 func (c *Client) Start(ctx context.Context) error {
 	c.mu.Lock()
 	// check if connected before
-	if prevClient, ok := c.syncClientStore.Load().(rpcpb.EdgeDevice_SyncClient); ok && prevClient != nil {
+	if c.syncClient() != nil {
 		c.mu.Unlock()
 		return clientutil.ErrClientAlreadyConnected
 	}
 
-	syncClient, err := c.client.Sync(ctx, grpc.WaitForReady(true))
+	syncCtx := ctx
+	if len(c.metadata) != 0 {
+		syncCtx = metadata.AppendToOutgoingContext(ctx, c.metadata...)
+	}
+
+	syncClient, err := c.client.Sync(syncCtx, grpc.WaitForReady(true), grpc.ForceCodec(cmdCodec{}))
 	if err != nil {
 		c.mu.Unlock()
+
+		switch status.Code(err) {
+		case codes.Unauthenticated, codes.PermissionDenied:
+			err = fmt.Errorf("%v: %w", err, clientutil.ErrUnrecoverable)
+		}
+
 		return err
 	}
-	c.syncClientStore.Store(syncClient)
+	c.syncClientStore.Store(syncClientRef{client: syncClient})
 	c.mu.Unlock()
 
 	defer func() {
 		c.mu.Lock()
-		c.syncClientStore.Store((*rpcpb.EdgeDevice_SyncClient)(nil))
+		c.syncClientStore.Store(syncClientRef{})
 		c.mu.Unlock()
 	}()
 
 	cmdCh := make(chan []byte, 1)
 	go func() {
-		cmd := new(aranyagopb.Cmd)
 		for {
-			cmd.Reset()
-
-			err := syncClient.RecvMsg(cmd)
+			var cmd rawCmd
+			err := syncClient.RecvMsg(&cmd)
 			if err != nil {
 				close(cmdCh)
 
@@ -177,12 +248,6 @@ func (c *Client) Start(ctx context.Context) error {
 				return
 			}
 
-			data, err := cmd.Marshal()
-			if err != nil {
-				c.Log.I("invalid cmd", log.Error(err))
-				return
-			}
-
 			select {
 			case <-syncClient.Context().Done():
 				// disconnected from cloud controller
@@ -190,7 +255,7 @@ func (c *Client) Start(ctx context.Context) error {
 			case <-ctx.Done():
 				// leaving
 				return
-			case cmdCh <- data:
+			case cmdCh <- cmd:
 			}
 		}
 	}()
@@ -213,21 +278,37 @@ func (c *Client) Start(ctx context.Context) error {
 }
 
 func (c *Client) PostMsg(msg *aranyagopb.Msg) error {
-	client, ok := c.syncClientStore.Load().(rpcpb.EdgeDevice_SyncClient)
-	if !ok || client == nil {
+	client := c.syncClient()
+	if client == nil {
 		return clientutil.ErrClientNotConnected
 	}
 
 	return client.Send(msg)
 }
 
+// Ping waits until the grpc connection is ready or idle (connected on use)
+func (c *Client) Ping(ctx context.Context) error {
+	for {
+		state := c.conn.GetState()
+		switch state {
+		case connectivity.Ready, connectivity.Idle:
+			return nil
+		case connectivity.Shutdown:
+			return clientutil.ErrClientNotConnected
+		}
+
+		if !c.conn.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("grpc connection not ready (%s): %w", state, ctx.Err())
+		}
+	}
+}
+
 func (c *Client) Close() error {
 	return c.OnClose(func() error {
 		c.mu.Lock()
 		defer c.mu.Unlock()
 
-		client, ok := c.syncClientStore.Load().(rpcpb.EdgeDevice_SyncClient)
-		if ok && client == nil {
+		if client := c.syncClient(); client != nil {
 			_ = client.CloseSend()
 		}
 
@@ -0,0 +1,238 @@
+// +build !noclient_grpc
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/aranya-proto/aranyagopb/aranyagoconst"
+	"arhat.dev/aranya-proto/aranyagopb/rpcpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"arhat.dev/arhat/pkg/client/clientutil"
+	"arhat.dev/arhat/pkg/types"
+)
+
+// endingServer ends every sync stream once a msg received
+type endingServer struct {
+	msgs chan *aranyagopb.Msg
+}
+
+func (s *endingServer) Sync(stream rpcpb.EdgeDevice_SyncServer) error {
+	msg, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	s.msgs <- msg
+	return nil
+}
+
+// recordingServer records metadata of every sync stream, sends its cmd and
+// ends the stream once a msg received
+type recordingServer struct {
+	cmd *aranyagopb.Cmd
+
+	mds  chan metadata.MD
+	msgs chan *aranyagopb.Msg
+}
+
+func newRecordingServer(cmd *aranyagopb.Cmd) *recordingServer {
+	return &recordingServer{
+		cmd:  cmd,
+		mds:  make(chan metadata.MD, 2),
+		msgs: make(chan *aranyagopb.Msg, 2),
+	}
+}
+
+func (s *recordingServer) Sync(stream rpcpb.EdgeDevice_SyncServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	s.mds <- md
+
+	if s.cmd != nil {
+		err := stream.Send(s.cmd)
+		if err != nil {
+			return err
+		}
+	}
+
+	msg, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	s.msgs <- msg
+	return nil
+}
+
+func runServer(t *testing.T, srv rpcpb.EdgeDeviceServer, opts ...grpc.ServerOption) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := grpc.NewServer(opts...)
+	rpcpb.RegisterEdgeDeviceServer(s, srv)
+	go func() { _ = s.Serve(l) }()
+	t.Cleanup(s.Stop)
+
+	return l.Addr().String()
+}
+
+func newTestClient(t *testing.T, endpoint string) *Client {
+	return newTestClientWithConfig(t, func([]byte) {}, &Config{
+		CommonConfig: clientutil.CommonConfig{
+			Endpoint:       endpoint,
+			MaxPayloadSize: aranyagoconst.MaxGRPCDataSize,
+		},
+	})
+}
+
+func newTestClientWithConfig(t *testing.T, handleCmd types.AgentCmdHandleFunc, config *Config) *Client {
+	c, err := NewGRPCClient(context.TODO(), handleCmd, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+
+	return c.(*Client)
+}
+
+// syncOnce starts the client and posts msg, returns after the stream ended
+func syncOnce(t *testing.T, c *Client, msg *aranyagopb.Msg) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := c.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Start(ctx)
+	}()
+
+	for c.syncClient() == nil {
+		select {
+		case err = <-done:
+			t.Fatalf("client stopped before stream started: %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	err = c.PostMsg(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatal("client not stopped after stream ended")
+	}
+}
+
+func TestClientRestartAfterStreamEnded(t *testing.T) {
+	srv := &endingServer{msgs: make(chan *aranyagopb.Msg, 1)}
+	c := newTestClient(t, runServer(t, srv))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := c.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		done := make(chan error, 1)
+		go func() {
+			done <- c.Start(ctx)
+		}()
+
+		// stream is available once started
+		for c.syncClient() == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		err = c.PostMsg(&aranyagopb.Msg{Kind: aranyagopb.MSG_STATE, Sid: uint64(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case msg := <-srv.msgs:
+			if msg.Sid != uint64(i) {
+				t.Errorf("unexpected msg %d received", msg.Sid)
+			}
+		case <-ctx.Done():
+			t.Fatal("msg not received")
+		}
+
+		// stream ended by the server
+		select {
+		case err = <-done:
+			if errors.Is(err, clientutil.ErrClientAlreadyConnected) {
+				t.Fatalf("sync stream of previous start not cleared")
+			}
+		case <-ctx.Done():
+			t.Fatal("client not stopped after stream ended")
+		}
+
+		if c.syncClient() != nil {
+			t.Fatal("sync stream not cleared")
+		}
+
+		err = c.PostMsg(&aranyagopb.Msg{Kind: aranyagopb.MSG_STATE})
+		if !errors.Is(err, clientutil.ErrClientNotConnected) {
+			t.Errorf("unexpected error when not connected: %v", err)
+		}
+	}
+}
+
+// closeSendStream records CloseSend calls
+type closeSendStream struct {
+	rpcpb.EdgeDevice_SyncClient
+
+	closed bool
+}
+
+func (s *closeSendStream) CloseSend() error {
+	s.closed = true
+	return nil
+}
+
+func TestClientCloseSend(t *testing.T) {
+	c := newTestClient(t, "127.0.0.1:0")
+
+	stream := &closeSendStream{}
+	c.syncClientStore.Store(syncClientRef{client: stream})
+
+	_ = c.Close()
+	if !stream.closed {
+		t.Error("sync stream not closed on client close")
+	}
+}
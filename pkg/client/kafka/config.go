@@ -0,0 +1,67 @@
+// +build !noclient_kafka
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"time"
+
+	"arhat.dev/arhat/pkg/client/clientutil"
+)
+
+type Config struct {
+	clientutil.CommonConfig `json:",inline" yaml:",inline"`
+
+	// Brokers are bootstrap broker addresses, endpoint is used when empty
+	Brokers []string `json:"brokers" yaml:"brokers"`
+
+	// TopicNamespace used to derive cmd/msg/status topics
+	TopicNamespace string `json:"topicNamespace" yaml:"topicNamespace"`
+
+	// ClientID of the kafka client, also used as device id in state messages
+	ClientID string `json:"clientID" yaml:"clientID"`
+
+	// ConsumerGroup to join and commit consumed offsets of the cmd topic,
+	// if empty, only new cmds are consumed after connected
+	ConsumerGroup string `json:"consumerGroup" yaml:"consumerGroup"`
+
+	// SessionTimeout of the consumer group membership, heartbeats are sent
+	// every third of it
+	SessionTimeout time.Duration `json:"sessionTimeout" yaml:"sessionTimeout"`
+
+	// PartitionKey is the key of published records, defaults to ClientID
+	PartitionKey string `json:"partitionKey" yaml:"partitionKey"`
+
+	// FetchMaxWait is the max time for the broker to wait for new cmds
+	FetchMaxWait time.Duration `json:"fetchMaxWait" yaml:"fetchMaxWait"`
+
+	// RequestTimeout of a single request to the broker
+	RequestTimeout time.Duration `json:"requestTimeout" yaml:"requestTimeout"`
+
+	SASL SASLConfig `json:"sasl" yaml:"sasl"`
+}
+
+type SASLConfig struct {
+	// Mechanism of sasl authentication, sasl is disabled when empty
+	//
+	// one of [PLAIN, SCRAM-SHA-256, SCRAM-SHA-512]
+	Mechanism string `json:"mechanism" yaml:"mechanism"`
+
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"password" yaml:"password"`
+}
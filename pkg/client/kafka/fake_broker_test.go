@@ -0,0 +1,948 @@
+// +build !noclient_kafka
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/apiversions"
+	"github.com/segmentio/kafka-go/protocol/consumer"
+	"github.com/segmentio/kafka-go/protocol/fetch"
+	"github.com/segmentio/kafka-go/protocol/findcoordinator"
+	"github.com/segmentio/kafka-go/protocol/heartbeat"
+	"github.com/segmentio/kafka-go/protocol/joingroup"
+	"github.com/segmentio/kafka-go/protocol/leavegroup"
+	"github.com/segmentio/kafka-go/protocol/listoffsets"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/offsetcommit"
+	"github.com/segmentio/kafka-go/protocol/offsetfetch"
+	"github.com/segmentio/kafka-go/protocol/produce"
+	"github.com/segmentio/kafka-go/protocol/syncgroup"
+)
+
+const (
+	fakeBrokerHost = "kafka"
+	fakeBrokerPort = 9092
+
+	// fakeFetchVersion is the only fetch api version supported, it is the
+	// version preferred by kafka-go
+	fakeFetchVersion = 10
+
+	rangeAssignor = "range"
+)
+
+// fakeBrokerAPIs are apis implemented by the fake broker, versions
+// supported are those supported by the protocol package
+var fakeBrokerAPIs = []protocol.ApiKey{
+	protocol.Produce,
+	protocol.Fetch,
+	protocol.ListOffsets,
+	protocol.Metadata,
+	protocol.OffsetCommit,
+	protocol.OffsetFetch,
+	protocol.FindCoordinator,
+	protocol.JoinGroup,
+	protocol.Heartbeat,
+	protocol.LeaveGroup,
+	protocol.SyncGroup,
+	protocol.ApiVersions,
+}
+
+// fakeBroker is an in-process kafka broker implementing apis used by
+// kafka-go, requests and responses are encoded with the protocol package of
+// kafka-go, it is the only node of the cluster, so it's both the partition
+// leader and the group coordinator
+type fakeBroker struct {
+	t *testing.T
+
+	mu   *sync.Mutex
+	cond *sync.Cond
+
+	// partitions is the partition count of topics created on first use,
+	// defaults to 1
+	partitions map[string]int
+	topics     map[string][]*fakePartition
+	groups     map[string]*fakeGroup
+	memberSeq  int
+
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// fakePartition stores records, offset of a record is its index
+type fakePartition struct {
+	records []fakeRecord
+}
+
+type fakeRecord struct {
+	time  time.Time
+	key   []byte
+	value []byte
+}
+
+type fakeGroup struct {
+	generation int32
+	leader     string
+	// members of current generation with their metadata
+	members map[string][]byte
+
+	// rebalancing is true when waiting for members to (re)join
+	rebalancing bool
+	joining     map[string][]byte
+	deadline    time.Time
+	// round increases every time a rebalance finished
+	round int
+
+	// assignments sent by the leader of current generation
+	assignments map[string][]byte
+
+	offsets map[string]map[int32]int64
+	commits []fakeCommit
+}
+
+type fakeCommit struct {
+	generation int32
+	memberID   string
+	partition  int32
+	offset     int64
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	b := &fakeBroker{
+		t:  t,
+		mu: new(sync.Mutex),
+
+		partitions: make(map[string]int),
+		topics:     make(map[string][]*fakePartition),
+		groups:     make(map[string]*fakeGroup),
+		conns:      make(map[net.Conn]struct{}),
+	}
+	b.cond = sync.NewCond(b.mu)
+
+	t.Cleanup(b.close)
+
+	return b
+}
+
+// dial is used as Client.dial, every call creates a new in-memory connection
+func (b *fakeBroker) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if addr != fmt.Sprintf("%s:%d", fakeBrokerHost, fakeBrokerPort) {
+		return nil, fmt.Errorf("unknown broker %q", addr)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, fmt.Errorf("broker closed")
+	}
+
+	client, server := net.Pipe()
+	b.conns[server] = struct{}{}
+	go b.serve(server)
+
+	return client, nil
+}
+
+func (b *fakeBroker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for conn := range b.conns {
+		_ = conn.Close()
+	}
+
+	b.cond.Broadcast()
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer func() {
+		b.mu.Lock()
+		delete(b.conns, conn)
+		b.mu.Unlock()
+
+		_ = conn.Close()
+	}()
+
+	for {
+		version, correlationID, _, req, err := protocol.ReadRequest(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				b.t.Errorf("invalid request: %v", err)
+			}
+
+			return
+		}
+
+		if r, ok := req.(*fetch.Request); ok {
+			err = b.writeFetchResponse(conn, version, correlationID, r)
+		} else {
+			var resp protocol.Message
+			resp, err = b.handle(req)
+			if err != nil {
+				b.t.Errorf("failed to handle %s request: %v", req.ApiKey(), err)
+				return
+			}
+
+			err = protocol.WriteResponse(conn, version, correlationID, resp)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handle the request and returns the response
+func (b *fakeBroker) handle(req protocol.Message) (protocol.Message, error) {
+	switch r := req.(type) {
+	case *apiversions.Request:
+		resp := new(apiversions.Response)
+		for _, k := range fakeBrokerAPIs {
+			resp.ApiKeys = append(resp.ApiKeys, apiversions.ApiKeyResponse{
+				ApiKey:     int16(k),
+				MinVersion: k.MinVersion(),
+				MaxVersion: k.MaxVersion(),
+			})
+		}
+
+		return resp, nil
+	case *metadata.Request:
+		return b.handleMetadata(r), nil
+	case *produce.Request:
+		return b.handleProduce(r)
+	case *listoffsets.Request:
+		return b.handleListOffsets(r), nil
+	case *findcoordinator.Request:
+		return &findcoordinator.Response{
+			NodeID: 0,
+			Host:   fakeBrokerHost,
+			Port:   fakeBrokerPort,
+		}, nil
+	case *offsetfetch.Request:
+		return b.handleOffsetFetch(r), nil
+	case *offsetcommit.Request:
+		return b.handleOffsetCommit(r), nil
+	case *joingroup.Request:
+		return b.handleJoinGroup(r), nil
+	case *syncgroup.Request:
+		return b.handleSyncGroup(r), nil
+	case *heartbeat.Request:
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		return &heartbeat.Response{
+			ErrorCode: b.group(r.GroupID).memberError(r.GenerationID, r.MemberID),
+		}, nil
+	case *leavegroup.Request:
+		return b.handleLeaveGroup(r), nil
+	default:
+		return nil, fmt.Errorf("unsupported api")
+	}
+}
+
+// topic returns partitions of the topic, b.mu MUST be held
+func (b *fakeBroker) topic(name string) []*fakePartition {
+	partitions, ok := b.topics[name]
+	if ok {
+		return partitions
+	}
+
+	n := b.partitions[name]
+	if n <= 0 {
+		n = 1
+	}
+
+	for i := 0; i < n; i++ {
+		partitions = append(partitions, new(fakePartition))
+	}
+
+	b.topics[name] = partitions
+	return partitions
+}
+
+// createTopics creates topics if not exist
+func (b *fakeBroker) createTopics(names ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, name := range names {
+		_ = b.topic(name)
+	}
+}
+
+// group returns the consumer group, b.mu MUST be held
+func (b *fakeBroker) group(name string) *fakeGroup {
+	g, ok := b.groups[name]
+	if !ok {
+		g = &fakeGroup{
+			members: make(map[string][]byte),
+			offsets: make(map[string]map[int32]int64),
+		}
+		b.groups[name] = g
+	}
+
+	return g
+}
+
+// appendRecords appends records to the partition and returns the offset of
+// the first record, b.mu MUST be held
+func (b *fakeBroker) appendRecords(topic string, partition int32, records ...fakeRecord) int64 {
+	p := b.topic(topic)[partition]
+
+	base := int64(len(p.records))
+	p.records = append(p.records, records...)
+
+	b.cond.Broadcast()
+	return base
+}
+
+// produce a single record with value to the partition of the topic
+func (b *fakeBroker) produce(topic string, partition int32, value []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.appendRecords(topic, partition, fakeRecord{time: time.Now(), value: value})
+}
+
+// values returns all record values in the topic
+func (b *fakeBroker) values(topic string) [][]byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var ret [][]byte
+	for _, p := range b.topic(topic) {
+		for _, r := range p.records {
+			ret = append(ret, r.value)
+		}
+	}
+
+	return ret
+}
+
+// committed returns the committed offset of the partition, -1 if not
+// committed
+func (b *fakeBroker) committed(group, topic string, partition int32) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	offset, ok := b.group(group).offsets[topic][partition]
+	if !ok {
+		return -1
+	}
+
+	return offset
+}
+
+// assigned returns partitions of the topic assigned to members of current
+// generation of the group
+func (b *fakeBroker) assigned(group, topic string) map[string][]int32 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	g := b.group(group)
+	if g.rebalancing || g.assignments == nil {
+		return nil
+	}
+
+	ret := make(map[string][]int32)
+	for id, data := range g.assignments {
+		a := new(consumer.Assignment)
+		err := protocol.Unmarshal(data, consumer.MaxVersionSupported, a)
+		if err != nil {
+			b.t.Errorf("invalid assignment: %v", err)
+		}
+
+		ret[id] = nil
+		for _, tp := range a.AssignedPartitions {
+			if tp.Topic == topic {
+				ret[id] = append(ret[id], tp.Partitions...)
+			}
+		}
+	}
+
+	return ret
+}
+
+func (b *fakeBroker) handleMetadata(req *metadata.Request) *metadata.Response {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	topics := req.TopicNames
+	if topics == nil {
+		// all topics
+		for name := range b.topics {
+			topics = append(topics, name)
+		}
+		sort.Strings(topics)
+	}
+
+	resp := &metadata.Response{
+		Brokers: []metadata.ResponseBroker{{
+			NodeID: 0,
+			Host:   fakeBrokerHost,
+			Port:   fakeBrokerPort,
+		}},
+		ControllerID: 0,
+	}
+
+	for _, name := range topics {
+		t := metadata.ResponseTopic{Name: name}
+		for i := range b.topic(name) {
+			t.Partitions = append(t.Partitions, metadata.ResponsePartition{
+				PartitionIndex: int32(i),
+				LeaderID:       0,
+				ReplicaNodes:   []int32{0},
+				IsrNodes:       []int32{0},
+			})
+		}
+
+		resp.Topics = append(resp.Topics, t)
+	}
+
+	return resp
+}
+
+func (b *fakeBroker) handleProduce(req *produce.Request) (*produce.Response, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	resp := new(produce.Response)
+	for _, t := range req.Topics {
+		rt := produce.ResponseTopic{Topic: t.Topic}
+		for _, p := range t.Partitions {
+			rp := produce.ResponsePartition{
+				Partition:     p.Partition,
+				BaseOffset:    -1,
+				LogAppendTime: -1,
+			}
+
+			if p.Partition < 0 || int(p.Partition) >= len(b.topic(t.Topic)) {
+				rp.ErrorCode = int16(kafka.UnknownTopicOrPartition)
+				rt.Partitions = append(rt.Partitions, rp)
+				continue
+			}
+
+			var records []fakeRecord
+			for {
+				r, err := p.RecordSet.Records.ReadRecord()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+
+				if err != nil {
+					return nil, err
+				}
+
+				record := fakeRecord{time: r.Time}
+				if record.key, err = readBytes(r.Key); err != nil {
+					return nil, err
+				}
+
+				if record.value, err = readBytes(r.Value); err != nil {
+					return nil, err
+				}
+
+				records = append(records, record)
+			}
+
+			rp.BaseOffset = b.appendRecords(t.Topic, p.Partition, records...)
+			rt.Partitions = append(rt.Partitions, rp)
+		}
+
+		resp.Topics = append(resp.Topics, rt)
+	}
+
+	return resp, nil
+}
+
+func readBytes(data protocol.Bytes) ([]byte, error) {
+	if data == nil {
+		return nil, nil
+	}
+
+	return protocol.ReadAll(data)
+}
+
+// fakeFetchResponse is fetch.Response with raw record batches, records
+// encoded by protocol.RecordSet always start from offset 0 and an empty
+// record set can not be encoded, so it is not suitable for fetch responses
+type fakeFetchResponse struct {
+	ThrottleTimeMs int32                    `kafka:"min=v10,max=v10"`
+	ErrorCode      int16                    `kafka:"min=v10,max=v10"`
+	SessionID      int32                    `kafka:"min=v10,max=v10"`
+	Topics         []fakeFetchResponseTopic `kafka:"min=v10,max=v10"`
+}
+
+type fakeFetchResponseTopic struct {
+	Topic      string                       `kafka:"min=v10,max=v10"`
+	Partitions []fakeFetchResponsePartition `kafka:"min=v10,max=v10"`
+}
+
+type fakeFetchResponsePartition struct {
+	Partition           int32                       `kafka:"min=v10,max=v10"`
+	ErrorCode           int16                       `kafka:"min=v10,max=v10"`
+	HighWatermark       int64                       `kafka:"min=v10,max=v10"`
+	LastStableOffset    int64                       `kafka:"min=v10,max=v10"`
+	LogStartOffset      int64                       `kafka:"min=v10,max=v10"`
+	AbortedTransactions []fetch.ResponseTransaction `kafka:"min=v10,max=v10"`
+	Records             []byte                      `kafka:"min=v10,max=v10"`
+}
+
+func (b *fakeBroker) writeFetchResponse(
+	w io.Writer, version int16, correlationID int32, req *fetch.Request,
+) error {
+	if version != fakeFetchVersion {
+		b.t.Errorf("unsupported fetch version %d", version)
+		return fmt.Errorf("unsupported fetch version")
+	}
+
+	resp, err := b.handleFetch(req)
+	if err != nil {
+		b.t.Errorf("failed to handle fetch request: %v", err)
+		return err
+	}
+
+	body, err := protocol.Marshal(version, *resp)
+	if err != nil {
+		b.t.Errorf("failed to encode fetch response: %v", err)
+		return err
+	}
+
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(len(body)+4))
+	binary.BigEndian.PutUint32(header[4:], uint32(correlationID))
+
+	_, err = w.Write(append(header, body...))
+	return err
+}
+
+func (b *fakeBroker) handleFetch(req *fetch.Request) (*fakeFetchResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// long polling until any record available
+	maxWait := time.Duration(req.MaxWaitTime) * time.Millisecond
+	deadline := time.Now().Add(maxWait)
+	timer := time.AfterFunc(maxWait, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		b.cond.Broadcast()
+	})
+	defer timer.Stop()
+
+	hasData := func() bool {
+		for _, t := range req.Topics {
+			partitions := b.topic(t.Topic)
+			for _, p := range t.Partitions {
+				if int(p.Partition) < len(partitions) &&
+					int64(len(partitions[p.Partition].records)) > p.FetchOffset {
+					return true
+				}
+			}
+		}
+
+		return false
+	}
+
+	for !b.closed && !hasData() && time.Now().Before(deadline) {
+		b.cond.Wait()
+	}
+
+	resp := new(fakeFetchResponse)
+	for _, t := range req.Topics {
+		rt := fakeFetchResponseTopic{Topic: t.Topic}
+		partitions := b.topic(t.Topic)
+		for _, p := range t.Partitions {
+			rp := fakeFetchResponsePartition{
+				Partition:        p.Partition,
+				HighWatermark:    -1,
+				LastStableOffset: -1,
+				Records:          []byte{},
+			}
+
+			switch {
+			case int(p.Partition) >= len(partitions):
+				rp.ErrorCode = int16(kafka.UnknownTopicOrPartition)
+			case p.FetchOffset < 0 || p.FetchOffset > int64(len(partitions[p.Partition].records)):
+				rp.ErrorCode = int16(kafka.OffsetOutOfRange)
+			default:
+				records := partitions[p.Partition].records
+				rp.HighWatermark = int64(len(records))
+				rp.LastStableOffset = rp.HighWatermark
+
+				var err error
+				rp.Records, err = encodeRecordBatch(p.FetchOffset, records[p.FetchOffset:])
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			rt.Partitions = append(rt.Partitions, rp)
+		}
+
+		resp.Topics = append(resp.Topics, rt)
+	}
+
+	return resp, nil
+}
+
+// encodeRecordBatch encodes records as a single record batch starting at
+// the base offset
+func encodeRecordBatch(base int64, records []fakeRecord) ([]byte, error) {
+	if len(records) == 0 {
+		return []byte{}, nil
+	}
+
+	var rs []protocol.Record
+	for _, r := range records {
+		rs = append(rs, protocol.Record{
+			Time:  r.time,
+			Key:   protocol.NewBytes(r.key),
+			Value: protocol.NewBytes(r.value),
+		})
+	}
+
+	buf := new(bytes.Buffer)
+	_, err := (&protocol.RecordSet{
+		Version: 2,
+		Records: protocol.NewRecordReader(rs...),
+	}).WriteTo(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	// skip size of the record set, base offset is not covered by crc
+	data := buf.Bytes()[4:]
+	binary.BigEndian.PutUint64(data, uint64(base))
+
+	return data, nil
+}
+
+func (b *fakeBroker) handleListOffsets(req *listoffsets.Request) *listoffsets.Response {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	resp := new(listoffsets.Response)
+	for _, t := range req.Topics {
+		rt := listoffsets.ResponseTopic{Topic: t.Topic}
+		for _, p := range t.Partitions {
+			rp := listoffsets.ResponsePartition{
+				Partition: p.Partition,
+				Timestamp: -1,
+			}
+
+			switch p.Timestamp {
+			case kafka.FirstOffset:
+				rp.Offset = 0
+			default:
+				rp.Offset = int64(len(b.topic(t.Topic)[p.Partition].records))
+			}
+
+			rt.Partitions = append(rt.Partitions, rp)
+		}
+
+		resp.Topics = append(resp.Topics, rt)
+	}
+
+	return resp
+}
+
+func (b *fakeBroker) handleOffsetFetch(req *offsetfetch.Request) *offsetfetch.Response {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	g := b.group(req.GroupID)
+
+	resp := new(offsetfetch.Response)
+	for _, t := range req.Topics {
+		rt := offsetfetch.ResponseTopic{Name: t.Name}
+		for _, p := range t.PartitionIndexes {
+			offset, ok := g.offsets[t.Name][p]
+			if !ok {
+				offset = -1
+			}
+
+			rt.Partitions = append(rt.Partitions, offsetfetch.ResponsePartition{
+				PartitionIndex:  p,
+				CommittedOffset: offset,
+			})
+		}
+
+		resp.Topics = append(resp.Topics, rt)
+	}
+
+	return resp
+}
+
+// memberError checks generation and membership, b.mu MUST be held
+func (g *fakeGroup) memberError(generation int32, memberID string) int16 {
+	_, isMember := g.members[memberID]
+	_, isJoining := g.joining[memberID]
+
+	switch {
+	case !isMember && !isJoining:
+		return int16(kafka.UnknownMemberId)
+	case g.rebalancing:
+		return int16(kafka.RebalanceInProgress)
+	case generation != g.generation:
+		return int16(kafka.IllegalGeneration)
+	}
+
+	return 0
+}
+
+func (b *fakeBroker) handleOffsetCommit(req *offsetcommit.Request) *offsetcommit.Response {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	g := b.group(req.GroupID)
+
+	var code int16
+	if req.GenerationID >= 0 || req.MemberID != "" {
+		code = g.memberError(req.GenerationID, req.MemberID)
+	}
+
+	resp := new(offsetcommit.Response)
+	for _, t := range req.Topics {
+		rt := offsetcommit.ResponseTopic{Name: t.Name}
+		for _, p := range t.Partitions {
+			rt.Partitions = append(rt.Partitions, offsetcommit.ResponsePartition{
+				PartitionIndex: p.PartitionIndex,
+				ErrorCode:      code,
+			})
+
+			if code != 0 {
+				continue
+			}
+
+			if g.offsets[t.Name] == nil {
+				g.offsets[t.Name] = make(map[int32]int64)
+			}
+
+			g.offsets[t.Name][p.PartitionIndex] = p.CommittedOffset
+			g.commits = append(g.commits, fakeCommit{
+				generation: req.GenerationID,
+				memberID:   req.MemberID,
+				partition:  p.PartitionIndex,
+				offset:     p.CommittedOffset,
+			})
+		}
+
+		resp.Topics = append(resp.Topics, rt)
+	}
+
+	return resp
+}
+
+// startRebalance waits for all members to rejoin, b.mu MUST be held
+func (b *fakeBroker) startRebalance(g *fakeGroup, timeout time.Duration) {
+	if g.rebalancing {
+		return
+	}
+
+	g.rebalancing = true
+	g.joining = make(map[string][]byte)
+	g.assignments = nil
+	g.deadline = time.Now().Add(timeout)
+
+	time.AfterFunc(timeout, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		b.cond.Broadcast()
+	})
+
+	b.cond.Broadcast()
+}
+
+// finishRebalance completes the rebalance if all members rejoined or
+// timed out, b.mu MUST be held
+func (b *fakeBroker) finishRebalance(g *fakeGroup) {
+	if !g.rebalancing {
+		return
+	}
+
+	if time.Now().Before(g.deadline) {
+		for id := range g.members {
+			if _, ok := g.joining[id]; !ok {
+				return
+			}
+		}
+	}
+
+	// members not rejoined are removed
+	g.members = g.joining
+	g.joining = nil
+	g.rebalancing = false
+	g.generation++
+	g.round++
+
+	var ids []string
+	for id := range g.members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	g.leader = ""
+	if len(ids) != 0 {
+		g.leader = ids[0]
+	}
+
+	b.cond.Broadcast()
+}
+
+func (b *fakeBroker) handleJoinGroup(req *joingroup.Request) *joingroup.Response {
+	var metadata []byte
+	for _, p := range req.Protocols {
+		if p.Name == rangeAssignor {
+			metadata = p.Metadata
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	g := b.group(req.GroupID)
+
+	memberID := req.MemberID
+	errorResponse := func(code kafka.Error) *joingroup.Response {
+		return &joingroup.Response{
+			ErrorCode:    int16(code),
+			GenerationID: -1,
+			MemberID:     memberID,
+		}
+	}
+
+	if metadata == nil {
+		return errorResponse(kafka.InconsistentGroupProtocol)
+	}
+
+	if memberID == "" {
+		b.memberSeq++
+		memberID = fmt.Sprintf("member-%d", b.memberSeq)
+	} else if _, ok := g.members[memberID]; !ok {
+		return errorResponse(kafka.UnknownMemberId)
+	}
+
+	b.startRebalance(g, time.Duration(req.RebalanceTimeoutMS)*time.Millisecond)
+	round := g.round
+	g.joining[memberID] = metadata
+
+	for !b.closed && g.round == round {
+		b.finishRebalance(g)
+		if g.round != round {
+			break
+		}
+
+		b.cond.Wait()
+	}
+
+	if _, ok := g.members[memberID]; !ok {
+		return errorResponse(kafka.UnknownMemberId)
+	}
+
+	resp := &joingroup.Response{
+		GenerationID: g.generation,
+		ProtocolName: rangeAssignor,
+		LeaderID:     g.leader,
+		MemberID:     memberID,
+	}
+
+	if memberID != g.leader {
+		return resp
+	}
+
+	var ids []string
+	for id := range g.members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		resp.Members = append(resp.Members, joingroup.ResponseMember{
+			MemberID: id,
+			Metadata: g.members[id],
+		})
+	}
+
+	return resp
+}
+
+func (b *fakeBroker) handleSyncGroup(req *syncgroup.Request) *syncgroup.Response {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	g := b.group(req.GroupID)
+	if code := g.memberError(req.GenerationID, req.MemberID); code != 0 {
+		return &syncgroup.Response{ErrorCode: code}
+	}
+
+	if req.MemberID == g.leader {
+		g.assignments = make(map[string][]byte)
+		for _, a := range req.Assignments {
+			g.assignments[a.MemberID] = a.Assignment
+		}
+
+		b.cond.Broadcast()
+	}
+
+	for !b.closed && g.assignments == nil && !g.rebalancing && g.generation == req.GenerationID {
+		b.cond.Wait()
+	}
+
+	if code := g.memberError(req.GenerationID, req.MemberID); code != 0 {
+		return &syncgroup.Response{ErrorCode: code}
+	}
+
+	return &syncgroup.Response{Assignments: g.assignments[req.MemberID]}
+}
+
+func (b *fakeBroker) handleLeaveGroup(req *leavegroup.Request) *leavegroup.Response {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	g := b.group(req.GroupID)
+	if _, ok := g.members[req.MemberID]; !ok {
+		return &leavegroup.Response{ErrorCode: int16(kafka.UnknownMemberId)}
+	}
+
+	delete(g.members, req.MemberID)
+	if len(g.members) != 0 {
+		b.startRebalance(g, 10*time.Second)
+	} else {
+		g.assignments = nil
+	}
+
+	return new(leavegroup.Response)
+}
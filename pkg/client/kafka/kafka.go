@@ -0,0 +1,683 @@
+// +build !noclient_kafka
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/aranya-proto/aranyagopb/aranyagoconst"
+	"arhat.dev/pkg/log"
+	"github.com/segmentio/kafka-go"
+
+	"arhat.dev/arhat/pkg/client"
+	"arhat.dev/arhat/pkg/client/clientutil"
+	"arhat.dev/arhat/pkg/types"
+)
+
+const (
+	defaultFetchMaxWait   = 500 * time.Millisecond
+	defaultRequestTimeout = 30 * time.Second
+	defaultSessionTimeout = 10 * time.Second
+
+	// fetchMaxBytes is the max size of fetched records of a partition
+	fetchMaxBytes = 4 * 1024 * 1024
+)
+
+func init() {
+	client.Register("kafka",
+		func() interface{} {
+			return &Config{
+				CommonConfig: clientutil.CommonConfig{
+					// kafka defaults to 1MB max record batch size, leave
+					// room for record batch overhead
+					MaxPayloadSize: 1000 * 1024,
+				},
+				FetchMaxWait:   defaultFetchMaxWait,
+				RequestTimeout: defaultRequestTimeout,
+				SessionTimeout: defaultSessionTimeout,
+			}
+		},
+		NewClient,
+	)
+}
+
+func NewClient(
+	ctx context.Context,
+	handleCmd types.AgentCmdHandleFunc,
+	cfg interface{},
+) (client.Interface, error) {
+	config, ok := cfg.(*Config)
+	if !ok {
+		return nil, fmt.Errorf("unexpected non kafka config")
+	}
+
+	brokers := config.Brokers
+	if len(brokers) == 0 && config.Endpoint != "" {
+		brokers = []string{config.Endpoint}
+	}
+
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("invalid empty kafka brokers")
+	}
+
+	if config.TopicNamespace == "" {
+		return nil, fmt.Errorf("invalid empty topic namespace")
+	}
+
+	if config.ClientID == "" {
+		return nil, fmt.Errorf("invalid empty client id")
+	}
+
+	mechanism, err := newSASLMechanism(&config.SASL)
+	if err != nil {
+		return nil, err
+	}
+
+	baseClient, err := clientutil.NewBaseClient(ctx, handleCmd, config.MaxPayloadSize, &config.MsgCompression)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create base client: %w", err)
+	}
+
+	tlsConfig, err := config.TLS.GetTLSConfig(false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tls config: %w", err)
+	}
+
+	partitionKey := config.PartitionKey
+	if partitionKey == "" {
+		partitionKey = config.ClientID
+	}
+
+	fetchMaxWait := config.FetchMaxWait
+	if fetchMaxWait <= 0 {
+		fetchMaxWait = defaultFetchMaxWait
+	}
+
+	requestTimeout := config.RequestTimeout
+	if requestTimeout <= 0 {
+		requestTimeout = defaultRequestTimeout
+	}
+
+	sessionTimeout := config.SessionTimeout
+	if sessionTimeout <= 0 {
+		sessionTimeout = defaultSessionTimeout
+	}
+
+	c := &Client{
+		BaseClient: baseClient,
+
+		brokers:        brokers,
+		groupID:        config.ConsumerGroup,
+		partitionKey:   []byte(partitionKey),
+		fetchMaxWait:   fetchMaxWait,
+		requestTimeout: requestTimeout,
+		sessionTimeout: sessionTimeout,
+
+		dial: new(net.Dialer).DialContext,
+
+		offlineOnce: new(sync.Once),
+
+		mu: new(sync.Mutex),
+	}
+
+	c.logger = kafka.LoggerFunc(func(format string, args ...interface{}) {
+		c.Log.D(fmt.Sprintf(format, args...))
+	})
+	c.errorLogger = kafka.LoggerFunc(func(format string, args ...interface{}) {
+		c.Log.I(fmt.Sprintf(format, args...))
+	})
+
+	// connections are created by c.dial instead of the dialer itself, so it
+	// can be replaced to work with an in-process kafka protocol
+	// implementation
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return c.dial(ctx, network, addr)
+	}
+
+	c.dialer = &kafka.Dialer{
+		ClientID:      config.ClientID,
+		Timeout:       requestTimeout,
+		DialFunc:      dial,
+		TLS:           tlsConfig,
+		SASLMechanism: mechanism,
+	}
+
+	c.transport = &kafka.Transport{
+		Dial:        dial,
+		DialTimeout: requestTimeout,
+		ClientID:    config.ClientID,
+		TLS:         tlsConfig,
+		SASL:        mechanism,
+	}
+
+	c.client = &kafka.Client{
+		Addr:      kafka.TCP(brokers...),
+		Timeout:   requestTimeout,
+		Transport: c.transport,
+	}
+
+	c.writer = &kafka.Writer{
+		Addr:      kafka.TCP(brokers...),
+		Balancer:  new(kafka.Murmur2Balancer),
+		Transport: c.transport,
+
+		// publish every message as a single record synchronously
+		BatchSize:    1,
+		RequiredAcks: kafka.RequireAll,
+		// retry once with fresh metadata if partition leader changed
+		MaxAttempts:  2,
+		WriteTimeout: requestTimeout,
+		ReadTimeout:  requestTimeout,
+
+		Logger:      c.logger,
+		ErrorLogger: c.errorLogger,
+	}
+
+	c.onlineMsgBytes, c.offlineMsgBytes = clientutil.CreateOnlineOfflineMessage(config.ClientID)
+
+	c.cmdTopic, c.msgTopic, c.statusTopic = aranyagoconst.AMQPTopics(config.TopicNamespace)
+
+	return c, nil
+}
+
+type Client struct {
+	*clientutil.BaseClient
+
+	onlineMsgBytes  []byte
+	offlineMsgBytes []byte
+	offlineOnce     *sync.Once
+
+	cmdTopic    string
+	msgTopic    string
+	statusTopic string
+
+	brokers        []string
+	groupID        string
+	partitionKey   []byte
+	fetchMaxWait   time.Duration
+	requestTimeout time.Duration
+	sessionTimeout time.Duration
+
+	// dial creates connections to brokers, can be replaced to work with an
+	// in-process kafka protocol implementation
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	logger      kafka.Logger
+	errorLogger kafka.Logger
+
+	// dialer is used by consumers, which talk to brokers with long lived
+	// connections
+	dialer *kafka.Dialer
+	// transport is shared by the writer and the client
+	transport *kafka.Transport
+	client    *kafka.Client
+	writer    *kafka.Writer
+
+	mu *sync.Mutex
+	// partitions of the cmd topic, set when connected
+	cmdPartitions []int
+	// group is the consumer group joined in Start
+	group *kafka.ConsumerGroup
+}
+
+func (c *Client) Connect(dialCtx context.Context) error {
+	var errs []string
+	for _, addr := range c.brokers {
+		partitions, err := c.cmdTopicPartitions(dialCtx, addr)
+		if err != nil {
+			if errors.Is(err, clientutil.ErrUnrecoverable) {
+				return err
+			}
+
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		c.mu.Lock()
+		c.cmdPartitions = partitions
+		c.mu.Unlock()
+
+		return nil
+	}
+
+	return fmt.Errorf("failed to connect kafka brokers: %s", strings.Join(errs, "; "))
+}
+
+// cmdTopicPartitions checks topics used by this client are available with
+// cluster metadata fetched from the broker, and returns partitions of the
+// cmd topic
+func (c *Client) cmdTopicPartitions(ctx context.Context, addr string) ([]int, error) {
+	topics := []string{c.cmdTopic, c.msgTopic, c.statusTopic}
+	md, err := c.client.Metadata(ctx, &kafka.MetadataRequest{
+		Addr:   kafka.TCP(addr),
+		Topics: topics,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch metadata from kafka broker %q: %w", addr, unrecoverable(err))
+	}
+
+	partitions := make(map[string][]int)
+	for _, t := range md.Topics {
+		if t.Error != nil {
+			return nil, fmt.Errorf("failed to get metadata of topic %q: %w", t.Name, unrecoverable(t.Error))
+		}
+
+		for _, p := range t.Partitions {
+			partitions[t.Name] = append(partitions[t.Name], p.ID)
+		}
+	}
+
+	for _, t := range topics {
+		if len(partitions[t]) == 0 {
+			return nil, fmt.Errorf("no partition available for topic %q", t)
+		}
+	}
+
+	return partitions[c.cmdTopic], nil
+}
+
+func (c *Client) Start(appCtx context.Context) error {
+	ctx, cancel := context.WithCancel(c.Context())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-appCtx.Done():
+			cancel()
+		}
+	}()
+
+	// join consumer group in Start instead of Connect, so a standby client
+	// does not take partitions from the active one
+	gen, offsets, err := c.assignOffsets(ctx)
+	if err != nil {
+		return err
+	}
+
+	// publish online message
+	err = c.publish(c.statusTopic, c.onlineMsgBytes)
+	if err != nil {
+		return fmt.Errorf("failed to publish initial online message: %w", err)
+	}
+
+	defer func() {
+		c.publishOffline()
+		c.leaveGroup()
+	}()
+
+	for {
+		rejoin, err := c.consumeAssigned(ctx, gen, offsets)
+		if err != nil || !rejoin {
+			return err
+		}
+
+		c.Log.I("consumer group rebalancing, rejoining")
+		gen, offsets, err = c.nextGeneration(ctx)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// assignOffsets joins the consumer group (if set) and returns offsets of
+// assigned partitions to start consuming, all partitions are consumed from
+// the latest offsets if consumer group is not set
+func (c *Client) assignOffsets(ctx context.Context) (*kafka.Generation, map[int]int64, error) {
+	c.mu.Lock()
+	partitions := c.cmdPartitions
+	c.mu.Unlock()
+
+	if partitions == nil {
+		return nil, nil, clientutil.ErrClientNotConnected
+	}
+
+	if c.groupID == "" {
+		offsets := make(map[int]int64)
+		for _, p := range partitions {
+			offsets[p] = kafka.LastOffset
+		}
+
+		err := c.resolveLatestOffsets(ctx, offsets)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return nil, offsets, nil
+	}
+
+	group, err := kafka.NewConsumerGroup(kafka.ConsumerGroupConfig{
+		ID:      c.groupID,
+		Brokers: c.brokers,
+		Dialer:  c.dialer,
+		Topics:  []string{c.cmdTopic},
+
+		GroupBalancers:    []kafka.GroupBalancer{kafka.RangeGroupBalancer{}},
+		HeartbeatInterval: c.sessionTimeout / 3,
+		SessionTimeout:    c.sessionTimeout,
+		// members are expected to rejoin within a session
+		RebalanceTimeout: c.sessionTimeout,
+		JoinGroupBackoff: c.sessionTimeout,
+		// only new cmds are consumed when no offset committed
+		StartOffset: kafka.LastOffset,
+		Timeout:     c.requestTimeout,
+
+		Logger:      c.logger,
+		ErrorLogger: c.errorLogger,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create consumer group %q: %w", c.groupID, err)
+	}
+
+	c.mu.Lock()
+	c.group = group
+	c.mu.Unlock()
+
+	return c.nextGeneration(ctx)
+}
+
+// nextGeneration waits for the next generation of the consumer group and
+// returns offsets of partitions assigned to this client
+func (c *Client) nextGeneration(ctx context.Context) (*kafka.Generation, map[int]int64, error) {
+	c.mu.Lock()
+	group := c.group
+	c.mu.Unlock()
+
+	if group == nil {
+		return nil, nil, clientutil.ErrClientNotConnected
+	}
+
+	for {
+		gen, err := group.Next(ctx)
+		switch {
+		case err == nil:
+		case errors.Is(err, kafka.RebalanceInProgress):
+			// joining again is throttled by the broker
+			continue
+		default:
+			return nil, nil, fmt.Errorf("failed to join consumer group %q: %w", c.groupID, unrecoverable(err))
+		}
+
+		offsets := make(map[int]int64)
+		for _, a := range gen.Assignments[c.cmdTopic] {
+			offsets[a.ID] = a.Offset
+		}
+
+		c.Log.D("joined consumer group",
+			log.String("member", gen.MemberID),
+			log.Int32("generation", gen.ID),
+			log.Any("offsets", offsets),
+		)
+
+		err = c.resolveLatestOffsets(ctx, offsets)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return gen, offsets, nil
+	}
+}
+
+// resolveLatestOffsets replaces kafka.LastOffset with the actual latest
+// offsets, so cmds sent after it returned are always consumed
+func (c *Client) resolveLatestOffsets(ctx context.Context, offsets map[int]int64) error {
+	var requests []kafka.OffsetRequest
+	for p, offset := range offsets {
+		if offset == kafka.LastOffset {
+			requests = append(requests, kafka.LastOffsetOf(p))
+		}
+	}
+
+	if len(requests) == 0 {
+		return nil
+	}
+
+	resp, err := c.client.ListOffsets(ctx, &kafka.ListOffsetsRequest{
+		Topics: map[string][]kafka.OffsetRequest{c.cmdTopic: requests},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list latest offsets of cmd topic: %w", err)
+	}
+
+	for _, p := range resp.Topics[c.cmdTopic] {
+		if p.Error != nil {
+			return fmt.Errorf("failed to list latest offset of cmd partition %d: %w", p.Partition, p.Error)
+		}
+
+		offsets[p.Partition] = p.LastOffset
+	}
+
+	return nil
+}
+
+// consumeAssigned consumes assigned partitions until ctx canceled or error
+// happened, it returns true when the generation of the consumer group
+// ended and the client needs to rejoin
+func (c *Client) consumeAssigned(
+	ctx context.Context, gen *kafka.Generation, offsets map[int]int64,
+) (rejoin bool, err error) {
+	runCtx, cancel := context.WithCancel(ctx)
+
+	var (
+		wg    = new(sync.WaitGroup)
+		errCh = make(chan error, len(offsets))
+		ended = make(chan struct{})
+
+		commit func(partition int, offset int64) error
+	)
+
+	if gen != nil {
+		commit = func(partition int, offset int64) error {
+			return gen.CommitOffsets(map[string]map[int]int64{
+				c.cmdTopic: {partition: offset},
+			})
+		}
+	}
+
+	for partition, offset := range offsets {
+		wg.Add(1)
+		go func(partition int, offset int64) {
+			defer wg.Done()
+
+			err := c.consume(runCtx, partition, offset, commit)
+			if err != nil {
+				errCh <- err
+			}
+		}(partition, offset)
+	}
+
+	if gen != nil {
+		// stop consuming when the consumer group is rebalancing, the
+		// generation ends as soon as this function returned, so wait for
+		// consumers to stop before partitions are assigned to other members
+		gen.Start(func(genCtx context.Context) {
+			select {
+			case <-genCtx.Done():
+				close(ended)
+				cancel()
+				wg.Wait()
+			case <-runCtx.Done():
+			}
+		})
+	}
+
+	select {
+	case <-runCtx.Done():
+	case err = <-errCh:
+	}
+
+	// wait for all consumers to stop before rejoining, partitions may be
+	// assigned to other members
+	cancel()
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	select {
+	case <-ended:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// consume the partition of the cmd topic from the offset until ctx is
+// canceled or error happened, offsets of handled cmds are committed if
+// commit is not nil
+func (c *Client) consume(
+	ctx context.Context,
+	partition int,
+	offset int64,
+	commit func(partition int, offset int64) error,
+) error {
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   c.brokers,
+		Topic:     c.cmdTopic,
+		Partition: partition,
+		Dialer:    c.dialer,
+
+		MinBytes: 1,
+		MaxBytes: fetchMaxBytes,
+		MaxWait:  c.fetchMaxWait,
+
+		Logger:      c.logger,
+		ErrorLogger: c.errorLogger,
+	})
+	defer func() { _ = r.Close() }()
+
+	err := r.SetOffset(offset)
+	if err != nil {
+		return fmt.Errorf("failed to set offset of cmd partition %d: %w", partition, err)
+	}
+
+	for {
+		m, err := r.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("failed to fetch cmds: %w", err)
+		}
+
+		c.HandleCmd(m.Value)
+
+		if commit == nil {
+			continue
+		}
+
+		err = commit(partition, m.Offset+1)
+		if err != nil {
+			// best effort, rebalancing is handled by the consumer group
+			c.Log.I("failed to commit cmd offset", log.Error(err))
+		}
+	}
+}
+
+func (c *Client) PostMsg(msg *aranyagopb.Msg) error {
+	data, err := c.EncodeMsg(msg)
+	if err != nil {
+		return err
+	}
+
+	return c.publish(c.msgTopic, data)
+}
+
+func (c *Client) Close() error {
+	return c.OnClose(func() error {
+		c.publishOffline()
+		c.leaveGroup()
+
+		err := c.writer.Close()
+		c.transport.CloseIdleConnections()
+
+		return err
+	})
+}
+
+// publishOffline publishes offline message once, best effort
+func (c *Client) publishOffline() {
+	c.offlineOnce.Do(func() {
+		c.mu.Lock()
+		connected := c.cmdPartitions != nil
+		c.mu.Unlock()
+
+		if connected {
+			_ = c.publish(c.statusTopic, c.offlineMsgBytes)
+		}
+	})
+}
+
+// leaveGroup leaves the consumer group so partitions can be reassigned
+// without waiting for session timeout
+func (c *Client) leaveGroup() {
+	c.mu.Lock()
+	group := c.group
+	c.group = nil
+	c.mu.Unlock()
+
+	if group != nil {
+		_ = group.Close()
+	}
+}
+
+// publish data as a single record to the topic, the partition is selected
+// by the partition key
+func (c *Client) publish(topic string, data []byte) error {
+	// not using client context, offline message is published after closed
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	defer cancel()
+
+	return c.writer.WriteMessages(ctx, kafka.Message{
+		Topic: topic,
+		Key:   c.partitionKey,
+		Value: data,
+	})
+}
+
+// unrecoverable wraps authentication and authorization failures with
+// clientutil.ErrUnrecoverable
+func unrecoverable(err error) error {
+	for _, e := range []kafka.Error{
+		kafka.TopicAuthorizationFailed,
+		kafka.GroupAuthorizationFailed,
+		kafka.ClusterAuthorizationFailed,
+		kafka.UnsupportedSASLMechanism,
+		kafka.SASLAuthenticationFailed,
+	} {
+		if errors.Is(err, e) {
+			return fmt.Errorf("%v: %w", err, clientutil.ErrUnrecoverable)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,323 @@
+// +build !noclient_kafka
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/aranya-proto/aranyagopb/aranyagoconst"
+
+	"arhat.dev/arhat/pkg/client/clientutil"
+)
+
+// cmdRecorder records cmds handled by clients
+type cmdRecorder struct {
+	mu   *sync.Mutex
+	cmds map[string][][]byte
+}
+
+func newCmdRecorder() *cmdRecorder {
+	return &cmdRecorder{
+		mu:   new(sync.Mutex),
+		cmds: make(map[string][][]byte),
+	}
+}
+
+func (r *cmdRecorder) handleFunc(name string) func(cmdBytes []byte) {
+	return func(cmdBytes []byte) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		r.cmds[name] = append(r.cmds[name], cmdBytes)
+	}
+}
+
+func (r *cmdRecorder) count(name string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.cmds[name])
+}
+
+func (r *cmdRecorder) total() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, cmds := range r.cmds {
+		n += len(cmds)
+	}
+
+	return n
+}
+
+const testTopicNamespace = "arhat.test"
+
+// newTestClient creates a client connecting to the fake broker, topics of
+// the client are created in the broker
+func newTestClient(
+	t *testing.T, b *fakeBroker, group string, handleCmd func(cmdBytes []byte),
+) *Client {
+	c, err := NewClient(context.TODO(), handleCmd, &Config{
+		CommonConfig: clientutil.CommonConfig{
+			MaxPayloadSize: 64 * 1024,
+		},
+		Brokers:        []string{"kafka:9092"},
+		TopicNamespace: testTopicNamespace,
+		ClientID:       "foo",
+		ConsumerGroup:  group,
+		FetchMaxWait:   100 * time.Millisecond,
+		RequestTimeout: 5 * time.Second,
+		SessionTimeout: 900 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := c.(*Client)
+	client.dial = b.dial
+
+	b.createTopics(client.cmdTopic, client.msgTopic, client.statusTopic)
+
+	return client
+}
+
+// startTestClient connects and starts the client in background, returns
+// the channel of the result of Start
+func startTestClient(t *testing.T, c *Client) <-chan error {
+	err := c.Connect(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		done   = make(chan error, 1)
+		exited = make(chan struct{})
+	)
+	go func() {
+		defer close(exited)
+
+		done <- c.Start(context.TODO())
+	}()
+
+	t.Cleanup(func() {
+		_ = c.Close()
+		<-exited
+	})
+
+	return done
+}
+
+func testCmd(t *testing.T, sid uint64) []byte {
+	data, err := (&aranyagopb.Cmd{Kind: aranyagopb.CMD_EXEC, Sid: sid, Complete: true}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestClient(t *testing.T) {
+	var (
+		b        = newFakeBroker(t)
+		recorder = newCmdRecorder()
+		c        = newTestClient(t, b, "", recorder.handleFunc("foo"))
+	)
+
+	// cmds sent before started are not consumed without consumer group
+	b.produce(c.cmdTopic, 0, testCmd(t, 1))
+
+	done := startTestClient(t, c)
+
+	waitFor(t, "online message", func() bool {
+		return len(b.values(c.statusTopic)) == 1
+	})
+	if !bytes.Equal(b.values(c.statusTopic)[0], c.onlineMsgBytes) {
+		t.Error("unexpected online message")
+	}
+
+	b.produce(c.cmdTopic, 0, testCmd(t, 2))
+
+	waitFor(t, "cmd", func() bool { return recorder.count("foo") == 1 })
+	if !bytes.Equal(recorder.cmds["foo"][0], testCmd(t, 2)) {
+		t.Error("unexpected cmd received")
+	}
+
+	err := c.PostMsg(&aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 1, Payload: []byte("data")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := b.values(c.msgTopic)
+	if len(msgs) != 1 {
+		t.Fatalf("expecting 1 msg published, got %d", len(msgs))
+	}
+
+	msg := new(aranyagopb.Msg)
+	if err = msg.Unmarshal(msgs[0]); err != nil || string(msg.Payload) != "data" {
+		t.Errorf("unexpected msg published: %v", err)
+	}
+
+	select {
+	case err = <-done:
+		t.Fatalf("client exited unexpectedly: %v", err)
+	default:
+	}
+
+	_ = c.Close()
+	if err = <-done; err != nil {
+		t.Error(err)
+	}
+
+	status := b.values(c.statusTopic)
+	if len(status) != 2 || !bytes.Equal(status[1], c.offlineMsgBytes) {
+		t.Error("offline message not published")
+	}
+}
+
+func TestClientConsumerGroup(t *testing.T) {
+	var (
+		b        = newFakeBroker(t)
+		recorder = newCmdRecorder()
+		c        = newTestClient(t, b, "foo", recorder.handleFunc("first"))
+	)
+
+	done := startTestClient(t, c)
+
+	waitFor(t, "online message", func() bool {
+		return len(b.values(c.statusTopic)) == 1
+	})
+
+	b.produce(c.cmdTopic, 0, testCmd(t, 1))
+	waitFor(t, "committed offset", func() bool {
+		return b.committed("foo", c.cmdTopic, 0) == 1
+	})
+
+	b.mu.Lock()
+	commit := b.groups["foo"].commits[0]
+	b.mu.Unlock()
+	if commit.generation != 1 || commit.memberID == "" {
+		t.Errorf("offset not committed as group member: %+v", commit)
+	}
+
+	_ = c.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(b.assigned("foo", c.cmdTopic)); n != 0 {
+		t.Errorf("group not left, %d members remain", n)
+	}
+
+	// cmds sent while offline are consumed after reconnected
+	b.produce(c.cmdTopic, 0, testCmd(t, 2))
+
+	c = newTestClient(t, b, "foo", recorder.handleFunc("second"))
+	startTestClient(t, c)
+
+	waitFor(t, "cmd sent while offline", func() bool {
+		return recorder.count("second") == 1
+	})
+
+	if recorder.count("first") != 1 || !bytes.Equal(recorder.cmds["second"][0], testCmd(t, 2)) {
+		t.Error("cmds not consumed from committed offset")
+	}
+}
+
+func TestClientConsumerGroupRebalance(t *testing.T) {
+	b := newFakeBroker(t)
+	recorder := newCmdRecorder()
+
+	cmdTopic, _, _ := aranyagoconst.AMQPTopics(testTopicNamespace)
+	b.partitions[cmdTopic] = 2
+
+	first := newTestClient(t, b, "foo", recorder.handleFunc("first"))
+
+	startTestClient(t, first)
+	waitFor(t, "online message", func() bool {
+		return len(b.values(first.statusTopic)) == 1
+	})
+
+	// commit offsets of all partitions, so cmds are not missed during
+	// rebalance
+	for i := int32(0); i < 2; i++ {
+		b.produce(first.cmdTopic, i, testCmd(t, uint64(i)))
+	}
+	waitFor(t, "committed offsets", func() bool {
+		return b.committed("foo", first.cmdTopic, 0) == 1 &&
+			b.committed("foo", first.cmdTopic, 1) == 1
+	})
+
+	// a standby client connected but not started MUST NOT join the group
+	standby := newTestClient(t, b, "foo", recorder.handleFunc("standby"))
+	if err := standby.Connect(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = standby.Close() }()
+
+	second := newTestClient(t, b, "foo", recorder.handleFunc("second"))
+	startTestClient(t, second)
+
+	waitFor(t, "rebalanced", func() bool {
+		a := b.assigned("foo", first.cmdTopic)
+		if len(a) != 2 {
+			return false
+		}
+
+		for _, partitions := range a {
+			if len(partitions) != 1 {
+				return false
+			}
+		}
+
+		return true
+	})
+
+	for i := int32(0); i < 2; i++ {
+		b.produce(first.cmdTopic, i, testCmd(t, uint64(i+2)))
+	}
+
+	waitFor(t, "cmds consumed", func() bool {
+		return recorder.total() == 4
+	})
+
+	time.Sleep(200 * time.Millisecond)
+	if recorder.count("first") != 3 || recorder.count("second") != 1 || recorder.count("standby") != 0 {
+		t.Errorf("cmds not consumed by assigned members: %d, %d, %d",
+			recorder.count("first"), recorder.count("second"), recorder.count("standby"))
+	}
+}
@@ -0,0 +1,48 @@
+// +build !noclient_kafka
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// newSASLMechanism creates the sasl mechanism from config, nil if sasl is
+// disabled
+func newSASLMechanism(config *SASLConfig) (sasl.Mechanism, error) {
+	switch strings.ToUpper(config.Mechanism) {
+	case "":
+		return nil, nil
+	case "PLAIN":
+		return plain.Mechanism{
+			Username: config.Username,
+			Password: config.Password,
+		}, nil
+	case "SCRAM-SHA-256":
+		return scram.Mechanism(scram.SHA256, config.Username, config.Password)
+	case "SCRAM-SHA-512":
+		return scram.Mechanism(scram.SHA512, config.Username, config.Password)
+	default:
+		return nil, fmt.Errorf("unsupported sasl mechanism %q", config.Mechanism)
+	}
+}
@@ -47,6 +47,60 @@ type Config struct {
 	Username           string             `json:"username" yaml:"username"`
 	Password           string             `json:"password" yaml:"password"`
 	KeepaliveInterval  time.Duration      `json:"keepaliveInterval" yaml:"keepaliveInterval"`
+
+	// SessionExpiryInterval is the time broker keeps the session after
+	// disconnected (mqtt v5 only), 0 means session ends with the connection
+	SessionExpiryInterval time.Duration `json:"sessionExpiryInterval" yaml:"sessionExpiryInterval"`
+
+	// MessageExpiryInterval is the lifetime of stream data messages
+	// (mqtt v5 only), 0 means no expiry
+	MessageExpiryInterval time.Duration `json:"messageExpiryInterval" yaml:"messageExpiryInterval"`
+
+	QoS          QoSConfig          `json:"qos" yaml:"qos"`
+	SessionStore SessionStoreConfig `json:"sessionStore" yaml:"sessionStore"`
+}
+
+// QoSConfig defines qos levels of messages published
+type QoSConfig struct {
+	// State for messages other than stream data (e.g. node status, errors)
+	State int `json:"state" yaml:"state"`
+
+	// Data for stream data (e.g. output of `kubectl exec`)
+	Data int `json:"data" yaml:"data"`
+
+	// Metrics for data of metrics collection
+	Metrics int `json:"metrics" yaml:"metrics"`
+}
+
+// SessionStoreConfig defines the on disk store of messages published with
+// qos 1 or 2 but not acknowledged by the broker
+type SessionStoreConfig struct {
+	// Dir to store messages, session store is disabled if empty
+	Dir string `json:"dir" yaml:"dir"`
+
+	// MaxPending is the max count of messages stored, the oldest message
+	// is dropped when exceeded, 0 means no limit
+	MaxPending int `json:"maxPending" yaml:"maxPending"`
+}
+
+func (c QoSConfig) levels() (state, data, metrics libmqtt.QosLevel, err error) {
+	for _, q := range []struct {
+		name  string
+		value int
+		level *libmqtt.QosLevel
+	}{
+		{name: "state", value: c.State, level: &state},
+		{name: "data", value: c.Data, level: &data},
+		{name: "metrics", value: c.Metrics, level: &metrics},
+	} {
+		if q.value < 0 || q.value > int(libmqtt.Qos2) {
+			return 0, 0, 0, fmt.Errorf("invalid %s qos %d", q.name, q.value)
+		}
+
+		*q.level = libmqtt.QosLevel(q.value)
+	}
+
+	return
 }
 
 type ConfigConnectInfo struct {
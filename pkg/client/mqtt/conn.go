@@ -0,0 +1,215 @@
+// +build !noclient_mqtt
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/goiiot/libmqtt"
+)
+
+// dial is the libmqtt connector used for mqtt v5 or with session store,
+// libmqtt doesn't expose packets sent by the broker, so packets received
+// are observed (never modified) to honor the broker's maximum packet size
+// and reason code of DISCONNECT, and to find messages acknowledged
+func (c *Client) dial(
+	ctx context.Context,
+	address string,
+	timeout time.Duration,
+	tlsConfig *tls.Config,
+) (net.Conn, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	switch c.transport {
+	case "websocket":
+		conn, err = dialWebsocket(ctx, address, timeout, tlsConfig)
+	default:
+		conn, err = dialTCP(ctx, address, timeout, tlsConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// new connection, forget limits and errors of the previous one
+	c.setBrokerMaxPacketSize(0)
+	c.setDisconnectError(nil)
+
+	return newObservedConn(conn, c.handleBrokerPacket), nil
+}
+
+// handleBrokerPacket is called with packets observed by observedConn
+func (c *Client) handleBrokerPacket(header byte, body []byte) {
+	switch header >> 4 {
+	case libmqtt.CtrlPubAck, libmqtt.CtrlPubComp:
+		// sent by the broker only for messages published by us
+		if c.store != nil && len(body) >= 2 {
+			c.store.ack(binary.BigEndian.Uint16(body))
+		}
+	case libmqtt.CtrlConnAck, libmqtt.CtrlDisConn:
+		if c.v5 {
+			c.handleV5BrokerPacket(header, body)
+		}
+	}
+}
+
+func dialTCP(
+	ctx context.Context,
+	address string,
+	timeout time.Duration,
+	tlsConfig *tls.Config,
+) (net.Conn, error) {
+	conn, err := (&net.Dialer{Timeout: timeout}).DialContext(ctx, "tcp", address)
+	if err != nil || tlsConfig == nil {
+		return conn, err
+	}
+
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = address
+		if host, _, err2 := net.SplitHostPort(address); err2 == nil {
+			tlsConfig.ServerName = host
+		}
+	}
+
+	if timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	err = tlsConn.Handshake()
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
+
+const (
+	observeHeader = iota
+	observeRemainingLength
+	observeBody
+	observeStopped
+)
+
+// observedConn splits packets read from conn and calls handle with
+// CONNACK, DISCONNECT, PUBACK and PUBCOMP packets before they are returned
+// to libmqtt
+type observedConn struct {
+	net.Conn
+
+	handle func(header byte, body []byte)
+
+	state     int
+	header    byte
+	remaining int
+	shift     uint
+	body      []byte
+}
+
+func newObservedConn(conn net.Conn, handle func(header byte, body []byte)) *observedConn {
+	return &observedConn{
+		Conn:   conn,
+		handle: handle,
+		state:  observeHeader,
+	}
+}
+
+// Read is only called by libmqtt's receiving routine, no lock required
+func (c *observedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.observe(p[:n])
+	return n, err
+}
+
+func (c *observedConn) observe(data []byte) {
+	for len(data) != 0 {
+		switch c.state {
+		case observeHeader:
+			c.header, data = data[0], data[1:]
+			c.remaining, c.shift = 0, 0
+			c.state = observeRemainingLength
+		case observeRemainingLength:
+			b := data[0]
+			data = data[1:]
+
+			c.remaining |= int(b&0x7f) << c.shift
+			c.shift += 7
+			if b&0x80 != 0 {
+				if c.shift >= 28 {
+					// malformed remaining length, libmqtt will close the
+					// connection
+					c.state = observeStopped
+				}
+
+				continue
+			}
+
+			c.body = c.body[:0]
+			c.state = observeBody
+			if c.remaining == 0 {
+				c.complete()
+			}
+		case observeBody:
+			n := c.remaining
+			if n > len(data) {
+				n = len(data)
+			}
+
+			if c.wanted() {
+				c.body = append(c.body, data[:n]...)
+			}
+
+			c.remaining -= n
+			data = data[n:]
+			if c.remaining == 0 {
+				c.complete()
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (c *observedConn) wanted() bool {
+	switch c.header >> 4 {
+	case libmqtt.CtrlConnAck, libmqtt.CtrlDisConn,
+		libmqtt.CtrlPubAck, libmqtt.CtrlPubComp:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *observedConn) complete() {
+	if c.wanted() {
+		c.handle(c.header, c.body)
+	}
+
+	c.state = observeHeader
+}
@@ -21,6 +21,7 @@ package mqtt
 import (
 	"context"
 	"fmt"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -53,6 +54,19 @@ func init() {
 				Username:           "",
 				Password:           "",
 				KeepaliveInterval:  60 * time.Second,
+
+				SessionExpiryInterval: time.Hour,
+				MessageExpiryInterval: 0,
+
+				QoS: QoSConfig{
+					State:   1,
+					Data:    1,
+					Metrics: 1,
+				},
+				SessionStore: SessionStoreConfig{
+					Dir:        "",
+					MaxPending: 1000,
+				},
 			}
 		},
 		NewMQTTClient,
@@ -93,6 +107,11 @@ func NewMQTTClient(
 		return nil, fmt.Errorf("invalid config options for mqtt connect: %w", err)
 	}
 
+	qosState, qosData, qosMetrics, err := config.QoS.levels()
+	if err != nil {
+		return nil, err
+	}
+
 	if connInfo.TLSConfig != nil {
 		options = append(options, libmqtt.WithCustomTLS(connInfo.TLSConfig))
 	}
@@ -110,6 +129,31 @@ func NewMQTTClient(
 
 	onlineMsgBytes, offlineMsgBytes := clientutil.CreateOnlineOfflineMessage(config.ClientID)
 
+	c := &Client{
+		supportRetain: connInfo.SupportRetain,
+
+		brokerAddress:     config.Endpoint,
+		cmdSubTopicHandle: connInfo.CmdSubTopicHandle,
+		cmdSubTopic:       connInfo.CmdSubTopic,
+		pubTopic:          connInfo.MsgPubTopic,
+		pubWillTopic:      connInfo.WillPubTopic,
+		onlineMsg:         onlineMsgBytes,
+
+		netErrCh:  make(chan error),
+		connErrCh: make(chan error),
+		subErrCh:  make(chan error),
+
+		transport:     config.Transport,
+		v5:            config.Version == "5",
+		disconnMu:     new(sync.Mutex),
+		sessionExpiry: secondsOf(config.SessionExpiryInterval),
+		messageExpiry: secondsOf(config.MessageExpiryInterval),
+
+		qosState:   qosState,
+		qosData:    qosData,
+		qosMetrics: qosMetrics,
+	}
+
 	options = append(options, libmqtt.WithRouter(connInfo.TopicRouter))
 	options = append(options, libmqtt.WithConnPacket(libmqtt.ConnPacket{
 		Username:     connInfo.Username,
@@ -119,39 +163,31 @@ func NewMQTTClient(
 		CleanSession: false, // retain session data on connection lost for data streaming
 		IsWill:       true,
 		WillTopic:    connInfo.WillPubTopic,
-		WillQos:      libmqtt.Qos1,
+		WillQos:      qosState,
 		WillRetain:   connInfo.SupportRetain,
 		WillMessage:  offlineMsgBytes,
+		Props:        c.connProps(),
 	}))
 
 	options = append(options, libmqtt.WithKeepalive(uint16(keepalive), 1.2))
 
-	client, err := libmqtt.NewClient(options...)
+	c.client, err = libmqtt.NewClient(options...)
 	if err != nil {
 		return nil, err
 	}
 
-	c := &Client{
-		client:        client,
-		supportRetain: connInfo.SupportRetain,
-
-		brokerAddress:     config.Endpoint,
-		cmdSubTopicHandle: connInfo.CmdSubTopicHandle,
-		cmdSubTopic:       connInfo.CmdSubTopic,
-		pubTopic:          connInfo.MsgPubTopic,
-		pubWillTopic:      connInfo.WillPubTopic,
-		onlineMsg:         onlineMsgBytes,
-
-		netErrCh:  make(chan error),
-		connErrCh: make(chan error),
-		subErrCh:  make(chan error),
-	}
-
-	c.BaseClient, err = clientutil.NewBaseClient(ctx, handleCmd, connInfo.MaxPayloadSize)
+	c.BaseClient, err = clientutil.NewBaseClient(ctx, handleCmd, connInfo.MaxPayloadSize, &config.MsgCompression)
 	if err != nil {
 		return nil, err
 	}
 
+	if config.SessionStore.Dir != "" {
+		c.store, err = newSessionStore(config.SessionStore.Dir, config.SessionStore.MaxPending, c.Log)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return c, nil
 }
 
@@ -172,6 +208,22 @@ type Client struct {
 
 	exited        uint32
 	supportRetain bool
+	transport     string
+
+	// mqtt v5 only
+	v5                   bool
+	sessionExpiry        uint32
+	messageExpiry        uint32
+	brokerMaxPayloadSize int64
+
+	disconnMu  *sync.Mutex
+	disconnErr *DisconnectError
+
+	qosState   libmqtt.QosLevel
+	qosData    libmqtt.QosLevel
+	qosMetrics libmqtt.QosLevel
+
+	store *sessionStore
 }
 
 func (c *Client) Connect(dialCtx context.Context) error {
@@ -183,6 +235,14 @@ func (c *Client) Connect(dialCtx context.Context) error {
 		libmqtt.WithNetHandleFunc(c.handleNet),
 	}
 
+	if c.store != nil {
+		dialOpts = append(dialOpts, libmqtt.WithPersist(c.store))
+	}
+
+	if c.v5 || c.store != nil {
+		dialOpts = append(dialOpts, libmqtt.WithCustomConnector(c.dial))
+	}
+
 	dd, ok := dialCtx.Deadline()
 	if ok {
 		dialOpts = append(dialOpts, libmqtt.WithDialTimeout(uint16(time.Until(dd).Seconds())))
@@ -231,6 +291,10 @@ func (c *Client) Start(ctx context.Context) error {
 	c.Log.D("publishing online message")
 	c.pubOnline()
 
+	if c.store != nil {
+		c.store.redeliver(c.client.Publish, c.pubTopic)
+	}
+
 	select {
 	case err := <-c.netErrCh:
 		return err
@@ -241,17 +305,64 @@ func (c *Client) Start(ctx context.Context) error {
 	}
 }
 
+// MaxPayloadSize returns the configured max payload size, limited by the
+// max packet size of the mqtt v5 broker
+func (c *Client) MaxPayloadSize() int {
+	size := c.BaseClient.MaxPayloadSize()
+	if brokerSize := atomic.LoadInt64(&c.brokerMaxPayloadSize); brokerSize > 0 && brokerSize < int64(size) {
+		return int(brokerSize)
+	}
+
+	return size
+}
+
 func (c *Client) PostMsg(msg *aranyagopb.Msg) error {
-	data, err := msg.Marshal()
+	return c.postMsg(msg, false)
+}
+
+// PostMetricsMsg publishes data of metrics collection with metrics qos
+func (c *Client) PostMetricsMsg(msg *aranyagopb.Msg) error {
+	return c.postMsg(msg, true)
+}
+
+func (c *Client) postMsg(msg *aranyagopb.Msg, isMetrics bool) error {
+	data, err := c.EncodeMsg(msg)
 	if err != nil {
 		return err
 	}
 
-	c.client.Publish(&libmqtt.PublishPacket{TopicName: c.pubTopic, Qos: libmqtt.Qos1, Payload: data})
+	pkt := &libmqtt.PublishPacket{
+		TopicName: c.pubTopic,
+		Qos:       c.msgQoS(msg, isMetrics),
+		Payload:   data,
+		Props:     c.publishProps(msg),
+	}
+	if pkt.Qos != libmqtt.Qos0 && c.store != nil {
+		err = c.store.add(pkt)
+		if err != nil {
+			c.Log.I("failed to store message", log.Error(err))
+		}
+	}
+
+	c.client.Publish(pkt)
 
 	return nil
 }
 
+// msgQoS returns qos level of the msg according to its class
+func (c *Client) msgQoS(msg *aranyagopb.Msg, isMetrics bool) libmqtt.QosLevel {
+	switch msg.Kind {
+	case aranyagopb.MSG_DATA, aranyagopb.MSG_DATA_STDERR:
+		if isMetrics {
+			return c.qosMetrics
+		}
+
+		return c.qosData
+	default:
+		return c.qosState
+	}
+}
+
 func (c *Client) Close() error {
 	return c.OnClose(func() error {
 		c.client.Destroy(true)
@@ -267,7 +378,7 @@ func (c *Client) Close() error {
 func (c *Client) pubOnline() {
 	c.client.Publish(&libmqtt.PublishPacket{
 		TopicName: c.pubWillTopic,
-		Qos:       libmqtt.Qos1,
+		Qos:       c.qosState,
 		Payload:   c.onlineMsg,
 		IsRetain:  c.supportRetain,
 	})
@@ -279,6 +390,11 @@ func (c *Client) handleNet(client libmqtt.Client, server string, err error) {
 		return
 	}
 
+	if derr := c.disconnectError(); derr != nil {
+		// broker told us why
+		err = derr
+	}
+
 	// close client on network error
 	c.Log.I("connection error", log.String("server", server), log.Error(err))
 	if atomic.CompareAndSwapUint32(&c.exited, 0, 1) {
@@ -304,10 +420,20 @@ func (c *Client) handleConn(dialExitSig <-chan struct{}) libmqtt.ConnHandleFunc
 				return
 			}
 		} else if code != libmqtt.CodeSuccess {
+			err = fmt.Errorf("rejected by mqtt broker, code: %d", code)
+			switch code {
+			case libmqtt.CodeServerUnavailable,
+				libmqtt.CodeServerUnavail,
+				libmqtt.CodeServerBusy:
+			default:
+				// broker refused this client
+				err = fmt.Errorf("%v: %w", err, clientutil.ErrUnrecoverable)
+			}
+
 			select {
 			case <-dialExitSig:
 				return
-			case c.connErrCh <- fmt.Errorf("rejected by mqtt broker, code: %d", code):
+			case c.connErrCh <- err:
 				return
 			}
 		}
@@ -0,0 +1,177 @@
+// +build !noclient_mqtt
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mqtt
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/aranya-proto/aranyagopb/aranyagoconst"
+	_ "arhat.dev/pkg/nethelper/stdnet" // add tcp network support
+	"github.com/goiiot/libmqtt"
+
+	"arhat.dev/arhat/pkg/client/clientutil"
+	"arhat.dev/arhat/pkg/conf"
+	"arhat.dev/arhat/pkg/simulator"
+)
+
+// msgRecorder records messages published to the broker
+type msgRecorder struct {
+	mu   *sync.Mutex
+	msgs [][]byte
+}
+
+func (r *msgRecorder) handle(_ string, payload []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.msgs = append(r.msgs, payload)
+}
+
+func (r *msgRecorder) get() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([][]byte{}, r.msgs...)
+}
+
+func runBroker(t *testing.T) (*simulator.Broker, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := simulator.NewBroker()
+	go func() { _ = b.Serve(l) }()
+	t.Cleanup(func() { _ = b.Close() })
+
+	return b, l.Addr().String()
+}
+
+func newTestClient(t *testing.T, endpoint, storeDir string) *Client {
+	c, err := NewMQTTClient(context.TODO(), func([]byte) {}, &Config{
+		CommonConfig: clientutil.CommonConfig{
+			Endpoint:       endpoint,
+			MaxPayloadSize: aranyagoconst.MaxMQTTDataSize,
+		},
+		Version:            "3.1.1",
+		Variant:            "standard",
+		Transport:          "tcp",
+		TopicNamespaceFrom: conf.ValueFromSpec{Text: "arhat.test"},
+		ClientID:           "foo",
+		KeepaliveInterval:  time.Minute,
+		QoS:                QoSConfig{State: 1, Data: 1, Metrics: 0},
+		SessionStore:       SessionStoreConfig{Dir: storeDir},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c.(*Client)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestClientRedeliverAfterRestart(t *testing.T) {
+	b, endpoint := runBroker(t)
+	dir := t.TempDir()
+
+	_, msgTopic, _ := aranyagoconst.MQTTTopics("arhat.test")
+	recorder := &msgRecorder{mu: new(sync.Mutex)}
+	b.Subscribe(msgTopic, recorder.handle)
+
+	// messages left by a previous process exited before acknowledged
+	s := newTestStore(t, dir, 0)
+	for _, payload := range []string{"a", "b"} {
+		err := s.add(&libmqtt.PublishPacket{TopicName: msgTopic, Qos: libmqtt.Qos1, Payload: []byte(payload)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := newTestClient(t, endpoint, dir)
+	err := c.Connect(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Start(context.TODO())
+	}()
+	defer func() {
+		_ = c.Close()
+		<-done
+	}()
+
+	waitFor(t, "pending messages redelivered", func() bool {
+		return len(recorder.get()) == 2
+	})
+
+	msgs := recorder.get()
+	if string(msgs[0]) != "a" || string(msgs[1]) != "b" {
+		t.Errorf("unexpected messages redelivered: %q", msgs)
+	}
+
+	err = c.PostMsg(&aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 1, Payload: []byte("data")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "new message", func() bool { return len(recorder.get()) == 3 })
+	waitFor(t, "acknowledged messages removed", func() bool {
+		return len(storedFiles(t, dir)) == 0
+	})
+}
+
+func TestClientMsgQoS(t *testing.T) {
+	c := &Client{qosState: libmqtt.Qos2, qosData: libmqtt.Qos1, qosMetrics: libmqtt.Qos0}
+
+	for _, test := range []struct {
+		kind      aranyagopb.MsgType
+		isMetrics bool
+		expected  libmqtt.QosLevel
+	}{
+		{kind: aranyagopb.MSG_DATA, isMetrics: false, expected: libmqtt.Qos1},
+		{kind: aranyagopb.MSG_DATA_STDERR, isMetrics: false, expected: libmqtt.Qos1},
+		{kind: aranyagopb.MSG_DATA, isMetrics: true, expected: libmqtt.Qos0},
+		{kind: aranyagopb.MSG_ERROR, isMetrics: true, expected: libmqtt.Qos2},
+		{kind: aranyagopb.MSG_STATE, isMetrics: false, expected: libmqtt.Qos2},
+	} {
+		qos := c.msgQoS(&aranyagopb.Msg{Kind: test.kind}, test.isMetrics)
+		if qos != test.expected {
+			t.Errorf("expecting qos %d of %v (metrics: %v), got %d", test.expected, test.kind, test.isMetrics, qos)
+		}
+	}
+}
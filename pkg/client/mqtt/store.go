@@ -0,0 +1,338 @@
+// +build !noclient_mqtt
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mqtt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"arhat.dev/pkg/log"
+	"github.com/goiiot/libmqtt"
+)
+
+const (
+	storeFileSuffix    = ".msg"
+	storeTmpFileSuffix = ".tmp"
+)
+
+// sessionStore keeps messages published with qos 1 or 2 on local disk until
+// the broker acknowledged them, messages left in the store are published
+// again by the next client using the same store
+//
+// it implements libmqtt.PersistMethod to learn packet ids assigned to
+// messages published, packets are never loaded from it
+//
+// libmqtt deletes the same send key when the broker acknowledged a message
+// and when acknowledging an incoming cmd with the same packet id, so its
+// deletes are ignored, messages are removed by ack when PUBACK or PUBCOMP
+// for a packet id issued to them is received from the broker
+type sessionStore struct {
+	dir        string
+	maxPending int
+	logger     log.Interface
+
+	mu      *sync.Mutex
+	nextSeq uint64
+	entries map[uint64]*storeEntry
+
+	// inflight entries waiting for packet id
+	byPacket map[*libmqtt.PublishPacket]*storeEntry
+	// inflight entries waiting for ack
+	byID map[uint16]*storeEntry
+}
+
+type storeEntry struct {
+	seq uint64
+	qos libmqtt.QosLevel
+
+	// inflight is true after published by current client
+	inflight bool
+	id       uint16
+	hasID    bool
+}
+
+func newSessionStore(dir string, maxPending int, logger log.Interface) (*sessionStore, error) {
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, fmt.Errorf("failed to ensure session store dir: %w", err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session store dir: %w", err)
+	}
+
+	s := &sessionStore{
+		dir:        dir,
+		maxPending: maxPending,
+		logger:     logger,
+
+		mu:      new(sync.Mutex),
+		nextSeq: 1,
+		entries: make(map[uint64]*storeEntry),
+
+		byPacket: make(map[*libmqtt.PublishPacket]*storeEntry),
+		byID:     make(map[uint16]*storeEntry),
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		switch {
+		case f.IsDir():
+			continue
+		case strings.HasSuffix(name, storeTmpFileSuffix):
+			// incomplete write
+			_ = os.Remove(filepath.Join(dir, name))
+			continue
+		case !strings.HasSuffix(name, storeFileSuffix):
+			continue
+		}
+
+		seq, err2 := strconv.ParseUint(strings.TrimSuffix(name, storeFileSuffix), 10, 64)
+		if err2 != nil {
+			continue
+		}
+
+		qos, err2 := readStoreFileQoS(filepath.Join(dir, name))
+		if err2 != nil {
+			logger.I("ignored bad session store file", log.String("file", name), log.Error(err2))
+			continue
+		}
+
+		s.entries[seq] = &storeEntry{seq: seq, qos: qos}
+		if seq >= s.nextSeq {
+			s.nextSeq = seq + 1
+		}
+	}
+
+	return s, nil
+}
+
+// add stores the message before publishing
+func (s *sessionStore) add(pkt *libmqtt.PublishPacket) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seq := s.nextSeq
+	s.nextSeq++
+
+	err := s.writeFile(seq, pkt.Qos, pkt.Payload)
+	if err != nil {
+		return err
+	}
+
+	e := &storeEntry{seq: seq, qos: pkt.Qos, inflight: true}
+	s.entries[seq] = e
+	s.byPacket[pkt] = e
+
+	if s.maxPending > 0 && len(s.entries) > s.maxPending {
+		oldest := e
+		for _, v := range s.entries {
+			if v.seq < oldest.seq {
+				oldest = v
+			}
+		}
+
+		s.logger.I("session store full, dropped oldest message", log.Uint64("seq", oldest.seq))
+		s.remove(oldest)
+	}
+
+	return nil
+}
+
+// ack removes the message acknowledged by the broker, id not issued to
+// stored messages is ignored
+func (s *sessionStore) ack(id uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.byID[id]
+	if !ok {
+		return
+	}
+
+	s.remove(e)
+}
+
+// redeliver publishes messages stored by previous clients
+func (s *sessionStore) redeliver(publish func(pkts ...*libmqtt.PublishPacket), topic string) {
+	s.mu.Lock()
+	var pending []*storeEntry
+	for _, e := range s.entries {
+		if !e.inflight {
+			pending = append(pending, e)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].seq < pending[j].seq
+	})
+
+	s.logger.I("redelivering pending messages", log.Int("count", len(pending)))
+	for _, e := range pending {
+		payload, err := ioutil.ReadFile(s.filename(e.seq))
+		if err != nil || len(payload) == 0 {
+			s.logger.I("dropped bad pending message", log.Uint64("seq", e.seq), log.Error(err))
+
+			s.mu.Lock()
+			s.remove(e)
+			s.mu.Unlock()
+			continue
+		}
+
+		pkt := &libmqtt.PublishPacket{
+			TopicName: topic,
+			Qos:       e.qos,
+			Payload:   payload[1:],
+		}
+
+		s.mu.Lock()
+		if _, ok := s.entries[e.seq]; !ok {
+			// dropped
+			s.mu.Unlock()
+			continue
+		}
+		e.inflight = true
+		s.byPacket[pkt] = e
+		s.mu.Unlock()
+
+		publish(pkt)
+	}
+}
+
+// remove entry and its file, must be called with s.mu held
+func (s *sessionStore) remove(e *storeEntry) {
+	delete(s.entries, e.seq)
+	if e.hasID {
+		delete(s.byID, e.id)
+	}
+
+	for pkt, v := range s.byPacket {
+		if v == e {
+			delete(s.byPacket, pkt)
+			break
+		}
+	}
+
+	err := os.Remove(s.filename(e.seq))
+	if err != nil && !os.IsNotExist(err) {
+		s.logger.I("failed to remove session store file", log.Uint64("seq", e.seq), log.Error(err))
+	}
+}
+
+// writeFile writes qos and payload of the message atomically
+func (s *sessionStore) writeFile(seq uint64, qos libmqtt.QosLevel, payload []byte) error {
+	name := s.filename(seq)
+	tmpName := strings.TrimSuffix(name, storeFileSuffix) + storeTmpFileSuffix
+
+	f, err := os.OpenFile(tmpName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create session store file: %w", err)
+	}
+
+	_, err = f.Write(append([]byte{qos}, payload...))
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+
+	if err == nil {
+		err = os.Rename(tmpName, name)
+	}
+
+	if err != nil {
+		_ = os.Remove(tmpName)
+		return fmt.Errorf("failed to write session store file: %w", err)
+	}
+
+	return nil
+}
+
+func (s *sessionStore) filename(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, storeFileSuffix))
+}
+
+func readStoreFileQoS(file string) (libmqtt.QosLevel, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var buf [1]byte
+	_, err = f.Read(buf[:])
+	if err != nil {
+		return 0, err
+	}
+
+	if buf[0] > libmqtt.Qos2 || buf[0] == libmqtt.Qos0 {
+		return 0, fmt.Errorf("invalid qos %d", buf[0])
+	}
+
+	return buf[0], nil
+}
+
+// libmqtt.PersistMethod implementation
+
+func (s *sessionStore) Name() string { return "SessionStore" }
+
+// Store records the packet id of the message published
+func (s *sessionStore) Store(key string, p libmqtt.Packet) error {
+	pkt, ok := p.(*libmqtt.PublishPacket)
+	if !ok || !strings.HasPrefix(key, "S") {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.byPacket[pkt]
+	if !ok {
+		return nil
+	}
+
+	delete(s.byPacket, pkt)
+	e.id, e.hasID = pkt.PacketID, true
+	s.byID[pkt.PacketID] = e
+
+	return nil
+}
+
+func (s *sessionStore) Load(key string) (libmqtt.Packet, bool) { return nil, false }
+
+func (s *sessionStore) Range(func(key string, p libmqtt.Packet) bool) {}
+
+// Delete is ignored, see ack
+func (s *sessionStore) Delete(key string) error { return nil }
+
+func (s *sessionStore) Destroy() error { return nil }
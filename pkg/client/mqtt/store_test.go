@@ -0,0 +1,256 @@
+// +build !noclient_mqtt
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mqtt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"arhat.dev/pkg/log"
+	"github.com/goiiot/libmqtt"
+)
+
+// storedFiles returns names of message files in the store dir
+func storedFiles(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ret []string
+	for _, f := range files {
+		ret = append(ret, f.Name())
+	}
+
+	return ret
+}
+
+func newTestStore(t *testing.T, dir string, maxPending int) *sessionStore {
+	s, err := newSessionStore(dir, maxPending, log.NoOpLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// publishPackets records packets published by the store
+type publishPackets []*libmqtt.PublishPacket
+
+func (p *publishPackets) publish(pkts ...*libmqtt.PublishPacket) {
+	*p = append(*p, pkts...)
+}
+
+// sent simulates libmqtt assigning packet id to the packet and persisting
+// it with the send key
+func sent(t *testing.T, s *sessionStore, pkt *libmqtt.PublishPacket, id uint16) {
+	pkt.PacketID = id
+	err := s.Store(fmt.Sprintf("S%d", id), pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// acked simulates PUBACK received from the broker and libmqtt deleting the
+// send key afterwards
+func acked(t *testing.T, s *sessionStore, id uint16) {
+	c := &Client{store: s}
+	observeInChunks(c, []byte{libmqtt.CtrlPubAck << 4, 2, byte(id >> 8), byte(id)}, 1)
+
+	err := s.Delete(fmt.Sprintf("S%d", id))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionStoreRedeliverAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestStore(t, dir, 0)
+
+	pkts := []*libmqtt.PublishPacket{
+		{TopicName: "msg", Qos: libmqtt.Qos1, Payload: []byte("acked")},
+		{TopicName: "msg", Qos: libmqtt.Qos2, Payload: []byte("sent")},
+		{TopicName: "msg", Qos: libmqtt.Qos1, Payload: []byte("not sent")},
+	}
+	for _, pkt := range pkts {
+		if err := s.add(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sent(t, s, pkts[0], 1)
+	sent(t, s, pkts[1], 2)
+	acked(t, s, 1)
+
+	// acknowledgement of incoming messages
+	if err := s.Delete("R2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// inflight messages are not redelivered by the same store
+	var published publishPackets
+	s.redeliver(published.publish, "msg")
+	if len(published) != 0 {
+		t.Fatalf("inflight messages redelivered: %d", len(published))
+	}
+
+	// incomplete write before restart
+	err := ioutil.WriteFile(filepath.Join(dir, "00000000000000000004"+storeTmpFileSuffix), []byte{1}, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// restart
+	s = newTestStore(t, dir, 0)
+	if files := storedFiles(t, dir); len(files) != 2 {
+		t.Errorf("expecting 2 pending messages stored, got %v", files)
+	}
+
+	s.redeliver(published.publish, "new-msg")
+	if len(published) != 2 {
+		t.Fatalf("expecting 2 messages redelivered, got %d", len(published))
+	}
+
+	for i, pkt := range published {
+		expected := pkts[i+1]
+		if pkt.TopicName != "new-msg" || pkt.Qos != expected.Qos || string(pkt.Payload) != string(expected.Payload) {
+			t.Errorf("unexpected message %d redelivered: %+v", i, pkt)
+		}
+	}
+
+	// messages added after restart do not reuse sequence numbers
+	pkt := &libmqtt.PublishPacket{TopicName: "new-msg", Qos: libmqtt.Qos1, Payload: []byte("new")}
+	if err = s.add(pkt); err != nil {
+		t.Fatal(err)
+	}
+
+	if files := storedFiles(t, dir); len(files) != 3 {
+		t.Errorf("expecting 3 messages stored, got %v", files)
+	}
+
+	for i, p := range append(published, pkt) {
+		sent(t, s, p, uint16(i+1))
+		acked(t, s, uint16(i+1))
+	}
+
+	if files := storedFiles(t, dir); len(files) != 0 {
+		t.Errorf("acked messages not removed: %v", files)
+	}
+
+	s = newTestStore(t, dir, 0)
+	published = nil
+	s.redeliver(published.publish, "msg")
+	if len(published) != 0 {
+		t.Errorf("acked messages redelivered: %d", len(published))
+	}
+}
+
+func TestSessionStoreIncomingSamePacketID(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestStore(t, dir, 0)
+
+	pkt := &libmqtt.PublishPacket{TopicName: "msg", Qos: libmqtt.Qos1, Payload: []byte("msg")}
+	if err := s.add(pkt); err != nil {
+		t.Fatal(err)
+	}
+
+	sent(t, s, pkt, 1)
+
+	// libmqtt acknowledging incoming qos 1 cmd with the same packet id
+	cmd := &libmqtt.PublishPacket{TopicName: "cmd", Qos: libmqtt.Qos1, PacketID: 1}
+	if err := s.Store("R1", cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Delete("S1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if files := storedFiles(t, dir); len(files) != 1 {
+		t.Fatalf("pending message removed by incoming cmd: %v", files)
+	}
+
+	// broker sent PUBCOMP for another packet id
+	observeInChunks(&Client{store: s}, []byte{libmqtt.CtrlPubComp << 4, 2, 0, 2}, 2)
+	if files := storedFiles(t, dir); len(files) != 1 {
+		t.Fatalf("pending message removed by ack of other packet: %v", files)
+	}
+
+	// restart before acknowledged by the broker
+	var published publishPackets
+	newTestStore(t, dir, 0).redeliver(published.publish, "msg")
+	if len(published) != 1 || string(published[0].Payload) != "msg" {
+		t.Errorf("pending message not redelivered: %v", published)
+	}
+
+	acked(t, s, 1)
+	if files := storedFiles(t, dir); len(files) != 0 {
+		t.Errorf("acked message not removed: %v", files)
+	}
+}
+
+func TestSessionStoreMaxPending(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestStore(t, dir, 2)
+
+	for _, payload := range []string{"a", "b", "c"} {
+		err := s.add(&libmqtt.PublishPacket{TopicName: "msg", Qos: libmqtt.Qos1, Payload: []byte(payload)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := storedFiles(t, dir)
+	if len(files) != 2 || files[0] != filepath.Base(s.filename(2)) {
+		t.Errorf("oldest message not dropped: %v", files)
+	}
+
+	if len(s.byPacket) != 2 {
+		t.Errorf("dropped message still tracked")
+	}
+}
+
+func TestSessionStoreBadFile(t *testing.T) {
+	dir := t.TempDir()
+
+	for name, data := range map[string][]byte{
+		"00000000000000000001" + storeFileSuffix: {0},
+		"00000000000000000002" + storeFileSuffix: {},
+		"00000000000000000003" + storeFileSuffix: append([]byte{1}, "ok"...),
+	} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := newTestStore(t, dir, 0)
+
+	var published publishPackets
+	s.redeliver(published.publish, "msg")
+	if len(published) != 1 || string(published[0].Payload) != "ok" {
+		t.Errorf("unexpected messages redelivered: %v", published)
+	}
+
+	if s.nextSeq != 4 {
+		t.Errorf("unexpected next seq %d", s.nextSeq)
+	}
+}
@@ -0,0 +1,236 @@
+// +build !noclient_mqtt
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/pkg/log"
+	"github.com/goiiot/libmqtt"
+
+	"arhat.dev/arhat/pkg/client/clientutil"
+)
+
+// mqtt v5 user properties of messages published by arhat
+const (
+	userPropSid = "sid"
+	userPropSeq = "seq"
+)
+
+// maxMsgHeaderSize is the max size of a aranyagopb.Msg without payload
+var maxMsgHeaderSize = (&aranyagopb.Msg{
+	Kind:     math.MaxInt32,
+	Sid:      math.MaxUint64,
+	Seq:      math.MaxUint64,
+	Complete: true,
+}).Size() + 1 + binary.MaxVarintLen32 // payload tag and length
+
+// DisconnectError is the error returned when mqtt v5 broker sent DISCONNECT
+// to the client, it wraps clientutil.ErrUnrecoverable if reconnecting with
+// the same config will be rejected again
+type DisconnectError struct {
+	// Code is the reason code of the DISCONNECT packet
+	Code byte
+
+	// Reason is the human readable reason string, can be empty
+	Reason string
+}
+
+func (e *DisconnectError) Error() string {
+	msg := fmt.Sprintf("disconnected by mqtt broker, code: 0x%02x", e.Code)
+	if e.Reason != "" {
+		msg += ", reason: " + e.Reason
+	}
+
+	return msg
+}
+
+// Temporary returns true when the broker may accept the client later
+func (e *DisconnectError) Temporary() bool {
+	switch e.Code {
+	case libmqtt.CodeNotAuthorized,
+		libmqtt.CodeBadAuthenticationMethod,
+		libmqtt.CodeSessionTakenOver,
+		libmqtt.CodeTopicFilterInvalid,
+		libmqtt.CodeTopicNameInvalid,
+		libmqtt.CodePayloadFormatInvalid,
+		libmqtt.CodeRetainNotSupported,
+		libmqtt.CodeQosNoSupported,
+		libmqtt.CodeUseAnotherServer,
+		libmqtt.CodeServerMoved,
+		libmqtt.CodeSharedSubscriptionNotSupported,
+		libmqtt.CodeSubscriptionIdentifiersNotSupported,
+		libmqtt.CodeWildcardSubscriptionNotSupported:
+		return false
+	default:
+		return true
+	}
+}
+
+func (e *DisconnectError) Unwrap() error {
+	if e.Temporary() {
+		return nil
+	}
+
+	return clientutil.ErrUnrecoverable
+}
+
+// connProps returns properties of the CONNECT packet, nil for mqtt 3.1.1
+func (c *Client) connProps() *libmqtt.ConnProps {
+	if !c.v5 {
+		return nil
+	}
+
+	return &libmqtt.ConnProps{SessionExpiryInterval: c.sessionExpiry}
+}
+
+// publishProps returns properties of the PUBLISH packet for the msg,
+// nil for mqtt 3.1.1
+func (c *Client) publishProps(msg *aranyagopb.Msg) *libmqtt.PublishProps {
+	if !c.v5 {
+		return nil
+	}
+
+	props := &libmqtt.PublishProps{UserProps: libmqtt.UserProps{}}
+	switch msg.Kind {
+	case aranyagopb.MSG_DATA, aranyagopb.MSG_DATA_STDERR:
+		props.MessageExpiryInterval = c.messageExpiry
+	}
+
+	props.UserProps.Set(userPropSid, strconv.FormatUint(msg.Sid, 10))
+	props.UserProps.Set(userPropSeq, strconv.FormatUint(msg.Seq, 10))
+
+	return props
+}
+
+// handleV5BrokerPacket inspects CONNACK and DISCONNECT sent by the broker,
+// which are not exposed by libmqtt
+func (c *Client) handleV5BrokerPacket(header byte, body []byte) {
+	switch header >> 4 {
+	case libmqtt.CtrlConnAck:
+		pkt, ok := decodeV5Packet(header, body).(*libmqtt.ConnAckPacket)
+		if !ok || pkt.Code != libmqtt.CodeSuccess || pkt.Props == nil {
+			return
+		}
+
+		c.Log.D("mqtt v5 session established",
+			log.Uint32("maxPacketSize", pkt.Props.MaxPacketSize),
+			log.Uint32("sessionExpiryInterval", pkt.Props.SessionExpiryInterval),
+			log.Uint16("maxRecv", pkt.Props.MaxRecv),
+		)
+
+		c.setBrokerMaxPacketSize(pkt.Props.MaxPacketSize)
+	case libmqtt.CtrlDisConn:
+		// reason code and properties can be omitted
+		derr := &DisconnectError{Code: libmqtt.CodeNormalDisconn}
+		if len(body) > 0 {
+			derr.Code = body[0]
+		}
+
+		// libmqtt can only decode DISCONNECT with property length
+		if len(body) > 1 {
+			pkt, ok := decodeV5Packet(header, body).(*libmqtt.DisconnPacket)
+			if ok && pkt.Props != nil {
+				derr.Reason = pkt.Props.Reason
+			}
+		}
+
+		c.Log.I("received disconnect from broker", log.Error(derr))
+
+		c.setDisconnectError(derr)
+	}
+}
+
+// setBrokerMaxPacketSize limits max payload size according to the max
+// packet size the broker is willing to accept, 0 means no limit
+func (c *Client) setBrokerMaxPacketSize(maxPacketSize uint32) {
+	if maxPacketSize == 0 {
+		atomic.StoreInt64(&c.brokerMaxPayloadSize, 0)
+		return
+	}
+
+	// fixed header, topic name, packet id and properties
+	overhead := 1 + 4 + 2 + len(c.pubTopic) + 2 + 4 +
+		5 + 2*(1+2+len(userPropSid)+2+20)
+
+	size := int64(maxPacketSize) - int64(overhead) - int64(maxMsgHeaderSize)
+	if size <= 0 {
+		// cannot send anything, keep the value positive so the agent
+		// can still make progress and let the broker report the error
+		size = 1
+	}
+
+	atomic.StoreInt64(&c.brokerMaxPayloadSize, size)
+}
+
+func (c *Client) setDisconnectError(derr *DisconnectError) {
+	c.disconnMu.Lock()
+	c.disconnErr = derr
+	c.disconnMu.Unlock()
+}
+
+// disconnectError returns the error from broker's DISCONNECT if any
+func (c *Client) disconnectError() error {
+	c.disconnMu.Lock()
+	defer c.disconnMu.Unlock()
+
+	if c.disconnErr == nil {
+		return nil
+	}
+
+	return c.disconnErr
+}
+
+func decodeV5Packet(header byte, body []byte) libmqtt.Packet {
+	var lenBuf [binary.MaxVarintLen32]byte
+	lenSize := binary.PutUvarint(lenBuf[:], uint64(len(body)))
+
+	buf := make([]byte, 0, 1+lenSize+len(body))
+	buf = append(buf, header)
+	buf = append(buf, lenBuf[:lenSize]...)
+	buf = append(buf, body...)
+
+	pkt, err := libmqtt.Decode(libmqtt.V5, bytes.NewBuffer(buf))
+	if err != nil {
+		return nil
+	}
+
+	return pkt
+}
+
+// secondsOf converts d to seconds used in mqtt v5 properties
+func secondsOf(d time.Duration) uint32 {
+	switch {
+	case d <= 0:
+		return 0
+	case d >= math.MaxUint32*time.Second:
+		return math.MaxUint32
+	case d < time.Second:
+		return 1
+	default:
+		return uint32(d / time.Second)
+	}
+}
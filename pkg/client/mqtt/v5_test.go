@@ -0,0 +1,234 @@
+// +build !noclient_mqtt
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"github.com/goiiot/libmqtt"
+
+	"arhat.dev/arhat/pkg/client/clientutil"
+)
+
+func newTestV5Client(t *testing.T) *Client {
+	base, err := clientutil.NewBaseClient(context.TODO(), func([]byte) {}, 64*1024, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Client{
+		BaseClient: base,
+		pubTopic:   "arhat.test/msg",
+		v5:         true,
+		disconnMu:  new(sync.Mutex),
+		netErrCh:   make(chan error, 1),
+	}
+
+	c.client, err = libmqtt.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// observeInChunks feeds data to a new observedConn of c in chunks of size
+// n to simulate packets split across reads
+func observeInChunks(c *Client, data []byte, n int) {
+	conn := newObservedConn(nil, c.handleBrokerPacket)
+	for len(data) > n {
+		conn.observe(data[:n])
+		data = data[n:]
+	}
+
+	conn.observe(data)
+}
+
+func TestClientPublishProps(t *testing.T) {
+	c := &Client{v5: true, messageExpiry: 30}
+
+	for _, test := range []struct {
+		name   string
+		msg    *aranyagopb.Msg
+		expiry uint32
+		sid    string
+		seq    string
+	}{
+		{
+			name:   "data",
+			msg:    &aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 1, Seq: 2},
+			expiry: 30,
+			sid:    "1",
+			seq:    "2",
+		},
+		{
+			name:   "state",
+			msg:    &aranyagopb.Msg{Kind: aranyagopb.MSG_STATE, Sid: 3},
+			expiry: 0,
+			sid:    "3",
+			seq:    "0",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			props := c.publishProps(test.msg)
+			if props == nil {
+				t.Fatal("no properties for mqtt v5")
+			}
+
+			if props.MessageExpiryInterval != test.expiry {
+				t.Errorf("unexpected message expiry %d", props.MessageExpiryInterval)
+			}
+
+			if sid, _ := props.UserProps.Get(userPropSid); sid != test.sid {
+				t.Errorf("unexpected sid %q", sid)
+			}
+
+			if seq, _ := props.UserProps.Get(userPropSeq); seq != test.seq {
+				t.Errorf("unexpected seq %q", seq)
+			}
+		})
+	}
+
+	c.v5 = false
+	if c.publishProps(&aranyagopb.Msg{Kind: aranyagopb.MSG_DATA}) != nil {
+		t.Error("properties set for mqtt 3.1.1")
+	}
+}
+
+func TestClientConnProps(t *testing.T) {
+	c := &Client{v5: true, sessionExpiry: 3600}
+
+	props := c.connProps()
+	if props == nil || props.SessionExpiryInterval != 3600 {
+		t.Errorf("unexpected connect properties %v", props)
+	}
+
+	c.v5 = false
+	if c.connProps() != nil {
+		t.Error("properties set for mqtt 3.1.1")
+	}
+}
+
+func TestClientBrokerMaxPacketSize(t *testing.T) {
+	c := newTestV5Client(t)
+	baseSize := c.BaseClient.MaxPayloadSize()
+
+	// session present, reason code and maximum packet size property
+	connAck := func(maxPacketSize uint32) []byte {
+		return []byte{
+			libmqtt.CtrlConnAck << 4, 8, 0, libmqtt.CodeSuccess, 5, 39,
+			byte(maxPacketSize >> 24), byte(maxPacketSize >> 16),
+			byte(maxPacketSize >> 8), byte(maxPacketSize),
+		}
+	}
+
+	// packets before CONNACK must be skipped
+	data := append([]byte{libmqtt.CtrlPingResp << 4, 0}, connAck(4096)...)
+
+	for _, n := range []int{1, 3, len(data)} {
+		c.setBrokerMaxPacketSize(0)
+		if c.MaxPayloadSize() != baseSize {
+			t.Fatalf("max payload size %d limited without connack", c.MaxPayloadSize())
+		}
+
+		observeInChunks(c, data, n)
+
+		size := c.MaxPayloadSize()
+		if size <= 0 || size >= 4096-maxMsgHeaderSize {
+			t.Errorf("max payload size %d not limited by broker (chunk size %d)", size, n)
+		}
+	}
+
+	// broker allowing larger packets doesn't raise the configured size
+	observeInChunks(c, connAck(1024*1024), 2)
+	if c.MaxPayloadSize() != baseSize {
+		t.Errorf("max payload size %d not limited by config", c.MaxPayloadSize())
+	}
+}
+
+func TestClientDisconnectError(t *testing.T) {
+	reason := "go away"
+	reasonProp := append([]byte{31, 0, byte(len(reason))}, reason...)
+
+	for _, test := range []struct {
+		name          string
+		packet        []byte
+		code          byte
+		reason        string
+		unrecoverable bool
+	}{
+		{
+			name:   "no reason code",
+			packet: []byte{libmqtt.CtrlDisConn << 4, 0},
+			code:   libmqtt.CodeNormalDisconn,
+		},
+		{
+			name:   "server busy",
+			packet: []byte{libmqtt.CtrlDisConn << 4, 1, libmqtt.CodeServerBusy},
+			code:   libmqtt.CodeServerBusy,
+		},
+		{
+			name:          "not authorized",
+			packet:        []byte{libmqtt.CtrlDisConn << 4, 2, libmqtt.CodeNotAuthorized, 0},
+			code:          libmqtt.CodeNotAuthorized,
+			unrecoverable: true,
+		},
+		{
+			name: "session taken over with reason",
+			packet: append([]byte{
+				libmqtt.CtrlDisConn << 4, byte(2 + len(reasonProp)),
+				libmqtt.CodeSessionTakenOver, byte(len(reasonProp)),
+			}, reasonProp...),
+			code:          libmqtt.CodeSessionTakenOver,
+			reason:        reason,
+			unrecoverable: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestV5Client(t)
+			observeInChunks(c, test.packet, 1)
+
+			var derr *DisconnectError
+			if !errors.As(c.disconnectError(), &derr) {
+				t.Fatal("disconnect error not recorded")
+			}
+
+			if derr.Code != test.code || derr.Reason != test.reason {
+				t.Errorf("unexpected disconnect error %v", derr)
+			}
+
+			// libmqtt reports the closed connection to the net handler
+			c.handleNet(c.client, "test", io.EOF)
+
+			err := <-c.netErrCh
+			if !errors.As(err, &derr) {
+				t.Fatalf("disconnect error not reported: %v", err)
+			}
+
+			if errors.Is(err, clientutil.ErrUnrecoverable) != test.unrecoverable {
+				t.Errorf("unexpected classification of %v", err)
+			}
+		})
+	}
+}
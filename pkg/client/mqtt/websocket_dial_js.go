@@ -0,0 +1,52 @@
+// +build !noclient_mqtt
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// dialWebsocket connects to the mqtt broker with the websocket api of the
+// js runtime, which manages tls and proxy on its own
+func dialWebsocket(
+	ctx context.Context,
+	address string,
+	_ time.Duration,
+	tlsConfig *tls.Config,
+) (net.Conn, error) {
+	scheme := "ws"
+	if tlsConfig != nil {
+		scheme = "wss"
+	}
+
+	// nolint:bodyclose
+	conn, _, err := websocket.Dial(ctx, scheme+"://"+address, &websocket.DialOptions{
+		Subprotocols: []string{"mqtt"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return websocket.NetConn(context.Background(), conn, websocket.MessageBinary), nil
+}
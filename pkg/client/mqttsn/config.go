@@ -0,0 +1,82 @@
+// +build !noclient_mqttsn
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mqttsn
+
+import (
+	"time"
+
+	"arhat.dev/arhat/pkg/client/clientutil"
+	"arhat.dev/arhat/pkg/conf"
+)
+
+type Config struct {
+	clientutil.CommonConfig `json:",inline" yaml:",inline"`
+
+	// Transport is the udp network, one of [udp, udp4, udp6]
+	Transport string `json:"transport" yaml:"transport"`
+
+	// TopicNamespaceFrom is used to derive topics in the same way as the
+	// standard mqtt variant
+	TopicNamespaceFrom conf.ValueFromSpec `json:"topicNamespaceFrom" yaml:"topicNamespaceFrom"`
+
+	ClientID string `json:"clientID" yaml:"clientID"`
+
+	// QoS of published messages, one of [-1, 0, 1]
+	//
+	// qos -1 requires predefined topic ids of msg and status topics
+	QoS int `json:"qos" yaml:"qos"`
+
+	// PredefinedTopicIDs configured in the gateway, topics without
+	// predefined id are registered after connected
+	PredefinedTopicIDs PredefinedTopicIDs `json:"predefinedTopicIDs" yaml:"predefinedTopicIDs"`
+
+	KeepaliveInterval time.Duration `json:"keepaliveInterval" yaml:"keepaliveInterval"`
+
+	// RetryInterval and MaxRetries of requests waiting for acknowledgement
+	RetryInterval time.Duration `json:"retryInterval" yaml:"retryInterval"`
+	MaxRetries    int           `json:"maxRetries" yaml:"maxRetries"`
+
+	// SleepDuration enables asleep state when set, the client goes asleep
+	// after no message published for a keepalive interval
+	SleepDuration time.Duration `json:"sleepDuration" yaml:"sleepDuration"`
+	// WakeInterval is the interval to wake up and receive buffered cmds
+	// when asleep, defaults to half of SleepDuration
+	WakeInterval time.Duration `json:"wakeInterval" yaml:"wakeInterval"`
+
+	// Discovery of gateway, used when endpoint is empty
+	Discovery DiscoveryConfig `json:"discovery" yaml:"discovery"`
+}
+
+type PredefinedTopicIDs struct {
+	Cmd    uint16 `json:"cmd" yaml:"cmd"`
+	Msg    uint16 `json:"msg" yaml:"msg"`
+	Status uint16 `json:"status" yaml:"status"`
+}
+
+type DiscoveryConfig struct {
+	// Address to send SEARCHGW messages, usually a broadcast or multicast
+	// address with port
+	Address string `json:"address" yaml:"address"`
+
+	// Radius of the SEARCHGW broadcast
+	Radius uint8 `json:"radius" yaml:"radius"`
+
+	// Timeout of gateway discovery
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+}
@@ -0,0 +1,88 @@
+// +build !noclient_mqttsn
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mqttsn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// discoverGateway broadcasts SEARCHGW messages to the discovery address
+// and returns the address of the first gateway replied with GWINFO or
+// ADVERTISE
+func (c *Client) discoverGateway(ctx context.Context) (string, error) {
+	raddr, err := net.ResolveUDPAddr(c.network, c.discovery.Address)
+	if err != nil {
+		return "", err
+	}
+
+	pc, err := net.ListenPacket(c.network, ":0")
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = pc.Close() }()
+
+	deadline := time.Now().Add(c.discovery.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	search := (&packet{msgType: msgTypeSearchGW, radius: c.discovery.Radius}).marshal()
+	buf := make([]byte, maxPacketSize)
+	for time.Now().Before(deadline) {
+		_, err = pc.WriteTo(search, raddr)
+		if err != nil {
+			return "", err
+		}
+
+		waitUntil := time.Now().Add(c.retryInterval)
+		if waitUntil.After(deadline) {
+			waitUntil = deadline
+		}
+
+		_ = pc.SetReadDeadline(waitUntil)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				var nErr net.Error
+				if errors.As(err, &nErr) && nErr.Timeout() {
+					break
+				}
+
+				return "", err
+			}
+
+			p, err := unmarshalPacket(buf[:n])
+			if err != nil {
+				continue
+			}
+
+			switch {
+			case p.msgType == msgTypeAdvertise,
+				// GWINFO with gateway address is sent by other clients
+				p.msgType == msgTypeGWInfo && len(p.payload) == 0:
+				return from.String(), nil
+			}
+		}
+	}
+
+	return "", errGatewayNotDiscovered
+}
@@ -0,0 +1,280 @@
+// +build !noclient_mqttsn
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mqttsn
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGateway is an in-process mqtt-sn gateway serving a single client
+// over udp, it records messages published by the client and can publish
+// to the client
+type fakeGateway struct {
+	t    *testing.T
+	conn *net.UDPConn
+
+	mu         *sync.Mutex
+	client     *net.UDPAddr
+	connected  bool
+	willTopic  string
+	willMsg    []byte
+	topics     map[string]uint16
+	subscribed map[string]bool
+	published  map[string][][]byte
+	msgID      uint16
+
+	// pubAcks receives PUBACK from the client
+	pubAcks chan *packet
+}
+
+func newFakeGateway(t *testing.T, predefined map[string]uint16) *fakeGateway {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := &fakeGateway{
+		t:    t,
+		conn: conn,
+
+		mu:         new(sync.Mutex),
+		topics:     make(map[string]uint16),
+		subscribed: make(map[string]bool),
+		published:  make(map[string][][]byte),
+
+		pubAcks: make(chan *packet, 16),
+	}
+
+	for topic, id := range predefined {
+		g.topics[topic] = id
+	}
+
+	go g.serve()
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return g
+}
+
+func (g *fakeGateway) addr() string {
+	return g.conn.LocalAddr().String()
+}
+
+func (g *fakeGateway) send(p *packet) {
+	g.mu.Lock()
+	client := g.client
+	g.mu.Unlock()
+
+	_, _ = g.conn.WriteToUDP(p.marshal(), client)
+}
+
+func (g *fakeGateway) serve() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		p, err := unmarshalPacket(append([]byte{}, buf[:n]...))
+		if err != nil {
+			g.t.Errorf("invalid packet from client: %v", err)
+			continue
+		}
+
+		g.mu.Lock()
+		g.client = addr
+		g.mu.Unlock()
+
+		g.handle(p)
+	}
+}
+
+// topicID returns the id of the topic, assign one if not registered
+func (g *fakeGateway) topicID(topic string) uint16 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	id, ok := g.topics[topic]
+	if !ok {
+		id = uint16(len(g.topics) + 100)
+		g.topics[topic] = id
+	}
+
+	return id
+}
+
+func (g *fakeGateway) topicName(id uint16) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for name, topicID := range g.topics {
+		if topicID == id {
+			return name
+		}
+	}
+
+	return ""
+}
+
+func (g *fakeGateway) handle(p *packet) {
+	switch p.msgType {
+	case msgTypeConnect:
+		if p.flags&flagWill != 0 {
+			g.send(&packet{msgType: msgTypeWillTopicReq})
+			return
+		}
+
+		g.setConnected(true)
+		g.send(&packet{msgType: msgTypeConnAck, code: returnCodeAccepted})
+	case msgTypeWillTopic:
+		g.mu.Lock()
+		g.willTopic = string(p.payload)
+		g.mu.Unlock()
+
+		g.send(&packet{msgType: msgTypeWillMsgReq})
+	case msgTypeWillMsg:
+		g.mu.Lock()
+		g.willMsg = p.payload
+		g.mu.Unlock()
+
+		g.setConnected(true)
+		g.send(&packet{msgType: msgTypeConnAck, code: returnCodeAccepted})
+	case msgTypeRegister:
+		g.send(&packet{
+			msgType: msgTypeRegAck,
+			topicID: g.topicID(string(p.payload)),
+			msgID:   p.msgID,
+			code:    returnCodeAccepted,
+		})
+	case msgTypeSubscribe:
+		topic := string(p.payload)
+		if p.flags&flagTopicIDTypeMask != topicIDTypeNormal {
+			topic = g.topicName(uint16(p.payload[0])<<8 | uint16(p.payload[1]))
+		}
+
+		g.mu.Lock()
+		g.subscribed[topic] = true
+		g.mu.Unlock()
+
+		g.send(&packet{
+			msgType: msgTypeSubAck,
+			flags:   flagQoS1,
+			topicID: g.topicID(topic),
+			msgID:   p.msgID,
+			code:    returnCodeAccepted,
+		})
+	case msgTypePublish:
+		topic := g.topicName(p.topicID)
+
+		g.mu.Lock()
+		g.published[topic] = append(g.published[topic], p.payload)
+		g.mu.Unlock()
+
+		if p.flags&flagQoSMask == flagQoS1 {
+			g.send(&packet{
+				msgType: msgTypePubAck,
+				topicID: p.topicID,
+				msgID:   p.msgID,
+				code:    returnCodeAccepted,
+			})
+		}
+	case msgTypePubAck:
+		g.pubAcks <- p
+	case msgTypePingReq:
+		g.send(&packet{msgType: msgTypePingResp})
+	case msgTypeDisconnect:
+		g.setConnected(false)
+		g.send(&packet{msgType: msgTypeDisconnect})
+	}
+}
+
+func (g *fakeGateway) setConnected(connected bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.connected = connected
+}
+
+func (g *fakeGateway) isConnected() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.connected
+}
+
+// will returns will topic and message of the client
+func (g *fakeGateway) will() (string, []byte) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.willTopic, g.willMsg
+}
+
+func (g *fakeGateway) isSubscribed(topic string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.subscribed[topic]
+}
+
+// messages returns payloads published by the client to the topic
+func (g *fakeGateway) messages(topic string) [][]byte {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return append([][]byte{}, g.published[topic]...)
+}
+
+// publish data to the client with qos 1, returns the return code of PUBACK
+func (g *fakeGateway) publish(topic string, data []byte) (byte, error) {
+	g.mu.Lock()
+	g.msgID++
+	msgID := g.msgID
+	idType := topicIDTypeNormal
+	if g.topics[topic] < 100 {
+		idType = topicIDTypePredefined
+	}
+	g.mu.Unlock()
+
+	g.send(&packet{
+		msgType: msgTypePublish,
+		flags:   flagQoS1 | idType,
+		topicID: g.topicID(topic),
+		msgID:   msgID,
+		payload: data,
+	})
+
+	timer := time.NewTimer(5 * time.Second)
+	defer timer.Stop()
+
+	for {
+		select {
+		case p := <-g.pubAcks:
+			if p.msgID == msgID {
+				return p.code, nil
+			}
+		case <-timer.C:
+			return 0, fmt.Errorf("no PUBACK for msg %d", msgID)
+		}
+	}
+}
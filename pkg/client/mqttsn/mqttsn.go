@@ -0,0 +1,956 @@
+// +build !noclient_mqttsn
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mqttsn
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/aranya-proto/aranyagopb/aranyagoconst"
+	"arhat.dev/pkg/log"
+	"arhat.dev/pkg/nethelper"
+
+	"arhat.dev/arhat/pkg/client"
+	"arhat.dev/arhat/pkg/client/clientutil"
+	"arhat.dev/arhat/pkg/types"
+)
+
+const (
+	defaultMaxPayloadSize    = 1024
+	defaultKeepaliveInterval = 60 * time.Second
+	defaultRetryInterval     = 10 * time.Second
+	defaultMaxRetries        = 3
+	defaultDiscoveryTimeout  = 30 * time.Second
+
+	// maxPacketSize of mqtt-sn messages (2 bytes length field)
+	maxPacketSize = 0xffff
+
+	// maxQueuedCmds is the max count of cmds received but not handled,
+	// cmds exceeding the limit are rejected with congestion
+	maxQueuedCmds = 64
+)
+
+type clientState int32
+
+const (
+	stateDisconnected clientState = iota
+	stateActive
+	stateAsleep
+)
+
+var (
+	errNoResponse             = errors.New("no response from mqtt-sn gateway")
+	errDisconnectedByGateway  = errors.New("disconnected by mqtt-sn gateway")
+	errGatewayClosed          = errors.New("mqtt-sn connection closed")
+	errGatewayNotDiscovered   = errors.New("no mqtt-sn gateway discovered")
+	errNoGatewayOrDiscovery   = errors.New("invalid empty gateway endpoint and discovery address")
+	errQoSM1RequirePredefined = errors.New("qos -1 requires predefined or short topic ids of msg and status topics")
+)
+
+func init() {
+	client.Register("mqtt-sn",
+		func() interface{} {
+			return &Config{
+				CommonConfig: clientutil.CommonConfig{
+					MaxPayloadSize: defaultMaxPayloadSize,
+				},
+				Transport:         "udp",
+				QoS:               1,
+				KeepaliveInterval: defaultKeepaliveInterval,
+				RetryInterval:     defaultRetryInterval,
+				MaxRetries:        defaultMaxRetries,
+				Discovery: DiscoveryConfig{
+					Radius:  1,
+					Timeout: defaultDiscoveryTimeout,
+				},
+			}
+		},
+		NewClient,
+	)
+}
+
+func NewClient(
+	ctx context.Context,
+	handleCmd types.AgentCmdHandleFunc,
+	cfg interface{},
+) (client.Interface, error) {
+	config, ok := cfg.(*Config)
+	if !ok {
+		return nil, fmt.Errorf("unexpected non mqtt-sn config")
+	}
+
+	if config.Endpoint == "" && config.Discovery.Address == "" {
+		return nil, errNoGatewayOrDiscovery
+	}
+
+	if config.ClientID == "" {
+		return nil, fmt.Errorf("invalid empty client id")
+	}
+
+	network := config.Transport
+	switch network {
+	case "":
+		network = "udp"
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("unsupported transport method: %s", config.Transport)
+	}
+
+	if config.QoS < -1 || config.QoS > 1 {
+		return nil, fmt.Errorf("unsupported qos level %d", config.QoS)
+	}
+
+	topicNamespace, err := config.TopicNamespaceFrom.Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get topic namespace value: %w", err)
+	}
+
+	if topicNamespace == "" {
+		return nil, fmt.Errorf("invalid empty topic namespace")
+	}
+
+	maxPayloadSize := config.MaxPayloadSize
+	if maxPayloadSize <= 0 || maxPayloadSize > maxPacketSize-7 {
+		maxPayloadSize = defaultMaxPayloadSize
+	}
+
+	baseClient, err := clientutil.NewBaseClient(ctx, handleCmd, maxPayloadSize, &config.MsgCompression)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create base client: %w", err)
+	}
+
+	tlsConfig, err := config.TLS.GetTLSConfig(false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tls config: %w", err)
+	}
+
+	c := &Client{
+		BaseClient: baseClient,
+
+		network:   network,
+		endpoint:  config.Endpoint,
+		tlsConfig: tlsConfig,
+		discovery: config.Discovery,
+		clientID:  config.ClientID,
+		qos:       config.QoS,
+
+		keepalive:     config.KeepaliveInterval,
+		retryInterval: config.RetryInterval,
+		maxRetries:    config.MaxRetries,
+		sleepDuration: config.SleepDuration,
+		wakeInterval:  config.WakeInterval,
+
+		cmds: newCmdQueue(maxQueuedCmds),
+
+		waitersMu: new(sync.Mutex),
+		waiters:   make(map[waitKey]chan *packet),
+
+		stateMu:  new(sync.Mutex),
+		state:    stateDisconnected,
+		topicsMu: new(sync.RWMutex),
+		topics:   make(map[string]topicRef),
+
+		readErrCh: make(chan error, 1),
+		readDone:  make(chan struct{}),
+		closeOnce: new(sync.Once),
+		closedSig: make(chan struct{}),
+	}
+
+	c.dial = c.dialGateway
+
+	if c.keepalive <= 0 || c.keepalive.Seconds() > 0xffff {
+		c.keepalive = defaultKeepaliveInterval
+	}
+
+	if c.keepalive < time.Second {
+		c.keepalive = time.Second
+	}
+
+	if c.retryInterval <= 0 {
+		c.retryInterval = defaultRetryInterval
+	}
+
+	if c.maxRetries <= 0 {
+		c.maxRetries = defaultMaxRetries
+	}
+
+	if c.sleepDuration.Seconds() > 0xffff {
+		return nil, fmt.Errorf("sleep duration too long")
+	}
+
+	if c.wakeInterval <= 0 || c.wakeInterval >= c.sleepDuration {
+		c.wakeInterval = c.sleepDuration / 2
+	}
+
+	if c.discovery.Timeout <= 0 {
+		c.discovery.Timeout = defaultDiscoveryTimeout
+	}
+
+	c.onlineMsgBytes, c.offlineMsgBytes = clientutil.CreateOnlineOfflineMessage(config.ClientID)
+	c.cmdTopic, c.msgTopic, c.statusTopic = aranyagoconst.MQTTTopics(topicNamespace)
+
+	for topic, id := range map[string]uint16{
+		c.cmdTopic:    config.PredefinedTopicIDs.Cmd,
+		c.msgTopic:    config.PredefinedTopicIDs.Msg,
+		c.statusTopic: config.PredefinedTopicIDs.Status,
+	} {
+		switch {
+		case id != 0:
+			c.topics[topic] = topicRef{id: id, idType: topicIDTypePredefined}
+		case len(topic) == 2:
+			c.topics[topic] = topicRef{id: uint16(topic[0])<<8 | uint16(topic[1]), idType: topicIDTypeShort}
+		}
+	}
+
+	if c.qos == -1 {
+		_, msgOK := c.topics[c.msgTopic]
+		_, statusOK := c.topics[c.statusTopic]
+		if !msgOK || !statusOK {
+			return nil, errQoSM1RequirePredefined
+		}
+	}
+
+	return c, nil
+}
+
+// topicRef is the reference to a topic in mqtt-sn messages
+type topicRef struct {
+	id     uint16
+	idType byte
+}
+
+type waitKey struct {
+	msgType byte
+	msgID   uint16
+}
+
+type Client struct {
+	*clientutil.BaseClient
+
+	network   string
+	endpoint  string
+	tlsConfig *tls.Config
+	discovery DiscoveryConfig
+	clientID  string
+	qos       int
+
+	keepalive     time.Duration
+	retryInterval time.Duration
+	maxRetries    int
+	sleepDuration time.Duration
+	wakeInterval  time.Duration
+
+	cmdTopic    string
+	msgTopic    string
+	statusTopic string
+
+	onlineMsgBytes  []byte
+	offlineMsgBytes []byte
+
+	// dial creates the datagram connection to the gateway, can be replaced
+	// to work with an in-process mqtt-sn gateway
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	conn net.Conn
+
+	// cmds received are handled in a separate goroutine started in Start,
+	// cmd handling may publish messages and wait for acknowledgements from
+	// the read loop
+	cmds *cmdQueue
+
+	waitersMu *sync.Mutex
+	waiters   map[waitKey]chan *packet
+	msgID     uint32
+
+	// stateMu serializes state transitions and requests waiting for
+	// acknowledgements
+	stateMu    *sync.Mutex
+	state      clientState
+	lastActive time.Time
+
+	topicsMu *sync.RWMutex
+	// topics are references to known topics by topic name
+	topics map[string]topicRef
+
+	readErrCh chan error
+	readDone  chan struct{}
+	closeOnce *sync.Once
+	closedSig chan struct{}
+}
+
+func (c *Client) Connect(dialCtx context.Context) error {
+	addr := c.endpoint
+	if addr == "" {
+		var err error
+		addr, err = c.discoverGateway(dialCtx)
+		if err != nil {
+			return err
+		}
+
+		c.Log.I("discovered mqtt-sn gateway", log.String("addr", addr))
+	}
+
+	conn, err := c.dial(dialCtx, c.network, addr)
+	if err != nil {
+		return fmt.Errorf("failed to dial mqtt-sn gateway: %w", err)
+	}
+
+	c.conn = conn
+	go c.readLoop()
+
+	err = c.setup()
+	if err != nil {
+		c.closeConn()
+		return err
+	}
+
+	return nil
+}
+
+// setup connects to the gateway and registers topics to publish, cmd topic
+// is subscribed in Start, so a standby client does not receive cmds
+func (c *Client) setup() error {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	err := c.connect()
+	if err != nil {
+		return err
+	}
+
+	for _, topic := range []string{c.msgTopic, c.statusTopic} {
+		_, err = c.topicRef(topic)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) Start(appCtx context.Context) error {
+	defer c.shutdown()
+
+	c.cmds.open()
+	go c.handleCmds()
+
+	err := c.subscribeCmds()
+	if err != nil {
+		return err
+	}
+
+	// publish online message
+	err = c.publish(c.statusTopic, c.onlineMsgBytes)
+	if err != nil {
+		return fmt.Errorf("failed to publish initial online message: %w", err)
+	}
+
+	timer := time.NewTimer(c.keepalive)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-c.Context().Done():
+			return nil
+		case <-appCtx.Done():
+			return nil
+		case err = <-c.readErrCh:
+			return err
+		case <-timer.C:
+		}
+
+		err = c.tick()
+		if err != nil {
+			return err
+		}
+
+		if c.getState() == stateAsleep {
+			timer.Reset(c.wakeInterval)
+		} else {
+			timer.Reset(c.keepalive)
+		}
+	}
+}
+
+// Ping the gateway, only usable before going asleep
+func (c *Client) Ping(ctx context.Context) error {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	if c.state != stateActive {
+		return clientutil.ErrClientNotConnected
+	}
+
+	_, err := c.request(&packet{msgType: msgTypePingReq}, msgTypePingResp)
+	return err
+}
+
+func (c *Client) PostMsg(msg *aranyagopb.Msg) error {
+	data, err := c.EncodeMsg(msg)
+	if err != nil {
+		return err
+	}
+
+	return c.publish(c.msgTopic, data)
+}
+
+func (c *Client) Close() error {
+	return c.OnClose(func() error {
+		c.shutdown()
+		return nil
+	})
+}
+
+func (c *Client) dialGateway(ctx context.Context, network, addr string) (net.Conn, error) {
+	if c.tlsConfig != nil {
+		return nethelper.Dial(ctx, nil, network, addr, c.tlsConfig)
+	}
+
+	return nethelper.Dial(ctx, nil, network, addr, nil)
+}
+
+// shutdown publishes offline message and disconnects gracefully if
+// connected, the offline message is published by the gateway as will
+// message if not
+func (c *Client) shutdown() {
+	c.closeOnce.Do(func() {
+		if c.conn == nil {
+			close(c.closedSig)
+			return
+		}
+
+		if c.getState() != stateDisconnected {
+			_ = c.publish(c.statusTopic, c.offlineMsgBytes)
+			_, _ = c.conn.Write((&packet{msgType: msgTypeDisconnect}).marshal())
+		}
+
+		c.closeConn()
+	})
+}
+
+func (c *Client) closeConn() {
+	c.stateMu.Lock()
+	c.state = stateDisconnected
+	c.stateMu.Unlock()
+
+	select {
+	case <-c.closedSig:
+	default:
+		close(c.closedSig)
+	}
+
+	_ = c.conn.Close()
+}
+
+func (c *Client) getState() clientState {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	return c.state
+}
+
+// tick does keepalive when active, goes asleep when idle if sleep enabled
+// and wakes up to receive buffered cmds when asleep
+func (c *Client) tick() error {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	switch c.state {
+	case stateActive:
+		if c.sleepDuration > 0 && time.Since(c.lastActive) >= c.keepalive {
+			_, err := c.request(&packet{
+				msgType:  msgTypeDisconnect,
+				duration: uint16(c.sleepDuration / time.Second),
+			}, msgTypeDisconnect)
+			if err != nil {
+				return fmt.Errorf("failed to go asleep: %w", err)
+			}
+
+			c.state = stateAsleep
+			return nil
+		}
+
+		_, err := c.request(&packet{msgType: msgTypePingReq}, msgTypePingResp)
+		if err != nil {
+			return fmt.Errorf("keepalive failed: %w", err)
+		}
+	case stateAsleep:
+		// buffered messages are sent by the gateway before PINGRESP, and
+		// the client is asleep again after PINGRESP
+		_, err := c.request(&packet{
+			msgType: msgTypePingReq,
+			payload: []byte(c.clientID),
+		}, msgTypePingResp)
+		if err != nil {
+			return fmt.Errorf("failed to wake up: %w", err)
+		}
+	default:
+		return clientutil.ErrClientNotConnected
+	}
+
+	return nil
+}
+
+// connect sends CONNECT and waits for CONNACK, will topic and message are
+// sent by the read loop when requested
+//
+// MUST be called with stateMu locked
+func (c *Client) connect() error {
+	resp, err := c.request(&packet{
+		msgType:  msgTypeConnect,
+		flags:    flagWill, // keep session for asleep state
+		duration: uint16(c.keepalive / time.Second),
+		payload:  []byte(c.clientID),
+	}, msgTypeConnAck)
+	if err != nil {
+		return fmt.Errorf("failed to connect mqtt-sn gateway: %w", err)
+	}
+
+	switch resp.code {
+	case returnCodeAccepted:
+	case returnCodeCongestion:
+		return fmt.Errorf("mqtt-sn connection rejected: congestion")
+	default:
+		return fmt.Errorf("mqtt-sn connection rejected with code %d: %w", resp.code, clientutil.ErrUnrecoverable)
+	}
+
+	c.state = stateActive
+	c.lastActive = time.Now()
+
+	return nil
+}
+
+// subscribeCmds subscribes cmd topic, connect again if asleep
+func (c *Client) subscribeCmds() error {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	switch c.state {
+	case stateDisconnected:
+		return clientutil.ErrClientNotConnected
+	case stateAsleep:
+		err := c.connect()
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.subscribe(c.cmdTopic)
+}
+
+// subscribe topic with qos 1
+//
+// MUST be called with stateMu locked
+func (c *Client) subscribe(topic string) error {
+	p := &packet{
+		msgType: msgTypeSubscribe,
+		flags:   flagQoS1,
+		msgID:   c.nextMsgID(),
+	}
+
+	c.topicsMu.RLock()
+	ref, ok := c.topics[topic]
+	c.topicsMu.RUnlock()
+
+	if ok {
+		p.flags |= ref.idType
+		p.payload = []byte{byte(ref.id >> 8), byte(ref.id)}
+	} else {
+		p.flags |= topicIDTypeNormal
+		p.payload = []byte(topic)
+	}
+
+	resp, err := c.request(p, msgTypeSubAck)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe topic %q: %w", topic, err)
+	}
+
+	if resp.code != returnCodeAccepted {
+		return fmt.Errorf("subscription of topic %q rejected with code %d", topic, resp.code)
+	}
+
+	if !ok {
+		c.setTopicRef(topic, topicRef{id: resp.topicID, idType: topicIDTypeNormal})
+	}
+
+	return nil
+}
+
+// topicRef returns reference of the topic, topic is registered if unknown
+//
+// MUST be called with stateMu locked
+func (c *Client) topicRef(topic string) (topicRef, error) {
+	c.topicsMu.RLock()
+	ref, ok := c.topics[topic]
+	c.topicsMu.RUnlock()
+
+	if ok {
+		return ref, nil
+	}
+
+	resp, err := c.request(&packet{
+		msgType: msgTypeRegister,
+		msgID:   c.nextMsgID(),
+		payload: []byte(topic),
+	}, msgTypeRegAck)
+	if err != nil {
+		return ref, fmt.Errorf("failed to register topic %q: %w", topic, err)
+	}
+
+	if resp.code != returnCodeAccepted {
+		return ref, fmt.Errorf("registration of topic %q rejected with code %d", topic, resp.code)
+	}
+
+	ref = topicRef{id: resp.topicID, idType: topicIDTypeNormal}
+	c.setTopicRef(topic, ref)
+
+	return ref, nil
+}
+
+func (c *Client) setTopicRef(topic string, ref topicRef) {
+	c.topicsMu.Lock()
+	defer c.topicsMu.Unlock()
+
+	c.topics[topic] = ref
+}
+
+func (c *Client) deleteTopicRef(topic string) {
+	c.topicsMu.Lock()
+	defer c.topicsMu.Unlock()
+
+	delete(c.topics, topic)
+}
+
+// publish data to the topic with configured qos, connect again if asleep
+func (c *Client) publish(topic string, data []byte) error {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	switch c.state {
+	case stateDisconnected:
+		return clientutil.ErrClientNotConnected
+	case stateAsleep:
+		// qos -1 messages can be published in any state
+		if c.qos >= 0 {
+			err := c.connect()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := 0; ; i++ {
+		ref, err := c.topicRef(topic)
+		if err != nil {
+			return err
+		}
+
+		p := &packet{
+			msgType: msgTypePublish,
+			flags:   qosFlag(c.qos) | ref.idType,
+			topicID: ref.id,
+			payload: data,
+		}
+
+		if c.qos < 1 {
+			_, err = c.conn.Write(p.marshal())
+			if err != nil {
+				return err
+			}
+
+			break
+		}
+
+		p.msgID = c.nextMsgID()
+		resp, err := c.request(p, msgTypePubAck)
+		if err != nil {
+			return fmt.Errorf("failed to publish to topic %q: %w", topic, err)
+		}
+
+		if resp.code == returnCodeAccepted {
+			break
+		}
+
+		if resp.code == returnCodeInvalidTopicID && ref.idType == topicIDTypeNormal && i == 0 {
+			// registration lost, register again
+			c.deleteTopicRef(topic)
+			continue
+		}
+
+		return fmt.Errorf("publish to topic %q rejected with code %d", topic, resp.code)
+	}
+
+	if c.state == stateActive {
+		c.lastActive = time.Now()
+	}
+
+	return nil
+}
+
+// request sends the packet and waits for the response, the packet is sent
+// again if no response received in retry interval
+func (c *Client) request(p *packet, respType byte) (*packet, error) {
+	key := waitKey{msgType: respType, msgID: p.msgID}
+	if respType != msgTypeRegAck && respType != msgTypePubAck && respType != msgTypeSubAck {
+		key.msgID = 0
+	}
+
+	ch := make(chan *packet, 1)
+	c.waitersMu.Lock()
+	c.waiters[key] = ch
+	c.waitersMu.Unlock()
+
+	defer func() {
+		c.waitersMu.Lock()
+		delete(c.waiters, key)
+		c.waitersMu.Unlock()
+	}()
+
+	timer := time.NewTimer(c.retryInterval)
+	defer timer.Stop()
+
+	for i := 0; i <= c.maxRetries; i++ {
+		if i > 0 {
+			p.flags |= flagDUP
+			timer.Reset(c.retryInterval)
+		}
+
+		_, err := c.conn.Write(p.marshal())
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case resp := <-ch:
+			return resp, nil
+		case <-c.readDone:
+			return nil, errGatewayClosed
+		case <-timer.C:
+		}
+	}
+
+	return nil, errNoResponse
+}
+
+// deliver response to the waiter, returns false if no one is waiting
+func (c *Client) deliver(key waitKey, p *packet) bool {
+	c.waitersMu.Lock()
+	ch, ok := c.waiters[key]
+	c.waitersMu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	select {
+	case ch <- p:
+	default:
+		// duplicate response
+	}
+
+	return true
+}
+
+func (c *Client) nextMsgID() uint16 {
+	for {
+		id := uint16(atomic.AddUint32(&c.msgID, 1))
+		if id != 0 {
+			return id
+		}
+	}
+}
+
+func (c *Client) send(p *packet) {
+	_, err := c.conn.Write(p.marshal())
+	if err != nil {
+		c.Log.I("failed to send mqtt-sn message", log.Error(err))
+	}
+}
+
+func (c *Client) readLoop() {
+	defer close(c.readDone)
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			select {
+			case <-c.closedSig:
+				err = errGatewayClosed
+			default:
+			}
+
+			select {
+			case c.readErrCh <- err:
+			default:
+			}
+
+			return
+		}
+
+		p, err := unmarshalPacket(append([]byte{}, buf[:n]...))
+		if err != nil {
+			c.Log.I("invalid mqtt-sn message", log.Error(err))
+			continue
+		}
+
+		c.handlePacket(p)
+	}
+}
+
+func (c *Client) handlePacket(p *packet) {
+	switch p.msgType {
+	case msgTypePublish:
+		c.handlePublish(p)
+	case msgTypeRegister:
+		// gateway informs topic id of topic name before publishing to it
+		c.setTopicRef(string(p.payload), topicRef{id: p.topicID, idType: topicIDTypeNormal})
+		c.send(&packet{
+			msgType: msgTypeRegAck,
+			topicID: p.topicID,
+			msgID:   p.msgID,
+			code:    returnCodeAccepted,
+		})
+	case msgTypeWillTopicReq:
+		c.send(&packet{
+			msgType: msgTypeWillTopic,
+			flags:   flagQoS1,
+			payload: []byte(c.statusTopic),
+		})
+	case msgTypeWillMsgReq:
+		c.send(&packet{
+			msgType: msgTypeWillMsg,
+			payload: c.offlineMsgBytes,
+		})
+	case msgTypePingReq:
+		c.send(&packet{msgType: msgTypePingResp})
+	case msgTypeDisconnect:
+		if !c.deliver(waitKey{msgType: p.msgType}, p) {
+			select {
+			case c.readErrCh <- errDisconnectedByGateway:
+			default:
+			}
+		}
+	case msgTypeConnAck, msgTypePingResp:
+		_ = c.deliver(waitKey{msgType: p.msgType}, p)
+	case msgTypeRegAck, msgTypePubAck, msgTypeSubAck:
+		_ = c.deliver(waitKey{msgType: p.msgType, msgID: p.msgID}, p)
+	}
+}
+
+func (c *Client) handlePublish(p *packet) {
+	c.topicsMu.RLock()
+	ref, ok := c.topics[c.cmdTopic]
+	c.topicsMu.RUnlock()
+
+	isCmd := ok && ref.id == p.topicID && ref.idType == p.flags&flagTopicIDTypeMask
+
+	code := returnCodeInvalidTopicID
+	if isCmd {
+		code = returnCodeAccepted
+		// not started (standby with a resumed session) or too many cmds
+		// pending, let the gateway deliver it later
+		if !c.cmds.push(p.payload) {
+			code = returnCodeCongestion
+			c.Log.I("cmd rejected, client not started or cmd queue full")
+		}
+	}
+
+	if p.flags&flagQoSMask == flagQoS1 {
+		c.send(&packet{
+			msgType: msgTypePubAck,
+			topicID: p.topicID,
+			msgID:   p.msgID,
+			code:    code,
+		})
+	}
+}
+
+func (c *Client) handleCmds() {
+	for {
+		select {
+		case <-c.readDone:
+			return
+		case <-c.cmds.signal:
+		}
+
+		for _, cmd := range c.cmds.popAll() {
+			c.HandleCmd(cmd)
+		}
+	}
+}
+
+// cmdQueue is a bounded queue of received cmds, cmds are only accepted
+// after opened
+type cmdQueue struct {
+	mu     *sync.Mutex
+	opened bool
+	size   int
+	cmds   [][]byte
+	signal chan struct{}
+}
+
+func newCmdQueue(size int) *cmdQueue {
+	return &cmdQueue{
+		mu:     new(sync.Mutex),
+		size:   size,
+		signal: make(chan struct{}, 1),
+	}
+}
+
+func (q *cmdQueue) open() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.opened = true
+}
+
+// push cmd to the queue, returns false if not opened or full
+func (q *cmdQueue) push(cmd []byte) bool {
+	q.mu.Lock()
+	if !q.opened || len(q.cmds) >= q.size {
+		q.mu.Unlock()
+		return false
+	}
+
+	q.cmds = append(q.cmds, cmd)
+	q.mu.Unlock()
+
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+func (q *cmdQueue) popAll() [][]byte {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	cmds := q.cmds
+	q.cmds = nil
+	return cmds
+}
@@ -0,0 +1,223 @@
+// +build !noclient_mqttsn
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mqttsn
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	_ "arhat.dev/pkg/nethelper/stdnet" // add udp network support
+
+	"arhat.dev/arhat/pkg/client/clientutil"
+	"arhat.dev/arhat/pkg/conf"
+)
+
+// cmdRecorder records cmds handled by the client
+type cmdRecorder struct {
+	mu   *sync.Mutex
+	cmds [][]byte
+}
+
+func (r *cmdRecorder) handleCmd(cmdBytes []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cmds = append(r.cmds, cmdBytes)
+}
+
+func (r *cmdRecorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.cmds)
+}
+
+func newTestClient(
+	t *testing.T, g *fakeGateway, predefined PredefinedTopicIDs, handleCmd func(cmdBytes []byte),
+) *Client {
+	c, err := NewClient(context.TODO(), handleCmd, &Config{
+		CommonConfig: clientutil.CommonConfig{
+			Endpoint:       g.addr(),
+			MaxPayloadSize: defaultMaxPayloadSize,
+		},
+		TopicNamespaceFrom: conf.ValueFromSpec{Text: "arhat.test"},
+		ClientID:           "foo",
+		QoS:                1,
+		PredefinedTopicIDs: predefined,
+		KeepaliveInterval:  time.Minute,
+		RetryInterval:      time.Second,
+		MaxRetries:         3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c.(*Client)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestClient(t *testing.T) {
+	var (
+		g        = newFakeGateway(t, nil)
+		recorder = &cmdRecorder{mu: new(sync.Mutex)}
+		c        = newTestClient(t, g, PredefinedTopicIDs{}, recorder.handleCmd)
+	)
+
+	err := c.Connect(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	willTopic, willMsg := g.will()
+	if willTopic != c.statusTopic || !bytes.Equal(willMsg, c.offlineMsgBytes) {
+		t.Errorf("unexpected will topic %q and message", willTopic)
+	}
+
+	if g.isSubscribed(c.cmdTopic) {
+		t.Error("cmd topic subscribed before started")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Start(context.TODO())
+	}()
+
+	waitFor(t, "online message", func() bool {
+		return len(g.messages(c.statusTopic)) == 1
+	})
+
+	if !g.isSubscribed(c.cmdTopic) {
+		t.Error("cmd topic not subscribed after started")
+	}
+
+	if !bytes.Equal(g.messages(c.statusTopic)[0], c.onlineMsgBytes) {
+		t.Error("unexpected online message")
+	}
+
+	code, err := g.publish(c.cmdTopic, []byte("cmd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code != returnCodeAccepted {
+		t.Errorf("cmd rejected with code %d", code)
+	}
+
+	waitFor(t, "cmd handled", func() bool { return recorder.count() == 1 })
+
+	err = c.PostMsg(&aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 1, Payload: []byte("data")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := g.messages(c.msgTopic)
+	if len(msgs) != 1 {
+		t.Fatalf("expecting 1 msg published, got %d", len(msgs))
+	}
+
+	msg := new(aranyagopb.Msg)
+	if err = msg.Unmarshal(msgs[0]); err != nil || string(msg.Payload) != "data" {
+		t.Errorf("unexpected msg published: %v", err)
+	}
+
+	_ = c.Close()
+	if err = <-done; err != nil {
+		t.Error(err)
+	}
+
+	status := g.messages(c.statusTopic)
+	if len(status) != 2 || !bytes.Equal(status[1], c.offlineMsgBytes) {
+		t.Error("offline message not published")
+	}
+
+	waitFor(t, "disconnected", func() bool { return !g.isConnected() })
+}
+
+func TestClientStandby(t *testing.T) {
+	var (
+		g        = newFakeGateway(t, map[string]uint16{"arhat.test/cmd": 1})
+		recorder = &cmdRecorder{mu: new(sync.Mutex)}
+		c        = newTestClient(t, g, PredefinedTopicIDs{Cmd: 1}, recorder.handleCmd)
+	)
+
+	err := c.Connect(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+
+	// a resumed session of the standby client may still deliver cmds with
+	// predefined topic id
+	code, err := g.publish(c.cmdTopic, []byte("cmd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code != returnCodeCongestion {
+		t.Errorf("cmd to standby client not rejected, code %d", code)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if recorder.count() != 0 {
+		t.Error("cmd handled by standby client")
+	}
+}
+
+func TestCmdQueue(t *testing.T) {
+	q := newCmdQueue(2)
+
+	if q.push([]byte("0")) {
+		t.Error("cmd accepted before opened")
+	}
+
+	q.open()
+	for i := 0; i < 2; i++ {
+		if !q.push([]byte{byte(i)}) {
+			t.Fatalf("cmd %d rejected", i)
+		}
+	}
+
+	if q.push([]byte("2")) {
+		t.Error("cmd accepted when queue full")
+	}
+
+	if cmds := q.popAll(); len(cmds) != 2 {
+		t.Errorf("expecting 2 cmds, got %d", len(cmds))
+	}
+
+	if !q.push([]byte("3")) {
+		t.Error("cmd rejected after queue drained")
+	}
+}
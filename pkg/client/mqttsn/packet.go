@@ -0,0 +1,251 @@
+// +build !noclient_mqttsn
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mqttsn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// mqtt-sn message types
+const (
+	msgTypeAdvertise    byte = 0x00
+	msgTypeSearchGW     byte = 0x01
+	msgTypeGWInfo       byte = 0x02
+	msgTypeConnect      byte = 0x04
+	msgTypeConnAck      byte = 0x05
+	msgTypeWillTopicReq byte = 0x06
+	msgTypeWillTopic    byte = 0x07
+	msgTypeWillMsgReq   byte = 0x08
+	msgTypeWillMsg      byte = 0x09
+	msgTypeRegister     byte = 0x0a
+	msgTypeRegAck       byte = 0x0b
+	msgTypePublish      byte = 0x0c
+	msgTypePubAck       byte = 0x0d
+	msgTypeSubscribe    byte = 0x12
+	msgTypeSubAck       byte = 0x13
+	msgTypePingReq      byte = 0x16
+	msgTypePingResp     byte = 0x17
+	msgTypeDisconnect   byte = 0x18
+)
+
+// flags field
+const (
+	flagDUP     byte = 0x80
+	flagQoSMask byte = 0x60
+	flagQoS0    byte = 0x00
+	flagQoS1    byte = 0x20
+	flagQoSM1   byte = 0x60
+	flagWill    byte = 0x08
+
+	flagTopicIDTypeMask byte = 0x03
+)
+
+// topic id types
+const (
+	topicIDTypeNormal     byte = 0x00
+	topicIDTypePredefined byte = 0x01
+	topicIDTypeShort      byte = 0x02
+)
+
+// return codes
+const (
+	returnCodeAccepted       byte = 0x00
+	returnCodeCongestion     byte = 0x01
+	returnCodeInvalidTopicID byte = 0x02
+)
+
+const protocolID byte = 0x01
+
+var errMalformedPacket = errors.New("malformed mqtt-sn packet")
+
+// packet is a mqtt-sn message, only fields used by its message type are
+// encoded
+type packet struct {
+	msgType  byte
+	flags    byte
+	code     byte
+	gwID     byte
+	radius   byte
+	topicID  uint16
+	msgID    uint16
+	duration uint16
+
+	// payload is message type specific, it can be topic name, published
+	// data, client id, will topic, will message or gateway address
+	payload []byte
+}
+
+func (p *packet) marshal() []byte {
+	body := make([]byte, 0, 7+len(p.payload))
+	u16 := func(v uint16) {
+		body = append(body, byte(v>>8), byte(v))
+	}
+
+	switch p.msgType {
+	case msgTypeAdvertise:
+		body = append(body, p.gwID)
+		u16(p.duration)
+	case msgTypeSearchGW:
+		body = append(body, p.radius)
+	case msgTypeGWInfo:
+		body = append(body, p.gwID)
+		body = append(body, p.payload...)
+	case msgTypeConnect:
+		body = append(body, p.flags, protocolID)
+		u16(p.duration)
+		body = append(body, p.payload...)
+	case msgTypeConnAck:
+		body = append(body, p.code)
+	case msgTypeWillTopic:
+		body = append(body, p.flags)
+		body = append(body, p.payload...)
+	case msgTypeWillMsg, msgTypePingReq:
+		body = append(body, p.payload...)
+	case msgTypeRegister:
+		u16(p.topicID)
+		u16(p.msgID)
+		body = append(body, p.payload...)
+	case msgTypeRegAck, msgTypePubAck:
+		u16(p.topicID)
+		u16(p.msgID)
+		body = append(body, p.code)
+	case msgTypePublish:
+		body = append(body, p.flags)
+		u16(p.topicID)
+		u16(p.msgID)
+		body = append(body, p.payload...)
+	case msgTypeSubscribe:
+		body = append(body, p.flags)
+		u16(p.msgID)
+		body = append(body, p.payload...)
+	case msgTypeSubAck:
+		body = append(body, p.flags)
+		u16(p.topicID)
+		u16(p.msgID)
+		body = append(body, p.code)
+	case msgTypeDisconnect:
+		if p.duration != 0 {
+			u16(p.duration)
+		}
+	}
+
+	length := len(body) + 2
+	if length <= 0xff {
+		return append([]byte{byte(length), p.msgType}, body...)
+	}
+
+	length += 2
+	return append([]byte{0x01, byte(length >> 8), byte(length), p.msgType}, body...)
+}
+
+func unmarshalPacket(data []byte) (*packet, error) {
+	if len(data) < 2 {
+		return nil, errMalformedPacket
+	}
+
+	length, headerSize := int(data[0]), 1
+	if data[0] == 0x01 {
+		if len(data) < 4 {
+			return nil, errMalformedPacket
+		}
+
+		length, headerSize = int(binary.BigEndian.Uint16(data[1:])), 3
+	}
+
+	if length > len(data) || length < headerSize+1 {
+		return nil, errMalformedPacket
+	}
+
+	p := &packet{msgType: data[headerSize]}
+	body := data[headerSize+1 : length]
+
+	// minimum body size of the message type
+	var min int
+	switch p.msgType {
+	case msgTypeAdvertise, msgTypeConnect:
+		min = 3
+	case msgTypeSearchGW, msgTypeGWInfo, msgTypeConnAck, msgTypeWillTopic:
+		min = 1
+	case msgTypeRegister:
+		min = 4
+	case msgTypeSubscribe:
+		min = 3
+	case msgTypeRegAck, msgTypePubAck, msgTypePublish:
+		min = 5
+	case msgTypeSubAck:
+		min = 6
+	}
+
+	if len(body) < min {
+		return nil, fmt.Errorf("%w: message type %d too short", errMalformedPacket, p.msgType)
+	}
+
+	u16 := func(i int) uint16 {
+		return binary.BigEndian.Uint16(body[i:])
+	}
+
+	switch p.msgType {
+	case msgTypeAdvertise:
+		p.gwID, p.duration = body[0], u16(1)
+	case msgTypeSearchGW:
+		p.radius = body[0]
+	case msgTypeGWInfo:
+		p.gwID, p.payload = body[0], body[1:]
+	case msgTypeConnect:
+		p.flags, p.duration, p.payload = body[0], u16(2), body[4:]
+		if body[1] != protocolID {
+			return nil, fmt.Errorf("unsupported mqtt-sn protocol id %d", body[1])
+		}
+	case msgTypeConnAck:
+		p.code = body[0]
+	case msgTypeWillTopic:
+		p.flags, p.payload = body[0], body[1:]
+	case msgTypeWillMsg, msgTypePingReq:
+		p.payload = body
+	case msgTypeRegister:
+		p.topicID, p.msgID, p.payload = u16(0), u16(2), body[4:]
+	case msgTypeRegAck, msgTypePubAck:
+		p.topicID, p.msgID, p.code = u16(0), u16(2), body[4]
+	case msgTypePublish:
+		p.flags, p.topicID, p.msgID, p.payload = body[0], u16(1), u16(3), body[5:]
+	case msgTypeSubscribe:
+		p.flags, p.msgID, p.payload = body[0], u16(1), body[3:]
+	case msgTypeSubAck:
+		p.flags, p.topicID, p.msgID, p.code = body[0], u16(1), u16(3), body[5]
+	case msgTypeDisconnect:
+		if len(body) >= 2 {
+			p.duration = u16(0)
+		}
+	}
+
+	return p, nil
+}
+
+func qosFlag(qos int) byte {
+	switch qos {
+	case -1:
+		return flagQoSM1
+	case 1:
+		return flagQoS1
+	default:
+		return flagQoS0
+	}
+}
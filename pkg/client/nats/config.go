@@ -50,4 +50,16 @@ type Config struct {
 
 	NKey string `json:"nkey" yaml:"nkey"`
 	JWT  string `json:"jwt" yaml:"jwt"`
+
+	// JetStream options, only used by nats-jetstream
+	JetStream JetStreamConfig `json:"jetstream" yaml:"jetstream"`
+}
+
+type JetStreamConfig struct {
+	// Stream containing the cmd subject, looked up by subject if empty
+	Stream string `json:"stream" yaml:"stream"`
+
+	// Durable name of the cmd consumer, defaults to ClientID with
+	// characters not allowed replaced by `_`
+	Durable string `json:"durable" yaml:"durable"`
 }
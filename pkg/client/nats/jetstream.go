@@ -0,0 +1,250 @@
+// +build !noclient_nats
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nats
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/aranya-proto/aranyagopb/aranyagoconst"
+	"arhat.dev/pkg/log"
+	"github.com/nats-io/nats.go"
+
+	"arhat.dev/arhat/pkg/client"
+	"arhat.dev/arhat/pkg/client/clientutil"
+	"arhat.dev/arhat/pkg/types"
+)
+
+func init() {
+	client.Register("nats-jetstream",
+		func() interface{} {
+			return &Config{
+				CommonConfig: clientutil.CommonConfig{
+					MaxPayloadSize: 1024 * 1024,
+				},
+				PingInterval: nats.DefaultPingInterval,
+				AckWait:      15 * time.Second,
+			}
+		},
+		NewJetStreamClient,
+	)
+}
+
+func NewJetStreamClient(
+	ctx context.Context,
+	handleCmd types.AgentCmdHandleFunc,
+	cfg interface{},
+) (client.Interface, error) {
+	config, ok := cfg.(*Config)
+	if !ok {
+		return nil, fmt.Errorf("unexpected non nats config")
+	}
+
+	if config.Endpoint == "" {
+		return nil, fmt.Errorf("invalid empty nats server endpoint")
+	}
+
+	if config.SubjectNamespace == "" {
+		return nil, fmt.Errorf("invalid empty subject namespace")
+	}
+
+	durable := config.JetStream.Durable
+	if durable == "" {
+		durable = strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_").Replace(config.ClientID)
+	}
+
+	if durable == "" {
+		return nil, fmt.Errorf("invalid empty durable name and client id")
+	}
+
+	baseClient, err := clientutil.NewBaseClient(ctx, handleCmd, config.MaxPayloadSize, &config.MsgCompression)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create base client: %w", err)
+	}
+
+	tlsConfig, err := config.TLS.GetTLSConfig(false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tls config: %w", err)
+	}
+
+	disconnSig := make(chan error, 1)
+	options, err := newConnOptions(config, tlsConfig, disconnSig)
+	if err != nil {
+		return nil, err
+	}
+
+	ackWait := config.AckWait
+	if ackWait == 0 {
+		ackWait = 15 * time.Second
+	}
+
+	c := &JetStreamClient{
+		BaseClient: baseClient,
+
+		ackWait: ackWait,
+		stream:  config.JetStream.Stream,
+		durable: durable,
+
+		options: options,
+
+		disconnSig: disconnSig,
+		closeOnce:  new(sync.Once),
+	}
+
+	c.onlineMsgBytes, c.offlineMsgBytes = clientutil.CreateOnlineOfflineMessage(config.ClientID)
+
+	c.cmdSubTopic, c.msgPubTopic, c.statePubTopic = aranyagoconst.NatsTopics(config.SubjectNamespace)
+
+	return c, nil
+}
+
+// JetStreamClient consumes cmds with a durable consumer, so cmds sent
+// when offline are delivered after connected again
+type JetStreamClient struct {
+	*clientutil.BaseClient
+
+	onlineMsgBytes  []byte
+	offlineMsgBytes []byte
+
+	cmdSubTopic   string
+	msgPubTopic   string
+	statePubTopic string
+
+	ackWait time.Duration
+	stream  string
+	durable string
+
+	options *nats.Options
+	nc      *nats.Conn
+	js      nats.JetStreamContext
+
+	disconnSig chan error
+	started    uint32
+	closeOnce  *sync.Once
+}
+
+func (c *JetStreamClient) Connect(dialCtx context.Context) error {
+	var err error
+	c.nc, err = connect(dialCtx, c.options)
+	if err != nil {
+		return err
+	}
+
+	c.js, err = c.nc.JetStream(nats.MaxWait(c.ackWait))
+	if err != nil {
+		c.nc.Close()
+		return fmt.Errorf("failed to create jetstream context: %w", err)
+	}
+
+	return nil
+}
+
+func (c *JetStreamClient) Start(appCtx context.Context) error {
+	opts := []nats.SubOpt{
+		nats.Durable(c.durable),
+		// only new cmds are delivered when the consumer is created
+		nats.DeliverNew(),
+		nats.AckExplicit(),
+		nats.ManualAck(),
+		nats.AckWait(c.ackWait),
+	}
+
+	if c.stream != "" {
+		opts = append(opts, nats.BindStream(c.stream))
+	}
+
+	defer c.shutdown()
+
+	_, err := c.js.Subscribe(c.cmdSubTopic, func(msg *nats.Msg) {
+		c.HandleCmd(msg.Data)
+
+		err2 := msg.Ack()
+		if err2 != nil {
+			c.Log.I("failed to ack cmd", log.Error(err2))
+		}
+	}, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe cmd subject: %w", err)
+	}
+
+	atomic.StoreUint32(&c.started, 1)
+
+	// publish online message
+	_, err = c.js.Publish(c.statePubTopic, c.onlineMsgBytes)
+	if err != nil {
+		return fmt.Errorf("failed to publish initial online message: %w", err)
+	}
+
+	select {
+	case <-c.Context().Done():
+		return nil
+	case <-appCtx.Done():
+		return nil
+	case err := <-c.disconnSig:
+		return err
+	}
+}
+
+func (c *JetStreamClient) PostMsg(msg *aranyagopb.Msg) error {
+	data, err := c.EncodeMsg(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.js.Publish(c.msgPubTopic, data)
+	return err
+}
+
+// Ping the nats server with a round trip
+func (c *JetStreamClient) Ping(ctx context.Context) error {
+	return c.nc.FlushWithContext(ctx)
+}
+
+func (c *JetStreamClient) Close() error {
+	return c.OnClose(func() error {
+		c.shutdown()
+		return nil
+	})
+}
+
+// shutdown publishes offline message if started and drains the connection,
+// cmds being handled are acked before the connection is closed
+func (c *JetStreamClient) shutdown() {
+	c.closeOnce.Do(func() {
+		if c.nc == nil {
+			return
+		}
+
+		if atomic.LoadUint32(&c.started) == 1 {
+			// publish offline message, best effort
+			_, _ = c.js.Publish(c.statePubTopic, c.offlineMsgBytes)
+		}
+
+		// drain instead of unsubscribe to keep the durable consumer
+		err := c.nc.Drain()
+		if err != nil {
+			c.nc.Close()
+		}
+	})
+}
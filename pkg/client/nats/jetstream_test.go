@@ -0,0 +1,377 @@
+// +build !noclient_nats
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nats
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+
+	"arhat.dev/arhat/pkg/client/clientutil"
+)
+
+const (
+	testStream   = "ARANYA"
+	testDurable  = "foo"
+	testSubjects = "arhat.test.>"
+)
+
+// runJetStreamServer runs an embedded nats server with jetstream enabled
+// and a stream capturing all subjects of the test client
+func runJetStreamServer(t *testing.T) (*server.Server, nats.JetStreamContext) {
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go s.Start()
+	t.Cleanup(s.Shutdown)
+
+	if !s.ReadyForConnections(10 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:     testStream,
+		Subjects: []string{testSubjects},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, js
+}
+
+// cmdRecorder records cmds handled by clients, handling blocks while
+// the recorder is paused
+type cmdRecorder struct {
+	mu   *sync.Mutex
+	cmds map[string][][]byte
+
+	paused chan struct{}
+}
+
+func newCmdRecorder() *cmdRecorder {
+	return &cmdRecorder{
+		mu:   new(sync.Mutex),
+		cmds: make(map[string][][]byte),
+	}
+}
+
+func (r *cmdRecorder) handleFunc(name string) func(cmdBytes []byte) {
+	return func(cmdBytes []byte) {
+		r.mu.Lock()
+		r.cmds[name] = append(r.cmds[name], cmdBytes)
+		paused := r.paused
+		r.mu.Unlock()
+
+		if paused != nil {
+			<-paused
+		}
+	}
+}
+
+func (r *cmdRecorder) pause() (resume func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	paused := make(chan struct{})
+	r.paused = paused
+
+	once := new(sync.Once)
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			r.paused = nil
+			r.mu.Unlock()
+
+			close(paused)
+		})
+	}
+}
+
+func (r *cmdRecorder) get(name string) [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([][]byte{}, r.cmds[name]...)
+}
+
+func newTestJetStreamClient(
+	t *testing.T, s *server.Server, ackWait time.Duration, handleCmd func(cmdBytes []byte),
+) *JetStreamClient {
+	c, err := NewJetStreamClient(context.TODO(), handleCmd, &Config{
+		CommonConfig: clientutil.CommonConfig{
+			Endpoint:       s.ClientURL(),
+			MaxPayloadSize: 1024 * 1024,
+		},
+		PingInterval:     time.Minute,
+		SubjectNamespace: "arhat.test",
+		ClientID:         "foo",
+		AckWait:          ackWait,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c.(*JetStreamClient)
+}
+
+// startTestClient connects and starts the client in background, returns
+// the channel of the result of Start
+func startTestClient(t *testing.T, c *JetStreamClient) <-chan error {
+	err := c.Connect(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		done   = make(chan error, 1)
+		exited = make(chan struct{})
+	)
+	go func() {
+		defer close(exited)
+
+		done <- c.Start(context.TODO())
+	}()
+
+	t.Cleanup(func() {
+		_ = c.Close()
+		<-exited
+	})
+
+	return done
+}
+
+func testCmd(t *testing.T, sid uint64) []byte {
+	data, err := (&aranyagopb.Cmd{Kind: aranyagopb.CMD_EXEC, Sid: sid, Complete: true}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// waitConsumer waits until the durable consumer exists and satisfies cond
+func waitConsumer(t *testing.T, js nats.JetStreamContext, what string, cond func(info *nats.ConsumerInfo) bool) {
+	t.Helper()
+
+	waitFor(t, what, func() bool {
+		info, err := js.ConsumerInfo(testStream, testDurable)
+		return err == nil && cond(info)
+	})
+}
+
+// statusMessages reads n messages of the status subject from the stream
+func statusMessages(t *testing.T, js nats.JetStreamContext, subject string, n int) [][]byte {
+	sub, err := js.SubscribeSync(subject, nats.DeliverAll())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = sub.Unsubscribe() }()
+
+	var ret [][]byte
+	for i := 0; i < n; i++ {
+		msg, err := sub.NextMsg(5 * time.Second)
+		if err != nil {
+			t.Fatalf("expecting %d status messages: %v", n, err)
+		}
+
+		ret = append(ret, msg.Data)
+	}
+
+	return ret
+}
+
+func TestJetStreamClientOfflineDelivery(t *testing.T) {
+	s, js := runJetStreamServer(t)
+	recorder := newCmdRecorder()
+
+	c := newTestJetStreamClient(t, s, 5*time.Second, recorder.handleFunc("first"))
+	done := startTestClient(t, c)
+
+	waitConsumer(t, js, "durable consumer", func(*nats.ConsumerInfo) bool { return true })
+
+	_, err := js.Publish(c.cmdSubTopic, testCmd(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "cmd", func() bool { return len(recorder.get("first")) == 1 })
+
+	err = c.PostMsg(&aranyagopb.Msg{Kind: aranyagopb.MSG_DATA, Sid: 1, Payload: []byte("data")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = c.Close()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	status := statusMessages(t, js, c.statePubTopic, 2)
+	if !bytes.Equal(status[0], c.onlineMsgBytes) || !bytes.Equal(status[1], c.offlineMsgBytes) {
+		t.Error("unexpected online and offline messages")
+	}
+
+	// durable consumer is kept after the connection drained
+	info, err := js.ConsumerInfo(testStream, testDurable)
+	if err != nil {
+		t.Fatalf("durable consumer not kept: %v", err)
+	}
+
+	if info.NumAckPending != 0 || info.AckFloor.Stream == 0 {
+		t.Errorf("cmd not acked: %+v", info)
+	}
+
+	// cmds sent while offline are delivered after connected again
+	_, err = js.Publish(c.cmdSubTopic, testCmd(t, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c = newTestJetStreamClient(t, s, 5*time.Second, recorder.handleFunc("second"))
+	startTestClient(t, c)
+
+	waitFor(t, "cmd sent while offline", func() bool { return len(recorder.get("second")) == 1 })
+
+	time.Sleep(200 * time.Millisecond)
+	if cmds := recorder.get("second"); len(cmds) != 1 || !bytes.Equal(cmds[0], testCmd(t, 2)) {
+		t.Error("unexpected cmds delivered after reconnected")
+	}
+}
+
+func TestJetStreamClientAckAfterHandled(t *testing.T) {
+	s, js := runJetStreamServer(t)
+	recorder := newCmdRecorder()
+
+	resume := recorder.pause()
+	defer resume()
+
+	c := newTestJetStreamClient(t, s, time.Second, recorder.handleFunc("first"))
+	done := startTestClient(t, c)
+
+	waitConsumer(t, js, "durable consumer", func(*nats.ConsumerInfo) bool { return true })
+
+	_, err := js.Publish(c.cmdSubTopic, testCmd(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "cmd", func() bool { return len(recorder.get("first")) == 1 })
+
+	// not acked while handling
+	time.Sleep(200 * time.Millisecond)
+	info, err := js.ConsumerInfo(testStream, testDurable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.NumAckPending != 1 {
+		t.Errorf("cmd acked before handled: %+v", info)
+	}
+
+	resume()
+	waitConsumer(t, js, "cmd acked", func(info *nats.ConsumerInfo) bool {
+		return info.NumAckPending == 0 && info.AckFloor.Stream == info.Delivered.Stream
+	})
+
+	// cmd being handled when closed is acked after handled
+	resume = recorder.pause()
+	_, err = js.Publish(c.cmdSubTopic, testCmd(t, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "cmd", func() bool { return len(recorder.get("first")) == 2 })
+
+	_ = c.Close()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	resume()
+	waitConsumer(t, js, "cmd acked when draining", func(info *nats.ConsumerInfo) bool {
+		return info.NumAckPending == 0 && info.AckFloor.Stream == info.Delivered.Stream
+	})
+
+	// cmd not acked when connection lost is delivered again
+	c = newTestJetStreamClient(t, s, time.Second, recorder.handleFunc("second"))
+	startTestClient(t, c)
+
+	resume = recorder.pause()
+	_, err = js.Publish(c.cmdSubTopic, testCmd(t, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "cmd", func() bool { return len(recorder.get("second")) == 1 })
+
+	c.nc.Close()
+	resume()
+
+	c = newTestJetStreamClient(t, s, time.Second, recorder.handleFunc("third"))
+	startTestClient(t, c)
+
+	waitFor(t, "cmd redelivered", func() bool { return len(recorder.get("third")) == 1 })
+	if !bytes.Equal(recorder.get("third")[0], testCmd(t, 3)) {
+		t.Error("unexpected cmd redelivered")
+	}
+
+	waitConsumer(t, js, "redelivered cmd acked", func(info *nats.ConsumerInfo) bool {
+		return info.NumAckPending == 0 && info.AckFloor.Stream == info.Delivered.Stream
+	})
+}
@@ -20,16 +20,12 @@ package nats
 
 import (
 	"context"
-	"encoding/base64"
 	"fmt"
-	"net"
 	"time"
 
 	"arhat.dev/aranya-proto/aranyagopb"
 	"arhat.dev/aranya-proto/aranyagopb/aranyagoconst"
-	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats.go"
-	"github.com/nats-io/nkeys"
 	"github.com/nats-io/stan.go"
 	"github.com/nats-io/stan.go/pb"
 
@@ -72,7 +68,7 @@ func NewClient(
 		return nil, fmt.Errorf("invalid empty subject namespace: %w", err)
 	}
 
-	baseClient, err := clientutil.NewBaseClient(ctx, handleCmd, config.MaxPayloadSize)
+	baseClient, err := clientutil.NewBaseClient(ctx, handleCmd, config.MaxPayloadSize, &config.MsgCompression)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create base client: %w", err)
 	}
@@ -83,104 +79,9 @@ func NewClient(
 	}
 
 	disconnSig := make(chan error, 1)
-
-	nats.UserCredentials("")
-	options := &nats.Options{
-		Servers:     []string{config.Endpoint},
-		NoRandomize: false,
-		NoEcho:      true,
-		Name:        config.ClientID,
-
-		// auth method is handled later
-		Nkey:        "",
-		UserJWT:     nil,
-		SignatureCB: nil,
-
-		User:         config.Username,
-		Password:     config.Password,
-		Token:        config.Token,
-		TokenHandler: nil,
-
-		Verbose:   false, // disable +OK/-ERR ack
-		Pedantic:  false,
-		Secure:    tlsConfig != nil && tlsConfig.InsecureSkipVerify,
-		TLSConfig: tlsConfig,
-
-		// disable auto reconnect
-		AllowReconnect:         false,
-		MaxReconnect:           0,
-		ReconnectWait:          0,
-		CustomReconnectDelayCB: nil,
-		ReconnectJitter:        0,
-		ReconnectJitterTLS:     0,
-		ReconnectedCB:          nil,
-		ReconnectBufSize:       0,
-
-		CustomDialer:   nil, // set when connect
-		Timeout:        0,   // set when connect
-		DrainTimeout:   nats.DefaultDrainTimeout,
-		FlusherTimeout: 0, // no flush delay
-
-		PingInterval: config.PingInterval,
-		MaxPingsOut:  nats.DefaultMaxPingOut,
-		DisconnectedErrCB: func(c *nats.Conn, e error) {
-			select {
-			case <-disconnSig:
-			default:
-				disconnSig <- e
-				close(disconnSig)
-			}
-		},
-
-		ClosedCB:            nil,
-		DiscoveredServersCB: nil, // no discovery
-		AsyncErrorCB:        nil, // no error handling regarding message sub
-		SubChanLen:          0,   // no sync sub
-
-		UseOldRequestStyle:          false,
-		NoCallbacksAfterClientClose: true,
-	}
-
-	if config.NKey != "" {
-		nkeyBytes, err2 := base64.StdEncoding.DecodeString(config.NKey)
-		if err2 != nil {
-			return nil, fmt.Errorf("invalid base64 encoded nkey: %w", err2)
-		}
-
-		kp, err2 := jwt.ParseDecoratedNKey(nkeyBytes)
-		if err2 != nil {
-			return nil, fmt.Errorf("invalid nkey: %w", err2)
-		}
-
-		if config.JWT != "" {
-			jwtBytes, err2 := base64.StdEncoding.DecodeString(config.JWT)
-			if err2 != nil {
-				return nil, fmt.Errorf("invalid jwt: %w", err2)
-			}
-
-			userJWT, err2 := jwt.ParseDecoratedJWT(jwtBytes)
-			if err2 != nil {
-				return nil, fmt.Errorf("invalid user jwt: %w", err2)
-			}
-
-			options.UserJWT = func() (string, error) {
-				return userJWT, nil
-			}
-
-			options.SignatureCB = kp.Sign
-		} else {
-			pub, err := kp.PublicKey()
-			if err != nil {
-				return nil, fmt.Errorf("failed to get public key of nkey: %w", err)
-			}
-
-			if !nkeys.IsValidPublicUserKey(pub) {
-				return nil, fmt.Errorf("invalid nkey user seed")
-			}
-
-			options.Nkey = pub
-			options.SignatureCB = kp.Sign
-		}
+	options, err := newConnOptions(config, tlsConfig, disconnSig)
+	if err != nil {
+		return nil, err
 	}
 
 	maxPendingPubAck := config.MaxPendingPubAck
@@ -241,18 +142,10 @@ type Client struct {
 }
 
 func (c *Client) Connect(dialCtx context.Context) error {
-	deadline, ok := dialCtx.Deadline()
-	if ok {
-		c.options.CustomDialer = &net.Dialer{
-			Deadline: deadline,
-		}
-		c.options.Timeout = time.Until(deadline)
-	}
-
 	var err error
-	c.nc, err = c.options.Connect()
+	c.nc, err = connect(dialCtx, c.options)
 	if err != nil {
-		return fmt.Errorf("failed to connect to nats server: %w", err)
+		return err
 	}
 
 	c.client, err = stan.Connect(c.clusterID, c.options.Name,
@@ -330,7 +223,7 @@ func (c *Client) postData(data []byte) error {
 }
 
 func (c *Client) PostMsg(msg *aranyagopb.Msg) error {
-	data, err := msg.Marshal()
+	data, err := c.EncodeMsg(msg)
 	if err != nil {
 		return err
 	}
@@ -338,6 +231,11 @@ func (c *Client) PostMsg(msg *aranyagopb.Msg) error {
 	return c.postData(data)
 }
 
+// Ping the nats server with a round trip
+func (c *Client) Ping(ctx context.Context) error {
+	return c.nc.FlushWithContext(ctx)
+}
+
 func (c *Client) Close() error {
 	return c.OnClose(func() error {
 		if c.client != nil {
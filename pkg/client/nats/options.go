@@ -0,0 +1,161 @@
+// +build !noclient_nats
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nats
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+
+	"arhat.dev/arhat/pkg/client/clientutil"
+)
+
+// newConnOptions creates nats connection options with auth methods set,
+// disconnSig receives the first disconnection error and is closed then
+func newConnOptions(config *Config, tlsConfig *tls.Config, disconnSig chan error) (*nats.Options, error) {
+	nats.UserCredentials("")
+	options := &nats.Options{
+		Servers:     []string{config.Endpoint},
+		NoRandomize: false,
+		NoEcho:      true,
+		Name:        config.ClientID,
+
+		// auth method is handled later
+		Nkey:        "",
+		UserJWT:     nil,
+		SignatureCB: nil,
+
+		User:         config.Username,
+		Password:     config.Password,
+		Token:        config.Token,
+		TokenHandler: nil,
+
+		Verbose:   false, // disable +OK/-ERR ack
+		Pedantic:  false,
+		Secure:    tlsConfig != nil && tlsConfig.InsecureSkipVerify,
+		TLSConfig: tlsConfig,
+
+		// disable auto reconnect
+		AllowReconnect:         false,
+		MaxReconnect:           0,
+		ReconnectWait:          0,
+		CustomReconnectDelayCB: nil,
+		ReconnectJitter:        0,
+		ReconnectJitterTLS:     0,
+		ReconnectedCB:          nil,
+		ReconnectBufSize:       0,
+
+		CustomDialer:   nil, // set when connect
+		Timeout:        0,   // set when connect
+		DrainTimeout:   nats.DefaultDrainTimeout,
+		FlusherTimeout: 0, // no flush delay
+
+		PingInterval: config.PingInterval,
+		MaxPingsOut:  nats.DefaultMaxPingOut,
+		DisconnectedErrCB: func(c *nats.Conn, e error) {
+			select {
+			case <-disconnSig:
+			default:
+				disconnSig <- e
+				close(disconnSig)
+			}
+		},
+
+		ClosedCB:            nil,
+		DiscoveredServersCB: nil, // no discovery
+		AsyncErrorCB:        nil, // no error handling regarding message sub
+		SubChanLen:          0,   // no sync sub
+
+		UseOldRequestStyle:          false,
+		NoCallbacksAfterClientClose: true,
+	}
+
+	if config.NKey != "" {
+		nkeyBytes, err2 := base64.StdEncoding.DecodeString(config.NKey)
+		if err2 != nil {
+			return nil, fmt.Errorf("invalid base64 encoded nkey: %w", err2)
+		}
+
+		kp, err2 := jwt.ParseDecoratedNKey(nkeyBytes)
+		if err2 != nil {
+			return nil, fmt.Errorf("invalid nkey: %w", err2)
+		}
+
+		if config.JWT != "" {
+			jwtBytes, err2 := base64.StdEncoding.DecodeString(config.JWT)
+			if err2 != nil {
+				return nil, fmt.Errorf("invalid jwt: %w", err2)
+			}
+
+			userJWT, err2 := jwt.ParseDecoratedJWT(jwtBytes)
+			if err2 != nil {
+				return nil, fmt.Errorf("invalid user jwt: %w", err2)
+			}
+
+			options.UserJWT = func() (string, error) {
+				return userJWT, nil
+			}
+
+			options.SignatureCB = kp.Sign
+		} else {
+			pub, err := kp.PublicKey()
+			if err != nil {
+				return nil, fmt.Errorf("failed to get public key of nkey: %w", err)
+			}
+
+			if !nkeys.IsValidPublicUserKey(pub) {
+				return nil, fmt.Errorf("invalid nkey user seed")
+			}
+
+			options.Nkey = pub
+			options.SignatureCB = kp.Sign
+		}
+	}
+
+	return options, nil
+}
+
+func connect(dialCtx context.Context, options *nats.Options) (*nats.Conn, error) {
+	deadline, ok := dialCtx.Deadline()
+	if ok {
+		options.CustomDialer = &net.Dialer{
+			Deadline: deadline,
+		}
+		options.Timeout = time.Until(deadline)
+	}
+
+	nc, err := options.Connect()
+	if err != nil {
+		if errors.Is(err, nats.ErrAuthorization) || errors.Is(err, nats.ErrAuthExpired) {
+			err = fmt.Errorf("%v: %w", err, clientutil.ErrUnrecoverable)
+		}
+
+		return nil, fmt.Errorf("failed to connect to nats server: %w", err)
+	}
+
+	return nc, nil
+}
@@ -0,0 +1,532 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/pkg/backoff"
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/arhat/pkg/client/clientutil"
+	"arhat.dev/arhat/pkg/types"
+)
+
+// Method is a configured connectivity method
+type Method struct {
+	Name   string
+	Config interface{}
+}
+
+type SupervisorOptions struct {
+	// Methods sorted by priority, the first one is preferred
+	Methods []Method
+
+	DialTimeout time.Duration
+	Backoff     *backoff.Strategy
+
+	// Standby keeps the next available method connected for failover
+	Standby bool
+
+	// FailbackInterval is the interval to probe methods with higher priority
+	// than the active one, non-positive value disables failback
+	FailbackInterval time.Duration
+
+	// MaxPublishFailures is the count of consecutive publish failures to
+	// treat the active client as unrecoverable, non-positive value disables
+	// this check
+	MaxPublishFailures int
+
+	// QuarantineDuration is the duration a method is skipped after it failed
+	// with unrecoverable error
+	QuarantineDuration time.Duration
+}
+
+// NewSupervisor creates a supervisor maintaining connectivity according to
+// method priority, setClient is called with the active client (nil when
+// there is no connectivity)
+func NewSupervisor(
+	ctx context.Context,
+	logger log.Interface,
+	handleCmd types.AgentCmdHandleFunc,
+	setClient func(Interface),
+	opts *SupervisorOptions,
+) *Supervisor {
+	return &Supervisor{
+		ctx:       ctx,
+		logger:    logger,
+		handleCmd: handleCmd,
+		setClient: setClient,
+		opts:      opts,
+
+		quarantine: make(map[int]time.Time),
+		mu:         new(sync.Mutex),
+	}
+}
+
+type Supervisor struct {
+	ctx       context.Context
+	logger    log.Interface
+	handleCmd types.AgentCmdHandleFunc
+	setClient func(Interface)
+	opts      *SupervisorOptions
+
+	// quarantine is the deadline of skipping methods failed with
+	// unrecoverable errors, key is the index of the method
+	quarantine map[int]time.Time
+	mu         *sync.Mutex
+}
+
+// supervisedClient wraps client to detect consecutive publish failures
+type supervisedClient struct {
+	Interface
+
+	index int
+	id    string
+
+	// done receives the result of Start
+	done chan error
+
+	maxPublishFailures int32
+	publishFailures    int32
+
+	// unhealthy is closed when too many publish failures
+	unhealthy     chan struct{}
+	unhealthyErr  error
+	unhealthyOnce *sync.Once
+}
+
+func (c *supervisedClient) PostMsg(msg *aranyagopb.Msg) error {
+	return c.checkPublish(c.Interface.PostMsg(msg))
+}
+
+// PostMetricsMsg posts with PostMetricsMsg of the client if implemented
+func (c *supervisedClient) PostMetricsMsg(msg *aranyagopb.Msg) error {
+	if p, ok := c.Interface.(MetricsMsgPoster); ok {
+		return c.checkPublish(p.PostMetricsMsg(msg))
+	}
+
+	return c.PostMsg(msg)
+}
+
+// checkPublish counts consecutive publish failures, returns err as is
+func (c *supervisedClient) checkPublish(err error) error {
+	if err == nil {
+		atomic.StoreInt32(&c.publishFailures, 0)
+		return nil
+	}
+
+	if c.maxPublishFailures > 0 && atomic.AddInt32(&c.publishFailures, 1) >= c.maxPublishFailures {
+		c.unhealthyOnce.Do(func() {
+			c.unhealthyErr = fmt.Errorf(
+				"%d consecutive publish failures, last error: %v: %w",
+				c.maxPublishFailures, err, clientutil.ErrUnrecoverable,
+			)
+			close(c.unhealthy)
+		})
+	}
+
+	return err
+}
+
+func (c *supervisedClient) start(ctx context.Context) {
+	go func() {
+		c.done <- c.Start(ctx)
+	}()
+}
+
+// Run maintains connectivity until ctx canceled
+func (s *Supervisor) Run() error {
+	if len(s.opts.Methods) == 0 {
+		return fmt.Errorf("no connectivity method configured")
+	}
+
+	var (
+		active, standby *supervisedClient
+
+		// results of background connecting
+		standbyCh  = make(chan *supervisedClient)
+		failbackCh = make(chan *supervisedClient)
+		warming    bool
+		probing    bool
+
+		standbyRetry  <-chan time.Time
+		failbackTimer <-chan time.Time
+		// reconnect is the backoff before reconnecting, standby becoming
+		// available during the backoff is used immediately
+		reconnect <-chan time.Time
+	)
+
+	multiple := len(s.opts.Methods) > 1
+	if multiple && s.opts.FailbackInterval > 0 {
+		ticker := time.NewTicker(s.opts.FailbackInterval)
+		defer ticker.Stop()
+
+		failbackTimer = ticker.C
+	}
+
+	defer func() {
+		s.setClient(nil)
+
+		for _, c := range []*supervisedClient{active, standby} {
+			if c != nil {
+				_ = c.Close()
+			}
+		}
+
+		// drain background connecting
+		for warming || probing {
+			select {
+			case c := <-standbyCh:
+				warming = false
+				closeIfNotNil(c)
+			case c := <-failbackCh:
+				probing = false
+				closeIfNotNil(c)
+			}
+		}
+	}()
+
+	for {
+		if active == nil {
+			if standby != nil && !s.probe(standby) {
+				_ = standby.Close()
+				standby = nil
+
+				// no connectivity until reconnected
+				s.setClient(nil)
+			}
+
+			switch {
+			case standby != nil:
+				s.logger.I("failing over to standby", log.String("id", standby.id))
+				active, standby = standby, nil
+				reconnect = nil
+			case reconnect == nil:
+				active = s.connectWithBackoff()
+				if active == nil {
+					// ctx canceled
+					return nil
+				}
+			}
+
+			if active != nil {
+				s.setClient(active)
+				s.logger.I("connected, starting communication", log.String("id", active.id))
+				active.start(s.ctx)
+			}
+		}
+
+		// nil channels when waiting for reconnection
+		var (
+			activeDone      <-chan error
+			activeUnhealthy <-chan struct{}
+		)
+
+		if active != nil {
+			activeDone, activeUnhealthy = active.done, active.unhealthy
+
+			if s.opts.Standby && multiple && standby == nil && !warming && standbyRetry == nil {
+				warming = true
+				go func(exclude int) {
+					standbyCh <- s.connectFirst(len(s.opts.Methods), exclude)
+				}(active.index)
+			}
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return nil
+		case err := <-activeDone:
+			if err == nil && s.ctx.Err() != nil {
+				return nil
+			}
+
+			reconnect = s.handleActiveExited(active, err, standby == nil)
+			active = nil
+		case <-activeUnhealthy:
+			reconnect = s.handleActiveExited(active, active.unhealthyErr, standby == nil)
+			active = nil
+		case <-reconnect:
+			reconnect = nil
+		case c := <-standbyCh:
+			warming = false
+			if c == nil {
+				// no method available, retry later
+				standbyRetry = time.After(s.opts.Backoff.Next("standby"))
+				break
+			}
+
+			s.opts.Backoff.Reset("standby")
+			s.logger.D("standby connected", log.String("id", c.id))
+			standby = c
+		case <-standbyRetry:
+			standbyRetry = nil
+		case <-failbackTimer:
+			if probing || active == nil || active.index == 0 {
+				break
+			}
+
+			if standby != nil && standby.index < active.index {
+				if s.probe(standby) {
+					// standby has higher priority, use it directly
+					s.promote(active, standby)
+					active, standby = standby, nil
+					break
+				}
+
+				_ = standby.Close()
+				standby = nil
+			}
+
+			probing = true
+			go func(to int) {
+				failbackCh <- s.connectFirst(to, -1)
+			}(active.index)
+		case c := <-failbackCh:
+			probing = false
+			if c == nil {
+				break
+			}
+
+			if active == nil {
+				// active exited while probing, fail over to it
+				if standby == nil {
+					standby = c
+				} else {
+					_ = c.Close()
+				}
+
+				break
+			}
+
+			if c.index >= active.index {
+				_ = c.Close()
+				break
+			}
+
+			s.promote(active, c)
+			active = c
+		}
+	}
+}
+
+// promote c as the active client and close the previous one
+func (s *Supervisor) promote(prev, c *supervisedClient) {
+	s.logger.I("failing back", log.String("from", prev.id), log.String("to", c.id))
+
+	s.setClient(c)
+	c.start(s.ctx)
+
+	_ = prev.Close()
+}
+
+// probe checks whether the connected but not started client is still usable
+func (s *Supervisor) probe(c *supervisedClient) bool {
+	err := c.Context().Err()
+	if p, ok := c.Interface.(Pinger); ok && err == nil {
+		ctx, cancel := context.WithTimeout(s.ctx, s.opts.DialTimeout)
+		err = p.Ping(ctx)
+		cancel()
+	}
+
+	if err != nil {
+		s.logger.I("standby not usable", log.String("id", c.id), log.Error(err))
+		return false
+	}
+
+	return true
+}
+
+// handleActiveExited closes the exited active client, when there is no
+// standby, it returns the backoff timer before reconnecting
+func (s *Supervisor) handleActiveExited(
+	c *supervisedClient, err error, noStandby bool,
+) (reconnect <-chan time.Time) {
+	_ = c.Close()
+
+	if errors.Is(err, clientutil.ErrUnrecoverable) {
+		s.logger.I("connectivity failed with unrecoverable error",
+			log.String("id", c.id), log.Error(err))
+		s.setQuarantine(c.index)
+	} else {
+		s.logger.I("connectivity lost", log.String("id", c.id), log.Error(err))
+	}
+
+	if !noStandby {
+		// standby will be used immediately
+		return nil
+	}
+
+	s.setClient(nil)
+
+	wait := s.opts.Backoff.Next(c.id)
+	if wait <= 0 {
+		return nil
+	}
+
+	s.logger.I("connectivity backoff", log.Duration("wait", wait))
+	return time.After(wait)
+}
+
+// connectWithBackoff tries all methods in order until one connected, returns
+// nil only when ctx canceled
+func (s *Supervisor) connectWithBackoff() *supervisedClient {
+	for {
+		for i := range s.opts.Methods {
+			if s.ctx.Err() != nil {
+				return nil
+			}
+
+			if s.isQuarantined(i) && !s.allQuarantined() {
+				continue
+			}
+
+			c, err := s.connect(i)
+			if err == nil {
+				s.opts.Backoff.Reset(c.id)
+				return c
+			}
+
+			id := s.methodID(i)
+			if errors.Is(err, clientutil.ErrUnrecoverable) {
+				s.setQuarantine(i)
+			}
+
+			wait := s.opts.Backoff.Next(id)
+			s.logger.I("connectivity backoff", log.String("id", id), log.Duration("wait", wait))
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-s.ctx.Done():
+				timer.Stop()
+				return nil
+			case <-timer.C:
+			}
+		}
+	}
+}
+
+// connectFirst returns the first connected client of methods before index
+// `to`, except the method at index `exclude`, returns nil if none connected
+func (s *Supervisor) connectFirst(to, exclude int) *supervisedClient {
+	for i := 0; i < to; i++ {
+		if i == exclude || s.isQuarantined(i) {
+			continue
+		}
+
+		c, err := s.connect(i)
+		if err == nil {
+			return c
+		}
+
+		if errors.Is(err, clientutil.ErrUnrecoverable) {
+			s.setQuarantine(i)
+		}
+	}
+
+	return nil
+}
+
+func (s *Supervisor) connect(i int) (*supervisedClient, error) {
+	var (
+		m  = s.opts.Methods[i]
+		id = s.methodID(i)
+	)
+
+	s.logger.I("creating client", log.String("id", id))
+	cl, err := NewClient(s.ctx, m.Name, s.handleCmd, m.Config)
+	if err != nil {
+		s.logger.I("failed to create client", log.String("id", id), log.Error(err))
+		return nil, err
+	}
+
+	err = func() error {
+		dialCtx, cancelDial := context.WithTimeout(s.ctx, s.opts.DialTimeout)
+		defer cancelDial()
+
+		s.logger.I("establishing connectivity", log.String("id", id))
+		return cl.Connect(dialCtx)
+	}()
+	if err != nil {
+		s.logger.I("failed to establish connectivity", log.String("id", id), log.Error(err))
+		_ = cl.Close()
+		return nil, err
+	}
+
+	return &supervisedClient{
+		Interface: cl,
+
+		index: i,
+		id:    id,
+		done:  make(chan error, 1),
+
+		maxPublishFailures: int32(s.opts.MaxPublishFailures),
+		unhealthy:          make(chan struct{}),
+		unhealthyOnce:      new(sync.Once),
+	}, nil
+}
+
+func (s *Supervisor) methodID(i int) string {
+	return fmt.Sprintf("%s@%d", s.opts.Methods[i].Name, i)
+}
+
+func (s *Supervisor) setQuarantine(i int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.quarantine[i] = time.Now().Add(s.opts.QuarantineDuration)
+}
+
+func (s *Supervisor) isQuarantined(i int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	until, ok := s.quarantine[i]
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(until) {
+		delete(s.quarantine, i)
+		return false
+	}
+
+	return true
+}
+
+func (s *Supervisor) allQuarantined() bool {
+	for i := range s.opts.Methods {
+		if !s.isQuarantined(i) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func closeIfNotNil(c *supervisedClient) {
+	if c != nil {
+		_ = c.Close()
+	}
+}
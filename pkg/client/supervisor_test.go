@@ -0,0 +1,243 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/pkg/backoff"
+	"arhat.dev/pkg/log"
+
+	"arhat.dev/arhat/pkg/types"
+)
+
+type testClientConfig struct {
+	connectDelay time.Duration
+	// startErr is returned by Start after startDelay, nil means Start blocks
+	// until ctx canceled
+	startErr   error
+	startDelay time.Duration
+	// pingErr is returned by Ping
+	pingErr error
+}
+
+type testClient struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	config *testClientConfig
+}
+
+func (c *testClient) Context() context.Context { return c.ctx }
+func (c *testClient) MaxPayloadSize() int      { return 4096 }
+
+func (c *testClient) Connect(dialCtx context.Context) error {
+	select {
+	case <-dialCtx.Done():
+		return dialCtx.Err()
+	case <-time.After(c.config.connectDelay):
+		return nil
+	}
+}
+
+func (c *testClient) Start(appCtx context.Context) error {
+	if c.config.startErr == nil {
+		<-c.ctx.Done()
+		return nil
+	}
+
+	select {
+	case <-c.ctx.Done():
+		return nil
+	case <-time.After(c.config.startDelay):
+		return c.config.startErr
+	}
+}
+
+func (c *testClient) Ping(ctx context.Context) error { return c.config.pingErr }
+
+func (c *testClient) PostMsg(msg *aranyagopb.Msg) error { return nil }
+
+func (c *testClient) Close() error {
+	c.cancel()
+	return nil
+}
+
+func init() {
+	Register("test",
+		func() interface{} { return new(testClientConfig) },
+		func(ctx context.Context, _ types.AgentCmdHandleFunc, cfg interface{}) (Interface, error) {
+			ctx, cancel := context.WithCancel(ctx)
+			return &testClient{ctx: ctx, cancel: cancel, config: cfg.(*testClientConfig)}, nil
+		},
+	)
+}
+
+func TestSupervisorFailoverDuringBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mu      = new(sync.Mutex)
+		current Interface
+	)
+
+	s := NewSupervisor(ctx, log.NoOpLogger, nil, func(c Interface) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		current = c
+	}, &SupervisorOptions{
+		Methods: []Method{
+			// exits before standby connected
+			{Name: "test", Config: &testClientConfig{
+				startErr:   errors.New("test"),
+				startDelay: 100 * time.Millisecond,
+			}},
+			{Name: "test", Config: &testClientConfig{
+				connectDelay: 500 * time.Millisecond,
+			}},
+		},
+		DialTimeout: time.Second,
+		// backoff longer than the test
+		Backoff: backoff.NewStrategy(time.Minute, time.Minute, 1, 0),
+		Standby: true,
+	})
+
+	done := make(chan error)
+	go func() {
+		done <- s.Run()
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		c, ok := current.(*supervisedClient)
+		mu.Unlock()
+
+		if ok && c.index == 1 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("standby not used during backoff")
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor not stopped")
+	}
+}
+
+func TestSupervisorProbeStandby(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mu = new(sync.Mutex)
+		// index of clients set, -1 for nil
+		history []int
+	)
+
+	s := NewSupervisor(ctx, log.NoOpLogger, nil, func(c Interface) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if c == nil {
+			history = append(history, -1)
+			return
+		}
+
+		history = append(history, c.(*supervisedClient).index)
+	}, &SupervisorOptions{
+		Methods: []Method{
+			// exits after standby connected
+			{Name: "test", Config: &testClientConfig{
+				startErr:   errors.New("test"),
+				startDelay: 300 * time.Millisecond,
+			}},
+			// connected but not usable
+			{Name: "test", Config: &testClientConfig{
+				pingErr: errors.New("dead"),
+			}},
+		},
+		DialTimeout: time.Second,
+		Backoff:     backoff.NewStrategy(10*time.Millisecond, 10*time.Millisecond, 1, 0),
+		Standby:     true,
+	})
+
+	done := make(chan error)
+	go func() {
+		done <- s.Run()
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(history)
+		mu.Unlock()
+
+		if n >= 3 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("not reconnected after standby probe failed")
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor not stopped")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// active, lost with unusable standby, reconnected
+	expected := []int{0, -1, 0}
+	for i, idx := range expected {
+		if history[i] != idx {
+			t.Fatalf("unexpected client history %v", history)
+		}
+	}
+
+	for _, idx := range history {
+		if idx == 1 {
+			t.Fatalf("unusable standby promoted: %v", history)
+		}
+	}
+}
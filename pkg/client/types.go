@@ -42,3 +42,17 @@ type Interface interface {
 	// MaxPayloadSize of a single message for this client
 	MaxPayloadSize() int
 }
+
+// MetricsMsgPoster is implemented by clients posting data of metrics
+// collection differently from other messages (e.g. with another qos level)
+type MetricsMsgPoster interface {
+	// PostMetricsMsg posts data msg of metrics collection to aranya
+	PostMetricsMsg(msg *aranyagopb.Msg) error
+}
+
+// Pinger is implemented by clients able to check the connection before
+// Start, used to probe standby clients before promoting them
+type Pinger interface {
+	// Ping the server/broker, returns error when the connection is not usable
+	Ping(ctx context.Context) error
+}
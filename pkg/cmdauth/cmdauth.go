@@ -0,0 +1,429 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmdauth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Magic is the first byte of sealed cmds
+	Magic byte = 0x07
+
+	flagEncrypted byte = 1 << 0
+
+	timestampSize = 8
+	NonceSize     = 12
+	headerSize    = 2 + timestampSize + NonceSize
+
+	// Overhead of a sealed cmd without encryption
+	Overhead = headerSize + ed25519.SignatureSize
+)
+
+var (
+	ErrNotSealed        = errors.New("cmd not sealed")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrNotEncrypted     = errors.New("cmd not encrypted")
+	ErrNoEncryptionKey  = errors.New("no encryption key for encrypted cmd")
+	ErrClockSkew        = errors.New("cmd timestamp out of window")
+	ErrReplayed         = errors.New("cmd replayed")
+)
+
+// IsSealed returns true when data looks like a sealed cmd
+func IsSealed(data []byte) bool {
+	return len(data) > 0 && data[0] == Magic
+}
+
+// NewSealer creates a Sealer signing cmds with key, cmds are encrypted
+// if aead is not nil
+func NewSealer(key ed25519.PrivateKey, aead cipher.AEAD) *Sealer {
+	return &Sealer{key: key, aead: aead}
+}
+
+// Sealer seals cmds on the aranya side
+type Sealer struct {
+	key  ed25519.PrivateKey
+	aead cipher.AEAD
+}
+
+// Seal signs (and encrypts) the protobuf encoded cmd
+func (s *Sealer) Seal(cmd []byte) ([]byte, error) {
+	size := Overhead + len(cmd)
+	if s.aead != nil {
+		size += s.aead.Overhead()
+	}
+
+	buf := make([]byte, headerSize, size)
+	buf[0] = Magic
+	binary.BigEndian.PutUint64(buf[2:], uint64(time.Now().UnixNano()))
+
+	nonce := buf[2+timestampSize : headerSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	if s.aead != nil {
+		buf[1] |= flagEncrypted
+		buf = s.aead.Seal(buf, nonce, cmd, buf[:headerSize])
+	} else {
+		buf = append(buf, cmd...)
+	}
+
+	return append(buf, ed25519.Sign(s.key, buf)...), nil
+}
+
+// VerifierConfig configures the window of accepted cmds and replay
+// protection of a Verifier
+type VerifierConfig struct {
+	// MaxClockSkew is the max duration the cmd timestamp can be ahead of
+	// local time
+	MaxClockSkew time.Duration
+
+	// MaxAge is the max duration since the cmd was sealed, defaults to
+	// MaxClockSkew, cmds queued by the connectivity while the device was
+	// offline are rejected if queued longer than this
+	MaxAge time.Duration
+
+	// NonceFile persists nonces seen so that cmds can not be replayed after
+	// restart, nonces are kept in memory only if empty
+	NonceFile string
+}
+
+// NewVerifier creates a Verifier accepting cmds signed by publicKey, all
+// cmds MUST be encrypted if aead is not nil
+func NewVerifier(publicKey ed25519.PublicKey, aead cipher.AEAD, config VerifierConfig) (*Verifier, error) {
+	v := &Verifier{
+		publicKey:    publicKey,
+		aead:         aead,
+		maxClockSkew: config.MaxClockSkew,
+		maxAge:       config.MaxAge,
+
+		nonces: make(map[[NonceSize]byte]int64),
+		mu:     new(sync.Mutex),
+	}
+
+	if v.maxAge <= 0 {
+		v.maxAge = v.maxClockSkew
+	}
+
+	if config.NonceFile != "" {
+		err := v.loadNonces(config.NonceFile, time.Now().UnixNano())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load nonce file: %w", err)
+		}
+	}
+
+	return v, nil
+}
+
+// Verifier opens sealed cmds on the agent side
+type Verifier struct {
+	publicKey    ed25519.PublicKey
+	aead         cipher.AEAD
+	maxClockSkew time.Duration
+	maxAge       time.Duration
+
+	// nonces seen in the accepted window, and when they expire
+	nonces    map[[NonceSize]byte]int64
+	lastPrune int64
+	mu        *sync.Mutex
+
+	// nonces are persisted to nonceFilePath if set
+	nonceFilePath string
+	nonceFile     *os.File
+	nonceRecords  int
+}
+
+// Open verifies the sealed cmd and returns the protobuf encoded cmd in it
+func (v *Verifier) Open(data []byte) ([]byte, error) {
+	if !IsSealed(data) || len(data) < Overhead {
+		return nil, ErrNotSealed
+	}
+
+	signed, sig := data[:len(data)-ed25519.SignatureSize], data[len(data)-ed25519.SignatureSize:]
+	if !ed25519.Verify(v.publicKey, signed, sig) {
+		return nil, ErrInvalidSignature
+	}
+
+	flags := data[1]
+	ts := int64(binary.BigEndian.Uint64(data[2:]))
+	var nonce [NonceSize]byte
+	copy(nonce[:], data[2+timestampSize:headerSize])
+
+	body := signed[headerSize:]
+	switch encrypted := flags&flagEncrypted != 0; {
+	case encrypted && v.aead == nil:
+		return nil, ErrNoEncryptionKey
+	case !encrypted && v.aead != nil:
+		return nil, ErrNotEncrypted
+	case encrypted:
+		var err error
+		body, err = v.aead.Open(nil, nonce[:], body, signed[:headerSize])
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt cmd: %w", err)
+		}
+	}
+
+	err := v.check(ts, nonce, time.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
+
+// Close the nonce file if any
+func (v *Verifier) Close() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.nonceFile == nil {
+		return nil
+	}
+
+	err := v.nonceFile.Close()
+	v.nonceFile = nil
+	return err
+}
+
+// check the timestamp is in the accepted window and records the nonce
+func (v *Verifier) check(ts int64, nonce [NonceSize]byte, now int64) error {
+	if ts < now-int64(v.maxAge) || ts > now+int64(v.maxClockSkew) {
+		return ErrClockSkew
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	// nonces expired are rejected by timestamp check
+	if now-v.lastPrune > int64(v.maxAge) {
+		for n, expireAt := range v.nonces {
+			if expireAt < now {
+				delete(v.nonces, n)
+			}
+		}
+
+		v.lastPrune = now
+
+		if v.nonceFilePath != "" && v.nonceRecords > 2*len(v.nonces)+nonceCompactThreshold {
+			err := v.compactNonces()
+			if err != nil {
+				return fmt.Errorf("failed to compact nonce file: %w", err)
+			}
+		}
+	}
+
+	if _, ok := v.nonces[nonce]; ok {
+		return ErrReplayed
+	}
+
+	expireAt := ts + int64(v.maxAge)
+	if v.nonceFilePath != "" {
+		// reject the cmd if not recorded, or it can be replayed after
+		// restart
+		if v.nonceFile == nil {
+			return fmt.Errorf("failed to record nonce: nonce file not open")
+		}
+
+		_, err := v.nonceFile.Write(appendNonceRecord(nil, nonce, expireAt))
+		if err != nil {
+			return fmt.Errorf("failed to record nonce: %w", err)
+		}
+
+		v.nonceRecords++
+	}
+
+	v.nonces[nonce] = expireAt
+	return nil
+}
+
+// nonce file is a sequence of records of nonce and its expiry time in unix
+// nanoseconds (big endian)
+const (
+	nonceRecordSize = NonceSize + 8
+
+	// nonceCompactThreshold is the min count of expired records to compact
+	// nonce file
+	nonceCompactThreshold = 1024
+)
+
+func appendNonceRecord(dst []byte, nonce [NonceSize]byte, expireAt int64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(expireAt))
+
+	dst = append(dst, nonce[:]...)
+	return append(dst, buf[:]...)
+}
+
+// loadNonces loads nonces not expired from the file and compacts it, the
+// file is created if not existing
+func (v *Verifier) loadNonces(file string, now int64) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// partial record at the end is a incomplete write
+	for ; len(data) >= nonceRecordSize; data = data[nonceRecordSize:] {
+		var nonce [NonceSize]byte
+		copy(nonce[:], data)
+
+		expireAt := int64(binary.BigEndian.Uint64(data[NonceSize:]))
+		if expireAt >= now {
+			v.nonces[nonce] = expireAt
+		}
+	}
+
+	v.nonceFilePath = file
+	v.lastPrune = now
+	return v.compactNonces()
+}
+
+// compactNonces rewrites the nonce file with nonces in memory, must be
+// called with v.mu held
+func (v *Verifier) compactNonces() error {
+	var (
+		file = v.nonceFilePath
+		tmp  = file + ".tmp"
+		data = make([]byte, 0, len(v.nonces)*nonceRecordSize)
+	)
+
+	for nonce, expireAt := range v.nonces {
+		data = appendNonceRecord(data, nonce, expireAt)
+	}
+
+	err := ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	// open file can not be replaced on windows
+	if v.nonceFile != nil {
+		_ = v.nonceFile.Close()
+		v.nonceFile = nil
+	}
+
+	err = os.Rename(tmp, file)
+	if err != nil {
+		_ = os.Remove(tmp)
+	} else {
+		v.nonceRecords = len(v.nonces)
+	}
+
+	// keep recording to the old file if not replaced
+	f, err2 := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err2 != nil {
+		return err2
+	}
+
+	v.nonceFile = f
+	return err
+}
+
+// ParsePublicKey parses Ed25519 public key in PEM (PKIX) or base64 encoded
+// raw form
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		pk, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("unexpected public key type %T", key)
+		}
+
+		return pk, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+
+	if len(data) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key size %d", len(data))
+	}
+
+	return data, nil
+}
+
+// ParsePrivateKey parses Ed25519 private key in PEM (PKCS#8) or base64
+// encoded raw (seed or full private key) form
+func ParsePrivateKey(s string) (ed25519.PrivateKey, error) {
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		pk, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("unexpected private key type %T", key)
+		}
+
+		return pk, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+
+	switch len(data) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(data), nil
+	case ed25519.PrivateKeySize:
+		return data, nil
+	default:
+		return nil, fmt.Errorf("invalid private key size %d", len(data))
+	}
+}
+
+// NewAEAD creates AES-256-GCM cipher with base64 encoded 32 bytes key
+func NewAEAD(key string) (cipher.AEAD, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+
+	if len(data) != 32 {
+		return nil, fmt.Errorf("invalid encryption key size %d, expecting 32", len(data))
+	}
+
+	block, err := aes.NewCipher(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
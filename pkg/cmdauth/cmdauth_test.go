@@ -0,0 +1,358 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmdauth
+
+import (
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestKey(t *testing.T) ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func newTestAEAD(t *testing.T) cipher.AEAD {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aead, err := NewAEAD(base64.StdEncoding.EncodeToString(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return aead
+}
+
+func newTestVerifier(t *testing.T, key ed25519.PrivateKey, aead cipher.AEAD, config VerifierConfig) *Verifier {
+	if config.MaxClockSkew == 0 {
+		config.MaxClockSkew = time.Minute
+	}
+
+	v, err := NewVerifier(key.Public().(ed25519.PublicKey), aead, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = v.Close() })
+
+	return v
+}
+
+func seal(t *testing.T, s *Sealer, cmd string) []byte {
+	data, err := s.Seal([]byte(cmd))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestSealOpen(t *testing.T) {
+	key := newTestKey(t)
+	aead := newTestAEAD(t)
+
+	for _, test := range []struct {
+		name string
+		aead cipher.AEAD
+	}{
+		{name: "Plain", aead: nil},
+		{name: "Encrypted", aead: aead},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				s = NewSealer(key, test.aead)
+				v = newTestVerifier(t, key, test.aead, VerifierConfig{})
+			)
+
+			data := seal(t, s, "foo")
+			if !IsSealed(data) {
+				t.Fatal("sealed cmd not recognized")
+			}
+
+			if encrypted := data[1]&flagEncrypted != 0; encrypted != (test.aead != nil) {
+				t.Errorf("unexpected encrypted flag %v", encrypted)
+			}
+
+			cmd, err := v.Open(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(cmd) != "foo" {
+				t.Errorf("unexpected cmd %q", cmd)
+			}
+
+			// empty cmd
+			cmd, err = v.Open(seal(t, s, ""))
+			if err != nil || len(cmd) != 0 {
+				t.Errorf("failed to open empty cmd: %q, %v", cmd, err)
+			}
+		})
+	}
+}
+
+func TestOpenTampered(t *testing.T) {
+	key := newTestKey(t)
+
+	for _, test := range []struct {
+		name string
+		aead cipher.AEAD
+	}{
+		{name: "Plain", aead: nil},
+		{name: "Encrypted", aead: newTestAEAD(t)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				s = NewSealer(key, test.aead)
+				v = newTestVerifier(t, key, test.aead, VerifierConfig{})
+			)
+
+			data := seal(t, s, "foo")
+			for _, pos := range []struct {
+				name  string
+				index int
+			}{
+				{name: "flags", index: 1},
+				{name: "timestamp", index: 2},
+				{name: "nonce", index: 2 + timestampSize},
+				{name: "body", index: headerSize},
+				{name: "signature", index: len(data) - 1},
+			} {
+				tampered := append([]byte{}, data...)
+				tampered[pos.index] ^= 0x01
+
+				if _, err := v.Open(tampered); err != ErrInvalidSignature {
+					t.Errorf("tampered %s not rejected: %v", pos.name, err)
+				}
+			}
+
+			if _, err := v.Open(data[:Overhead-1]); err != ErrNotSealed {
+				t.Errorf("truncated cmd not rejected: %v", err)
+			}
+
+			if _, err := v.Open([]byte{0x0a, 0x03, 'f', 'o', 'o'}); err != ErrNotSealed {
+				t.Errorf("plain protobuf cmd not rejected: %v", err)
+			}
+		})
+	}
+}
+
+func TestOpenWrongKey(t *testing.T) {
+	var (
+		key  = newTestKey(t)
+		aead = newTestAEAD(t)
+		v    = newTestVerifier(t, key, aead, VerifierConfig{})
+	)
+
+	if _, err := v.Open(seal(t, NewSealer(newTestKey(t), aead), "foo")); err != ErrInvalidSignature {
+		t.Errorf("cmd signed by other key not rejected: %v", err)
+	}
+
+	// signed by the trusted key, but encrypted with other key
+	if _, err := v.Open(seal(t, NewSealer(key, newTestAEAD(t)), "foo")); err == nil {
+		t.Error("cmd encrypted with other key accepted")
+	}
+}
+
+func TestOpenEncryptionMismatch(t *testing.T) {
+	var (
+		key  = newTestKey(t)
+		aead = newTestAEAD(t)
+	)
+
+	v := newTestVerifier(t, key, aead, VerifierConfig{})
+	if _, err := v.Open(seal(t, NewSealer(key, nil), "foo")); err != ErrNotEncrypted {
+		t.Errorf("plaintext cmd not rejected when encryption required: %v", err)
+	}
+
+	v = newTestVerifier(t, key, nil, VerifierConfig{})
+	if _, err := v.Open(seal(t, NewSealer(key, aead), "foo")); err != ErrNoEncryptionKey {
+		t.Errorf("encrypted cmd not rejected without encryption key: %v", err)
+	}
+}
+
+func TestOpenReplayed(t *testing.T) {
+	var (
+		key = newTestKey(t)
+		s   = NewSealer(key, nil)
+		v   = newTestVerifier(t, key, nil, VerifierConfig{})
+	)
+
+	data := seal(t, s, "foo")
+	if _, err := v.Open(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := v.Open(data); err != ErrReplayed {
+		t.Errorf("replayed cmd not rejected: %v", err)
+	}
+
+	// same cmd sealed again has a new nonce
+	if _, err := v.Open(seal(t, s, "foo")); err != nil {
+		t.Errorf("cmd sealed again rejected: %v", err)
+	}
+}
+
+func TestCheckWindow(t *testing.T) {
+	v := newTestVerifier(t, newTestKey(t), nil, VerifierConfig{
+		MaxClockSkew: time.Minute,
+		MaxAge:       time.Hour,
+	})
+
+	now := time.Now().UnixNano()
+	for i, test := range []struct {
+		ts       int64
+		expected error
+	}{
+		{ts: now, expected: nil},
+		{ts: now + int64(time.Minute), expected: nil},
+		{ts: now + int64(time.Minute) + 1, expected: ErrClockSkew},
+		// queued while offline
+		{ts: now - int64(30*time.Minute), expected: nil},
+		{ts: now - int64(time.Hour), expected: nil},
+		{ts: now - int64(time.Hour) - 1, expected: ErrClockSkew},
+	} {
+		var nonce [NonceSize]byte
+		nonce[0] = byte(i)
+
+		if err := v.check(test.ts, nonce, now); err != test.expected {
+			t.Errorf("#%d: expecting %v, got %v", i, test.expected, err)
+		}
+	}
+
+	// max age defaults to max clock skew
+	v = newTestVerifier(t, newTestKey(t), nil, VerifierConfig{MaxClockSkew: time.Minute})
+	if err := v.check(now-int64(time.Minute)-1, [NonceSize]byte{}, now); err != ErrClockSkew {
+		t.Errorf("cmd older than max clock skew not rejected: %v", err)
+	}
+}
+
+func TestNonceFile(t *testing.T) {
+	var (
+		key  = newTestKey(t)
+		s    = NewSealer(key, nil)
+		file = filepath.Join(t.TempDir(), "nonces")
+
+		config = VerifierConfig{MaxClockSkew: time.Minute, NonceFile: file}
+	)
+
+	v := newTestVerifier(t, key, nil, config)
+
+	data := seal(t, s, "foo")
+	if _, err := v.Open(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// restarted
+	_ = v.Close()
+	v = newTestVerifier(t, key, nil, config)
+	if _, err := v.Open(data); err != ErrReplayed {
+		t.Errorf("cmd replayed after restart not rejected: %v", err)
+	}
+
+	if _, err := v.Open(seal(t, s, "foo")); err != nil {
+		t.Errorf("new cmd rejected after restart: %v", err)
+	}
+
+	// expired nonces are not loaded
+	_ = v.Close()
+	v = newTestVerifier(t, key, nil, config)
+	if len(v.nonces) != 2 {
+		t.Errorf("expecting 2 nonces loaded, got %d", len(v.nonces))
+	}
+
+	_ = v.Close()
+	v = newTestVerifier(t, key, nil, VerifierConfig{MaxClockSkew: time.Minute})
+	if err := v.loadNonces(file, time.Now().Add(2*time.Minute).UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(v.nonces) != 0 {
+		t.Errorf("expired nonces loaded: %d", len(v.nonces))
+	}
+
+	if info, err := os.Stat(file); err != nil || info.Size() != 0 {
+		t.Errorf("expired nonces not removed from file: %v", err)
+	}
+}
+
+func TestNonceFileCompaction(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "nonces")
+	v := newTestVerifier(t, newTestKey(t), nil, VerifierConfig{
+		MaxClockSkew: time.Second,
+		NonceFile:    file,
+	})
+
+	now := time.Now().UnixNano()
+	for i := 0; i < 2*nonceCompactThreshold; i++ {
+		var nonce [NonceSize]byte
+		nonce[0], nonce[1] = byte(i), byte(i>>8)
+
+		if err := v.check(now, nonce, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// all previous nonces expired
+	later := now + int64(2*time.Second)
+	if err := v.check(later, [NonceSize]byte{0xff, 0xff}, later); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the last nonce is recorded
+	if info.Size() != nonceRecordSize {
+		t.Errorf("nonce file not compacted, size %d", info.Size())
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	key := newTestKey(t)
+
+	pk, err := ParsePublicKey(base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+	if err != nil || !pk.Equal(key.Public()) {
+		t.Errorf("failed to parse public key: %v", err)
+	}
+
+	for _, raw := range [][]byte{key.Seed(), key} {
+		sk, err := ParsePrivateKey(base64.StdEncoding.EncodeToString(raw))
+		if err != nil || !sk.Equal(key) {
+			t.Errorf("failed to parse private key of size %d: %v", len(raw), err)
+		}
+	}
+
+	if _, err = ParsePublicKey(base64.StdEncoding.EncodeToString([]byte("foo"))); err == nil {
+		t.Error("invalid public key accepted")
+	}
+}
@@ -0,0 +1,36 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cmdauth implements end-to-end authentication of cmds sent by
+// aranya, independent of the connectivity method
+//
+// A sealed cmd is laid out as
+//
+//	[ 0x07 ][ flags (1) ][ timestamp (8) ][ nonce (12) ][ body ][ signature (64) ]
+//
+// 0x07 is an invalid protobuf wire type, so sealed cmds never collide with
+// plain protobuf encoded cmds. Bit 0 of flags is set when body is encrypted.
+// Timestamp is unix nanoseconds (big endian) when the cmd was sealed, nonce
+// is random and also used as the AES-GCM nonce when encrypted. Body is the
+// protobuf encoded Cmd, or its AES-GCM ciphertext with all previous fields
+// as additional data. Signature is the Ed25519 signature of all previous
+// fields.
+//
+// Verifier accepts cmds sealed within the clock skew and max age window,
+// and rejects nonces seen in the window. Without a nonce file, nonces are
+// kept in memory only and cmds accepted before restart can be replayed
+// within the window.
+package cmdauth
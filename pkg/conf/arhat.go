@@ -19,6 +19,7 @@ package conf
 import (
 	"context"
 	"io/ioutil"
+	"time"
 
 	"arhat.dev/pkg/exechelper"
 	"arhat.dev/pkg/log"
@@ -43,6 +44,8 @@ type AppConfig struct {
 	Host HostConfig `json:"host" yaml:"host"`
 	Node NodeConfig `json:"node" yaml:"node"`
 
+	Workers WorkersConfig `json:"workers" yaml:"workers"`
+
 	PProf perfhelper.PProfConfig `json:"pprof" yaml:"pprof"`
 }
 
@@ -55,6 +58,10 @@ type HostConfig struct {
 	AllowExec        bool `json:"allowExec" yaml:"allowExec"`
 	AllowLog         bool `json:"allowLog" yaml:"allowLog"`
 	AllowPortForward bool `json:"allowPortForward" yaml:"allowPortForward"`
+
+	ExecPolicy        ExecPolicyConfig        `json:"execPolicy" yaml:"execPolicy"`
+	PortForwardPolicy PortForwardPolicyConfig `json:"portForwardPolicy" yaml:"portForwardPolicy"`
+	LogPolicy         LogPolicyConfig         `json:"logPolicy" yaml:"logPolicy"`
 }
 
 func FlagsForArhatHostConfig(prefix string, config *HostConfig) *pflag.FlagSet {
@@ -68,9 +75,38 @@ func FlagsForArhatHostConfig(prefix string, config *HostConfig) *pflag.FlagSet {
 	return fs
 }
 
+// WorkersConfig limits concurrent works for commands
+type WorkersConfig struct {
+	// MaxActive is the global limit of concurrent works, 0 means default,
+	// negative value means no limit
+	MaxActive int `json:"maxActive" yaml:"maxActive"`
+
+	// ReservedControl is the count of slots in MaxActive only usable by
+	// short control works (node info, metrics, storage, peripheral and net),
+	// 0 means default, negative value means no reservation
+	ReservedControl int `json:"reservedControl" yaml:"reservedControl"`
+
+	// MaxQueued is the limit of works waiting for free slots, control works
+	// can use extra ReservedControl places in the queue, works exceeding
+	// this limit are rejected, 0 means default, negative value means no limit
+	MaxQueued int `json:"maxQueued" yaml:"maxQueued"`
+
+	// MaxQueueWait is the longest time a work can wait in the queue, works
+	// waited longer are rejected, 0 means default, negative value means no
+	// limit
+	MaxQueueWait time.Duration `json:"maxQueueWait" yaml:"maxQueueWait"`
+
+	// Limits of concurrent works per kind, key is the kind of work
+	// (e.g. exec, attach, logs, port-forward, metrics, node)
+	Limits map[string]int `json:"limits" yaml:"limits"`
+}
+
 type NodeConfig struct {
 	MachineIDFrom ValueFromSpec `json:"machineIDFrom" yaml:"machineIDFrom"`
 	ExtInfo       []NodeExtInfo `json:"extInfo" yaml:"extInfo"`
+
+	Conditions NodeConditionsConfig `json:"conditions" yaml:"conditions"`
+	Probes     []NodeProbe          `json:"probes" yaml:"probes"`
 }
 
 type ValueFromSpec struct {
@@ -34,9 +34,97 @@ type ConnectivityConfig struct {
 	MaxBackoff     time.Duration `json:"maxBackoff" yaml:"maxBackoff"`
 	BackoffFactor  float64       `json:"backoffFactor" yaml:"backoffFactor"`
 
+	// Standby keeps the next available method connected for failover
+	Standby bool `json:"standby" yaml:"standby"`
+	// FailbackInterval is the interval to probe methods with higher priority
+	// than the active one, 0 means default, negative value disables failback
+	FailbackInterval time.Duration `json:"failbackInterval" yaml:"failbackInterval"`
+	// MaxPublishFailures is the count of consecutive publish failures to
+	// fail over, 0 means default, negative value disables this check
+	MaxPublishFailures int `json:"maxPublishFailures" yaml:"maxPublishFailures"`
+
+	// PartialCmdTTL is the max duration to complete an incomplete cmd since
+	// its first chunk, 0 means default, negative value means never expire
+	PartialCmdTTL time.Duration `json:"partialCmdTTL" yaml:"partialCmdTTL"`
+	// MaxCmdSize is the max size of a reassembled cmd payload, 0 means
+	// default, negative value means no limit
+	MaxCmdSize int `json:"maxCmdSize" yaml:"maxCmdSize"`
+	// MaxCmdChunks is the max count of chunks of a cmd, 0 means default,
+	// negative value means no limit
+	MaxCmdChunks int `json:"maxCmdChunks" yaml:"maxCmdChunks"`
+
+	// CmdDedup drops cmd packets delivered more than once
+	CmdDedup CmdDedupConfig `json:"cmdDedup" yaml:"cmdDedup"`
+
+	// Spool keeps messages failed to post on local disk, they are posted
+	// again once connected
+	Spool SpoolConfig `json:"spool" yaml:"spool"`
+
+	// CmdAuth requires cmds to be signed by aranya end-to-end
+	CmdAuth CmdAuthConfig `json:"cmdAuth" yaml:"cmdAuth"`
+
 	Methods []ConnectivityMethod `json:"methods" yaml:"methods"`
 }
 
+// CmdDedupConfig defines detection of duplicate cmd packets
+type CmdDedupConfig struct {
+	// Enabled to drop cmd packets seen before
+	Enabled bool `json:"enabled" yaml:"enabled"`
+
+	// TTL is the duration to remember a cmd packet since first seen, 0 means
+	// default
+	TTL time.Duration `json:"ttl" yaml:"ttl"`
+
+	// MaxEntries is the max count of cmd packets to remember, least recently
+	// seen ones are forgotten first, 0 means default
+	MaxEntries int `json:"maxEntries" yaml:"maxEntries"`
+}
+
+// SpoolConfig defines the on disk spool of outbound messages
+type SpoolConfig struct {
+	// Dir to store messages, spool is disabled if empty
+	Dir string `json:"dir" yaml:"dir"`
+
+	// MaxSize is the max total size of spooled messages in bytes, messages
+	// of the oldest sessions are dropped when exceeded, 0 means default,
+	// negative value means no limit
+	MaxSize int64 `json:"maxSize" yaml:"maxSize"`
+
+	// Retention is the max duration to keep spooled messages by msg kind
+	// (e.g. data, error, node_status), only state, error, node_status and
+	// data_metrics (metrics replies) are spooled by default, other kinds not
+	// listed use the value of `default` if set, 0 means never expire,
+	// negative value means never spool
+	Retention map[string]time.Duration `json:"retention" yaml:"retention"`
+}
+
+// CmdAuthConfig defines end-to-end authentication of cmds, see package
+// arhat.dev/arhat/pkg/cmdauth for the format of sealed cmds
+type CmdAuthConfig struct {
+	// Enabled to reject cmds not signed by aranya
+	Enabled bool `json:"enabled" yaml:"enabled"`
+
+	// PublicKeyFrom is the Ed25519 public key of aranya, in PEM (PKIX) or
+	// base64 encoded raw form
+	PublicKeyFrom ValueFromSpec `json:"publicKeyFrom" yaml:"publicKeyFrom"`
+
+	// MaxClockSkew is the max duration the cmd timestamp can be ahead of
+	// local time, 0 means default
+	MaxClockSkew time.Duration `json:"maxClockSkew" yaml:"maxClockSkew"`
+
+	// MaxAge is the max duration since the cmd was sealed, 0 means the
+	// same as MaxClockSkew
+	MaxAge time.Duration `json:"maxAge" yaml:"maxAge"`
+
+	// NonceFile to persist nonces of cmds accepted, nonces are kept in
+	// memory only if empty
+	NonceFile string `json:"nonceFile" yaml:"nonceFile"`
+
+	// EncryptionKeyFrom is the base64 encoded 32 bytes AES-256-GCM key,
+	// cmds MUST be encrypted when set
+	EncryptionKeyFrom ValueFromSpec `json:"encryptionKeyFrom" yaml:"encryptionKeyFrom"`
+}
+
 type ConnectivityMethod struct {
 	Name     string `json:"name" yaml:"name"`
 	Priority int    `json:"priority" yaml:"priority"`
@@ -0,0 +1,158 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package conf
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NodeConditionsConfig defines thresholds used to report node pressure
+//
+// threshold value can be an absolute value with optional unit suffix
+// (e.g. `100Mi`, `1G`, `2000`) or a percentage of the total (e.g. `10%`),
+// condition will be reported as unhealthy when available resource is less
+// than the threshold, defaults will be used if not set
+type NodeConditionsConfig struct {
+	// MemoryAvailable is the threshold of available memory
+	MemoryAvailable string `json:"memoryAvailable" yaml:"memoryAvailable"`
+
+	// DiskAvailable is the threshold of available disk space in each
+	// filesystem
+	DiskAvailable string `json:"diskAvailable" yaml:"diskAvailable"`
+
+	// Filesystems are paths on filesystems to check disk space
+	Filesystems []string `json:"filesystems" yaml:"filesystems"`
+
+	// PidAvailable is the threshold of available pids (compared with pid_max)
+	PidAvailable string `json:"pidAvailable" yaml:"pidAvailable"`
+}
+
+// ResourceThreshold is the parsed threshold value
+type ResourceThreshold struct {
+	value      uint64
+	percentage float64
+}
+
+// ParseResourceThreshold parses threshold value in the form of `10%` or `100Mi`
+func ParseResourceThreshold(s string) (*ResourceThreshold, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, fmt.Errorf("empty threshold")
+	}
+
+	if strings.HasSuffix(s, "%") {
+		p, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid percentage %q: %w", s, err)
+		}
+
+		if p < 0 || p > 100 {
+			return nil, fmt.Errorf("percentage %q out of range", s)
+		}
+
+		return &ResourceThreshold{percentage: p}, nil
+	}
+
+	multipliers := []struct {
+		suffix string
+		value  uint64
+	}{
+		{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+		{"K", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12},
+	}
+
+	raw, multiplier := s, uint64(1)
+	for _, m := range multipliers {
+		if strings.HasSuffix(s, m.suffix) {
+			s = strings.TrimSuffix(s, m.suffix)
+			multiplier = m.value
+			break
+		}
+	}
+
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid threshold value %q: %w", s, err)
+	}
+
+	if v > math.MaxUint64/multiplier {
+		return nil, fmt.Errorf("threshold value %q overflows", raw)
+	}
+
+	return &ResourceThreshold{value: v * multiplier}, nil
+}
+
+// Reached checks whether available resource is less than the threshold
+func (t *ResourceThreshold) Reached(available, total uint64) bool {
+	if t == nil {
+		return false
+	}
+
+	if t.percentage != 0 {
+		return float64(available) < float64(total)*t.percentage/100
+	}
+
+	return available < t.value
+}
+
+// NodeProbe defines a health probe running periodically on the device, exactly
+// one of Exec, File, TCP and HTTP should be set
+type NodeProbe struct {
+	// Name of the probe, used in logs
+	Name string `json:"name" yaml:"name"`
+
+	// Interval between two probe runs
+	Interval time.Duration `json:"interval" yaml:"interval"`
+	// Timeout of a single probe run
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+	// FailureThreshold is the count of consecutive failures before reporting
+	// unhealthy
+	FailureThreshold int `json:"failureThreshold" yaml:"failureThreshold"`
+
+	// Exec a command, exit code 0 means healthy
+	Exec []string `json:"exec" yaml:"exec"`
+	// File path, existence means healthy
+	File string `json:"file" yaml:"file"`
+	// TCP address to dial (host:port), connected means healthy
+	TCP string `json:"tcp" yaml:"tcp"`
+	// HTTP url to GET, 2xx or 3xx status code means healthy
+	HTTP string `json:"http" yaml:"http"`
+
+	// Condition to report unhealthy when probe failed
+	//
+	// value can be one of [ready, memory, disk, pid, network, pod]
+	Condition string `json:"condition" yaml:"condition"`
+
+	// ExtInfo to report probe result as node label or annotation
+	ExtInfo *NodeProbeExtInfo `json:"extInfo" yaml:"extInfo"`
+}
+
+type NodeProbeExtInfo struct {
+	// ApplyTo which node object field
+	// value available: [metadata.annotations[''], metadata.labels['']]
+	ApplyTo string `json:"applyTo" yaml:"applyTo"`
+
+	// HealthyValue is the value set when probe succeeded
+	HealthyValue string `json:"healthyValue" yaml:"healthyValue"`
+
+	// UnhealthyValue is the value set when probe failed
+	UnhealthyValue string `json:"unhealthyValue" yaml:"unhealthyValue"`
+}
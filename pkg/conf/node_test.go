@@ -0,0 +1,114 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package conf
+
+import (
+	"testing"
+)
+
+func TestParseResourceThreshold(t *testing.T) {
+	tests := []struct {
+		name       string
+		value      string
+		expected   ResourceThreshold
+		shouldFail bool
+	}{
+		{name: "Plain", value: "2000", expected: ResourceThreshold{value: 2000}},
+		{name: "Spaces", value: " 10 ", expected: ResourceThreshold{value: 10}},
+		{name: "Ki", value: "4Ki", expected: ResourceThreshold{value: 4 << 10}},
+		{name: "Mi", value: "100Mi", expected: ResourceThreshold{value: 100 << 20}},
+		{name: "Gi", value: "1Gi", expected: ResourceThreshold{value: 1 << 30}},
+		{name: "Ti", value: "2Ti", expected: ResourceThreshold{value: 2 << 40}},
+		{name: "K", value: "3K", expected: ResourceThreshold{value: 3000}},
+		{name: "M", value: "5M", expected: ResourceThreshold{value: 5e6}},
+		{name: "G", value: "1G", expected: ResourceThreshold{value: 1e9}},
+		{name: "T", value: "7T", expected: ResourceThreshold{value: 7e12}},
+		{name: "Max", value: "16777215Ti", expected: ResourceThreshold{value: 16777215 << 40}},
+		{name: "Percentage", value: "10%", expected: ResourceThreshold{percentage: 10}},
+		{name: "Fraction Percentage", value: "0.5%", expected: ResourceThreshold{percentage: 0.5}},
+		{name: "Full Percentage", value: "100%", expected: ResourceThreshold{percentage: 100}},
+
+		{name: "Empty", value: "", shouldFail: true},
+		{name: "Blank", value: "  ", shouldFail: true},
+		{name: "Negative", value: "-1", shouldFail: true},
+		{name: "Fraction", value: "1.5Gi", shouldFail: true},
+		{name: "Unknown Unit", value: "10Xi", shouldFail: true},
+		{name: "Unit Only", value: "Mi", shouldFail: true},
+		{name: "Negative Percentage", value: "-1%", shouldFail: true},
+		{name: "Large Percentage", value: "101%", shouldFail: true},
+		{name: "Invalid Percentage", value: "a%", shouldFail: true},
+		{name: "Overflow", value: "18446744073709551616", shouldFail: true},
+		{name: "Overflow With Unit", value: "16777216Ti", shouldFail: true},
+		{name: "Overflow With Decimal Unit", value: "18446745T", shouldFail: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			th, err := ParseResourceThreshold(test.value)
+			if test.shouldFail {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", th)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if *th != test.expected {
+				t.Errorf("expected %+v, got %+v", test.expected, *th)
+			}
+		})
+	}
+}
+
+func TestResourceThresholdReached(t *testing.T) {
+	mustParse := func(s string) *ResourceThreshold {
+		th, err := ParseResourceThreshold(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return th
+	}
+
+	tests := []struct {
+		name      string
+		threshold *ResourceThreshold
+		available uint64
+		total     uint64
+		reached   bool
+	}{
+		{"Nil", nil, 0, 100, false},
+		{"Value Below", mustParse("1Ki"), 1023, 1 << 20, true},
+		{"Value Equal", mustParse("1Ki"), 1024, 1 << 20, false},
+		{"Value Above", mustParse("1Ki"), 2048, 1 << 20, false},
+		{"Percentage Below", mustParse("10%"), 9, 100, true},
+		{"Percentage Equal", mustParse("10%"), 10, 100, false},
+		{"Percentage Above", mustParse("10%"), 50, 100, false},
+		{"Percentage Zero Total", mustParse("10%"), 0, 0, false},
+		{"Zero", mustParse("0"), 0, 100, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if r := test.threshold.Reached(test.available, test.total); r != test.reached {
+				t.Errorf("expected reached %v, got %v", test.reached, r)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package conf
+
+// ExecPolicyConfig defines rules for `kubectl exec/cp` and `kubectl attach`
+// to the device host
+//
+// rules are evaluated in order, the first matched rule decides whether the
+// command is allowed, commands matching no rule are denied
+//
+// when there is no rule, the legacy `allowExec` and `allowAttach` options
+// are used
+type ExecPolicyConfig struct {
+	Rules []ExecPolicyRule `json:"rules" yaml:"rules"`
+}
+
+type ExecPolicyRule struct {
+	// Name of the rule, reported when command denied
+	Name string `json:"name" yaml:"name"`
+
+	// Action of this rule, one of [allow, deny]
+	Action string `json:"action" yaml:"action"`
+
+	// Kinds this rule applies to, values can be [exec, attach],
+	// empty means all
+	Kinds []string `json:"kinds" yaml:"kinds"`
+
+	// Command is a glob pattern matching the absolute path of the command
+	// binary, a plain command name without path separator is resolved in
+	// PATH like the requested command, empty means any
+	Command string `json:"command" yaml:"command"`
+
+	// Args is a regular expression matching all command arguments joined
+	// with NUL (`\x00` in the expression) so argument boundaries are kept,
+	// empty means any
+	Args string `json:"args" yaml:"args"`
+
+	// AllowTTY controls whether tty is allowed, defaults to true
+	AllowTTY *bool `json:"allowTTY" yaml:"allowTTY"`
+
+	// Env filters and forces environment variables
+	Env ExecEnvPolicy `json:"env" yaml:"env"`
+
+	// UID and GID force the command to run as the user/group (unix only)
+	UID *int `json:"uid" yaml:"uid"`
+	GID *int `json:"gid" yaml:"gid"`
+}
+
+type ExecEnvPolicy struct {
+	// Allow is a list of glob patterns of env names allowed to be set by
+	// the requester, empty means all
+	Allow []string `json:"allow" yaml:"allow"`
+
+	// Deny is a list of glob patterns of env names dropped from the request
+	Deny []string `json:"deny" yaml:"deny"`
+
+	// Set env values, override requested ones
+	Set map[string]string `json:"set" yaml:"set"`
+}
+
+// PortForwardPolicyConfig defines destinations allowed for
+// `kubectl port-forward` to the device host
+//
+// when all fields are empty, any public destination is allowed as long as
+// `allowPortForward` is true, private addresses are always denied unless
+// included in CIDRs, except loopback addresses of the default target
+// `localhost`
+type PortForwardPolicyConfig struct {
+	// Networks allowed, values can be [tcp, udp, unix], empty means
+	// [tcp, udp]
+	Networks []string `json:"networks" yaml:"networks"`
+
+	// Hosts is a list of glob patterns of host names allowed
+	Hosts []string `json:"hosts" yaml:"hosts"`
+
+	// CIDRs allowed, resolved addresses are checked against them, private
+	// addresses (including loopback and link local) are denied unless
+	// included in CIDRs
+	CIDRs []string `json:"cidrs" yaml:"cidrs"`
+
+	// Ports allowed, single port (e.g. `80`) or port range (e.g. `8000-9000`),
+	// empty means all
+	Ports []string `json:"ports" yaml:"ports"`
+
+	// UnixSockets is a list of glob patterns of unix socket paths allowed
+	UnixSockets []string `json:"unixSockets" yaml:"unixSockets"`
+}
+
+// LogPolicyConfig defines files and directories allowed for `kubectl logs`
+// with host path
+//
+// paths are resolved (symlinks evaluated) before checking
+type LogPolicyConfig struct {
+	// Roots are directories allowed, empty means any
+	Roots []string `json:"roots" yaml:"roots"`
+
+	// Allow is a list of glob patterns of files allowed, if the pattern
+	// contains no path separator, it's matched against the base name,
+	// empty means all in roots
+	Allow []string `json:"allow" yaml:"allow"`
+
+	// Deny is a list of glob patterns of paths denied, checked after allow
+	Deny []string `json:"deny" yaml:"deny"`
+}
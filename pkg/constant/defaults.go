@@ -23,8 +23,47 @@ const (
 	DefaultArhatConfigFile = "/etc/arhat/config.yaml"
 )
 
+// Connectivity defaults
+const (
+	DefaultPartialCmdTTL = 5 * time.Minute
+	DefaultMaxCmdSize    = 64 * 1024 * 1024
+	DefaultMaxCmdChunks  = 65536
+
+	DefaultCmdDedupTTL        = time.Minute
+	DefaultCmdDedupMaxEntries = 4096
+
+	DefaultCmdAuthMaxClockSkew = time.Minute
+
+	DefaultConnectivityFailbackInterval   = time.Minute
+	DefaultConnectivityMaxPublishFailures = 10
+
+	DefaultSpoolMaxSize   = 64 * 1024 * 1024
+	DefaultSpoolRetention = time.Hour
+)
+
 // Extension defaults
 const (
 	// peripheral
 	DefaultPeripheralMetricsCacheTimeout = 30 * time.Minute
 )
+
+// Node condition defaults
+const (
+	DefaultNodeMemoryAvailableThreshold = "100Mi"
+	DefaultNodeDiskAvailableThreshold   = "10%"
+	DefaultNodePidAvailableThreshold    = "5%"
+
+	DefaultNodeProbeInterval = 30 * time.Second
+	DefaultNodeProbeTimeout  = 5 * time.Second
+)
+
+// Command handling defaults
+const (
+	DefaultMaxActiveWorks       = 64
+	DefaultReservedControlWorks = 16
+	DefaultMaxQueuedWorks       = 128
+	DefaultMaxWorkQueueWait     = time.Minute
+
+	// grace period before killing processes of terminated sessions
+	DefaultSessionTerminationGracePeriod = 10 * time.Second
+)
@@ -0,0 +1,63 @@
+// +build darwin linux freebsd openbsd netbsd solaris dragonfly
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"syscall"
+	"time"
+
+	"arhat.dev/pkg/exechelper"
+)
+
+// withProcessGroup makes the process a process group leader, so all its
+// children can be terminated together
+func withProcessGroup(attr *syscall.SysProcAttr) *syscall.SysProcAttr {
+	if attr == nil {
+		attr = new(syscall.SysProcAttr)
+	}
+
+	attr.Setpgid = true
+	return attr
+}
+
+// Terminate sends SIGTERM to the process group of the cmd, then SIGKILL if
+// exited is not closed after gracePeriod
+//
+// commands handled internally are not affected
+func Terminate(cmd Cmd, exited <-chan struct{}, gracePeriod time.Duration) {
+	c, ok := cmd.(*exechelper.Cmd)
+	if !ok || c.ExecCmd.Process == nil {
+		return
+	}
+
+	// process group id is the same as the pid of the leader (started with
+	// Setpgid or Setsid)
+	pgid := c.ExecCmd.Process.Pid
+
+	_ = syscall.Kill(-pgid, syscall.SIGTERM)
+
+	timer := time.NewTimer(gracePeriod)
+	defer timer.Stop()
+
+	select {
+	case <-exited:
+	case <-timer.C:
+		_ = syscall.Kill(-pgid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,110 @@
+// +build linux
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"arhat.dev/pkg/exechelper"
+)
+
+// processGroup returns pids of live (not zombie) processes in the group
+func processGroup(t *testing.T, pgid int) []int {
+	files, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pids []int
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			// exited
+			continue
+		}
+
+		// pid (comm) state ppid pgrp ...
+		stat := string(data)
+		fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+		if len(fields) < 3 || fields[0] == "Z" || fields[2] != strconv.Itoa(pgid) {
+			continue
+		}
+
+		pid, _ := strconv.Atoi(filepath.Base(filepath.Dir(f)))
+		pids = append(pids, pid)
+	}
+
+	return pids
+}
+
+func TestTerminate(t *testing.T) {
+	cmd, err := DoIfTryFailed(nil, nil, nil,
+		[]string{"sh", "-c", `trap "" TERM; sleep 100 & wait`},
+		false, nil, nil, false,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pgid := cmd.(*exechelper.Cmd).ExecCmd.Process.Pid
+
+	// shell and sleep
+	deadline := time.Now().Add(5 * time.Second)
+	for len(processGroup(t, pgid)) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("process group not started: %v", processGroup(t, pgid))
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		_, _ = cmd.Wait()
+	}()
+
+	const gracePeriod = 200 * time.Millisecond
+	start := time.Now()
+	Terminate(cmd, exited, gracePeriod)
+
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("process not killed")
+	}
+
+	if time.Since(start) < gracePeriod {
+		t.Error("process exited on SIGTERM ignored")
+	}
+
+	deadline = time.Now().Add(5 * time.Second)
+	for len(processGroup(t, pgid)) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("processes left in the group: %v", processGroup(t, pgid))
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,43 @@
+// +build !darwin,!linux,!freebsd,!openbsd,!netbsd,!solaris,!dragonfly
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"syscall"
+	"time"
+
+	"arhat.dev/pkg/exechelper"
+)
+
+func withProcessGroup(attr *syscall.SysProcAttr) *syscall.SysProcAttr {
+	return attr
+}
+
+// Terminate kills the process of the cmd, there is no graceful termination
+// on this platform
+func Terminate(cmd Cmd, exited <-chan struct{}, gracePeriod time.Duration) {
+	_, _ = exited, gracePeriod
+
+	c, ok := cmd.(*exechelper.Cmd)
+	if !ok || c.ExecCmd.Process == nil {
+		return
+	}
+
+	_ = c.ExecCmd.Process.Kill()
+}
@@ -21,6 +21,7 @@ package exec
 import (
 	"io"
 	"path/filepath"
+	"syscall"
 
 	"arhat.dev/pkg/exechelper"
 	"arhat.dev/pkg/wellknownerrors"
@@ -32,12 +33,16 @@ var (
 
 // DoIfTryFailed will first try to handle command internally, if the command is not handled or failed to handle,
 // execute it directly on host
+//
+// commands with sysProcAttr set are always executed on host, since internal handlers
+// run inside arhat and cannot apply process attributes
 func DoIfTryFailed(
 	stdin io.Reader,
 	stdout, stderr io.Writer,
 	command []string,
 	tty bool,
 	env map[string]string,
+	sysProcAttr *syscall.SysProcAttr,
 	tryOnly bool,
 ) (Cmd, error) {
 	var (
@@ -47,7 +52,7 @@ func DoIfTryFailed(
 
 	bin := filepath.Base(command[0])
 	tryExec, ok := tryCommands[bin]
-	if ok {
+	if ok && sysProcAttr == nil {
 		// can try this command, do it
 		cmd, err = tryExec(stdin, stdout, stderr, command, tty)
 		if err == nil {
@@ -73,5 +78,7 @@ func DoIfTryFailed(
 		Stdout:  stdout,
 		Stderr:  stderr,
 		Tty:     tty,
+
+		SysProcAttr: withProcessGroup(sysProcAttr),
 	})
 }
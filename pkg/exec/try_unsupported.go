@@ -20,6 +20,7 @@ package exec
 
 import (
 	"io"
+	"syscall"
 
 	"arhat.dev/pkg/wellknownerrors"
 )
@@ -30,6 +31,7 @@ func DoIfTryFailed(
 	command []string,
 	tty bool,
 	env map[string]string,
+	sysProcAttr *syscall.SysProcAttr,
 	tryOnly bool,
 ) (Cmd, error) {
 	return nil, wellknownerrors.ErrNotSupported
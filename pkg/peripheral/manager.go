@@ -45,6 +45,8 @@ func NewManager(ctx context.Context, config *conf.PeripheralExtensionConfig) *Ma
 		metricsCache: NewMetricsCache(config.MetricsCacheTimeout),
 
 		mu: new(sync.RWMutex),
+
+		extensions: new(sync.Map),
 	}
 }
 
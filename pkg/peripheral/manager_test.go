@@ -0,0 +1,57 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package peripheral
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"arhat.dev/libext/server"
+
+	"arhat.dev/arhat/pkg/conf"
+)
+
+func TestManagerExtensions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := NewManager(ctx, &conf.PeripheralExtensionConfig{})
+
+	_, err := m.connectTarget("foo", "target", nil, nil)
+	if err == nil {
+		t.Error("connected to target without extension")
+	}
+
+	// extension connected
+	m.extensions.Store("foo", &server.ExtensionContext{Context: ctx, Name: "foo"})
+
+	// same extension connected again
+	handleFunc, _ := m.CreateExtensionHandleFunc("foo")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		handleFunc(&server.ExtensionContext{Context: ctx, Name: "foo"})
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("duplicate extension not rejected")
+	}
+}
@@ -0,0 +1,347 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"arhat.dev/pkg/wellknownerrors"
+
+	"arhat.dev/arhat/pkg/conf"
+)
+
+const (
+	ExecKindExec   = "exec"
+	ExecKindAttach = "attach"
+
+	actionAllow = "allow"
+	actionDeny  = "deny"
+
+	// argSeparator joins args for matching, it never appears in argv, so
+	// argument boundaries are kept (e.g. ["-rf /"] vs ["-rf", "/"])
+	argSeparator = '\x00'
+)
+
+// ExecRequest is the command requested to run on the device host
+type ExecRequest struct {
+	// Kind of the request, one of [exec, attach]
+	Kind    string
+	Command []string
+	Env     map[string]string
+	TTY     bool
+}
+
+// ExecDecision is the result of an allowed exec request
+type ExecDecision struct {
+	// Rule allowed the request
+	Rule string
+
+	// Command to run, the binary is resolved to the absolute path checked
+	// by the rule
+	Command []string
+
+	// Env is the filtered and forced env
+	Env map[string]string
+
+	// UID and GID to run the command as, nil means unchanged
+	UID *int
+	GID *int
+}
+
+type execPolicy struct {
+	rules []*execRule
+}
+
+type execRule struct {
+	name  string
+	allow bool
+	kinds map[string]struct{}
+
+	command string
+	args    *regexp.Regexp
+
+	allowTTY bool
+
+	envAllow []string
+	envDeny  []string
+	envSet   map[string]string
+
+	uid *int
+	gid *int
+}
+
+func newExecPolicy(config *conf.HostConfig) (*execPolicy, error) {
+	p := new(execPolicy)
+
+	if len(config.ExecPolicy.Rules) == 0 {
+		// legacy options
+		if config.AllowExec {
+			p.rules = append(p.rules, &execRule{
+				name:     "allowExec",
+				allow:    true,
+				kinds:    map[string]struct{}{ExecKindExec: {}},
+				allowTTY: true,
+			})
+		}
+
+		if config.AllowAttach {
+			p.rules = append(p.rules, &execRule{
+				name:     "allowAttach",
+				allow:    true,
+				kinds:    map[string]struct{}{ExecKindAttach: {}},
+				allowTTY: true,
+			})
+		}
+
+		return p, nil
+	}
+
+	for i, r := range config.ExecPolicy.Rules {
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+
+		rule := &execRule{
+			name:     name,
+			command:  r.Command,
+			allowTTY: r.AllowTTY == nil || *r.AllowTTY,
+
+			envAllow: r.Env.Allow,
+			envDeny:  r.Env.Deny,
+			envSet:   r.Env.Set,
+
+			uid: r.UID,
+			gid: r.GID,
+		}
+
+		switch strings.ToLower(r.Action) {
+		case actionAllow:
+			rule.allow = true
+		case actionDeny:
+			rule.allow = false
+		default:
+			return nil, fmt.Errorf("rule %q: invalid action %q", name, r.Action)
+		}
+
+		if len(r.Kinds) != 0 {
+			rule.kinds = make(map[string]struct{})
+		}
+
+		for _, k := range r.Kinds {
+			switch k {
+			case ExecKindExec, ExecKindAttach:
+				rule.kinds[k] = struct{}{}
+			default:
+				return nil, fmt.Errorf("rule %q: invalid kind %q", name, k)
+			}
+		}
+
+		if r.Command != "" {
+			if !strings.ContainsAny(r.Command, `/\`) && strings.ContainsAny(r.Command, `*?[`) {
+				return nil, fmt.Errorf(
+					"rule %q: command pattern without path separator must be a plain command name", name,
+				)
+			}
+
+			if _, err := path.Match(r.Command, ""); err != nil {
+				return nil, fmt.Errorf("rule %q: invalid command pattern: %w", name, err)
+			}
+		}
+
+		if r.Args != "" {
+			var err error
+			// match all arguments instead of any substring
+			rule.args, err = regexp.Compile(`^(?:` + r.Args + `)$`)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: invalid args pattern: %w", name, err)
+			}
+		}
+
+		for _, pattern := range append(append([]string{}, r.Env.Allow...), r.Env.Deny...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("rule %q: invalid env pattern: %w", name, err)
+			}
+		}
+
+		p.rules = append(p.rules, rule)
+	}
+
+	return p, nil
+}
+
+// CheckExec checks whether the exec request is allowed, returned error wraps
+// wellknownerrors.ErrNotSupported when denied
+func (e *Engine) CheckExec(req *ExecRequest) (*ExecDecision, error) {
+	if len(req.Command) == 0 {
+		return nil, fmt.Errorf("host %s without command: %w",
+			req.Kind, wellknownerrors.ErrNotSupported)
+	}
+
+	for _, arg := range req.Command {
+		// cannot be passed to the process, and is the separator of args
+		// when matching rules
+		if strings.IndexByte(arg, argSeparator) != -1 {
+			return nil, fmt.Errorf("host %s with NUL in command: %w",
+				req.Kind, wellknownerrors.ErrNotSupported)
+		}
+	}
+
+	// empty when not resolvable, only rules without command can match
+	bin, _ := resolveCommand(req.Command[0])
+
+	for _, r := range e.exec.rules {
+		if !r.match(req, bin) {
+			continue
+		}
+
+		if !r.allow {
+			return nil, fmt.Errorf("host %s denied by rule %q: %w",
+				req.Kind, r.name, wellknownerrors.ErrNotSupported)
+		}
+
+		if req.TTY && !r.allowTTY {
+			return nil, fmt.Errorf("host %s with tty denied by rule %q: %w",
+				req.Kind, r.name, wellknownerrors.ErrNotSupported)
+		}
+
+		command := req.Command
+		if bin != "" {
+			command = append([]string{bin}, req.Command[1:]...)
+		}
+
+		return &ExecDecision{
+			Rule:    r.name,
+			Command: command,
+			Env:     r.filterEnv(req.Env),
+			UID:     r.uid,
+			GID:     r.gid,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("host %s not allowed by any rule: %w",
+		req.Kind, wellknownerrors.ErrNotSupported)
+}
+
+// resolveCommand resolves the command binary to a clean absolute path, plain
+// command names are looked up in PATH, symlinks of parent dirs are resolved
+// but the binary itself is kept, since multi-call binaries behave
+// differently by the name they are called
+func resolveCommand(bin string) (string, error) {
+	var err error
+	if !strings.ContainsAny(bin, `/\`) {
+		bin, err = exec.LookPath(bin)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	bin, err = filepath.Abs(bin)
+	if err != nil {
+		return "", err
+	}
+
+	if dir, err := filepath.EvalSymlinks(filepath.Dir(bin)); err == nil {
+		bin = filepath.Join(dir, filepath.Base(bin))
+	}
+
+	return bin, nil
+}
+
+// match the request with resolved absolute path of the binary
+func (r *execRule) match(req *ExecRequest, bin string) bool {
+	if r.kinds != nil {
+		if _, ok := r.kinds[req.Kind]; !ok {
+			return false
+		}
+	}
+
+	if r.command != "" {
+		if bin == "" {
+			return false
+		}
+
+		pattern := r.command
+		if !strings.ContainsAny(pattern, `/\`) {
+			// plain command name, resolve it the same way
+			var err error
+			pattern, err = resolveCommand(pattern)
+			if err != nil {
+				return false
+			}
+
+			if bin != pattern {
+				return false
+			}
+		} else if ok, _ := path.Match(filepath.ToSlash(pattern), filepath.ToSlash(bin)); !ok {
+			return false
+		}
+	}
+
+	if r.args != nil {
+		var args []string
+		if len(req.Command) > 1 {
+			args = req.Command[1:]
+		}
+
+		if !r.args.MatchString(strings.Join(args, string(argSeparator))) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *execRule) filterEnv(env map[string]string) map[string]string {
+	if len(env) == 0 && len(r.envSet) == 0 {
+		return env
+	}
+
+	result := make(map[string]string)
+	for k, v := range env {
+		if len(r.envAllow) != 0 && !matchAny(r.envAllow, k) {
+			continue
+		}
+
+		if matchAny(r.envDeny, k) {
+			continue
+		}
+
+		result[k] = v
+	}
+
+	for k, v := range r.envSet {
+		result[k] = v
+	}
+
+	return result
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,316 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"arhat.dev/pkg/wellknownerrors"
+
+	"arhat.dev/arhat/pkg/conf"
+)
+
+// newTestExecDir creates executables `bin/ls`, `bin/kubectl` and `evil/ls`,
+// `link` is a symlink to `bin`, PATH is set to `bin` until test finished
+func newTestExecDir(t *testing.T) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("executables in test are unix only")
+	}
+
+	dir := t.TempDir()
+	// resolve symlinks of temp dir (e.g. /tmp on macos)
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []string{"bin/ls", "bin/kubectl", "evil/ls"} {
+		f = filepath.Join(dir, f)
+		if err = os.MkdirAll(filepath.Dir(f), 0750); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = os.WriteFile(f, []byte("#!/bin/sh\n"), 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = os.Symlink(filepath.Join(dir, "bin"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	oldPath := os.Getenv("PATH")
+	t.Cleanup(func() { _ = os.Setenv("PATH", oldPath) })
+
+	if err = os.Setenv("PATH", filepath.Join(dir, "bin")); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func newTestExecEngine(t *testing.T, rules ...conf.ExecPolicyRule) *Engine {
+	e, err := NewEngine(&conf.HostConfig{
+		ExecPolicy: conf.ExecPolicyConfig{Rules: rules},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return e
+}
+
+func TestNewExecPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		rule       conf.ExecPolicyRule
+		shouldFail bool
+	}{
+		{name: "Plain Command", rule: conf.ExecPolicyRule{Action: "allow", Command: "ls"}},
+		{name: "Path Pattern", rule: conf.ExecPolicyRule{Action: "Deny", Command: "/usr/*/ls"}},
+		{name: "Kinds", rule: conf.ExecPolicyRule{Action: "allow", Kinds: []string{"exec", "attach"}}},
+
+		{name: "Invalid Action", rule: conf.ExecPolicyRule{Action: "foo"}, shouldFail: true},
+		{name: "Invalid Kind", rule: conf.ExecPolicyRule{Action: "allow", Kinds: []string{"logs"}}, shouldFail: true},
+		{name: "Name Pattern", rule: conf.ExecPolicyRule{Action: "allow", Command: "*ctl"}, shouldFail: true},
+		{name: "Invalid Pattern", rule: conf.ExecPolicyRule{Action: "allow", Command: "/bin/[a"}, shouldFail: true},
+		{name: "Invalid Args", rule: conf.ExecPolicyRule{Action: "allow", Args: "("}, shouldFail: true},
+		{name: "Invalid Env", rule: conf.ExecPolicyRule{Action: "allow", Env: conf.ExecEnvPolicy{
+			Allow: []string{"[a"},
+		}}, shouldFail: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewEngine(&conf.HostConfig{
+				ExecPolicy: conf.ExecPolicyConfig{Rules: []conf.ExecPolicyRule{test.rule}},
+			})
+			if test.shouldFail && err == nil {
+				t.Error("expected error")
+			}
+
+			if !test.shouldFail && err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestCheckExecCommand(t *testing.T) {
+	dir := newTestExecDir(t)
+
+	e := newTestExecEngine(t,
+		conf.ExecPolicyRule{Name: "ls", Action: "allow", Command: "ls"},
+		conf.ExecPolicyRule{Name: "ctl", Action: "allow", Command: filepath.Join(dir, "bin", "*ctl")},
+	)
+
+	tests := []struct {
+		name     string
+		command  []string
+		rule     string
+		resolved string
+	}{
+		{"Name", []string{"ls", "-l"}, "ls", filepath.Join(dir, "bin", "ls")},
+		{"Absolute", []string{filepath.Join(dir, "bin", "ls")}, "ls", filepath.Join(dir, "bin", "ls")},
+		{"Unclean", []string{filepath.Join(dir, "evil", "..", "bin", "ls")}, "ls", filepath.Join(dir, "bin", "ls")},
+		{"Symlink Dir", []string{filepath.Join(dir, "link", "ls")}, "ls", filepath.Join(dir, "bin", "ls")},
+		{"Pattern", []string{"kubectl", "get"}, "ctl", filepath.Join(dir, "bin", "kubectl")},
+
+		{"Same Base Name", []string{filepath.Join(dir, "evil", "ls")}, "", ""},
+		{"Not Found", []string{"cat"}, "", ""},
+		{"Empty", nil, "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, err := e.CheckExec(&ExecRequest{Kind: ExecKindExec, Command: test.command})
+			if test.rule == "" {
+				if !errors.Is(err, wellknownerrors.ErrNotSupported) {
+					t.Fatalf("expected not supported, got %v", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if d.Rule != test.rule {
+				t.Errorf("expected rule %q, got %q", test.rule, d.Rule)
+			}
+
+			if d.Command[0] != test.resolved {
+				t.Errorf("expected binary %q, got %q", test.resolved, d.Command[0])
+			}
+
+			if len(d.Command) != len(test.command) {
+				t.Errorf("args changed: %v", d.Command)
+			}
+		})
+	}
+}
+
+func TestCheckExecDeny(t *testing.T) {
+	dir := newTestExecDir(t)
+
+	e := newTestExecEngine(t,
+		conf.ExecPolicyRule{Name: "no-ls", Action: "deny", Command: "ls"},
+		conf.ExecPolicyRule{Name: "all", Action: "allow"},
+	)
+
+	for _, bin := range []string{"ls", filepath.Join(dir, "bin", "ls"), filepath.Join(dir, "link", "ls")} {
+		if _, err := e.CheckExec(&ExecRequest{Kind: ExecKindExec, Command: []string{bin}}); err == nil {
+			t.Errorf("%q not denied", bin)
+		}
+	}
+
+	d, err := e.CheckExec(&ExecRequest{Kind: ExecKindExec, Command: []string{"kubectl"}})
+	if err != nil || d.Rule != "all" {
+		t.Errorf("unexpected result %v %v", d, err)
+	}
+}
+
+func TestCheckExecArgs(t *testing.T) {
+	newTestExecDir(t)
+
+	e := newTestExecEngine(t, conf.ExecPolicyRule{
+		Name:    "status",
+		Action:  "allow",
+		Command: "kubectl",
+		Args:    `(status|show)(\x00.*)?`,
+	})
+
+	tests := []struct {
+		name    string
+		args    []string
+		allowed bool
+	}{
+		{"Exact", []string{"status"}, true},
+		{"With Args", []string{"show", "-o", "yaml"}, true},
+		{"Prefix", []string{"delete", "status"}, false},
+		{"Suffix", []string{"statuses"}, false},
+		{"None", nil, false},
+		{"Packed Args", []string{"status --all"}, false},
+		{"NUL In Arg", []string{"status\x00--all"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := e.CheckExec(&ExecRequest{
+				Kind:    ExecKindExec,
+				Command: append([]string{"kubectl"}, test.args...),
+			})
+			if test.allowed && err != nil {
+				t.Error(err)
+			}
+
+			if !test.allowed && err == nil {
+				t.Error("expected denied")
+			}
+		})
+	}
+}
+
+func TestCheckExecKindAndTTY(t *testing.T) {
+	newTestExecDir(t)
+
+	noTTY := false
+	e := newTestExecEngine(t, conf.ExecPolicyRule{
+		Name:     "exec",
+		Action:   "allow",
+		Kinds:    []string{ExecKindExec},
+		AllowTTY: &noTTY,
+	})
+
+	if _, err := e.CheckExec(&ExecRequest{Kind: ExecKindExec, Command: []string{"ls"}}); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := e.CheckExec(&ExecRequest{Kind: ExecKindExec, Command: []string{"ls"}, TTY: true}); err == nil {
+		t.Error("tty not denied")
+	}
+
+	if _, err := e.CheckExec(&ExecRequest{Kind: ExecKindAttach, Command: []string{"ls"}}); err == nil {
+		t.Error("attach not denied")
+	}
+}
+
+func TestCheckExecLegacy(t *testing.T) {
+	newTestExecDir(t)
+
+	e, err := NewEngine(&conf.HostConfig{AllowExec: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = e.CheckExec(&ExecRequest{Kind: ExecKindExec, Command: []string{"ls"}}); err != nil {
+		t.Error(err)
+	}
+
+	// unresolvable commands are left as is
+	d, err := e.CheckExec(&ExecRequest{Kind: ExecKindExec, Command: []string{"tar", "xf", "-"}})
+	if err != nil || d.Command[0] != "tar" {
+		t.Errorf("unexpected result %v %v", d, err)
+	}
+
+	if _, err = e.CheckExec(&ExecRequest{Kind: ExecKindAttach, Command: []string{"sh"}}); err == nil {
+		t.Error("attach not denied")
+	}
+}
+
+func TestCheckExecEnv(t *testing.T) {
+	newTestExecDir(t)
+
+	e := newTestExecEngine(t, conf.ExecPolicyRule{
+		Action: "allow",
+		Env: conf.ExecEnvPolicy{
+			Allow: []string{"LC_*", "LANG", "SECRET"},
+			Deny:  []string{"SECRET"},
+			Set:   map[string]string{"PAGER": "cat"},
+		},
+	})
+
+	d, err := e.CheckExec(&ExecRequest{
+		Kind:    ExecKindExec,
+		Command: []string{"ls"},
+		Env: map[string]string{
+			"LC_ALL": "C",
+			"LANG":   "en",
+			"SECRET": "x",
+			"OTHER":  "y",
+			"PAGER":  "less",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"LC_ALL": "C", "LANG": "en", "PAGER": "cat"}
+	if len(d.Env) != len(expected) {
+		t.Fatalf("unexpected env %v", d.Env)
+	}
+
+	for k, v := range expected {
+		if d.Env[k] != v {
+			t.Errorf("expected %s=%s, got %q", k, v, d.Env[k])
+		}
+	}
+}
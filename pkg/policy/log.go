@@ -0,0 +1,146 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"arhat.dev/pkg/wellknownerrors"
+
+	"arhat.dev/arhat/pkg/conf"
+)
+
+type logPolicy struct {
+	enabled bool
+
+	roots []string
+	allow []string
+	deny  []string
+}
+
+func newLogPolicy(config *conf.HostConfig) (*logPolicy, error) {
+	p := &logPolicy{
+		enabled: config.AllowLog,
+		allow:   config.LogPolicy.Allow,
+		deny:    config.LogPolicy.Deny,
+	}
+
+	for _, r := range config.LogPolicy.Roots {
+		root, err := filepath.Abs(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid root %q: %w", r, err)
+		}
+
+		p.roots = append(p.roots, root)
+	}
+
+	for _, pattern := range append(append([]string{}, p.allow...), p.deny...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	return p, nil
+}
+
+// CheckLog checks whether host logs are allowed
+func (e *Engine) CheckLog() error {
+	if !e.log.enabled {
+		return fmt.Errorf("host logs not allowed: %w", wellknownerrors.ErrNotSupported)
+	}
+
+	return nil
+}
+
+// CheckLogPath resolves the path and checks whether it's allowed by the
+// policy, returns the resolved path if allowed
+//
+// returned error wraps wellknownerrors.ErrNotSupported when denied
+func (e *Engine) CheckLogPath(p string) (string, error) {
+	err := e.CheckLog()
+	if err != nil {
+		return "", err
+	}
+
+	resolved, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+
+	resolved, err = filepath.EvalSymlinks(resolved)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", err
+	}
+
+	if !e.log.allowed(resolved, info.IsDir()) {
+		return "", fmt.Errorf("host path %q denied by log policy: %w", p, wellknownerrors.ErrNotSupported)
+	}
+
+	return resolved, nil
+}
+
+// allowed checks resolved path, allow patterns only apply to files
+func (p *logPolicy) allowed(resolved string, isDir bool) bool {
+	if len(p.roots) != 0 {
+		inRoot := false
+		for _, root := range p.roots {
+			// roots can be symlinks as well
+			if r, err := filepath.EvalSymlinks(root); err == nil {
+				root = r
+			}
+
+			rel, err := filepath.Rel(root, resolved)
+			if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				inRoot = true
+				break
+			}
+		}
+
+		if !inRoot {
+			return false
+		}
+	}
+
+	if !isDir && len(p.allow) != 0 && !matchPath(p.allow, resolved) {
+		return false
+	}
+
+	return !matchPath(p.deny, resolved)
+}
+
+func matchPath(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		target := p
+		if !strings.ContainsAny(pattern, `/\`) {
+			target = filepath.Base(p)
+		}
+
+		if ok, _ := filepath.Match(pattern, target); ok {
+			return true
+		}
+	}
+
+	return false
+}
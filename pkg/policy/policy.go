@@ -0,0 +1,53 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"fmt"
+
+	"arhat.dev/arhat/pkg/conf"
+)
+
+// Engine checks host operations requested by aranya against configured rules
+type Engine struct {
+	exec        *execPolicy
+	portForward *portForwardPolicy
+	log         *logPolicy
+}
+
+func NewEngine(config *conf.HostConfig) (*Engine, error) {
+	execP, err := newExecPolicy(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exec policy: %w", err)
+	}
+
+	pfP, err := newPortForwardPolicy(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port-forward policy: %w", err)
+	}
+
+	logP, err := newLogPolicy(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log policy: %w", err)
+	}
+
+	return &Engine{
+		exec:        execP,
+		portForward: pfP,
+		log:         logP,
+	}, nil
+}
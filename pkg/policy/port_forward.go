@@ -0,0 +1,263 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"arhat.dev/pkg/wellknownerrors"
+
+	"arhat.dev/arhat/pkg/conf"
+)
+
+// privateCIDRs are address ranges not reachable from public internet
+var privateCIDRs = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"255.255.255.255/32",
+	"::/128",
+	"::1/128",
+	// NAT64 and 6to4 embed ipv4 addresses
+	"64:ff9b::/96",
+	"2002::/16",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+type portRange struct {
+	min, max int32
+}
+
+type portForwardPolicy struct {
+	enabled bool
+	// anyHost when no hosts and cidrs configured, public addresses of any
+	// host are allowed
+	anyHost bool
+
+	networks    map[string]struct{}
+	hosts       []string
+	cidrs       []*net.IPNet
+	ports       []portRange
+	unixSockets []string
+
+	private []*net.IPNet
+}
+
+func newPortForwardPolicy(config *conf.HostConfig) (*portForwardPolicy, error) {
+	pc := &config.PortForwardPolicy
+	p := &portForwardPolicy{
+		enabled: config.AllowPortForward,
+		anyHost: len(pc.Hosts) == 0 && len(pc.CIDRs) == 0,
+
+		networks:    make(map[string]struct{}),
+		hosts:       pc.Hosts,
+		unixSockets: pc.UnixSockets,
+	}
+
+	networks := pc.Networks
+	if len(networks) == 0 {
+		networks = []string{"tcp", "udp"}
+	}
+
+	for _, n := range networks {
+		switch n {
+		case "tcp", "udp", "unix":
+			p.networks[n] = struct{}{}
+		default:
+			return nil, fmt.Errorf("invalid network %q", n)
+		}
+	}
+
+	for _, pattern := range append(append([]string{}, pc.Hosts...), pc.UnixSockets...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	for _, c := range pc.CIDRs {
+		_, cidr, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q: %w", c, err)
+		}
+
+		p.cidrs = append(p.cidrs, cidr)
+	}
+
+	for _, r := range pc.Ports {
+		pr, err := parsePortRange(r)
+		if err != nil {
+			return nil, err
+		}
+
+		p.ports = append(p.ports, pr)
+	}
+
+	for _, c := range privateCIDRs {
+		_, cidr, _ := net.ParseCIDR(c)
+		p.private = append(p.private, cidr)
+	}
+
+	return p, nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	parts := strings.SplitN(s, "-", 2)
+
+	min, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+
+	max := min
+	if len(parts) == 2 {
+		max, err = strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 16)
+		if err != nil {
+			return portRange{}, fmt.Errorf("invalid port range %q: %w", s, err)
+		}
+	}
+
+	if max < min {
+		return portRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+
+	return portRange{min: int32(min), max: int32(max)}, nil
+}
+
+// PortForwardDialer checks the port-forward destination and returns a
+// dialer validating resolved addresses when connecting, so dns rebinding
+// cannot bypass the policy
+//
+// private addresses are denied unless included in configured cidrs, except
+// loopback addresses of the default target `localhost`
+//
+// returned error wraps wellknownerrors.ErrNotSupported when denied
+func (e *Engine) PortForwardDialer(network, host string, port int32) (*net.Dialer, error) {
+	p := e.portForward
+	if !p.enabled {
+		return nil, fmt.Errorf("host port-forward not allowed: %w", wellknownerrors.ErrNotSupported)
+	}
+
+	family := strings.TrimRight(network, "46")
+	if strings.HasPrefix(network, "unix") {
+		family = "unix"
+	}
+
+	if _, ok := p.networks[family]; !ok {
+		return nil, fmt.Errorf("port-forward network %q denied by policy: %w",
+			network, wellknownerrors.ErrNotSupported)
+	}
+
+	if family == "unix" {
+		socket, err := filepath.EvalSymlinks(host)
+		if err != nil {
+			socket = filepath.Clean(host)
+		}
+
+		if !matchAny(p.unixSockets, socket) {
+			return nil, fmt.Errorf("port-forward to unix socket %q denied by policy: %w",
+				host, wellknownerrors.ErrNotSupported)
+		}
+
+		return new(net.Dialer), nil
+	}
+
+	if !p.portAllowed(port) {
+		return nil, fmt.Errorf("port-forward to port %d denied by policy: %w",
+			port, wellknownerrors.ErrNotSupported)
+	}
+
+	host = strings.ToLower(host)
+	isLocalhost := host == "localhost"
+
+	hostAllowed := p.anyHost
+	if !hostAllowed && net.ParseIP(host) == nil {
+		hostAllowed = matchAny(p.hosts, host)
+		if !hostAllowed && !isLocalhost && len(p.cidrs) == 0 {
+			return nil, fmt.Errorf("port-forward to host %q denied by policy: %w",
+				host, wellknownerrors.ErrNotSupported)
+		}
+	}
+
+	return &net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			ipStr, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			ip := net.ParseIP(ipStr)
+			if ip == nil {
+				return fmt.Errorf("invalid resolved address %q", address)
+			}
+
+			if p.ipAllowed(ip, hostAllowed) || (isLocalhost && ip.IsLoopback()) {
+				return nil
+			}
+
+			return fmt.Errorf("port-forward to %q (%s) denied by policy: %w",
+				host, ip.String(), wellknownerrors.ErrNotSupported)
+		},
+	}, nil
+}
+
+func (p *portForwardPolicy) portAllowed(port int32) bool {
+	if len(p.ports) == 0 {
+		return true
+	}
+
+	for _, r := range p.ports {
+		if port >= r.min && port <= r.max {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *portForwardPolicy) ipAllowed(ip net.IP, hostAllowed bool) bool {
+	if containsIP(p.cidrs, ip) {
+		return true
+	}
+
+	if containsIP(p.private, ip) || ip.IsMulticast() {
+		return false
+	}
+
+	return hostAllowed
+}
+
+func containsIP(cidrs []*net.IPNet, ip net.IP) bool {
+	for _, c := range cidrs {
+		if c.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
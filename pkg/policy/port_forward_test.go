@@ -0,0 +1,129 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"testing"
+
+	"arhat.dev/arhat/pkg/conf"
+)
+
+func newTestPortForwardEngine(t *testing.T, pc conf.PortForwardPolicyConfig) *Engine {
+	e, err := NewEngine(&conf.HostConfig{
+		AllowPortForward:  true,
+		PortForwardPolicy: pc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return e
+}
+
+// checkPortForward returns whether the connection to resolved is allowed
+func checkPortForward(e *Engine, network, host string, port int32, resolved string) bool {
+	d, err := e.PortForwardDialer(network, host, port)
+	if err != nil {
+		return false
+	}
+
+	if d.Control == nil {
+		return true
+	}
+
+	return d.Control(network, resolved, nil) == nil
+}
+
+func TestPortForwardDialer(t *testing.T) {
+	restricted := conf.PortForwardPolicyConfig{
+		Hosts: []string{"*.example.com"},
+		Ports: []string{"80", "8000-9000"},
+	}
+
+	tests := []struct {
+		name     string
+		config   conf.PortForwardPolicyConfig
+		network  string
+		host     string
+		port     int32
+		resolved string
+		allowed  bool
+	}{
+		{"default public ip", conf.PortForwardPolicyConfig{}, "tcp", "1.1.1.1", 80, "1.1.1.1:80", true},
+		{"default public host", conf.PortForwardPolicyConfig{}, "tcp", "a.test", 80, "1.1.1.1:80", true},
+		{"default private ip", conf.PortForwardPolicyConfig{}, "tcp", "10.0.0.1", 80, "10.0.0.1:80", false},
+		{"default loopback ip", conf.PortForwardPolicyConfig{}, "tcp", "127.0.0.1", 80, "127.0.0.1:80", false},
+		{"default rebinding", conf.PortForwardPolicyConfig{}, "tcp", "a.test", 80, "192.168.1.1:80", false},
+		{"default localhost", conf.PortForwardPolicyConfig{}, "tcp", "localhost", 80, "127.0.0.1:80", true},
+		{"default localhost ipv6", conf.PortForwardPolicyConfig{}, "tcp", "localhost", 80, "[::1]:80", true},
+		{"default localhost to private", conf.PortForwardPolicyConfig{}, "tcp", "localhost", 80, "10.0.0.1:80", false},
+		{"default unix", conf.PortForwardPolicyConfig{}, "unix", "/tmp/a.sock", 0, "", false},
+		{"nat64", conf.PortForwardPolicyConfig{}, "tcp", "64:ff9b::a00:1", 80, "[64:ff9b::a00:1]:80", false},
+		{"6to4", conf.PortForwardPolicyConfig{}, "tcp", "2002:a00:1::", 80, "[2002:a00:1::]:80", false},
+		{"benchmark", conf.PortForwardPolicyConfig{}, "tcp", "198.18.0.1", 80, "198.18.0.1:80", false},
+		{"broadcast", conf.PortForwardPolicyConfig{}, "udp", "255.255.255.255", 80, "255.255.255.255:80", false},
+		{"ipv4 mapped private", conf.PortForwardPolicyConfig{}, "tcp", "::ffff:10.0.0.1", 80, "[::ffff:10.0.0.1]:80", false},
+		{"multicast", conf.PortForwardPolicyConfig{}, "udp", "224.0.0.1", 80, "224.0.0.1:80", false},
+		{"restricted host", restricted, "tcp", "a.example.com", 80, "1.1.1.1:80", true},
+		{"restricted host private", restricted, "tcp", "a.example.com", 80, "10.0.0.1:80", false},
+		{"restricted other host", restricted, "tcp", "a.test", 80, "1.1.1.1:80", false},
+		{"restricted public ip", restricted, "tcp", "1.1.1.1", 80, "1.1.1.1:80", false},
+		{"restricted port", restricted, "tcp", "a.example.com", 22, "1.1.1.1:22", false},
+		{"restricted port range", restricted, "tcp", "a.example.com", 8080, "1.1.1.1:8080", true},
+		{"restricted localhost", restricted, "tcp", "localhost", 8080, "127.0.0.1:8080", true},
+		{"restricted localhost port", restricted, "tcp", "localhost", 22, "127.0.0.1:22", false},
+		{
+			"cidrs private", conf.PortForwardPolicyConfig{CIDRs: []string{"10.0.0.0/8"}},
+			"tcp", "a.test", 80, "10.0.0.1:80", true,
+		},
+		{
+			"cidrs other", conf.PortForwardPolicyConfig{CIDRs: []string{"10.0.0.0/8"}},
+			"tcp", "a.test", 80, "1.1.1.1:80", false,
+		},
+		{
+			"networks", conf.PortForwardPolicyConfig{Networks: []string{"tcp"}},
+			"udp", "1.1.1.1", 53, "1.1.1.1:53", false,
+		},
+		{
+			"unix socket", conf.PortForwardPolicyConfig{
+				Networks: []string{"unix"}, UnixSockets: []string{"/nonexistent/*.sock"},
+			},
+			"unix", "/nonexistent/a.sock", 0, "", true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestPortForwardEngine(t, test.config)
+			allowed := checkPortForward(e, test.network, test.host, test.port, test.resolved)
+			if allowed != test.allowed {
+				t.Errorf("expected allowed %v, got %v", test.allowed, allowed)
+			}
+		})
+	}
+}
+
+func TestPortForwardDisabled(t *testing.T) {
+	e, err := NewEngine(&conf.HostConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = e.PortForwardDialer("tcp", "localhost", 80); err == nil {
+		t.Error("expected port-forward denied")
+	}
+}
@@ -0,0 +1,22 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package simulator provides an in-process aranya for end-to-end tests
+//
+// A Simulator serves the arhat connectivity (gRPC sync server or embedded
+// MQTT broker) on a loopback address, sends typed cmds to the connected
+// agent and reassembles the chunked msgs it replies by session id and seq
+package simulator
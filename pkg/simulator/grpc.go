@@ -0,0 +1,162 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package simulator
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/aranya-proto/aranyagopb/rpcpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/proto"
+
+	"arhat.dev/arhat/pkg/cmdauth"
+)
+
+// NewGRPC creates a Simulator serving the EdgeDevice sync service on a
+// random loopback port (insecure), cmds larger than maxPayloadSize are
+// split, non-positive maxPayloadSize means no limit
+func NewGRPC(ctx context.Context, maxPayloadSize int) (*Simulator, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	s := newSimulator(ctx, maxPayloadSize)
+	t := &grpcTransport{
+		sim:    s,
+		server: grpc.NewServer(grpc.CustomCodec(sealedCmdCodec{})),
+	}
+	rpcpb.RegisterEdgeDeviceServer(t.server, t)
+
+	s.endpoint = l.Addr().String()
+	s.transport = t
+
+	go func() {
+		_ = t.server.Serve(l)
+	}()
+
+	go func() {
+		<-s.ctx.Done()
+		_ = t.close()
+	}()
+
+	return s, nil
+}
+
+type grpcTransport struct {
+	sim    *Simulator
+	server *grpc.Server
+
+	stream rpcpb.EdgeDevice_SyncServer
+	mu     sync.Mutex
+
+	// sealer of cmds, *cmdauth.Sealer
+	sealer atomic.Value
+}
+
+func (t *grpcTransport) setSealer(sealer *cmdauth.Sealer) {
+	t.sealer.Store(sealer)
+}
+
+// Sync implements rpcpb.EdgeDeviceServer, the latest stream replaces
+// the previous one
+func (t *grpcTransport) Sync(stream rpcpb.EdgeDevice_SyncServer) error {
+	t.mu.Lock()
+	t.stream = stream
+	t.mu.Unlock()
+
+	t.sim.setConnected(true)
+
+	defer func() {
+		t.mu.Lock()
+		current := t.stream == stream
+		if current {
+			t.stream = nil
+		}
+		t.mu.Unlock()
+
+		if current {
+			t.sim.setConnected(false)
+		}
+	}()
+
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+
+		t.sim.handleMsg(msg)
+	}
+}
+
+func (t *grpcTransport) send(cmd *aranyagopb.Cmd) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stream == nil {
+		return fmt.Errorf("agent not connected")
+	}
+
+	sealer, _ := t.sealer.Load().(*cmdauth.Sealer)
+	if sealer == nil {
+		return t.stream.Send(cmd)
+	}
+
+	data, err := cmd.Marshal()
+	if err != nil {
+		return err
+	}
+
+	data, err = sealer.Seal(data)
+	if err != nil {
+		return err
+	}
+
+	return t.stream.SendMsg(sealedCmd(data))
+}
+
+func (t *grpcTransport) close() error {
+	t.server.Stop()
+	return nil
+}
+
+// sealedCmd is sent in place of an encoded cmd
+type sealedCmd []byte
+
+// sealedCmdCodec is the proto codec sending sealed cmds as is
+type sealedCmdCodec struct{}
+
+func (sealedCmdCodec) String() string { return proto.Name }
+
+func (sealedCmdCodec) Marshal(v interface{}) ([]byte, error) {
+	if cmd, ok := v.(sealedCmd); ok {
+		return cmd, nil
+	}
+
+	return encoding.GetCodec(proto.Name).Marshal(v)
+}
+
+func (sealedCmdCodec) Unmarshal(data []byte, v interface{}) error {
+	return encoding.GetCodec(proto.Name).Unmarshal(data, v)
+}
@@ -0,0 +1,62 @@
+// +build !noclient_grpc
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package simulator_test
+
+import (
+	"context"
+	"testing"
+
+	"arhat.dev/aranya-proto/aranyagopb/aranyagoconst"
+
+	"arhat.dev/arhat/pkg/agent"
+	"arhat.dev/arhat/pkg/client/clientutil"
+	"arhat.dev/arhat/pkg/client/grpc"
+	"arhat.dev/arhat/pkg/simulator"
+)
+
+func init() {
+	transports["grpc"] = connectGRPC
+}
+
+func connectGRPC(t *testing.T, ctx context.Context, ag *agent.Agent) *simulator.Simulator {
+	sim, err := simulator.NewGRPC(ctx, aranyagoconst.MaxGRPCDataSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sim.Close() })
+
+	c, err := grpc.NewGRPCClient(ctx, ag.HandleCmd, &grpc.Config{
+		CommonConfig: clientutil.CommonConfig{
+			Endpoint:       sim.Endpoint(),
+			MaxPayloadSize: aranyagoconst.MaxGRPCDataSize,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startClient(t, ctx, ag, c)
+
+	err = sim.WaitConnected(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sim
+}
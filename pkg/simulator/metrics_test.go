@@ -0,0 +1,73 @@
+// +build !nometrics
+// +build linux
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package simulator_test
+
+import (
+	"bytes"
+	"testing"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"github.com/klauspost/compress/zstd"
+
+	"arhat.dev/arhat/pkg/simulator"
+)
+
+func TestMetrics(t *testing.T) {
+	runTransports(t, nil, func(t *testing.T, sim *simulator.Simulator) {
+		sess, err := sim.CollectMetrics()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stream, err := sess.Wait(testContext(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if errMsg, _ := stream.Error(); errMsg == nil {
+			t.Error("metrics collected before configured")
+		}
+
+		sess, err = sim.ConfigureMetrics(&aranyagopb.MetricsConfigCmd{
+			Collect: []string{"loadavg"},
+		})
+		wait(t, sess, err)
+
+		sess, err = sim.CollectMetrics()
+		stream = wait(t, sess, err)
+
+		dec, err := zstd.NewReader(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dec.Close()
+
+		data, err := dec.DecodeAll(stream.Stdout(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, name := range []string{"node_load1", "arhat_agent_works_active"} {
+			if !bytes.Contains(data, []byte(name)) {
+				t.Errorf("metric %q not collected", name)
+			}
+		}
+	})
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package simulator
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/aranya-proto/aranyagopb/aranyagoconst"
+
+	"arhat.dev/arhat/pkg/cmdauth"
+)
+
+// NewMQTT creates a Simulator with an embedded mqtt broker listening on a
+// random loopback port (tcp), agent should use the standard variant with
+// the topicNamespace, cmds larger than maxPayloadSize are split,
+// non-positive maxPayloadSize means no limit
+func NewMQTT(ctx context.Context, topicNamespace string, maxPayloadSize int) (*Simulator, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	s := newSimulator(ctx, maxPayloadSize)
+	t := &mqttTransport{
+		broker: NewBroker(),
+	}
+	t.cmdTopic, t.msgTopic, t.statusTopic = aranyagoconst.MQTTTopics(topicNamespace)
+
+	t.broker.onSubChange = func() {
+		s.setConnected(t.broker.HasSubscriber(t.cmdTopic))
+	}
+	t.broker.Subscribe(t.msgTopic, func(_ string, payload []byte) {
+		s.handleMsgBytes(payload)
+	})
+	t.broker.Subscribe(t.statusTopic, func(_ string, payload []byte) {
+		s.handleMsgBytes(payload)
+	})
+
+	s.endpoint = l.Addr().String()
+	s.topicNamespace = topicNamespace
+	s.broker = t.broker
+	s.transport = t
+
+	go func() {
+		_ = t.broker.Serve(l)
+	}()
+
+	go func() {
+		<-s.ctx.Done()
+		_ = t.close()
+	}()
+
+	return s, nil
+}
+
+type mqttTransport struct {
+	broker *Broker
+
+	cmdTopic    string
+	msgTopic    string
+	statusTopic string
+
+	// sealer of cmds, *cmdauth.Sealer
+	sealer atomic.Value
+}
+
+func (t *mqttTransport) setSealer(sealer *cmdauth.Sealer) {
+	t.sealer.Store(sealer)
+}
+
+func (t *mqttTransport) send(cmd *aranyagopb.Cmd) error {
+	data, err := cmd.Marshal()
+	if err != nil {
+		return err
+	}
+
+	if sealer, _ := t.sealer.Load().(*cmdauth.Sealer); sealer != nil {
+		data, err = sealer.Seal(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !t.broker.HasSubscriber(t.cmdTopic) {
+		return fmt.Errorf("agent not connected")
+	}
+
+	t.broker.Publish(t.cmdTopic, data, 1, false)
+	return nil
+}
+
+func (t *mqttTransport) close() error {
+	return t.broker.Close()
+}
@@ -0,0 +1,766 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package simulator
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mqtt 3.1.1 control packet types
+const (
+	mqttConnect     byte = 1
+	mqttConnAck     byte = 2
+	mqttPublish     byte = 3
+	mqttPubAck      byte = 4
+	mqttPubRec      byte = 5
+	mqttPubRel      byte = 6
+	mqttPubComp     byte = 7
+	mqttSubscribe   byte = 8
+	mqttSubAck      byte = 9
+	mqttUnsubscribe byte = 10
+	mqttUnsubAck    byte = 11
+	mqttPingReq     byte = 12
+	mqttPingResp    byte = 13
+	mqttDisconnect  byte = 14
+)
+
+// connack return codes
+const (
+	mqttConnAccepted           byte = 0
+	mqttConnBadProtocolVersion byte = 1
+	mqttConnBadClientID        byte = 2
+)
+
+// suback return code for rejected subscriptions
+const mqttSubFailure byte = 0x80
+
+var errMalformedPacket = errors.New("malformed mqtt packet")
+
+// MessageHandleFunc handles messages published to the Broker
+type MessageHandleFunc func(topic string, payload []byte)
+
+// NewBroker creates a minimal in-memory mqtt 3.1.1 broker
+//
+// it supports qos 0, 1 and 2 for incoming messages, retained messages,
+// will messages and wildcard subscriptions, messages are delivered to
+// clients with qos up to 1 and never redelivered, sessions are always
+// discarded when the connection is lost
+func NewBroker() *Broker {
+	return &Broker{
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[string]*brokerConn),
+		retained:  make(map[string][]byte),
+	}
+}
+
+// Broker is an mqtt broker for tests
+type Broker struct {
+	listeners map[net.Listener]struct{}
+	conns     map[string]*brokerConn
+	handlers  []*brokerHandler
+	retained  map[string][]byte
+	closed    bool
+
+	// onSubChange is called when subscriptions of clients changed
+	onSubChange func()
+
+	mu sync.RWMutex
+}
+
+type brokerHandler struct {
+	filter string
+	handle MessageHandleFunc
+}
+
+// Serve mqtt clients accepted from the listener until it's closed
+func (b *Broker) Serve(l net.Listener) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return fmt.Errorf("broker closed")
+	}
+	b.listeners[l] = struct{}{}
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		delete(b.listeners, l)
+		b.mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			var nErr net.Error
+			if errors.As(err, &nErr) && nErr.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+
+			return err
+		}
+
+		go b.handleConn(conn)
+	}
+}
+
+// Subscribe registers an in-process handler for messages matching the
+// topic filter
+func (b *Broker) Subscribe(filter string, handle MessageHandleFunc) {
+	h := &brokerHandler{filter: filter, handle: handle}
+
+	b.mu.Lock()
+	b.handlers = append(b.handlers, h)
+	var retained []string
+	for topic := range b.retained {
+		if topicMatch(filter, topic) {
+			retained = append(retained, topic)
+		}
+	}
+	payloads := make([][]byte, len(retained))
+	for i, topic := range retained {
+		payloads[i] = b.retained[topic]
+	}
+	b.mu.Unlock()
+
+	for i, topic := range retained {
+		handle(topic, payloads[i])
+	}
+}
+
+// Publish a message to all subscribers of the topic
+func (b *Broker) Publish(topic string, payload []byte, qos byte, retain bool) {
+	b.publish(topic, payload, qos, retain)
+}
+
+// HasSubscriber checks whether there is any client subscribed to the topic
+func (b *Broker) HasSubscriber(topic string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, c := range b.conns {
+		if _, ok := c.match(topic); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Close all listeners and client connections, will messages of connected
+// clients are not published
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	listeners, conns := b.listeners, b.conns
+	b.listeners, b.conns = make(map[net.Listener]struct{}), make(map[string]*brokerConn)
+	b.mu.Unlock()
+
+	for l := range listeners {
+		_ = l.Close()
+	}
+
+	for _, c := range conns {
+		_ = c.conn.Close()
+	}
+
+	return nil
+}
+
+func (b *Broker) publish(topic string, payload []byte, qos byte, retain bool) {
+	b.mu.Lock()
+	if retain {
+		if len(payload) == 0 {
+			delete(b.retained, topic)
+		} else {
+			b.retained[topic] = payload
+		}
+	}
+
+	var (
+		handlers []*brokerHandler
+		conns    []*brokerConn
+		qosList  []byte
+	)
+	for _, h := range b.handlers {
+		if topicMatch(h.filter, topic) {
+			handlers = append(handlers, h)
+		}
+	}
+
+	for _, c := range b.conns {
+		if granted, ok := c.match(topic); ok {
+			conns = append(conns, c)
+			qosList = append(qosList, minQoS(qos, granted))
+		}
+	}
+	b.mu.Unlock()
+
+	for _, h := range handlers {
+		h.handle(topic, payload)
+	}
+
+	for i, c := range conns {
+		// retain flag is only set for retained messages sent on subscription
+		_ = c.writePublish(topic, payload, qosList[i], false)
+	}
+}
+
+func (b *Broker) notifySubChange() {
+	if b.onSubChange != nil {
+		b.onSubChange()
+	}
+}
+
+func (b *Broker) handleConn(conn net.Conn) {
+	c := &brokerConn{
+		broker:   b,
+		conn:     conn,
+		subs:     make(map[string]byte),
+		received: make(map[uint16]struct{}),
+	}
+
+	r := bufio.NewReader(conn)
+	err := c.handleConnect(r)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	defer func() {
+		_ = conn.Close()
+
+		b.mu.Lock()
+		current := b.conns[c.clientID] == c
+		if current {
+			delete(b.conns, c.clientID)
+		}
+		b.mu.Unlock()
+
+		if !current {
+			// taken over by another connection or broker closed
+			return
+		}
+
+		b.notifySubChange()
+
+		if will := c.will; will != nil {
+			b.publish(will.topic, will.payload, will.qos, will.retain)
+		}
+	}()
+
+	for {
+		if c.keepalive > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(c.keepalive * 3 / 2))
+		}
+
+		header, body, err := readPacket(r)
+		if err != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case mqttPublish:
+			err = c.handlePublish(header, body)
+		case mqttPubRel:
+			err = c.handlePubRel(body)
+		case mqttSubscribe:
+			err = c.handleSubscribe(body)
+		case mqttUnsubscribe:
+			err = c.handleUnsubscribe(body)
+		case mqttPingReq:
+			err = c.write(mqttPingResp<<4, nil)
+		case mqttDisconnect:
+			// normal disconnection, discard will message
+			c.will = nil
+			return
+		case mqttPubAck:
+			// messages to clients are never redelivered, nothing to do
+		default:
+			err = errMalformedPacket
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+type brokerMsg struct {
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
+}
+
+type brokerConn struct {
+	broker *Broker
+	conn   net.Conn
+
+	clientID  string
+	keepalive time.Duration
+	will      *brokerMsg
+
+	// subs is guarded by broker.mu
+	subs map[string]byte
+
+	// received are ids of qos 2 messages waiting for PUBREL
+	received map[uint16]struct{}
+
+	pid uint16
+	wmu sync.Mutex
+}
+
+func (c *brokerConn) handleConnect(r *bufio.Reader) error {
+	_ = c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	header, body, err := readPacket(r)
+	if err != nil {
+		return err
+	}
+
+	if header>>4 != mqttConnect {
+		return errMalformedPacket
+	}
+
+	pr := &packetReader{buf: body}
+	proto := pr.string()
+	level := pr.byte()
+	flags := pr.byte()
+	keepalive := pr.uint16()
+	if pr.err != nil {
+		return pr.err
+	}
+
+	switch {
+	case proto == "MQTT" && level == 4, proto == "MQIsdp" && level == 3:
+	default:
+		_ = c.write(mqttConnAck<<4, []byte{0, mqttConnBadProtocolVersion})
+		return fmt.Errorf("unsupported protocol %q level %d", proto, level)
+	}
+
+	c.clientID = pr.string()
+	if flags&0x04 != 0 {
+		c.will = &brokerMsg{
+			topic:   pr.string(),
+			payload: pr.bytes(),
+			qos:     (flags >> 3) & 0x03,
+			retain:  flags&0x20 != 0,
+		}
+	}
+
+	if flags&0x80 != 0 {
+		_ = pr.string()
+	}
+
+	if flags&0x40 != 0 {
+		_ = pr.bytes()
+	}
+
+	if pr.err != nil {
+		return pr.err
+	}
+
+	cleanSession := flags&0x02 != 0
+	if c.clientID == "" {
+		if !cleanSession {
+			_ = c.write(mqttConnAck<<4, []byte{0, mqttConnBadClientID})
+			return fmt.Errorf("empty client id")
+		}
+
+		c.clientID = fmt.Sprintf("simulator-%p", c)
+	}
+
+	c.keepalive = time.Duration(keepalive) * time.Second
+	_ = c.conn.SetReadDeadline(time.Time{})
+
+	b := c.broker
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return fmt.Errorf("broker closed")
+	}
+	prev := b.conns[c.clientID]
+	b.conns[c.clientID] = c
+	b.mu.Unlock()
+
+	if prev != nil {
+		// session take over
+		_ = prev.conn.Close()
+	}
+
+	return c.write(mqttConnAck<<4, []byte{0, mqttConnAccepted})
+}
+
+func (c *brokerConn) handlePublish(header byte, body []byte) error {
+	qos := (header >> 1) & 0x03
+	retain := header&0x01 != 0
+
+	pr := &packetReader{buf: body}
+	topic := pr.string()
+
+	var pid uint16
+	if qos > 0 {
+		pid = pr.uint16()
+	}
+
+	if pr.err != nil || qos > 2 || strings.ContainsAny(topic, "+#") {
+		return errMalformedPacket
+	}
+
+	payload := pr.buf
+	switch qos {
+	case 0:
+		c.broker.publish(topic, payload, qos, retain)
+		return nil
+	case 1:
+		c.broker.publish(topic, payload, qos, retain)
+		return c.write(mqttPubAck<<4, pidBytes(pid))
+	default:
+		if _, dup := c.received[pid]; !dup {
+			c.received[pid] = struct{}{}
+			c.broker.publish(topic, payload, qos, retain)
+		}
+
+		return c.write(mqttPubRec<<4, pidBytes(pid))
+	}
+}
+
+func (c *brokerConn) handlePubRel(body []byte) error {
+	pr := &packetReader{buf: body}
+	pid := pr.uint16()
+	if pr.err != nil {
+		return pr.err
+	}
+
+	delete(c.received, pid)
+	return c.write(mqttPubComp<<4, pidBytes(pid))
+}
+
+func (c *brokerConn) handleSubscribe(body []byte) error {
+	pr := &packetReader{buf: body}
+	pid := pr.uint16()
+
+	var (
+		filters []string
+		codes   []byte
+	)
+	for pr.err == nil && len(pr.buf) != 0 {
+		filter := pr.string()
+		qos := pr.byte()
+		if pr.err != nil {
+			break
+		}
+
+		if !validFilter(filter) || qos > 2 {
+			codes = append(codes, mqttSubFailure)
+			continue
+		}
+
+		filters = append(filters, filter)
+		codes = append(codes, minQoS(qos, 1))
+	}
+
+	if pr.err != nil || len(codes) == 0 {
+		return errMalformedPacket
+	}
+
+	b := c.broker
+	var retained []*brokerMsg
+	b.mu.Lock()
+	for i, filter := range filters {
+		c.subs[filter] = codes[i]
+	}
+
+	for topic, payload := range b.retained {
+		for i, filter := range filters {
+			if topicMatch(filter, topic) {
+				retained = append(retained, &brokerMsg{
+					topic:   topic,
+					payload: payload,
+					qos:     codes[i],
+				})
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	err := c.write(mqttSubAck<<4, append(pidBytes(pid), codes...))
+	if err != nil {
+		return err
+	}
+
+	b.notifySubChange()
+
+	for _, m := range retained {
+		err = c.writePublish(m.topic, m.payload, m.qos, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *brokerConn) handleUnsubscribe(body []byte) error {
+	pr := &packetReader{buf: body}
+	pid := pr.uint16()
+
+	var filters []string
+	for pr.err == nil && len(pr.buf) != 0 {
+		filters = append(filters, pr.string())
+	}
+
+	if pr.err != nil || len(filters) == 0 {
+		return errMalformedPacket
+	}
+
+	c.broker.mu.Lock()
+	for _, filter := range filters {
+		delete(c.subs, filter)
+	}
+	c.broker.mu.Unlock()
+
+	err := c.write(mqttUnsubAck<<4, pidBytes(pid))
+	if err != nil {
+		return err
+	}
+
+	c.broker.notifySubChange()
+	return nil
+}
+
+// match finds the max granted qos of subscriptions matching the topic,
+// caller MUST hold broker.mu
+func (c *brokerConn) match(topic string) (qos byte, ok bool) {
+	for filter, granted := range c.subs {
+		if topicMatch(filter, topic) {
+			if !ok || granted > qos {
+				qos = granted
+			}
+			ok = true
+		}
+	}
+
+	return
+}
+
+func (c *brokerConn) writePublish(topic string, payload []byte, qos byte, retain bool) error {
+	header := mqttPublish<<4 | qos<<1
+	if retain {
+		header |= 0x01
+	}
+
+	body := appendString(make([]byte, 0, 2+len(topic)+2+len(payload)), topic)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if qos > 0 {
+		c.pid++
+		if c.pid == 0 {
+			c.pid = 1
+		}
+		body = append(body, pidBytes(c.pid)...)
+	}
+
+	return c.doWrite(header, append(body, payload...))
+}
+
+func (c *brokerConn) write(header byte, body []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	return c.doWrite(header, body)
+}
+
+func (c *brokerConn) doWrite(header byte, body []byte) error {
+	_, err := c.conn.Write(encodePacket(header, body))
+	return err
+}
+
+func readPacket(r *bufio.Reader) (header byte, body []byte, err error) {
+	header, err = r.ReadByte()
+	if err != nil {
+		return
+	}
+
+	size, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errMalformedPacket
+		}
+
+		var b byte
+		b, err = r.ReadByte()
+		if err != nil {
+			return
+		}
+
+		size += int(b&0x7f) * multiplier
+		multiplier <<= 7
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	body = make([]byte, size)
+	_, err = io.ReadFull(r, body)
+	return
+}
+
+func encodePacket(header byte, body []byte) []byte {
+	buf := make([]byte, 1, 5+len(body))
+	buf[0] = header
+
+	size := len(body)
+	for {
+		b := byte(size & 0x7f)
+		size >>= 7
+		if size > 0 {
+			b |= 0x80
+		}
+
+		buf = append(buf, b)
+		if size == 0 {
+			break
+		}
+	}
+
+	return append(buf, body...)
+}
+
+type packetReader struct {
+	buf []byte
+	err error
+}
+
+func (r *packetReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if len(r.buf) < n {
+		r.err = errMalformedPacket
+		return nil
+	}
+
+	ret := r.buf[:n]
+	r.buf = r.buf[n:]
+	return ret
+}
+
+func (r *packetReader) byte() byte {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+
+	return b[0]
+}
+
+func (r *packetReader) uint16() uint16 {
+	b := r.next(2)
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *packetReader) bytes() []byte {
+	return r.next(int(r.uint16()))
+}
+
+func (r *packetReader) string() string {
+	return string(r.bytes())
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = append(buf, byte(len(s)>>8), byte(len(s)))
+	return append(buf, s...)
+}
+
+func pidBytes(pid uint16) []byte {
+	return []byte{byte(pid >> 8), byte(pid)}
+}
+
+func minQoS(a, b byte) byte {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// validFilter checks wildcards in the topic filter
+func validFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, l := range levels {
+		switch {
+		case l == "#":
+			if i != len(levels)-1 {
+				return false
+			}
+		case l == "+":
+		case strings.ContainsAny(l, "+#"):
+			return false
+		}
+	}
+
+	return true
+}
+
+// topicMatch checks whether the topic matches the filter
+func topicMatch(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && !strings.HasPrefix(filter, "$") {
+		// topics starting with $ are not matched by wildcards
+		if strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#") {
+			return false
+		}
+	}
+
+	fl := strings.Split(filter, "/")
+	tl := strings.Split(topic, "/")
+	for i, f := range fl {
+		if f == "#" {
+			return true
+		}
+
+		if i >= len(tl) {
+			return false
+		}
+
+		if f != "+" && f != tl[i] {
+			return false
+		}
+	}
+
+	return len(fl) == len(tl)
+}
@@ -0,0 +1,77 @@
+// +build !noclient_mqtt
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package simulator_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb/aranyagoconst"
+
+	"arhat.dev/arhat/pkg/agent"
+	"arhat.dev/arhat/pkg/client/clientutil"
+	"arhat.dev/arhat/pkg/client/mqtt"
+	"arhat.dev/arhat/pkg/conf"
+	"arhat.dev/arhat/pkg/simulator"
+)
+
+func init() {
+	transports["mqtt"] = connectMQTT
+}
+
+func connectMQTT(t *testing.T, ctx context.Context, ag *agent.Agent) *simulator.Simulator {
+	sim, err := simulator.NewMQTT(ctx, "arhat.test", aranyagoconst.MaxMQTTDataSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sim.Close() })
+
+	c, err := mqtt.NewMQTTClient(ctx, ag.HandleCmd, &mqtt.Config{
+		CommonConfig: clientutil.CommonConfig{
+			Endpoint:       sim.Endpoint(),
+			MaxPayloadSize: aranyagoconst.MaxMQTTDataSize,
+		},
+		Version:            "3.1.1",
+		Variant:            "standard",
+		Transport:          "tcp",
+		TopicNamespaceFrom: conf.ValueFromSpec{Text: sim.TopicNamespace()},
+		ClientID:           "foo",
+		KeepaliveInterval:  time.Minute,
+		QoS:                mqtt.QoSConfig{State: 1, Data: 1, Metrics: 0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startClient(t, ctx, ag, c)
+
+	ctx = testContext(t)
+	err = sim.WaitConnected(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sim.WaitOnline(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sim
+}
@@ -0,0 +1,257 @@
+// +build !noextension
+// +build !noextension_peripheral
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package simulator_test
+
+import (
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/arhat-proto/arhatgopb"
+	"arhat.dev/libext/codec"
+	_ "arhat.dev/libext/codec/gogoprotobuf" // add protobuf codec support
+	_ "arhat.dev/libext/codec/stdjson"      // add json codec support
+	"arhat.dev/libext/protoutil"
+
+	"arhat.dev/arhat/pkg/conf"
+	"arhat.dev/arhat/pkg/simulator"
+)
+
+// fakeExtension is a peripheral extension echoing operation data with the
+// `prefix` param of the operation prepended
+type fakeExtension struct {
+	mu   *sync.Mutex
+	cmds []arhatgopb.CmdType
+}
+
+// serve registers to the agent listening on the unix socket and handles
+// cmds until the connection closed
+func (e *fakeExtension) serve(t *testing.T, socket string) {
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	// agent listens in background
+	waitFor(t, "extension endpoint", func() bool {
+		conn, err = net.Dial("unix", socket)
+		return err == nil
+	})
+	t.Cleanup(func() { _ = conn.Close() })
+
+	jsonCodec, _ := codec.Get(arhatgopb.CODEC_JSON)
+	pbCodec, _ := codec.Get(arhatgopb.CODEC_PROTOBUF)
+
+	regMsg, err := protoutil.NewMsg(jsonCodec.Marshal, arhatgopb.MSG_REGISTER, 0, 0, &arhatgopb.RegisterMsg{
+		Name:          "fake",
+		Codec:         arhatgopb.CODEC_PROTOBUF,
+		ExtensionType: arhatgopb.EXTENSION_PERIPHERAL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = jsonCodec.NewEncoder(conn).Encode(regMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		var (
+			enc = pbCodec.NewEncoder(conn)
+			dec = pbCodec.NewDecoder(conn)
+		)
+
+		for {
+			cmd := new(arhatgopb.Cmd)
+			if dec.Decode(cmd) != nil {
+				return
+			}
+
+			if cmd.Kind == arhatgopb.CMD_PING {
+				continue
+			}
+
+			e.mu.Lock()
+			e.cmds = append(e.cmds, cmd.Kind)
+			e.mu.Unlock()
+
+			var (
+				kind             = arhatgopb.MSG_DONE
+				body interface{} = &arhatgopb.DoneMsg{}
+			)
+
+			if cmd.Kind == arhatgopb.CMD_PERIPHERAL_OPERATE {
+				opCmd := new(arhatgopb.PeripheralOperateCmd)
+				_ = opCmd.Unmarshal(cmd.Payload)
+
+				kind = arhatgopb.MSG_PERIPHERAL_OPERATION_RESULT
+				body = &arhatgopb.PeripheralOperationResultMsg{
+					Result: [][]byte{append([]byte(opCmd.Params["prefix"]), opCmd.Data...)},
+				}
+			}
+
+			msg, err := protoutil.NewMsg(pbCodec.Marshal, kind, cmd.Id, cmd.Seq, body)
+			if err != nil || enc.Encode(msg) != nil {
+				return
+			}
+		}
+	}()
+}
+
+func (e *fakeExtension) received() []arhatgopb.CmdType {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]arhatgopb.CmdType{}, e.cmds...)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// statusList returns peripheral names and states in the status list msg
+func statusList(t *testing.T, stream *simulator.Stream) map[string]aranyagopb.PeripheralState {
+	t.Helper()
+
+	if len(stream.Msgs) != 1 || stream.Msgs[0].Kind != aranyagopb.MSG_PERIPHERAL_STATUS_LIST {
+		t.Fatalf("unexpected msgs of peripheral status list: %v", stream.Msgs)
+	}
+
+	list := new(aranyagopb.PeripheralStatusListMsg)
+	if err := list.Unmarshal(stream.Msgs[0].Payload); err != nil {
+		t.Fatal(err)
+	}
+
+	ret := make(map[string]aranyagopb.PeripheralState)
+	for _, s := range list.Peripherals {
+		ret[s.Name] = s.State
+	}
+
+	return ret
+}
+
+func TestPeripherals(t *testing.T) {
+	var socket string
+	enableExtension := func(t *testing.T, config *conf.Config) {
+		socket = filepath.Join(t.TempDir(), "ext.sock")
+
+		config.Extension.Enabled = true
+		config.Extension.Endpoints = []conf.ExtensionEndpoint{{Listen: "unix://" + socket}}
+	}
+
+	runTransports(t, enableExtension, func(t *testing.T, sim *simulator.Simulator) {
+		ext := &fakeExtension{mu: new(sync.Mutex)}
+		ext.serve(t, socket)
+
+		ensureCmd := &aranyagopb.PeripheralEnsureCmd{
+			Kind: aranyagopb.PERIPHERAL_TYPE_NORMAL,
+			Name: "foo",
+			Connector: &aranyagopb.Connectivity{
+				Method: "fake",
+				Target: "/dev/fake",
+			},
+			Operations: []*aranyagopb.PeripheralOperation{{
+				OperationId: "echo",
+				Params:      map[string]string{"prefix": "echo: "},
+			}},
+		}
+
+		// extension is registered asynchronously
+		var stream *simulator.Stream
+		waitFor(t, "peripheral ensured", func() bool {
+			sess, err := sim.EnsurePeripheral(ensureCmd)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stream, err = sess.Wait(testContext(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			errMsg, _ := stream.Error()
+			return errMsg == nil
+		})
+
+		if len(stream.Msgs) != 1 || stream.Msgs[0].Kind != aranyagopb.MSG_PERIPHERAL_STATUS {
+			t.Fatalf("unexpected msgs of peripheral ensure: %v", stream.Msgs)
+		}
+
+		sess, err := sim.ListPeripherals()
+		if _, ok := statusList(t, wait(t, sess, err))["foo"]; !ok {
+			t.Error("ensured peripheral not listed")
+		}
+
+		sess, err = sim.OperatePeripheral(&aranyagopb.PeripheralOperateCmd{
+			PeripheralName: "foo",
+			OperationId:    "echo",
+			Data:           []byte("hello"),
+		})
+		stream = wait(t, sess, err)
+
+		result := new(aranyagopb.PeripheralOperationResultMsg)
+		if len(stream.Msgs) != 1 || result.Unmarshal(stream.Msgs[0].Payload) != nil {
+			t.Fatalf("unexpected msgs of peripheral operation: %v", stream.Msgs)
+		}
+
+		if len(result.Data) != 1 || string(result.Data[0]) != "echo: hello" {
+			t.Errorf("unexpected operation result %q", result.Data)
+		}
+
+		sess, err = sim.DeletePeripherals("foo")
+		if statusList(t, wait(t, sess, err))["foo"] != aranyagopb.PERIPHERAL_STATE_REMOVED {
+			t.Error("peripheral not removed")
+		}
+
+		sess, err = sim.ListPeripherals()
+		if _, ok := statusList(t, wait(t, sess, err))["foo"]; ok {
+			t.Error("deleted peripheral still listed")
+		}
+
+		expected := []arhatgopb.CmdType{
+			arhatgopb.CMD_PERIPHERAL_CONNECT,
+			arhatgopb.CMD_PERIPHERAL_OPERATE,
+			arhatgopb.CMD_PERIPHERAL_CLOSE,
+		}
+		cmds := ext.received()
+		if len(cmds) != len(expected) {
+			t.Fatalf("unexpected cmds received by extension: %v", cmds)
+		}
+
+		for i := range expected {
+			if cmds[i] != expected[i] {
+				t.Errorf("unexpected cmds received by extension: %v", cmds)
+			}
+		}
+	})
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package simulator
+
+import (
+	"sync"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+)
+
+// NewReassembler creates a Reassembler with no session tracked
+func NewReassembler() *Reassembler {
+	return &Reassembler{
+		sessions: make(map[uint64]*msgSeq),
+	}
+}
+
+// Reassembler orders msgs of the same session by their seq
+type Reassembler struct {
+	sessions map[uint64]*msgSeq
+
+	mu sync.Mutex
+}
+
+type msgSeq struct {
+	next    uint64
+	pending map[uint64]*aranyagopb.Msg
+}
+
+// Add a msg received from the agent, msgs of its session ready to deliver
+// are returned in seq order, complete is true when the last msg of the
+// session is returned, and the session state is dropped at the same time
+func (r *Reassembler) Add(msg *aranyagopb.Msg) (ready []*aranyagopb.Msg, complete bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.sessions[msg.Sid]
+	if !ok {
+		s = &msgSeq{pending: make(map[uint64]*aranyagopb.Msg)}
+		r.sessions[msg.Sid] = s
+	}
+
+	if msg.Seq < s.next {
+		// duplicated
+		return nil, false
+	}
+
+	s.pending[msg.Seq] = msg
+	for {
+		m, ok := s.pending[s.next]
+		if !ok {
+			return ready, false
+		}
+
+		delete(s.pending, s.next)
+		s.next++
+		ready = append(ready, m)
+
+		if m.Complete {
+			delete(r.sessions, msg.Sid)
+			return ready, true
+		}
+	}
+}
+
+// Pending returns count of sessions not completed yet
+func (r *Reassembler) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.sessions)
+}
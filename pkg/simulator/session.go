@@ -0,0 +1,229 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package simulator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+)
+
+func newMsgQueue() *msgQueue {
+	return &msgQueue{
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// msgQueue is an unbounded fifo of msgs, so that slow consumers never block
+// the transport
+type msgQueue struct {
+	msgs []*aranyagopb.Msg
+	done bool
+
+	notify chan struct{}
+	mu     sync.Mutex
+}
+
+func (q *msgQueue) push(msgs []*aranyagopb.Msg, done bool) {
+	q.mu.Lock()
+	q.msgs = append(q.msgs, msgs...)
+	q.done = q.done || done
+	q.mu.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pop the first msg, io.EOF is returned when the queue is done and empty
+func (q *msgQueue) pop(ctx context.Context) (*aranyagopb.Msg, error) {
+	for {
+		q.mu.Lock()
+		if len(q.msgs) != 0 {
+			msg := q.msgs[0]
+			q.msgs[0] = nil
+			q.msgs = q.msgs[1:]
+			q.mu.Unlock()
+
+			return msg, nil
+		}
+
+		done := q.done
+		q.mu.Unlock()
+
+		if done {
+			return nil, io.EOF
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-q.notify:
+		}
+	}
+}
+
+// Session is a cmd session started by the simulator
+type Session struct {
+	// Sid is the session id of the cmd
+	Sid uint64
+
+	sim      *Simulator
+	msgs     *msgQueue
+	inputSeq uint64
+}
+
+// Next returns the next msg of this session in seq order, io.EOF is
+// returned after the last msg (Complete) has been returned
+func (s *Session) Next(ctx context.Context) (*aranyagopb.Msg, error) {
+	return s.msgs.pop(ctx)
+}
+
+// Wait until the session is complete and return all msgs in seq order
+func (s *Session) Wait(ctx context.Context) (*Stream, error) {
+	stream := &Stream{Sid: s.Sid}
+	for {
+		msg, err := s.Next(ctx)
+		if err != nil {
+			if err == io.EOF {
+				return stream, nil
+			}
+
+			return stream, err
+		}
+
+		stream.Msgs = append(stream.Msgs, msg)
+	}
+}
+
+// Input sends data to the stdin (or the connection when port-forwarding)
+// of this session
+//
+// the agent creates the input stream asynchronously, data arrived before
+// that is treated as runtime data and dropped, so callers should wait for
+// the session to be ready (e.g. first output) before sending input
+func (s *Session) Input(data []byte) error {
+	return s.sendInput(data, false)
+}
+
+// CloseInput marks the end of input data
+func (s *Session) CloseInput() error {
+	return s.sendInput(nil, true)
+}
+
+func (s *Session) sendInput(data []byte, complete bool) error {
+	chunks := splitPayload(data, s.sim.maxPayloadSize)
+	for i, chunk := range chunks {
+		err := s.sim.send(&aranyagopb.Cmd{
+			Kind:     aranyagopb.CMD_DATA_UPSTREAM,
+			Sid:      s.Sid,
+			Seq:      atomic.AddUint64(&s.inputSeq, 1) - 1,
+			Complete: complete && i == len(chunks)-1,
+			Payload:  chunk,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Resize the tty of this session
+func (s *Session) Resize(cols, rows uint32) error {
+	return s.sim.sendCmd(s.Sid, aranyagopb.CMD_TTY_RESIZE, &aranyagopb.TerminalResizeCmd{
+		Cols: cols,
+		Rows: rows,
+	})
+}
+
+// Close asks the agent to terminate this session
+func (s *Session) Close() error {
+	return s.sim.sendCmd(s.Sid, aranyagopb.CMD_SESSION_CLOSE, &aranyagopb.SessionCloseCmd{
+		Sid: s.Sid,
+	})
+}
+
+// Stream is the reassembled msgs of a session
+type Stream struct {
+	Sid  uint64
+	Msgs []*aranyagopb.Msg
+}
+
+// Payload returns concatenated payload of msgs with the kind
+func (s *Stream) Payload(kind aranyagopb.MsgType) []byte {
+	var ret []byte
+	for _, msg := range s.Msgs {
+		if msg.Kind == kind {
+			ret = append(ret, msg.Payload...)
+		}
+	}
+
+	return ret
+}
+
+// Stdout returns the data output of the session, also used for metrics,
+// logs and port-forward data
+func (s *Stream) Stdout() []byte {
+	return s.Payload(aranyagopb.MSG_DATA)
+}
+
+// Stderr returns the stderr output of the session
+func (s *Stream) Stderr() []byte {
+	return s.Payload(aranyagopb.MSG_DATA_STDERR)
+}
+
+// Error returns the error reported by the agent in this session, nil if
+// there is no error msg
+func (s *Stream) Error() (*aranyagopb.ErrorMsg, error) {
+	for _, msg := range s.Msgs {
+		if msg.Kind != aranyagopb.MSG_ERROR {
+			continue
+		}
+
+		errMsg := new(aranyagopb.ErrorMsg)
+		err := errMsg.Unmarshal(msg.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal error msg: %w", err)
+		}
+
+		return errMsg, nil
+	}
+
+	return nil, nil
+}
+
+// splitPayload splits data into chunks not larger than size, at least one
+// chunk is returned, non-positive size means no limit
+func splitPayload(data []byte, size int) [][]byte {
+	if size <= 0 || len(data) <= size {
+		return [][]byte{data}
+	}
+
+	var chunks [][]byte
+	for len(data) > size {
+		chunks = append(chunks, data[:size])
+		data = data[size:]
+	}
+
+	return append(chunks, data)
+}
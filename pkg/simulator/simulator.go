@@ -0,0 +1,362 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package simulator
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+
+	"arhat.dev/arhat/pkg/client/clientutil"
+	"arhat.dev/arhat/pkg/cmdauth"
+)
+
+// Marshaler is the payload of cmds
+type Marshaler interface {
+	Marshal() ([]byte, error)
+}
+
+type transport interface {
+	// send one cmd packet to the agent
+	send(cmd *aranyagopb.Cmd) error
+
+	close() error
+}
+
+// sealingTransport is implemented by transports able to send sealed cmds
+type sealingTransport interface {
+	setSealer(sealer *cmdauth.Sealer)
+}
+
+func newSimulator(ctx context.Context, maxPayloadSize int) *Simulator {
+	ctx, exit := context.WithCancel(ctx)
+
+	return &Simulator{
+		ctx:  ctx,
+		exit: exit,
+
+		maxPayloadSize: maxPayloadSize,
+
+		reassembler: NewReassembler(),
+		sessions:    make(map[uint64]*Session),
+		unsolicited: newMsgQueue(),
+		connCh:      make(chan struct{}),
+	}
+}
+
+// Simulator is an in-process aranya serving one agent
+type Simulator struct {
+	ctx  context.Context
+	exit context.CancelFunc
+
+	endpoint       string
+	topicNamespace string
+	maxPayloadSize int
+	transport      transport
+	broker         *Broker
+
+	sid         uint64
+	reassembler *Reassembler
+	sessions    map[uint64]*Session
+	unsolicited *msgQueue
+
+	// connCh is closed when the agent is connected
+	connCh    chan struct{}
+	connected bool
+
+	// compressedMsgs is true when msgs framed as compressed are accepted
+	compressedMsgs bool
+
+	mu sync.Mutex
+}
+
+// Endpoint returns the address the agent should connect to
+func (s *Simulator) Endpoint() string {
+	return s.endpoint
+}
+
+// TopicNamespace returns the topic namespace used by pub/sub transports
+func (s *Simulator) TopicNamespace() string {
+	return s.topicNamespace
+}
+
+// Broker returns the embedded mqtt broker, nil if not using mqtt
+func (s *Simulator) Broker() *Broker {
+	return s.broker
+}
+
+// SealCmds seals all cmds sent afterwards with sealer, for agents with
+// cmd auth enabled, nil sealer stops sealing
+func (s *Simulator) SealCmds(sealer *cmdauth.Sealer) error {
+	t, ok := s.transport.(sealingTransport)
+	if !ok {
+		return fmt.Errorf("sealed cmds are not supported by this transport")
+	}
+
+	t.setSealer(sealer)
+	return nil
+}
+
+// AcceptCompressedMsgs decompresses msgs framed as compressed, for agents
+// with msg compression configured
+func (s *Simulator) AcceptCompressedMsgs(accept bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.compressedMsgs = accept
+}
+
+// Close the simulator and disconnect the agent
+func (s *Simulator) Close() error {
+	s.exit()
+	return s.transport.close()
+}
+
+// WaitConnected waits until the agent is ready to receive cmds
+func (s *Simulator) WaitConnected(ctx context.Context) error {
+	s.mu.Lock()
+	connCh := s.connCh
+	s.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	case <-connCh:
+		return nil
+	}
+}
+
+// WaitOnline waits until the agent reported it's online, only pub/sub
+// transports report online state
+func (s *Simulator) WaitOnline(ctx context.Context) error {
+	for {
+		msg, err := s.NextUnsolicited(ctx)
+		if err != nil {
+			return err
+		}
+
+		if msg.Kind != aranyagopb.MSG_STATE {
+			continue
+		}
+
+		state := new(aranyagopb.StateMsg)
+		if state.Unmarshal(msg.Payload) == nil && state.Kind == aranyagopb.STATE_ONLINE {
+			return nil
+		}
+	}
+}
+
+// NextUnsolicited returns the next msg not belonging to any session started
+// by the simulator (e.g. state and node status reported by the agent)
+func (s *Simulator) NextUnsolicited(ctx context.Context) (*aranyagopb.Msg, error) {
+	return s.unsolicited.pop(ctx)
+}
+
+// Exec runs a command in the container
+func (s *Simulator) Exec(cmd *aranyagopb.ExecOrAttachCmd) (*Session, error) {
+	return s.SendCmd(aranyagopb.CMD_EXEC, cmd)
+}
+
+// Attach to the running process in the container
+func (s *Simulator) Attach(cmd *aranyagopb.ExecOrAttachCmd) (*Session, error) {
+	return s.SendCmd(aranyagopb.CMD_ATTACH, cmd)
+}
+
+// Logs retrieves container logs
+func (s *Simulator) Logs(cmd *aranyagopb.LogsCmd) (*Session, error) {
+	return s.SendCmd(aranyagopb.CMD_LOGS, cmd)
+}
+
+// PortForward starts port-forwarding, use Session.Input to send data
+func (s *Simulator) PortForward(cmd *aranyagopb.PortForwardCmd) (*Session, error) {
+	return s.SendCmd(aranyagopb.CMD_PORT_FORWARD, cmd)
+}
+
+// GetNodeInfo requests node status
+func (s *Simulator) GetNodeInfo(kind aranyagopb.NodeInfoGetCmd_Kind) (*Session, error) {
+	return s.SendCmd(aranyagopb.CMD_NODE_INFO_GET, &aranyagopb.NodeInfoGetCmd{Kind: kind})
+}
+
+// ConfigureMetrics configures node metrics collection
+func (s *Simulator) ConfigureMetrics(cmd *aranyagopb.MetricsConfigCmd) (*Session, error) {
+	return s.SendCmd(aranyagopb.CMD_METRICS_CONFIG, cmd)
+}
+
+// CollectMetrics collects node metrics
+func (s *Simulator) CollectMetrics() (*Session, error) {
+	return s.SendCmd(aranyagopb.CMD_METRICS_COLLECT, nil)
+}
+
+// ListPeripherals lists status of peripherals, all peripherals are listed
+// if no name provided
+func (s *Simulator) ListPeripherals(names ...string) (*Session, error) {
+	return s.SendCmd(aranyagopb.CMD_PERIPHERAL_LIST, &aranyagopb.PeripheralListCmd{
+		PeripheralNames: names,
+	})
+}
+
+// EnsurePeripheral creates or updates a peripheral
+func (s *Simulator) EnsurePeripheral(cmd *aranyagopb.PeripheralEnsureCmd) (*Session, error) {
+	return s.SendCmd(aranyagopb.CMD_PERIPHERAL_ENSURE, cmd)
+}
+
+// DeletePeripherals deletes peripherals by name
+func (s *Simulator) DeletePeripherals(names ...string) (*Session, error) {
+	return s.SendCmd(aranyagopb.CMD_PERIPHERAL_DELETE, &aranyagopb.PeripheralDeleteCmd{
+		PeripheralNames: names,
+	})
+}
+
+// OperatePeripheral performs an operation on the peripheral
+func (s *Simulator) OperatePeripheral(cmd *aranyagopb.PeripheralOperateCmd) (*Session, error) {
+	return s.SendCmd(aranyagopb.CMD_PERIPHERAL_OPERATE, cmd)
+}
+
+// CollectPeripheralMetrics collects metrics of peripherals
+func (s *Simulator) CollectPeripheralMetrics(names ...string) (*Session, error) {
+	return s.SendCmd(aranyagopb.CMD_PERIPHERAL_COLLECT_METRICS, &aranyagopb.PeripheralMetricsCollectCmd{
+		PeripheralNames: names,
+	})
+}
+
+// SendCmd sends a cmd in a new session, the cmd is split into multiple
+// packets if its payload is larger than max payload size, payload can be nil
+func (s *Simulator) SendCmd(kind aranyagopb.CmdType, payload Marshaler) (*Session, error) {
+	sess := &Session{
+		Sid:  atomic.AddUint64(&s.sid, 1),
+		sim:  s,
+		msgs: newMsgQueue(),
+	}
+
+	s.mu.Lock()
+	s.sessions[sess.Sid] = sess
+	s.mu.Unlock()
+
+	err := s.sendCmd(sess.Sid, kind, payload)
+	if err != nil {
+		s.mu.Lock()
+		delete(s.sessions, sess.Sid)
+		s.mu.Unlock()
+
+		return nil, err
+	}
+
+	return sess, nil
+}
+
+func (s *Simulator) sendCmd(sid uint64, kind aranyagopb.CmdType, payload Marshaler) error {
+	var (
+		data []byte
+		err  error
+	)
+	if payload != nil {
+		data, err = payload.Marshal()
+		if err != nil {
+			return fmt.Errorf("failed to marshal cmd payload: %w", err)
+		}
+	}
+
+	chunks := splitPayload(data, s.maxPayloadSize)
+	for i, chunk := range chunks {
+		err = s.send(&aranyagopb.Cmd{
+			Kind:     kind,
+			Sid:      sid,
+			Seq:      uint64(i),
+			Complete: i == len(chunks)-1,
+			Payload:  chunk,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Simulator) send(cmd *aranyagopb.Cmd) error {
+	select {
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	default:
+	}
+
+	return s.transport.send(cmd)
+}
+
+func (s *Simulator) setConnected(connected bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.connected == connected {
+		return
+	}
+
+	s.connected = connected
+	if connected {
+		close(s.connCh)
+	} else {
+		s.connCh = make(chan struct{})
+	}
+}
+
+func (s *Simulator) handleMsgBytes(data []byte) {
+	s.mu.Lock()
+	compressed := s.compressedMsgs
+	s.mu.Unlock()
+
+	if compressed {
+		var err error
+		data, err = clientutil.Decompress(data)
+		if err != nil {
+			return
+		}
+	}
+
+	msg := new(aranyagopb.Msg)
+	if msg.Unmarshal(data) != nil {
+		// discard invalid data
+		return
+	}
+
+	s.handleMsg(msg)
+}
+
+func (s *Simulator) handleMsg(msg *aranyagopb.Msg) {
+	ready, complete := s.reassembler.Add(msg)
+	if len(ready) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	sess, ok := s.sessions[msg.Sid]
+	if ok && complete {
+		delete(s.sessions, msg.Sid)
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		s.unsolicited.push(ready, false)
+		return
+	}
+
+	sess.msgs.push(ready, complete)
+}
@@ -0,0 +1,378 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package simulator_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+	"arhat.dev/pkg/log"
+	_ "arhat.dev/pkg/nethelper/stdnet" // add tcp and unix network support
+
+	"arhat.dev/arhat/pkg/agent"
+	"arhat.dev/arhat/pkg/client"
+	"arhat.dev/arhat/pkg/cmdauth"
+	"arhat.dev/arhat/pkg/conf"
+	"arhat.dev/arhat/pkg/constant"
+	"arhat.dev/arhat/pkg/simulator"
+)
+
+// connectFunc creates a simulator and connects the agent to it with the
+// client of the same transport
+type connectFunc func(t *testing.T, ctx context.Context, ag *agent.Agent) *simulator.Simulator
+
+// transports registered by transport specific test files, so that tests
+// can run with some clients excluded by build tags
+var transports = make(map[string]connectFunc)
+
+// runTransports runs the test with a new agent connected to each transport,
+// configure is called for every agent created and can be nil
+func runTransports(
+	t *testing.T,
+	configure func(t *testing.T, config *conf.Config),
+	test func(t *testing.T, sim *simulator.Simulator),
+) {
+	if len(transports) == 0 {
+		t.Skip("no transport available")
+	}
+
+	var names []string
+	for name := range transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		connect := transports[name]
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			t.Cleanup(cancel)
+
+			config := new(conf.Config)
+			if configure != nil {
+				configure(t, config)
+			}
+
+			ag, err := agent.NewAgent(ctx, log.NoOpLogger, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			test(t, connect(t, ctx, ag))
+		})
+	}
+}
+
+// startClient connects the client and starts it as the active client of
+// the agent, the client is closed when the test finished
+func startClient(t *testing.T, ctx context.Context, ag *agent.Agent, c client.Interface) {
+	err := c.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ag.SetClient(c)
+
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+
+		_ = c.Start(ctx)
+	}()
+
+	t.Cleanup(func() {
+		_ = c.Close()
+		<-exited
+	})
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	return ctx
+}
+
+// wait for the session to complete and fail on error reported by the agent
+func wait(t *testing.T, sess *simulator.Session, err error) *simulator.Stream {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream, err := sess.Wait(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errMsg, err := stream.Error()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if errMsg != nil {
+		t.Fatalf("session %d failed: %s", stream.Sid, errMsg.Description)
+	}
+
+	return stream
+}
+
+// next returns the next msg of the session
+func next(t *testing.T, sess *simulator.Session) *aranyagopb.Msg {
+	t.Helper()
+
+	msg, err := sess.Next(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return msg
+}
+
+func TestExec(t *testing.T) {
+	allowExec := func(_ *testing.T, config *conf.Config) {
+		config.Arhat.Host.AllowExec = true
+	}
+
+	runTransports(t, allowExec, func(t *testing.T, sim *simulator.Simulator) {
+		sess, err := sim.Exec(&aranyagopb.ExecOrAttachCmd{
+			Command: []string{"sh", "-c", "echo foo; echo bar >&2"},
+			Stdout:  true,
+			Stderr:  true,
+		})
+
+		stream := wait(t, sess, err)
+
+		if string(stream.Stdout()) != "foo\n" || string(stream.Stderr()) != "bar\n" {
+			t.Errorf("unexpected output, stdout %q, stderr %q", stream.Stdout(), stream.Stderr())
+		}
+
+		sess, err = sim.Exec(&aranyagopb.ExecOrAttachCmd{
+			Command: []string{"cat"},
+			Stdin:   true,
+			Stdout:  true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// stdin is ready once the process started
+		if msg := next(t, sess); msg.Kind != aranyagopb.MSG_STREAM_CONTINUE {
+			t.Fatalf("unexpected first msg %v", msg.Kind)
+		}
+
+		if err = sess.Input([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = sess.CloseInput(); err != nil {
+			t.Fatal(err)
+		}
+
+		stream = wait(t, sess, nil)
+		if string(stream.Stdout()) != "hello" {
+			t.Errorf("unexpected output of stdin, got %q", stream.Stdout())
+		}
+	})
+}
+
+func TestExecDenied(t *testing.T) {
+	runTransports(t, nil, func(t *testing.T, sim *simulator.Simulator) {
+		sess, err := sim.Exec(&aranyagopb.ExecOrAttachCmd{
+			Command: []string{"true"},
+			Stdout:  true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stream, err := sess.Wait(testContext(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		errMsg, err := stream.Error()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if errMsg == nil {
+			t.Error("exec not denied by default")
+		}
+	})
+}
+
+func TestLogs(t *testing.T) {
+	allowLog := func(_ *testing.T, config *conf.Config) {
+		config.Arhat.Host.AllowLog = true
+	}
+
+	file := filepath.Join(t.TempDir(), "test.log")
+	content := bytes.Repeat([]byte("log line\n"), 1024)
+	err := ioutil.WriteFile(file, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runTransports(t, allowLog, func(t *testing.T, sim *simulator.Simulator) {
+		// aranya sets negative tail lines when not limited
+		sess, err := sim.Logs(&aranyagopb.LogsCmd{Path: file, TailLines: -1})
+
+		stream := wait(t, sess, err)
+
+		expected := append([]byte(constant.IdentifierLogFile+"\n"), content...)
+		if !bytes.Equal(stream.Stdout(), expected) {
+			t.Errorf("unexpected logs, got %d bytes, expecting %d", len(stream.Stdout()), len(expected))
+		}
+	})
+}
+
+// runEchoServer runs a tcp server greeting every connection and echoing
+// data received until the client closed its write side
+func runEchoServer(t *testing.T, greeting []byte) int32 {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer func() { _ = conn.Close() }()
+
+				_, err := conn.Write(greeting)
+				if err != nil {
+					return
+				}
+
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return int32(l.Addr().(*net.TCPAddr).Port)
+}
+
+func TestPortForward(t *testing.T) {
+	allowPortForward := func(_ *testing.T, config *conf.Config) {
+		config.Arhat.Host.AllowPortForward = true
+	}
+
+	port := runEchoServer(t, []byte("hello\n"))
+
+	runTransports(t, allowPortForward, func(t *testing.T, sim *simulator.Simulator) {
+		sess, err := sim.PortForward(&aranyagopb.PortForwardCmd{
+			Network: "tcp",
+			Address: "localhost",
+			Port:    port,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// input is accepted once the connection established
+		if msg := next(t, sess); msg.Kind != aranyagopb.MSG_STREAM_CONTINUE || len(msg.Payload) != 0 {
+			t.Fatalf("unexpected first msg %v %q", msg.Kind, msg.Payload)
+		}
+
+		if msg := next(t, sess); string(msg.Payload) != "hello\n" {
+			t.Fatalf("unexpected greeting %q", msg.Payload)
+		}
+
+		if err = sess.Input([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+
+		if msg := next(t, sess); string(msg.Payload) != "ping" {
+			t.Fatalf("unexpected echo %q", msg.Payload)
+		}
+
+		if err = sess.CloseInput(); err != nil {
+			t.Fatal(err)
+		}
+
+		stream := wait(t, sess, nil)
+		if len(stream.Stdout()) != 0 {
+			t.Errorf("unexpected data after input closed %q", stream.Stdout())
+		}
+	})
+}
+
+func TestSealedCmds(t *testing.T) {
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	aead, err := cmdauth.NewAEAD(encKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enableCmdAuth := func(_ *testing.T, config *conf.Config) {
+		config.Connectivity.CmdAuth.Enabled = true
+		config.Connectivity.CmdAuth.PublicKeyFrom.Text = base64.StdEncoding.EncodeToString(pk)
+		config.Connectivity.CmdAuth.EncryptionKeyFrom.Text = encKey
+	}
+
+	runTransports(t, enableCmdAuth, func(t *testing.T, sim *simulator.Simulator) {
+		// cmds not sealed are discarded without any response
+		sess, err := sim.GetNodeInfo(aranyagopb.NODE_INFO_DYN)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+
+		if _, err = sess.Next(ctx); err == nil {
+			t.Fatal("cmd not sealed accepted")
+		}
+
+		if err = sim.SealCmds(cmdauth.NewSealer(sk, aead)); err != nil {
+			t.Fatal(err)
+		}
+
+		sess, err = sim.GetNodeInfo(aranyagopb.NODE_INFO_DYN)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg := next(t, sess); msg.Kind != aranyagopb.MSG_NODE_STATUS {
+			t.Errorf("unexpected reply %v to sealed cmd", msg.Kind)
+		}
+	})
+}
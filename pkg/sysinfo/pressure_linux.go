@@ -0,0 +1,113 @@
+// +build !nosysinfo
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sysinfo
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// GetAvailableMemory returns bytes of memory available for new workloads
+// (MemAvailable in /proc/meminfo)
+func GetAvailableMemory() (uint64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// MemAvailable:    1234567 kB
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid MemAvailable value %q: %w", fields[1], err)
+		}
+
+		return kb * 1024, nil
+	}
+
+	if err = s.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, fmt.Errorf("MemAvailable not found in /proc/meminfo")
+}
+
+// GetDiskUsage returns available and total bytes of the filesystem
+// containing path
+// nolint:unconvert
+func GetDiskUsage(path string) (available, total uint64, err error) {
+	fs := unix.Statfs_t{}
+	err = unix.Statfs(path, &fs)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return uint64(fs.Bavail) * uint64(fs.Bsize), uint64(fs.Blocks) * uint64(fs.Bsize), nil
+}
+
+// GetPidUsage returns count of kernel scheduling entities (processes and
+// threads) and the value of pid_max
+func GetPidUsage() (used, max uint64, err error) {
+	data, err := ioutil.ReadFile("/proc/sys/kernel/pid_max")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	max, err = strconv.ParseUint(string(bytes.TrimSpace(data)), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid pid_max value: %w", err)
+	}
+
+	// 0.20 0.18 0.12 1/80 11206
+	data, err = ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) < 4 {
+		return 0, 0, fmt.Errorf("unexpected /proc/loadavg format")
+	}
+
+	parts := strings.SplitN(fields[3], "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("unexpected /proc/loadavg format")
+	}
+
+	used, err = strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid scheduling entity count: %w", err)
+	}
+
+	return used, max, nil
+}
@@ -0,0 +1,33 @@
+// +build nosysinfo !linux
+
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sysinfo
+
+import "arhat.dev/pkg/wellknownerrors"
+
+func GetAvailableMemory() (uint64, error) {
+	return 0, wellknownerrors.ErrNotSupported
+}
+
+func GetDiskUsage(path string) (available, total uint64, err error) {
+	return 0, 0, wellknownerrors.ErrNotSupported
+}
+
+func GetPidUsage() (used, max uint64, err error) {
+	return 0, 0, wellknownerrors.ErrNotSupported
+}
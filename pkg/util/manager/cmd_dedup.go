@@ -0,0 +1,143 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+)
+
+// NewCmdDeduplicator creates a deduplicator remembering at most maxEntries
+// recently seen cmd packets for ttl since first seen
+func NewCmdDeduplicator(ttl time.Duration, maxEntries int) *CmdDeduplicator {
+	return &CmdDeduplicator{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+
+		entries:    make(map[cmdKey]*list.Element),
+		lru:        list.New(),
+		duplicates: make(map[aranyagopb.CmdType]uint64),
+
+		mu: new(sync.Mutex),
+	}
+}
+
+type cmdKey struct {
+	sid  uint64
+	seq  uint64
+	kind aranyagopb.CmdType
+}
+
+type seenCmd struct {
+	key cmdKey
+	// firstSeen is not updated on redelivery, so a cmd packet is always
+	// forgotten after ttl
+	firstSeen time.Time
+}
+
+// CmdDeduplicator detects cmd packets delivered more than once by at least
+// once transports (e.g. mqtt qos 1, nats streaming redelivery, coap
+// retransmission), cmd packets are identified by (sid, seq, kind)
+type CmdDeduplicator struct {
+	ttl        time.Duration
+	maxEntries int
+
+	entries map[cmdKey]*list.Element
+	// lru list of *seenCmd, front is the most recently seen
+	lru *list.List
+
+	duplicates map[aranyagopb.CmdType]uint64
+
+	mu *sync.Mutex
+}
+
+// Seen records the cmd packet and returns true if it is a duplicate, that
+// is, the same packet was already seen within ttl, nil CmdDeduplicator
+// never reports duplicates
+func (d *CmdDeduplicator) Seen(cmd *aranyagopb.Cmd) bool {
+	if d == nil {
+		return false
+	}
+
+	return d.seen(cmd, time.Now())
+}
+
+func (d *CmdDeduplicator) seen(cmd *aranyagopb.Cmd, now time.Time) bool {
+	key := cmdKey{sid: cmd.Sid, seq: cmd.Seq, kind: cmd.Kind}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expire(now)
+
+	if e, ok := d.entries[key]; ok {
+		if now.Sub(e.Value.(*seenCmd).firstSeen) <= d.ttl {
+			d.lru.MoveToFront(e)
+
+			d.duplicates[cmd.Kind]++
+			return true
+		}
+
+		// expired but not at the back of lru
+		d.remove(e)
+	}
+
+	d.entries[key] = d.lru.PushFront(&seenCmd{key: key, firstSeen: now})
+
+	for d.lru.Len() > d.maxEntries {
+		d.remove(d.lru.Back())
+	}
+
+	return false
+}
+
+// Duplicates returns count of duplicate cmd packets by cmd kind
+func (d *CmdDeduplicator) Duplicates() map[aranyagopb.CmdType]uint64 {
+	if d == nil {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ret := make(map[aranyagopb.CmdType]uint64, len(d.duplicates))
+	for k, v := range d.duplicates {
+		ret[k] = v
+	}
+
+	return ret
+}
+
+// expire removes expired entries at the back of lru, other expired entries
+// are removed when seen again or evicted
+func (d *CmdDeduplicator) expire(now time.Time) {
+	for e := d.lru.Back(); e != nil; e = d.lru.Back() {
+		if now.Sub(e.Value.(*seenCmd).firstSeen) <= d.ttl {
+			return
+		}
+
+		d.remove(e)
+	}
+}
+
+func (d *CmdDeduplicator) remove(e *list.Element) {
+	d.lru.Remove(e)
+	delete(d.entries, e.Value.(*seenCmd).key)
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+)
+
+func TestCmdDeduplicatorSeen(t *testing.T) {
+	d := NewCmdDeduplicator(time.Minute, 16)
+	now := time.Now()
+
+	for i, test := range []struct {
+		cmd      *aranyagopb.Cmd
+		expected bool
+	}{
+		{cmd: chunk(1, 0, false, "a"), expected: false},
+		{cmd: chunk(1, 0, false, "a"), expected: true},
+		{cmd: chunk(1, 1, true, "b"), expected: false},
+		{cmd: chunk(2, 0, true, "a"), expected: false},
+		{cmd: &aranyagopb.Cmd{Kind: aranyagopb.CMD_TTY_RESIZE, Sid: 1}, expected: false},
+		{cmd: chunk(1, 1, true, "b"), expected: true},
+	} {
+		if seen := d.seen(test.cmd, now); seen != test.expected {
+			t.Errorf("#%d: expecting seen %v, got %v", i, test.expected, seen)
+		}
+	}
+
+	if dups := d.Duplicates(); len(dups) != 1 || dups[aranyagopb.CMD_EXEC] != 2 {
+		t.Errorf("unexpected duplicates %v", dups)
+	}
+
+	var nilDedup *CmdDeduplicator
+	if nilDedup.Seen(chunk(1, 0, false, "a")) || nilDedup.Duplicates() != nil {
+		t.Error("nil deduplicator reported duplicates")
+	}
+}
+
+func TestCmdDeduplicatorTTL(t *testing.T) {
+	d := NewCmdDeduplicator(time.Minute, 16)
+	now := time.Now()
+
+	if d.seen(chunk(1, 0, false, "a"), now) {
+		t.Fatal("new cmd reported as duplicate")
+	}
+
+	// redelivery doesn't extend ttl
+	if !d.seen(chunk(1, 0, false, "a"), now.Add(30*time.Second)) {
+		t.Error("cmd redelivered in ttl not detected")
+	}
+
+	if !d.seen(chunk(1, 0, false, "a"), now.Add(time.Minute)) {
+		t.Error("cmd redelivered at ttl not detected")
+	}
+
+	if d.seen(chunk(1, 0, false, "a"), now.Add(time.Minute+time.Second)) {
+		t.Error("cmd still remembered after ttl since first seen")
+	}
+
+	// expired entries at the back are removed
+	d.seen(chunk(2, 0, false, "a"), now.Add(time.Minute+time.Second))
+	d.seen(chunk(3, 0, false, "a"), now.Add(3*time.Minute))
+	if len(d.entries) != 1 || d.lru.Len() != 1 {
+		t.Errorf("expired entries not removed, %d left", len(d.entries))
+	}
+
+	// expired entry not at the back of lru
+	d = NewCmdDeduplicator(time.Minute, 16)
+	d.seen(chunk(1, 0, false, "a"), now)
+	d.seen(chunk(2, 0, false, "a"), now.Add(30*time.Second))
+	d.seen(chunk(1, 0, false, "a"), now.Add(40*time.Second))
+	if d.seen(chunk(1, 0, false, "a"), now.Add(70*time.Second)) {
+		t.Error("recently used cmd still remembered after ttl")
+	}
+
+	if !d.seen(chunk(2, 0, false, "a"), now.Add(80*time.Second)) {
+		t.Error("cmd in ttl forgotten")
+	}
+}
+
+func TestCmdDeduplicatorLRU(t *testing.T) {
+	d := NewCmdDeduplicator(time.Minute, 2)
+	now := time.Now()
+
+	d.seen(chunk(1, 0, false, "a"), now)
+	d.seen(chunk(2, 0, false, "a"), now)
+
+	// sid 1 becomes the most recently seen
+	if !d.seen(chunk(1, 0, false, "a"), now) {
+		t.Fatal("duplicate not detected")
+	}
+
+	// evicts sid 2
+	d.seen(chunk(3, 0, false, "a"), now)
+	if d.lru.Len() != 2 || len(d.entries) != 2 {
+		t.Fatalf("expecting 2 entries, got %d", d.lru.Len())
+	}
+
+	if !d.seen(chunk(1, 0, false, "a"), now) {
+		t.Error("recently seen cmd evicted")
+	}
+
+	if d.seen(chunk(2, 0, false, "a"), now) {
+		t.Error("least recently seen cmd not evicted")
+	}
+}
@@ -17,23 +17,84 @@ limitations under the License.
 package manager
 
 import (
+	"context"
+	"fmt"
+	"math"
 	"runtime"
 	"sync/atomic"
+	"time"
 
 	"arhat.dev/aranya-proto/aranyagopb"
 	"arhat.dev/pkg/queue"
 )
 
-func NewCmdManager() *CmdManager {
-	return &CmdManager{
-		sessionSQ:   make(map[uint64]*queue.SeqQueue),
-		partialCmds: make(map[uint64]*[]byte),
+// defaultDroppedCmdTTL is the duration to remember dropped cmds when
+// partial cmds never expire
+const defaultDroppedCmdTTL = 5 * time.Minute
+
+// CmdDropFunc is called when partial cmd data of the session was dropped
+type CmdDropFunc func(sid uint64, err error)
+
+// NewCmdManager creates a new cmd manager to reassemble partial cmds
+//
+// partial cmds not completed in ttl since their first chunk are dropped,
+// non-positive ttl means never expire; cmds larger than maxSize or with
+// more than maxChunks chunks are dropped, non-positive maxSize or maxChunks
+// means no limit
+func NewCmdManager(
+	ctx context.Context,
+	ttl time.Duration,
+	maxSize int,
+	maxChunks int,
+	onDrop CmdDropFunc,
+) *CmdManager {
+	m := &CmdManager{
+		ttl:        ttl,
+		droppedTTL: ttl,
+		maxSize:    maxSize,
+		maxChunks:  maxChunks,
+		onDrop:     onDrop,
+
+		partialCmds: make(map[uint64]*partialCmd),
+		droppedCmds: make(map[uint64]time.Time),
 	}
+
+	if ttl <= 0 {
+		m.droppedTTL = defaultDroppedCmdTTL
+	}
+
+	go m.gc(ctx)
+
+	return m
+}
+
+type partialCmd struct {
+	sq   *queue.SeqQueue
+	data []byte
+
+	// seqs of received chunks, duplicated chunks are discarded
+	received map[uint64]struct{}
+	// maxSeq is the seq of the last chunk, math.MaxUint64 if not known yet
+	maxSeq uint64
+
+	// size of all received payload
+	size int
+	// firstSeen is the time when the first chunk received
+	firstSeen time.Time
 }
 
 type CmdManager struct {
-	sessionSQ   map[uint64]*queue.SeqQueue
-	partialCmds map[uint64]*[]byte
+	ttl        time.Duration
+	droppedTTL time.Duration
+	maxSize    int
+	maxChunks  int
+	onDrop     CmdDropFunc
+
+	partialCmds map[uint64]*partialCmd
+	// droppedCmds are sessions with partial cmd dropped and when dropped,
+	// remaining chunks of them are discarded silently until droppedTTL
+	// expired
+	droppedCmds map[uint64]time.Time
 
 	_working uint32
 }
@@ -48,48 +109,139 @@ func (m *CmdManager) doExclusive(f func()) {
 	atomic.StoreUint32(&m._working, 0)
 }
 
-func (m *CmdManager) Process(cmd *aranyagopb.Cmd) (cmdPayload []byte, complete bool) {
+// Process cmd chunk, returns reassembled payload when all chunks arrived,
+// error is returned when the cmd was dropped, remaining chunks of a dropped
+// cmd are discarded without error
+func (m *CmdManager) Process(cmd *aranyagopb.Cmd) (cmdPayload []byte, complete bool, err error) {
 	// all in one cmd packet
 	if cmd.Seq == 0 && cmd.Complete {
-		return cmd.Payload, true
+		if m.maxSize > 0 && len(cmd.Payload) > m.maxSize {
+			return nil, false, fmt.Errorf(
+				"cmd size %d exceeds limit %d, dropped", len(cmd.Payload), m.maxSize,
+			)
+		}
+
+		return cmd.Payload, true, nil
 	}
 
-	var (
-		sid     = cmd.Sid
-		sq      *queue.SeqQueue
-		dataPtr *[]byte
-	)
+	sid := cmd.Sid
 	m.doExclusive(func() {
-		var ok bool
-		dataPtr, ok = m.partialCmds[sid]
-		if !ok {
-			data := make([]byte, 0, 32)
-			dataPtr = &data
-			m.partialCmds[sid] = dataPtr
+		if _, dropped := m.droppedCmds[sid]; dropped {
+			if cmd.Complete && m.ttl <= 0 {
+				// never expire, forget it once the last chunk arrived
+				delete(m.droppedCmds, sid)
+			}
+
+			return
 		}
 
-		sq, ok = m.sessionSQ[sid]
+		pc, ok := m.partialCmds[sid]
 		if !ok {
-			sq = queue.NewSeqQueue(func(seq uint64, d interface{}) {
-				*dataPtr = append(*dataPtr, d.([]byte)...)
+			pc = &partialCmd{
+				data:      make([]byte, 0, 32),
+				maxSeq:    math.MaxUint64,
+				received:  make(map[uint64]struct{}),
+				firstSeen: time.Now(),
+			}
+			pc.sq = queue.NewSeqQueue(func(seq uint64, d interface{}) {
+				pc.data = append(pc.data, d.([]byte)...)
 			})
-			m.sessionSQ[sid] = sq
+
+			m.partialCmds[sid] = pc
+		}
+
+		if _, dup := pc.received[cmd.Seq]; dup || cmd.Seq > pc.maxSeq {
+			// duplicated or exceeded, discard
+			return
+		}
+
+		// seq of chunks starts from 0, a seq not less than maxChunks means
+		// too many chunks, this also bounds seqs waiting in the queue
+		if m.maxChunks > 0 && cmd.Seq >= uint64(m.maxChunks) {
+			err = fmt.Errorf("partial cmd chunk count exceeds limit %d, dropped", m.maxChunks)
+			delete(m.partialCmds, sid)
+			m.droppedCmds[sid] = time.Now()
+			return
+		}
+
+		pc.received[cmd.Seq] = struct{}{}
+		pc.size += len(cmd.Payload)
+
+		if m.maxSize > 0 && pc.size > m.maxSize {
+			err = fmt.Errorf("partial cmd size exceeds limit %d, dropped", m.maxSize)
+			delete(m.partialCmds, sid)
+			m.droppedCmds[sid] = time.Now()
+			return
+		}
+
+		if cmd.Complete {
+			pc.maxSeq = cmd.Seq
+			_ = pc.sq.SetMaxSeq(cmd.Seq)
+		}
+
+		// offer and completion are done with the lock held, so a cmd
+		// can not be completed and expired at the same time
+		if pc.sq.Offer(cmd.Seq, cmd.Payload) {
+			cmdPayload, complete = pc.data, true
+			delete(m.partialCmds, sid)
 		}
 	})
 
-	if cmd.Complete {
-		_ = sq.SetMaxSeq(cmd.Seq)
+	return
+}
+
+// gc drops expired partial cmds and forgets expired dropped cmds
+// periodically
+func (m *CmdManager) gc(ctx context.Context) {
+	interval := m.droppedTTL / 2
+	if m.ttl > 0 && m.ttl < m.droppedTTL {
+		interval = m.ttl / 2
 	}
 
-	complete = sq.Offer(cmd.Seq, cmd.Payload)
-	if !complete {
-		return
+	if interval < time.Second {
+		interval = time.Second
 	}
 
-	cmdPayload = *dataPtr
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			expired := m.collect(now)
+			if m.onDrop == nil {
+				continue
+			}
+
+			for _, sid := range expired {
+				m.onDrop(sid, fmt.Errorf("partial cmd not completed in %v, dropped", m.ttl))
+			}
+		}
+	}
+}
+
+// collect expired partial cmds and dropped cmds, returns sids of expired
+// partial cmds
+func (m *CmdManager) collect(now time.Time) (expired []uint64) {
+	m.doExclusive(func() {
+		if m.ttl > 0 {
+			for sid, pc := range m.partialCmds {
+				if now.Sub(pc.firstSeen) > m.ttl {
+					expired = append(expired, sid)
+					delete(m.partialCmds, sid)
+					m.droppedCmds[sid] = now
+				}
+			}
+		}
 
-	delete(m.sessionSQ, sid)
-	delete(m.partialCmds, sid)
+		for sid, droppedAt := range m.droppedCmds {
+			if now.Sub(droppedAt) > m.droppedTTL {
+				delete(m.droppedCmds, sid)
+			}
+		}
+	})
 
 	return
 }
@@ -0,0 +1,304 @@
+/*
+Copyright 2020 The arhat.dev Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"arhat.dev/aranya-proto/aranyagopb"
+)
+
+func chunk(sid, seq uint64, complete bool, data string) *aranyagopb.Cmd {
+	return &aranyagopb.Cmd{
+		Kind:     aranyagopb.CMD_EXEC,
+		Sid:      sid,
+		Seq:      seq,
+		Complete: complete,
+		Payload:  []byte(data),
+	}
+}
+
+func TestCmdManagerReassemble(t *testing.T) {
+	m := NewCmdManager(context.TODO(), 0, 0, 0, nil)
+
+	for _, c := range []*aranyagopb.Cmd{
+		chunk(1, 2, true, "c"),
+		chunk(1, 0, false, "a"),
+	} {
+		_, complete, err := m.Process(c)
+		if err != nil || complete {
+			t.Fatalf("unexpected result %v %v", complete, err)
+		}
+	}
+
+	data, complete, err := m.Process(chunk(1, 1, false, "b"))
+	if err != nil || !complete || string(data) != "abc" {
+		t.Fatalf("unexpected result %q %v %v", data, complete, err)
+	}
+
+	data, complete, err = m.Process(chunk(2, 0, true, "single"))
+	if err != nil || !complete || string(data) != "single" {
+		t.Fatalf("unexpected result %q %v %v", data, complete, err)
+	}
+}
+
+func TestCmdManagerSizeLimit(t *testing.T) {
+	m := NewCmdManager(context.TODO(), 0, 8, 0, nil)
+
+	if _, _, err := m.Process(chunk(1, 0, true, "too large")); err == nil {
+		t.Fatal("single packet cmd exceeding limit not dropped")
+	}
+
+	if _, _, err := m.Process(chunk(2, 0, false, "12345")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := m.Process(chunk(2, 1, false, "67890")); err == nil {
+		t.Fatal("partial cmd exceeding limit not dropped")
+	}
+
+	// remaining chunks of the dropped cmd are discarded silently
+	for seq := uint64(2); seq < 5; seq++ {
+		data, complete, err := m.Process(chunk(2, seq, seq == 4, "x"))
+		if err != nil || complete || data != nil {
+			t.Fatalf("unexpected result of chunk %d: %q %v %v", seq, data, complete, err)
+		}
+	}
+
+	// other sessions are not affected
+	data, complete, err := m.Process(chunk(3, 0, true, "ok"))
+	if err != nil || !complete || string(data) != "ok" {
+		t.Fatalf("unexpected result %q %v %v", data, complete, err)
+	}
+}
+
+func TestCmdManagerTTL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var drops uint32
+	m := NewCmdManager(ctx, 100*time.Millisecond, 0, 0, func(sid uint64, err error) {
+		atomic.AddUint32(&drops, 1)
+	})
+
+	if _, _, err := m.Process(chunk(1, 0, false, "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint32(&drops) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expired partial cmd not dropped")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// late chunks do not create a new partial cmd
+	data, complete, err := m.Process(chunk(1, 1, true, "b"))
+	if err != nil || complete || data != nil {
+		t.Fatalf("unexpected result %q %v %v", data, complete, err)
+	}
+
+	// dropped sessions are forgotten after ttl
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		var n int
+		m.doExclusive(func() { n = len(m.droppedCmds) + len(m.partialCmds) })
+		if n == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("dropped cmd not forgotten")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := atomic.LoadUint32(&drops); n != 1 {
+		t.Fatalf("expecting 1 drop, got %d", n)
+	}
+}
+
+func TestCmdManagerDuplicatedChunks(t *testing.T) {
+	m := NewCmdManager(context.TODO(), 0, 8, 0, nil)
+
+	for _, c := range []*aranyagopb.Cmd{
+		chunk(1, 0, false, "1234"),
+		chunk(1, 0, false, "1234"),
+		chunk(1, 0, false, "1234"),
+	} {
+		_, complete, err := m.Process(c)
+		if err != nil || complete {
+			t.Fatalf("unexpected result %v %v", complete, err)
+		}
+	}
+
+	data, complete, err := m.Process(chunk(1, 1, true, "5678"))
+	if err != nil || !complete || string(data) != "12345678" {
+		t.Fatalf("unexpected result %q %v %v", data, complete, err)
+	}
+
+	// chunks exceeding the last seq are discarded
+	for _, c := range []*aranyagopb.Cmd{
+		chunk(2, 1, true, "1234"),
+		chunk(2, 2, false, "5678"),
+	} {
+		_, complete, err = m.Process(c)
+		if err != nil || complete {
+			t.Fatalf("unexpected result %v %v", complete, err)
+		}
+	}
+
+	data, complete, err = m.Process(chunk(2, 0, false, "abcd"))
+	if err != nil || !complete || string(data) != "abcd1234" {
+		t.Fatalf("unexpected result %q %v %v", data, complete, err)
+	}
+}
+
+func TestCmdManagerCompleteOrDrop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const (
+		ttl   = 100 * time.Millisecond
+		count = 200
+	)
+
+	var (
+		results = make([]uint32, count)
+		m       = NewCmdManager(ctx, ttl, 0, 0, func(sid uint64, err error) {
+			atomic.AddUint32(&results[sid], 1)
+		})
+	)
+
+	for sid := uint64(0); sid < count; sid++ {
+		if _, _, err := m.Process(chunk(sid, 0, false, "a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// gc runs every second, complete cmds around that time
+	start := time.Now()
+	done := make(chan struct{})
+	for sid := uint64(0); sid < count; sid++ {
+		go func(sid uint64) {
+			defer func() { done <- struct{}{} }()
+
+			time.Sleep(900*time.Millisecond + time.Duration(sid)*time.Millisecond - time.Since(start))
+
+			_, complete, err := m.Process(chunk(sid, 1, true, "b"))
+			if err != nil {
+				t.Error(err)
+			}
+
+			if complete {
+				atomic.AddUint32(&results[sid], 1)
+			}
+		}(sid)
+	}
+
+	for i := 0; i < count; i++ {
+		<-done
+	}
+
+	// drop callbacks are called after gc released the lock
+	deadline := time.Now().Add(5 * time.Second)
+	for sid := range results {
+		for atomic.LoadUint32(&results[sid]) == 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	for sid := range results {
+		if n := atomic.LoadUint32(&results[sid]); n != 1 {
+			t.Errorf("cmd %d completed or dropped %d times", sid, n)
+		}
+	}
+}
+
+func TestCmdManagerChunkLimit(t *testing.T) {
+	m := NewCmdManager(context.TODO(), 0, 8, 4, nil)
+
+	// empty chunks do not count toward size but toward chunk count
+	for seq := uint64(0); seq < 4; seq++ {
+		if _, _, err := m.Process(chunk(1, seq, false, "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := m.Process(chunk(1, 4, false, "")); err == nil {
+		t.Fatal("partial cmd exceeding chunk limit not dropped")
+	}
+
+	// seqs far beyond the limit are rejected without being queued
+	if _, _, err := m.Process(chunk(2, 1<<40, false, "")); err == nil {
+		t.Fatal("chunk with seq beyond limit not dropped")
+	}
+
+	m.doExclusive(func() {
+		if len(m.partialCmds) != 0 || len(m.droppedCmds) != 2 {
+			t.Errorf("unexpected state, partial %d, dropped %d", len(m.partialCmds), len(m.droppedCmds))
+		}
+	})
+
+	data, complete, err := m.Process(chunk(3, 3, true, "d"))
+	if err != nil || complete {
+		t.Fatalf("unexpected result %q %v %v", data, complete, err)
+	}
+}
+
+func TestCmdManagerExpireSinceFirstChunk(t *testing.T) {
+	m := NewCmdManager(context.TODO(), time.Minute, 0, 0, nil)
+
+	if _, _, err := m.Process(chunk(1, 0, false, "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a chunk arrived later does not extend ttl
+	if _, _, err := m.Process(chunk(1, 1, false, "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	expired := m.collect(time.Now().Add(time.Minute + time.Second))
+	if len(expired) != 1 || expired[0] != 1 {
+		t.Fatalf("partial cmd not expired: %v", expired)
+	}
+}
+
+func TestCmdManagerForgetDroppedWithoutTTL(t *testing.T) {
+	m := NewCmdManager(context.TODO(), 0, 1, 0, nil)
+
+	if _, _, err := m.Process(chunk(1, 0, false, "ab")); err == nil {
+		t.Fatal("partial cmd exceeding limit not dropped")
+	}
+
+	if expired := m.collect(time.Now()); len(expired) != 0 {
+		t.Fatalf("unexpected expired partial cmds %v", expired)
+	}
+
+	m.collect(time.Now().Add(defaultDroppedCmdTTL + time.Second))
+	m.doExclusive(func() {
+		if len(m.droppedCmds) != 0 {
+			t.Error("dropped cmd not forgotten when partial cmds never expire")
+		}
+	})
+}
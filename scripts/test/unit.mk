@@ -60,6 +60,8 @@ test.tags:
 	CGO_ENABLED=1 $(MAKE) arhat TAGS='noclient_mqtt'
 	CGO_ENABLED=1 $(MAKE) arhat TAGS='noclient_coap'
 	CGO_ENABLED=1 $(MAKE) arhat TAGS='noclient_grpc'
+	CGO_ENABLED=1 $(MAKE) arhat TAGS='noclient_kafka'
+	CGO_ENABLED=1 $(MAKE) arhat TAGS='noclient_mqttsn'
 	CGO_ENABLED=1 $(MAKE) arhat TAGS='noclient_grpc noclient_mqtt'
 	CGO_ENABLED=1 $(MAKE) arhat TAGS='noclient_coap noclient_grpc'
 	CGO_ENABLED=1 $(MAKE) arhat TAGS='noclient_coap noclient_mqtt'